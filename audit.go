@@ -0,0 +1,178 @@
+package pkiadm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	AOSuccess AuditOutcome = iota
+	AOFailed
+	// AOQueued marks requests continued by a job. The outcome of the job is
+	// recorded in another entry.
+	AOQueued
+)
+
+type (
+	// AuditOutcome is the result of an audited change.
+	AuditOutcome uint
+
+	// AuditEntry records a change of the storage. Every entry contains the
+	// hash of the entry before it, so that the log can't be changed without
+	// breaking the chain.
+	AuditEntry struct {
+		Seq  uint64
+		Time time.Time
+		// Caller is the identity of the client or 'pkiadmd' for changes made
+		// by the daemon itself.
+		Caller string
+		// Action is the RPC method or 'Refresh' for refreshes.
+		Action   string
+		Resource ResourceName
+		// Fields contains the fields changed by a set request.
+		Fields      []string `json:",omitempty"`
+		OldChecksum []byte   `json:",omitempty"`
+		NewChecksum []byte   `json:",omitempty"`
+		Outcome     AuditOutcome
+		// Error is the message of the failure, when the change failed.
+		Error string `json:",omitempty"`
+		// Job is the id of the job continuing the request.
+		Job string `json:",omitempty"`
+		// Prev is the hash of the previous entry.
+		Prev []byte `json:",omitempty"`
+		Hash []byte `json:",omitempty"`
+	}
+
+	// AuditFilter selects the entries of the audit log. Empty fields match
+	// all entries.
+	AuditFilter struct {
+		// Resource matches the beginning of the resource name, e.g. 'cert/'
+		// for all certificates or 'cert/www' for a single one.
+		Resource string
+		Caller   string
+		Action   string
+		Since    time.Time
+		// Failed only selects failed changes.
+		Failed bool
+	}
+
+	// AuditVerification is the result of checking the chain of the audit
+	// log.
+	AuditVerification struct {
+		Intact bool
+		// Entries is the number of entries found intact.
+		Entries int
+		// Broken is the sequence of the first entry breaking the chain.
+		Broken uint64
+		// Reason describes how the chain is broken.
+		Reason string
+	}
+
+	ResultAudit struct {
+		Result  Result
+		Entries []AuditEntry
+	}
+	ResultAuditVerification struct {
+		Result       Result
+		Verification AuditVerification
+	}
+)
+
+// ComputeHash returns the hash of the entry, which covers all fields except
+// the hash itself.
+func (e AuditEntry) ComputeHash() []byte {
+	e.Hash = nil
+	e.Time = e.Time.UTC()
+	raw, err := json.Marshal(e)
+	if err != nil {
+		// the entry only contains types, which can always be marshaled
+		panic(err)
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
+
+// Match returns true, when the entry is selected by the filter.
+func (f AuditFilter) Match(e AuditEntry) bool {
+	switch {
+	case f.Resource != "" && !strings.HasPrefix(e.Resource.String(), f.Resource):
+		return false
+	case f.Caller != "" && e.Caller != f.Caller:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case f.Failed && e.Outcome != AOFailed:
+		return false
+	}
+	return true
+}
+
+// VerifyAudit checks that the entries form an unbroken chain starting with
+// the first entry of the log.
+func VerifyAudit(entries []AuditEntry) AuditVerification {
+	res := AuditVerification{}
+	var prev []byte
+	var seq uint64
+	for _, e := range entries {
+		switch {
+		case e.Seq != seq+1:
+			res.Reason = fmt.Sprintf("expected entry %d, found %d", seq+1, e.Seq)
+		case !bytes.Equal(e.Prev, prev):
+			res.Reason = "the hash of the previous entry doesn't match"
+		case !bytes.Equal(e.Hash, e.ComputeHash()):
+			res.Reason = "the hash doesn't match the content"
+		default:
+			res.Entries++
+			prev = e.Hash
+			seq = e.Seq
+			continue
+		}
+		res.Broken = e.Seq
+		return res
+	}
+	res.Intact = true
+	return res
+}
+
+// Audit returns the entries of the audit log selected by the filter.
+func (c *Client) Audit(filter AuditFilter) ([]AuditEntry, error) {
+	result := &ResultAudit{}
+	if err := c.query("ListAudit", filter, result); err != nil {
+		return []AuditEntry{}, err
+	}
+	if result.Result.HasError {
+		return []AuditEntry{}, result.Result.Error
+	}
+	return result.Entries, nil
+}
+
+// VerifyAudit lets the server check the chain of the whole audit log.
+func (c *Client) VerifyAudit() (AuditVerification, error) {
+	result := &ResultAuditVerification{}
+	if err := c.query("VerifyAudit", Filter{}, result); err != nil {
+		return AuditVerification{}, err
+	}
+	if result.Result.HasError {
+		return AuditVerification{}, result.Result.Error
+	}
+	return result.Verification, nil
+}
+
+func (o AuditOutcome) String() string {
+	switch o {
+	case AOSuccess:
+		return "ok"
+	case AOFailed:
+		return "failed"
+	case AOQueued:
+		return "queued"
+	default:
+		return "unknown"
+	}
+}
@@ -2,6 +2,7 @@ package pkiadm
 
 import (
 	"strings"
+	"time"
 )
 
 const (
@@ -17,11 +18,47 @@ type (
 		ID          string
 		Type        CAType
 		Certificate ResourceName
+
+		// The following fields are only used by CAs of type CALetsEncrypt.
+		// DirectoryURL is the ACME directory to order certificates from. When
+		// empty, the Let's Encrypt production directory is used.
+		DirectoryURL string
+		// DirectoryCA is the path to a PEM file containing the certificates to
+		// trust for the connection to the directory, e.g. for a local test server.
+		DirectoryCA string
+		// AccountKey is the private key used to identify the ACME account.
+		AccountKey ResourceName
+		// Email is the contact address registered with the ACME account.
+		Email string
+		// ChallengeAddr is the address to answer http-01 challenges on.
+		ChallengeAddr string
+
+		// The following fields are only used by CAs of type CALocal.
+		// ACMEServer enables the issuing of certificates through the ACME
+		// directory of the server.
+		ACMEServer bool
+		// ACMESerial is the serial generator for certificates issued through
+		// ACME.
+		ACMESerial ResourceName
+		// ACMEDuration is the validity of certificates issued through ACME.
+		ACMEDuration time.Duration
+		// ACMEAllowed lists the identifiers, which may be ordered through ACME.
+		// Entries can be names like 'host.example.com', '*.example.com' for all
+		// names below a domain or networks like '10.0.0.0/8'.
+		ACMEAllowed []string
 	}
 	ResultCA struct {
 		Result Result
 		CAs    []CA
 	}
+	// CAImport contains an externally created CA certificate with its chain
+	// and the private key in PEM format. The private key, certificate and CA
+	// resources are all created with the same id.
+	CAImport struct {
+		ID          string
+		Certificate []byte
+		PrivateKey  []byte
+	}
 	CAChange struct {
 		CA        CA
 		FieldList []string
@@ -36,6 +73,11 @@ func (c *Client) SetCA(pk CA, fieldList []string) error {
 	changeset := CAChange{pk, fieldList}
 	return c.exec("SetCA", changeset)
 }
+
+// ImportCA creates a local CA from an existing certificate and private key.
+func (c *Client) ImportCA(id string, cert, key []byte) error {
+	return c.exec("ImportCA", CAImport{id, cert, key})
+}
 func (c *Client) DeleteCA(id string) error {
 	pk := ResourceName{ID: id, Type: RTCA}
 	return c.exec("DeleteCA", pk)
@@ -16,12 +16,80 @@ type (
 		Serial     ResourceName
 		CSR        ResourceName
 		CA         ResourceName
+		// Profile references the issuance settings to use. When set, the
+		// duration, usage and path length settings of the certificate are
+		// ignored.
+		Profile ResourceName
+
+		// KeyUsage and ExtKeyUsage restrict what the certificate may be used
+		// for. Certificates with cert-sign are issued as CA certificates. When
+		// no key usage is given for a self signed certificate, cert-sign,
+		// crl-sign and digital-signature are set.
+		KeyUsage    KeyUsage
+		ExtKeyUsage []ExtKeyUsage
+		// MaxPathLen is the maximum number of intermediate CAs allowed below a
+		// CA certificate. A negative value means no limit. Like in crypto/x509,
+		// a value of 0 only forbids intermediate CAs, when MaxPathLenZero is
+		// set.
+		MaxPathLen     int
+		MaxPathLenZero bool
+		// PathLenCritical marks the basic constraints as critical.
+		PathLenCritical bool
+
+		// Imported is set by the server for certificates, which were issued
+		// outside of pkiadm. They are not renewed until one of the signing
+		// settings is changed.
+		Imported bool
+
+		// KeepVersions is the number of issued certificates kept in the
+		// history. When 0, the server default of 10 is used.
+		KeepVersions int
+		// Version is filled by the server with the version of the currently
+		// used certificate.
+		Version int
+		// Renewal configures when the certificate is renewed. The lifetime
+		// is not used, as it is set by the duration.
+		Renewal Renewal
 
 		// Checksum is filled by the server with the checksum of the currently valid
 		// certificate.
 		Checksum []byte
 	}
 
+	// CertificateImport contains an externally issued certificate and its
+	// chain in PEM format. When PrivateKey is set, the key must match the
+	// certificate.
+	CertificateImport struct {
+		ID         string
+		PrivateKey ResourceName
+		Pem        []byte
+	}
+
+	// CertificateVersion is a certificate issued for a certificate resource in
+	// the past or present.
+	CertificateVersion struct {
+		Version int
+		// Serial is the serial number of the certificate in hex.
+		Serial    string
+		NotBefore time.Time
+		NotAfter  time.Time
+		Checksum  []byte
+		// CA is the id of the issuing CA. It is empty for imported
+		// certificates.
+		CA     string
+		Issued time.Time
+		// Current is set for the version currently in use.
+		Current bool
+		// Pem is only filled, when a single version is requested.
+		Pem []byte
+	}
+
+	// CertificateVersionName references a version of a certificate.
+	CertificateVersionName struct {
+		ID      string
+		Version int
+	}
+
 	CertificateChange struct {
 		Certificate Certificate
 		FieldList   []string
@@ -31,6 +99,11 @@ type (
 		Result       Result
 		Certificates []Certificate
 	}
+
+	ResultCertificateVersion struct {
+		Result   Result
+		Versions []CertificateVersion
+	}
 )
 
 // CreatePrivateKey sends a RPC request to create a new private key.
@@ -41,6 +114,12 @@ func (c *Client) SetCertificate(pk Certificate, fieldList []string) error {
 	changeset := CertificateChange{pk, fieldList}
 	return c.exec("SetCertificate", changeset)
 }
+
+// ImportCertificate stores an externally issued certificate together with its
+// chain.
+func (c *Client) ImportCertificate(id string, privateKey ResourceName, pem []byte) error {
+	return c.exec("ImportCertificate", CertificateImport{id, privateKey, pem})
+}
 func (c *Client) DeleteCertificate(id string) error {
 	pk := ResourceName{ID: id, Type: RTCertificate}
 	return c.exec("DeleteCertificate", pk)
@@ -69,3 +148,39 @@ func (c *Client) ShowCertificate(id string) (Certificate, error) {
 	}
 	return Certificate{}, nil
 }
+
+// HistoryCertificate returns all kept versions of the certificate from the
+// oldest to the newest.
+func (c *Client) HistoryCertificate(id string) ([]CertificateVersion, error) {
+	cert := ResourceName{ID: id, Type: RTCertificate}
+	result := &ResultCertificateVersion{}
+	if err := c.query("HistoryCertificate", cert, result); err != nil {
+		return []CertificateVersion{}, err
+	}
+	if result.Result.HasError {
+		return []CertificateVersion{}, result.Result.Error
+	}
+	return result.Versions, nil
+}
+
+// ShowCertificateVersion returns the version of the certificate including the
+// certificate itself.
+func (c *Client) ShowCertificateVersion(id string, version int) (CertificateVersion, error) {
+	result := &ResultCertificateVersion{}
+	if err := c.query("ShowCertificateVersion", CertificateVersionName{id, version}, result); err != nil {
+		return CertificateVersion{}, err
+	}
+	if result.Result.HasError {
+		return CertificateVersion{}, result.Result.Error
+	}
+	for _, v := range result.Versions {
+		return v, nil
+	}
+	return CertificateVersion{}, nil
+}
+
+// RollbackCertificate makes an earlier version of the certificate the current
+// one and writes it to the locations exporting the certificate.
+func (c *Client) RollbackCertificate(id string, version int) error {
+	return c.exec("RollbackCertificate", CertificateVersionName{id, version})
+}
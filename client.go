@@ -1,7 +1,10 @@
 package pkiadm
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/rpc"
 )
 
@@ -13,16 +16,54 @@ const (
 type (
 	Client struct {
 		c *rpc.Client
+		// cfg is kept to open further connections to the server.
+		cfg Config
 	}
 )
 
-// Create a new Client instance using the provided configuration.
+// Create a new Client instance using the provided configuration. When an
+// address is configured, the remote daemon is used.
 func NewClient(cfg Config) (*Client, error) {
+	if cfg.Address != "" {
+		return newRemoteClient(cfg)
+	}
 	conn, err := rpc.Dial("unix", cfg.Path)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+	return &Client{c: conn, cfg: cfg}, nil
+}
+
+// newRemoteClient connects to the daemon at the address of the config with
+// mutual TLS.
+func newRemoteClient(cfg Config) (*Client, error) {
+	if cfg.ClientCertificate == "" || cfg.ClientKey == "" {
+		return nil, fmt.Errorf("a client certificate and key are needed to connect to '%s'", cfg.Address)
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.ClientCertificate, cfg.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   cfg.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ServerCA != "" {
+		raw, err := ioutil.ReadFile(cfg.ServerCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read server CA: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates found in '%s'", cfg.ServerCA)
+		}
+	}
+	conn, err := tls.Dial("tcp", cfg.Address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c: rpc.NewClient(conn), cfg: cfg}, nil
 }
 
 // Close the client connection with the server. When the Connection is already
@@ -45,6 +86,19 @@ func (c *Client) exec(cmd string, input interface{}) error {
 	return nil
 }
 
+// submit executes the command and returns the id of the job continuing it in
+// the background. The id is empty, when the command already finished.
+func (c *Client) submit(cmd string, input interface{}) (string, error) {
+	result := &Result{}
+	if err := c.c.Call(fmt.Sprintf("%s.%s", ProtoIdent, cmd), input, result); err != nil {
+		return "", err
+	}
+	if result.HasError {
+		return "", result.Error
+	}
+	return result.Job, nil
+}
+
 // query can be used to call a function returning a result set.
 func (c *Client) query(cmd string, input interface{}, result interface{}) error {
 	if err := c.c.Call(fmt.Sprintf("%s.%s", ProtoIdent, cmd), input, result); err != nil {
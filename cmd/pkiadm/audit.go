@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func audit(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm audit", flag.ExitOnError)
+	filter := pkiadm.AuditFilter{}
+	fs.StringVar(&filter.Resource, "resource", "", "only show changes of resources starting with the name, e.g. cert/ or cert/www")
+	fs.StringVar(&filter.Caller, "caller", "", "only show changes made by the caller, e.g. \"user '1000/alice'\"")
+	fs.StringVar(&filter.Action, "action", "", "only show changes made by the action, e.g. SetCertificate or Refresh")
+	since := fs.Duration("since", 0, "only show changes of the last duration (in h, m, s)")
+	fs.BoolVar(&filter.Failed, "failed", false, "only show failed changes")
+	verify := fs.Bool("verify", false, "verify the chain of the whole audit log")
+	fs.Parse(args)
+
+	if *verify {
+		v, err := client.VerifyAudit()
+		if err != nil {
+			return err
+		}
+		if !v.Intact {
+			return errors.Errorf("audit log is broken at entry %d after %d intact entries: %s", v.Broken, v.Entries, v.Reason)
+		}
+		fmt.Printf("audit log is intact with %d entries\n", v.Entries)
+		return nil
+	}
+
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	entries, err := client.Audit(filter)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", "seq", "time", "caller", "action", "resource", "fields", "old", "new", "outcome")
+	for _, e := range entries {
+		fmt.Fprintf(
+			out,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			e.Seq,
+			e.Time.Local().Format(time.RFC3339),
+			e.Caller,
+			e.Action,
+			e.Resource,
+			ReplaceEmpty(strings.Join(e.Fields, ",")),
+			shortChecksum(e.OldChecksum),
+			shortChecksum(e.NewChecksum),
+			auditOutcome(e),
+		)
+	}
+	out.Flush()
+	for _, e := range entries {
+		if e.Outcome == pkiadm.AOFailed {
+			fmt.Printf("%d: %s\n", e.Seq, e.Error)
+		}
+	}
+	return nil
+}
+
+// shortChecksum returns the start of the checksum, which is enough to tell
+// the versions of a resource apart.
+func shortChecksum(sum []byte) string {
+	if len(sum) == 0 {
+		return "-"
+	}
+	if len(sum) > 6 {
+		sum = sum[:6]
+	}
+	return hex.EncodeToString(sum)
+}
+
+// auditOutcome returns the outcome and the job continuing the change.
+func auditOutcome(e pkiadm.AuditEntry) string {
+	if e.Job != "" {
+		return fmt.Sprintf("%s (job %s)", e.Outcome, e.Job)
+	}
+	return e.Outcome.String()
+}
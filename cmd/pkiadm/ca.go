@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/gibheer/pkiadm"
 	"github.com/pkg/errors"
@@ -11,48 +13,99 @@ import (
 )
 
 func createCA(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("pkiadm create-public", flag.ExitOnError)
-	id := fs.String("id", "", "the id to set for the CA")
-	ct := fs.String("type", "local", "the type of CA to create (local, LetsEncrypt)")
-	cert := fs.String("certificate", "", "the id of the certificate to use for CA creation")
-	fs.Parse(args)
-
-	caType := pkiadm.StringToCAType(*ct)
-	if caType == pkiadm.CAUnknown {
-		return errors.New("unknown ca type")
+	fs := flag.NewFlagSet("pkiadm create-ca", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm create-ca")
+		fmt.Print(`
+Create a new CA to sign certificate sign requests. A local CA signs with the
+private key of the given certificate. A LetsEncrypt CA orders the certificates
+from an ACME directory and answers the http-01 challenges on the challenge address.
+Local CAs can also issue certificates to ACME clients through the ACME listener
+of pkiadmd, when the ACME server is enabled for them.
+`)
+		fs.PrintDefaults()
 	}
-	caName := pkiadm.ResourceName{ID: *cert, Type: pkiadm.RTCertificate}
-	if err := client.CreateCA(
-		pkiadm.CA{ID: *id, Type: caType, Certificate: caName},
-	); err != nil {
+	ca := pkiadm.CA{}
+	fs.StringVar(&ca.ID, "id", "", "the id to set for the CA")
+	if err := parseCAArgs(fs, args, &ca); err != nil {
+		return err
+	}
+
+	if err := client.CreateCA(ca); err != nil {
 		return errors.Wrap(err, "Could not create CA")
 	}
 	return nil
 }
 func setCA(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("pkiadm set-public", flag.ExitOnError)
-	id := fs.String("id", "", "the id of the CA to change")
-	ct := fs.String("type", "local", "the type of CA to create (local, LetsEncrypt)")
-	cert := fs.String("certificate", "", "the id of the certificate to use for signing")
-	fs.Parse(args)
+	fs := flag.NewFlagSet("pkiadm set-ca", flag.ExitOnError)
+	ca := pkiadm.CA{}
+	fs.StringVar(&ca.ID, "id", "", "the id of the CA to change")
+	if err := parseCAArgs(fs, args, &ca); err != nil {
+		return err
+	}
 
 	fieldList := []string{}
-	for _, field := range []string{"certificate", "type"} {
+	for _, field := range []string{
+		"certificate", "type", "directory", "directory-ca", "account-key", "email",
+		"challenge-addr", "acme-server", "acme-serial", "acme-duration", "acme-allow",
+	} {
 		flag := fs.Lookup(field)
 		if flag.Changed {
 			fieldList = append(fieldList, field)
 		}
 	}
-	caType := pkiadm.StringToCAType(*ct)
-	if caType == pkiadm.CAUnknown {
+	if err := client.SetCA(ca, fieldList); err != nil {
+		return errors.Wrap(err, "Could not change CA")
+	}
+	return nil
+}
+func parseCAArgs(fs *flag.FlagSet, args []string, ca *pkiadm.CA) error {
+	ct := fs.String("type", "local", "the type of CA to create (local, LetsEncrypt)")
+	cert := fs.String("certificate", "", "the id of the certificate to use for signing")
+	fs.StringVar(&ca.DirectoryURL, "directory", "", "the URL of the ACME directory (defaults to Let's Encrypt)")
+	fs.StringVar(&ca.DirectoryCA, "directory-ca", "", "the path to a PEM file with certificates to trust for the ACME directory")
+	accountKey := fs.String("account-key", "", "the id of the private key to use for the ACME account")
+	fs.StringVar(&ca.Email, "email", "", "the contact mail address for the ACME account")
+	fs.StringVar(&ca.ChallengeAddr, "challenge-addr", ":80", "the address to answer http-01 challenges on")
+	fs.BoolVar(&ca.ACMEServer, "acme-server", false, "issue certificates of a local CA through the ACME directory of pkiadmd")
+	acmeSerial := fs.String("acme-serial", "", "the serial generator for certificates issued through ACME")
+	fs.DurationVar(&ca.ACMEDuration, "acme-duration", 90*24*time.Hour, "the validity of certificates issued through ACME")
+	fs.StringSliceVar(&ca.ACMEAllowed, "acme-allow", []string{}, "the names (host.example.com, *.example.com) or networks (10.0.0.0/8) allowed to be ordered through ACME")
+	fs.Parse(args)
+
+	ca.Type = pkiadm.StringToCAType(*ct)
+	if ca.Type == pkiadm.CAUnknown {
 		return errors.New("unknown ca type")
 	}
-	caName := pkiadm.ResourceName{ID: *cert, Type: pkiadm.RTCertificate}
-	if err := client.SetCA(
-		pkiadm.CA{ID: *id, Certificate: caName},
-		fieldList,
-	); err != nil {
-		return errors.Wrap(err, "Could not change CA")
+	ca.Certificate = pkiadm.ResourceName{ID: *cert, Type: pkiadm.RTCertificate}
+	ca.AccountKey = pkiadm.ResourceName{ID: *accountKey, Type: pkiadm.RTPrivateKey}
+	ca.ACMESerial = pkiadm.ResourceName{ID: *acmeSerial, Type: pkiadm.RTSerial}
+	return nil
+}
+func importCA(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("import-ca", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm import-ca")
+		fmt.Print(`
+Import an existing CA to issue certificates with. A private key, a certificate and a local CA are created, all with the given id. The certificate file may contain the chain after the CA certificate and the private key must match it.
+`)
+		fs.PrintDefaults()
+	}
+	id := fs.String("id", "", "set the unique id for the imported CA")
+	certFile := fs.String("cert", "", "the PEM file containing the CA certificate and its chain")
+	keyFile := fs.String("key", "", "the PEM file containing the private key of the CA")
+	fs.Parse(args)
+
+	cert, err := readInput(*certFile)
+	if err != nil {
+		return err
+	}
+	key, err := readInput(*keyFile)
+	if err != nil {
+		return err
+	}
+	if err := client.ImportCA(*id, cert, key); err != nil {
+		return errors.Wrap(err, "could not import CA")
 	}
 	return nil
 }
@@ -99,7 +152,19 @@ func showCA(args []string, client *pkiadm.Client) error {
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", ca.ID)
 	fmt.Fprintf(out, "type:\t%s\t\n", ca.Type.String())
-	fmt.Fprintf(out, "certificate:\t%s\t\n", ca.Certificate.ID)
+	fmt.Fprintf(out, "certificate:\t%s\t\n", ReplaceEmpty(ca.Certificate.ID))
+	if ca.Type == pkiadm.CALetsEncrypt {
+		fmt.Fprintf(out, "directory:\t%s\t\n", ReplaceEmpty(ca.DirectoryURL))
+		fmt.Fprintf(out, "directory-ca:\t%s\t\n", ReplaceEmpty(ca.DirectoryCA))
+		fmt.Fprintf(out, "account-key:\t%s\t\n", ReplaceEmpty(ca.AccountKey.ID))
+		fmt.Fprintf(out, "email:\t%s\t\n", ReplaceEmpty(ca.Email))
+		fmt.Fprintf(out, "challenge-addr:\t%s\t\n", ReplaceEmpty(ca.ChallengeAddr))
+	}
+	if ca.ACMEServer {
+		fmt.Fprintf(out, "acme-serial:\t%s\t\n", ReplaceEmpty(ca.ACMESerial.ID))
+		fmt.Fprintf(out, "acme-duration:\t%s\t\n", ca.ACMEDuration)
+		fmt.Fprintf(out, "acme-allow:\t%s\t\n", ReplaceEmpty(strings.Join(ca.ACMEAllowed, ", ")))
+	}
 	out.Flush()
 	return nil
 }
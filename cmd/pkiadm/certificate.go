@@ -23,7 +23,9 @@ This command creates a new certificate and signes it with the provided CA. If yo
 	}
 	cert := pkiadm.Certificate{}
 	fs.StringVar(&cert.ID, "id", "", "set the unique id for the new certificate")
-	parseCertificateArgs(fs, args, &cert)
+	if err := parseCertificateArgs(fs, args, &cert); err != nil {
+		return err
+	}
 
 	if err := client.CreateCertificate(cert); err != nil {
 		return errors.Wrap(err, "could not create certificate")
@@ -31,14 +33,43 @@ This command creates a new certificate and signes it with the provided CA. If yo
 
 	return nil
 }
+func importCertificate(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("import-cert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm import-cert")
+		fmt.Print(`
+Import a certificate issued outside of pkiadm. The file may contain the chain after the certificate. When a private key is given, it must match the certificate. Imported certificates are not renewed, until their settings are changed with set-cert. Importing a certificate with the id of an already imported one replaces it.
+`)
+		fs.PrintDefaults()
+	}
+	id := fs.String("id", "", "set the unique id for the imported certificate")
+	file := fs.String("file", "-", "the PEM file containing the certificate and its chain (- for stdin)")
+	private := fs.String("private", "", "the id of the private key belonging to the certificate")
+	fs.Parse(args)
+
+	raw, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	pk := pkiadm.ResourceName{}
+	if *private != "" {
+		pk = pkiadm.ResourceName{ID: *private, Type: pkiadm.RTPrivateKey}
+	}
+	if err := client.ImportCertificate(*id, pk, raw); err != nil {
+		return errors.Wrap(err, "could not import certificate")
+	}
+	return nil
+}
 func setCertificate(args []string, client *pkiadm.Client) error {
 	fs := flag.NewFlagSet("set-cert", flag.ExitOnError)
 	cert := pkiadm.Certificate{}
 	fs.StringVar(&cert.ID, "id", "", "set the id of the certificate to change")
-	parseCertificateArgs(fs, args, &cert)
+	if err := parseCertificateArgs(fs, args, &cert); err != nil {
+		return err
+	}
 
-	fieldList := []string{}
-	for _, field := range []string{"private", "csr", "ca", "serial", "duration", "self-sign"} {
+	fieldList := changedRenewalFields(fs)
+	for _, field := range []string{"private", "csr", "ca", "serial", "profile", "duration", "self-sign", "key-usage", "ext-key-usage", "max-path-len", "path-len-critical", "keep-versions"} {
 		flag := fs.Lookup(field)
 		if flag.Changed {
 			fieldList = append(fieldList, field)
@@ -50,19 +81,42 @@ func setCertificate(args []string, client *pkiadm.Client) error {
 	}
 	return nil
 }
-func parseCertificateArgs(fs *flag.FlagSet, args []string, cert *pkiadm.Certificate) {
+func parseCertificateArgs(fs *flag.FlagSet, args []string, cert *pkiadm.Certificate) error {
 	pk := fs.String("private", "", "the private key id to sign the certificate sign request")
 	csr := fs.String("csr", "", "the CSR to sign to get the resulting certificate")
 	ca := fs.String("ca", "", "the certificate to use to sign the certificate sign request")
 	serial := fs.String("serial", "", "the serial generator used to fetch a serial")
+	profile := fs.String("profile", "", "the profile to issue the certificate with (replaces the duration and usage options)")
 	fs.DurationVar(&cert.Duration, "duration", 360*24*time.Hour, "the time the certificate is valid (in h, m, s)") // these are 360 days
 	fs.BoolVar(&cert.IsCA, "self-sign", false, "set this to true to create a self signed certificate (for CA usage)")
+	keyUsage := fs.StringSlice("key-usage", []string{}, "the key usages (digital-signature, content-commitment, key-encipherment, data-encipherment, key-agreement, cert-sign, crl-sign, encipher-only, decipher-only); cert-sign creates a CA certificate")
+	extKeyUsage := fs.StringSlice("ext-key-usage", []string{}, "the extended key usages (server-auth, client-auth, code-signing, email-protection, ocsp-signing)")
+	fs.IntVar(&cert.MaxPathLen, "max-path-len", -1, "the maximum number of intermediate CAs below a CA certificate (-1 for no limit)")
+	fs.BoolVar(&cert.PathLenCritical, "path-len-critical", true, "mark the basic constraints of a CA certificate as critical")
+	fs.IntVar(&cert.KeepVersions, "keep-versions", 0, "the number of issued certificates to keep in the history (0 for the default of 10)")
+	addRenewalFlags(fs, &cert.Renewal, false)
 	fs.Parse(args)
 
+	// the default of -1 is only replaced by an explicit limit
+	cert.MaxPathLenZero = cert.MaxPathLen == 0
 	cert.PrivateKey = pkiadm.ResourceName{*pk, pkiadm.RTPrivateKey}
 	cert.CSR = pkiadm.ResourceName{*csr, pkiadm.RTCSR}
 	cert.CA = pkiadm.ResourceName{*ca, pkiadm.RTCA}
 	cert.Serial = pkiadm.ResourceName{*serial, pkiadm.RTSerial}
+	cert.Profile = pkiadm.ResourceName{*profile, pkiadm.RTProfile}
+
+	var err error
+	if cert.KeyUsage, err = pkiadm.StringsToKeyUsage(*keyUsage); err != nil {
+		return err
+	}
+	for _, name := range *extKeyUsage {
+		eku, err := pkiadm.StringToExtKeyUsage(name)
+		if err != nil {
+			return err
+		}
+		cert.ExtKeyUsage = append(cert.ExtKeyUsage, eku)
+	}
+	return nil
 }
 
 func deleteCertificate(args []string, client *pkiadm.Client) error {
@@ -99,22 +153,127 @@ func listCertificate(args []string, client *pkiadm.Client) error {
 func showCertificate(args []string, client *pkiadm.Client) error {
 	fs := flag.NewFlagSet("show-cert", flag.ExitOnError)
 	var id = fs.String("id", "", "set the id of the private key to show")
+	version := fs.Int("version", 0, "show the version from the history instead of the settings")
 	fs.Parse(args)
 
+	if *version > 0 {
+		return showCertificateVersion(*id, *version, client)
+	}
 	cert, err := client.ShowCertificate(*id)
 	if err != nil {
 		return err
 	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: cert.ID, Type: pkiadm.RTCertificate})
+	if err != nil {
+		return err
+	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "id:\t%s\n", cert.ID)
 	fmt.Fprintf(out, "private:\t%s\n", cert.PrivateKey.ID)
 	fmt.Fprintf(out, "csr:\t%s\n", cert.CSR.ID)
 	fmt.Fprintf(out, "ca:\t%s\n", cert.CA.ID)
 	fmt.Fprintf(out, "serial:\t%s\n", cert.Serial.ID)
+	fmt.Fprintf(out, "profile:\t%s\n", cert.Profile.ID)
 	fmt.Fprintf(out, "created:\t%s\n", cert.Created)
 	fmt.Fprintf(out, "duration:\t%s\n", cert.Duration)
 	fmt.Fprintf(out, "self-signed:\t%t\n", cert.IsCA)
+	fmt.Fprintf(out, "key usage:\t%s\n", cert.KeyUsage)
+	fmt.Fprintf(out, "ext key usage:\t%s\n", cert.ExtKeyUsage)
+	fmt.Fprintf(out, "max path len:\t%d\n", cert.MaxPathLen)
+	fmt.Fprintf(out, "path len critical:\t%t\n", cert.PathLenCritical)
+	fmt.Fprintf(out, "imported:\t%t\n", cert.Imported)
+	fmt.Fprintf(out, "keep versions:\t%d\n", cert.KeepVersions)
+	fmt.Fprintf(out, "version:\t%d\n", cert.Version)
+	printRenewal(out, cert.Renewal, false)
+	printStatus(out, st)
 	fmt.Fprintf(out, "checksum:\t%s\n", base64.StdEncoding.EncodeToString(cert.Checksum))
 	out.Flush()
 	return nil
 }
+
+// showCertificateVersion prints a version from the history of the certificate
+// followed by the certificate itself.
+func showCertificateVersion(id string, version int, client *pkiadm.Client) error {
+	v, err := client.ShowCertificateVersion(id, version)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "id:\t%s\n", id)
+	fmt.Fprintf(out, "version:\t%d\n", v.Version)
+	fmt.Fprintf(out, "current:\t%t\n", v.Current)
+	fmt.Fprintf(out, "serial:\t%s\n", v.Serial)
+	fmt.Fprintf(out, "ca:\t%s\n", v.CA)
+	fmt.Fprintf(out, "issued:\t%s\n", v.Issued)
+	fmt.Fprintf(out, "not before:\t%s\n", v.NotBefore)
+	fmt.Fprintf(out, "not after:\t%s\n", v.NotAfter)
+	fmt.Fprintf(out, "checksum:\t%s\n", base64.StdEncoding.EncodeToString(v.Checksum))
+	out.Flush()
+	os.Stdout.Write(v.Pem)
+	return nil
+}
+func historyCertificate(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("history-cert", flag.ExitOnError)
+	id := fs.String("id", "", "the id of the certificate")
+	fs.Parse(args)
+
+	versions, err := client.HistoryCertificate(*id)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", "version", "serial", "ca", "not before", "not after", "checksum", "current")
+	for _, v := range versions {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\t%t\t\n", v.Version, v.Serial, v.CA, v.NotBefore.Format(time.RFC3339), v.NotAfter.Format(time.RFC3339), base64.StdEncoding.EncodeToString(v.Checksum), v.Current)
+	}
+	out.Flush()
+	return nil
+}
+func rollbackCertificate(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("rollback-cert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm rollback-cert")
+		fmt.Print(`
+Make an earlier version of the certificate from its history the current one and write it to all locations exporting the certificate. The certificate is still renewed as configured, which adds a new version.
+`)
+		fs.PrintDefaults()
+	}
+	id := fs.String("id", "", "the id of the certificate")
+	version := fs.Int("version", 0, "the version to roll back to (see history-cert)")
+	fs.Parse(args)
+
+	if err := client.RollbackCertificate(*id, *version); err != nil {
+		return errors.Wrap(err, "could not roll back certificate")
+	}
+	return nil
+}
+
+func revokeCertificate(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("revoke-cert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm revoke-cert")
+		fmt.Print(`
+This command revokes a certificate. Either the id of the certificate or the CA and the serial in hex of a certificate issued through the ACME directory must be given. A certificate on hold can be released with the reason remove-from-crl.
+`)
+		fs.PrintDefaults()
+	}
+	rev := pkiadm.Revocation{}
+	fs.StringVar(&rev.ID, "id", "", "the id of the certificate to revoke")
+	ca := fs.String("ca", "", "the CA which issued the certificate")
+	fs.StringVar(&rev.Serial, "serial", "", "the serial of the certificate in hex")
+	reason := fs.String("reason", "unspecified", "the reason of the revocation (unspecified, key-compromise, ca-compromise, affiliation-changed, superseded, cessation-of-operation, certificate-hold, remove-from-crl, privilege-withdrawn, aa-compromise)")
+	fs.Parse(args)
+
+	var err error
+	rev.CA = pkiadm.ResourceName{*ca, pkiadm.RTCA}
+	if rev.Reason, err = pkiadm.StringToRevocationReason(*reason); err != nil {
+		return err
+	}
+	if err := client.RevokeCertificate(rev); err != nil {
+		return errors.Wrap(err, "could not revoke certificate")
+	}
+	return nil
+}
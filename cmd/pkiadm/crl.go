@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func createCRL(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm create-crl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm create-crl")
+		fmt.Print(`
+Create a new certificate revocation list signed by the given CA. The list is regenerated before the next update is reached and can be exported using a location.
+`)
+		fs.PrintDefaults()
+	}
+	crl := pkiadm.CRL{}
+	fs.StringVar(&crl.ID, "id", "", "set the unique id for the new CRL")
+	parseCRLArgs(fs, args, &crl)
+
+	if err := client.CreateCRL(crl); err != nil {
+		return errors.Wrap(err, "could not create CRL")
+	}
+	return nil
+}
+
+func setCRL(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm set-crl", flag.ExitOnError)
+	crl := pkiadm.CRL{}
+	fs.StringVar(&crl.ID, "id", "", "set the id of the CRL to change")
+	parseCRLArgs(fs, args, &crl)
+
+	fieldList := changedRenewalFields(fs)
+	for _, field := range []string{"ca", "duration"} {
+		flag := fs.Lookup(field)
+		if flag.Changed {
+			fieldList = append(fieldList, field)
+		}
+	}
+	if err := client.SetCRL(crl, fieldList); err != nil {
+		return errors.Wrap(err, "could not change CRL")
+	}
+	return nil
+}
+
+func parseCRLArgs(fs *flag.FlagSet, args []string, crl *pkiadm.CRL) {
+	ca := fs.String("ca", "", "the CA signing the revocation list")
+	fs.DurationVar(&crl.Duration, "duration", 7*24*time.Hour, "the time until the next update of the list (in h, m, s)")
+	addRenewalFlags(fs, &crl.Renewal, false)
+	fs.Parse(args)
+
+	crl.CA = pkiadm.ResourceName{*ca, pkiadm.RTCA}
+}
+
+func deleteCRL(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm delete-crl", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the CRL to delete")
+	fs.Parse(args)
+
+	if err := client.DeleteCRL(*id); err != nil {
+		return errors.Wrap(err, "could not delete CRL")
+	}
+	return nil
+}
+
+func listCRL(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm list-crl", flag.ExitOnError)
+	fs.Parse(args)
+
+	crls, err := client.ListCRL()
+	if err != nil {
+		return err
+	}
+	if len(crls) == 0 {
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t\n", "id", "ca", "duration", "number", "next update", "revoked")
+	for _, crl := range crls {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%d\t%s\t%d\t\n", crl.ID, crl.CA.ID, crl.Duration, crl.Number, crl.NextUpdate, crl.Revoked)
+	}
+	out.Flush()
+	return nil
+}
+
+func showCRL(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm show-crl", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the CRL to show")
+	fs.Parse(args)
+
+	crl, err := client.ShowCRL(*id)
+	if err != nil {
+		return err
+	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: crl.ID, Type: pkiadm.RTCRL})
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "id:\t%s\n", crl.ID)
+	fmt.Fprintf(out, "ca:\t%s\n", crl.CA.ID)
+	fmt.Fprintf(out, "duration:\t%s\n", crl.Duration)
+	fmt.Fprintf(out, "number:\t%d\n", crl.Number)
+	fmt.Fprintf(out, "next update:\t%s\n", crl.NextUpdate)
+	fmt.Fprintf(out, "revoked:\t%d\n", crl.Revoked)
+	printRenewal(out, crl.Renewal, false)
+	printStatus(out, st)
+	fmt.Fprintf(out, "checksum:\t%s\n", base64.StdEncoding.EncodeToString(crl.Checksum))
+	out.Flush()
+	return nil
+}
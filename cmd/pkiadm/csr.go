@@ -33,13 +33,35 @@ FQDNs, mail addresses and ips can be set multiple times or once as a comma separ
 
 	return nil
 }
+func importCSR(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("import-csr", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm import-csr")
+		fmt.Print(`
+Import a certificate sign request generated outside of pkiadm. The request can then be signed by a CA without access to the private key. Importing a request with the id of an already imported one replaces it.
+`)
+		fs.PrintDefaults()
+	}
+	id := fs.String("id", "", "set the unique id for the imported CSR")
+	file := fs.String("file", "-", "the PEM file containing the CSR (- for stdin)")
+	fs.Parse(args)
+
+	raw, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	if err := client.ImportCSR(*id, raw); err != nil {
+		return errors.Wrap(err, "could not import CSR")
+	}
+	return nil
+}
 func setCSR(args []string, client *pkiadm.Client) error {
 	fs := flag.NewFlagSet("set-csr", flag.ExitOnError)
 	csr := pkiadm.CSR{}
 	fs.StringVar(&csr.ID, "id", "", "set the id of the CSR to adjust")
 	parseCSRArgs(fs, args, &csr)
 
-	fieldList := []string{}
+	fieldList := changedRenewalFields(fs)
 	for _, field := range []string{"private-key", "subject", "ip", "fqdn", "mail"} {
 		flag := fs.Lookup(field)
 		if flag.Changed {
@@ -58,6 +80,7 @@ func parseCSRArgs(fs *flag.FlagSet, args []string, csr *pkiadm.CSR) {
 	fs.IPSliceVar(&csr.IPAddresses, "ip", []net.IP{}, "assign the ips")
 	pk := fs.String("private-key", "", "set the id of the private key to sign the request")
 	subject := fs.String("subject", "", "set the id of the subject to use for this request")
+	addRenewalFlags(fs, &csr.Renewal, true)
 	fs.Parse(args)
 
 	csr.PrivateKey = pkiadm.ResourceName{*pk, pkiadm.RTPrivateKey}
@@ -117,6 +140,10 @@ func showCSR(args []string, client *pkiadm.Client) error {
 	for _, ip := range csr.IPAddresses {
 		ips = append(ips, ip.String())
 	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: csr.ID, Type: pkiadm.RTCSR})
+	if err != nil {
+		return err
+	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", csr.ID)
 	fmt.Fprintf(out, "private:\t%s\t\n", csr.PrivateKey.ID)
@@ -124,6 +151,9 @@ func showCSR(args []string, client *pkiadm.Client) error {
 	fmt.Fprintf(out, "fqdn:\t%s\t\n", ReplaceEmpty(strings.Join(csr.DNSNames, ", ")))
 	fmt.Fprintf(out, "ip:\t%s\t\n", ReplaceEmpty(strings.Join(ips, ", ")))
 	fmt.Fprintf(out, "mail:\t%s\t\n", ReplaceEmpty(strings.Join(csr.EmailAddresses, ", ")))
+	fmt.Fprintf(out, "imported:\t%t\t\n", csr.Imported)
+	printRenewal(out, csr.Renewal, true)
+	printStatus(out, st)
 	fmt.Fprintf(out, "checksum:\t%s\t\n", base64.StdEncoding.EncodeToString(csr.Checksum))
 	out.Flush()
 	return nil
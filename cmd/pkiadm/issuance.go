@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+// opensslReasons contains the names OpenSSL uses for the revocation reasons in
+// the index file.
+var opensslReasons = map[pkiadm.RevocationReason]string{
+	pkiadm.RRUnspecified:          "unspecified",
+	pkiadm.RRKeyCompromise:        "keyCompromise",
+	pkiadm.RRCACompromise:         "CACompromise",
+	pkiadm.RRAffiliationChanged:   "affiliationChanged",
+	pkiadm.RRSuperseded:           "superseded",
+	pkiadm.RRCessationOfOperation: "cessationOfOperation",
+	pkiadm.RRCertificateHold:      "certificateHold",
+	pkiadm.RRRemoveFromCRL:        "removeFromCRL",
+}
+
+func findCertificate(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("find-cert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm find-cert")
+		fmt.Print(`
+Search the certificates issued by the CAs. All given options must match. Without options, all issued certificates are listed.
+`)
+		fs.PrintDefaults()
+	}
+	filter := pkiadm.IssuanceFilter{}
+	fs.StringVar(&filter.CA, "ca", "", "the id of the issuing CA")
+	fs.StringVar(&filter.Serial, "serial", "", "the serial of the certificate in hex")
+	fs.StringVar(&filter.SAN, "san", "", "a subject alternative name of the certificate")
+	fs.StringVar(&filter.Subject, "subject", "", "a part of the subject of the certificate")
+	fs.Parse(args)
+
+	issuances, err := client.FindCertificate(filter)
+	if err != nil {
+		return err
+	}
+	if len(issuances) == 0 {
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", "ca", "serial", "subject", "sans", "not after", "status", "requester")
+	for _, iss := range issuances {
+		status := iss.Status.String()
+		if iss.Status == pkiadm.ISRevoked {
+			status = fmt.Sprintf("%s (%s)", status, iss.Reason)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", iss.CA, iss.Serial, iss.Subject, strings.Join(iss.SANs, ","), iss.NotAfter.Format(time.RFC3339), status, iss.Requester)
+	}
+	out.Flush()
+	return nil
+}
+
+func exportIndex(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("export-index", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm export-index")
+		fmt.Print(`
+Export the certificates issued by a CA in the format of the OpenSSL index.txt.
+`)
+		fs.PrintDefaults()
+	}
+	ca := fs.String("ca", "", "the id of the CA to export the issued certificates of")
+	file := fs.String("file", "-", "the file to write the index to (- for stdout)")
+	fs.Parse(args)
+
+	if *ca == "" {
+		return fmt.Errorf("no CA given")
+	}
+	issuances, err := client.FindCertificate(pkiadm.IssuanceFilter{CA: *ca})
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Wrap(err, "could not open index file")
+		}
+		defer f.Close()
+		out = f
+	}
+	for _, iss := range issuances {
+		if _, err := fmt.Fprintln(out, indexLine(iss)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexLine formats the issuance as a line of the OpenSSL index.txt.
+func indexLine(iss pkiadm.Issuance) string {
+	status, revoked := "V", ""
+	switch iss.Status {
+	case pkiadm.ISExpired:
+		status = "E"
+	case pkiadm.ISRevoked:
+		status = "R"
+		revoked = indexTime(iss.RevokedAt)
+		if reason, found := opensslReasons[iss.Reason]; found && iss.Reason != pkiadm.RRUnspecified {
+			revoked += "," + reason
+		}
+	}
+	serial := strings.ToUpper(iss.Serial)
+	if len(serial)%2 == 1 {
+		serial = "0" + serial
+	}
+	return strings.Join([]string{status, indexTime(iss.NotAfter), revoked, serial, "unknown", opensslName(iss.Subject)}, "\t")
+}
+
+// indexTime formats the time as ASN.1 UTCTime or GeneralizedTime like OpenSSL
+// does.
+func indexTime(t time.Time) string {
+	t = t.UTC()
+	if t.Year() >= 2050 {
+		return t.Format("20060102150405Z")
+	}
+	return t.Format("060102150405Z")
+}
+
+// opensslName converts a distinguished name in the RFC 2253 format into the
+// one used by OpenSSL, e.g. 'CN=www,O=example' into '/O=example/CN=www'.
+func opensslName(name string) string {
+	parts := []string{}
+	current := ""
+	escaped := false
+	for _, r := range name {
+		switch {
+		case escaped:
+			current += string(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			parts = append(parts, current)
+			current = ""
+		default:
+			current += string(r)
+		}
+	}
+	parts = append(parts, current)
+	res := ""
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] != "" {
+			res += "/" + parts[i]
+		}
+	}
+	return res
+}
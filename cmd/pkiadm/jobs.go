@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func listJobs(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm jobs", flag.ExitOnError)
+	fs.Parse(args)
+
+	jobs, err := client.ListJobs()
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t\n", "id", "state", "resource", "created", "description")
+	for _, job := range jobs {
+		fmt.Fprintf(
+			out,
+			"%s\t%s\t%s\t%s\t%s\t\n",
+			job.ID,
+			job.State,
+			job.Resource,
+			job.Created.Format(time.RFC3339),
+			job.Description,
+		)
+	}
+	out.Flush()
+	for _, job := range jobs {
+		if job.State == pkiadm.JSFailed {
+			fmt.Printf("job %s: %s\n", job.ID, job.Error)
+		}
+	}
+	return nil
+}
+
+func waitJob(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm wait", flag.ExitOnError)
+	id := fs.String("id", "", "the id of the job to wait for")
+	timeout := fs.Duration("timeout", 0, "the maximum time to wait (in h, m, s; 0 waits until the job is finished)")
+	fs.Parse(args)
+
+	if *id == "" && fs.NArg() > 0 {
+		*id = fs.Arg(0)
+	}
+	if *id == "" {
+		return errors.New("no job given")
+	}
+	return waitFor(client, *id, *timeout)
+}
+
+// followJob reports the job started by a request. When wait is set, it waits
+// for the job to finish.
+func followJob(client *pkiadm.Client, id string, wait bool) error {
+	if id == "" {
+		return nil
+	}
+	if !wait {
+		fmt.Printf("started job %s, use 'pkiadm wait %s' to wait for it\n", id, id)
+		return nil
+	}
+	return waitFor(client, id, 0)
+}
+
+// waitFor waits for the job to finish or the timeout to pass. Without timeout
+// it waits until the job is finished. A failed job is returned as an error.
+func waitFor(client *pkiadm.Client, id string, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		wait := timeout
+		if !deadline.IsZero() {
+			// a timeout of 0 would wait as long as the server allows
+			wait = time.Until(deadline)
+			if wait <= 0 {
+				wait = time.Millisecond
+			}
+		}
+		job, err := client.WaitJob(id, wait)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job.State == pkiadm.JSFailed:
+			return errors.Errorf("job %s failed: %s", job.ID, job.Error)
+		case job.Done():
+			fmt.Printf("job %s done: %s\n", job.ID, job.Description)
+			return nil
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return errors.Errorf("job %s is still %s", job.ID, job.State)
+		}
+	}
+}
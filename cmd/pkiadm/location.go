@@ -99,12 +99,17 @@ func showLocation(args []string, client *pkiadm.Client) error {
 	for _, dep := range loc.Dependencies {
 		deps = append(deps, dep.String())
 	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: loc.ID, Type: pkiadm.RTLocation})
+	if err != nil {
+		return err
+	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", loc.ID)
 	fmt.Fprintf(out, "path:\t%s\t\n", loc.Path)
 	fmt.Fprintf(out, "pre-cmd:\t%s\t\n", ReplaceEmpty(loc.PreCommand))
 	fmt.Fprintf(out, "post-cmd:\t%s\t\n", ReplaceEmpty(loc.PostCommand))
 	fmt.Fprintf(out, "deps:\t%s\t\n", strings.Join(deps, ", "))
+	printStatus(out, st)
 	out.Flush()
 	return nil
 }
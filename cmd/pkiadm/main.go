@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"sort"
 	"text/tabwriter"
@@ -34,6 +35,22 @@ func main() {
 	switch cmd {
 	case `list`:
 		err = list(args, client)
+	case `audit`:
+		err = audit(args, client)
+	case `jobs`:
+		err = listJobs(args, client)
+	case `wait`:
+		err = waitJob(args, client)
+	case `watch`:
+		err = watch(args, client)
+	case `plan`:
+		err = plan(args, client)
+	case `status`:
+		err = status(args, client)
+	case `unlock`:
+		err = unlock(args, client)
+	case `rekey`:
+		err = rekey(args, client)
 	case `create-serial`:
 		err = createSerial(args, client)
 	case `delete-serial`:
@@ -48,6 +65,8 @@ func main() {
 		err = createCA(args, client)
 	case `delete-ca`:
 		err = deleteCA(args, client)
+	case `import-ca`:
+		err = importCA(args, client)
 	case `list-ca`:
 		err = listCA(args, client)
 	case `set-ca`:
@@ -68,6 +87,8 @@ func main() {
 		err = createPrivateKey(args, client)
 	case `delete-private`:
 		err = deletePrivateKey(args, client)
+	case `import-private`:
+		err = importPrivateKey(args, client)
 	case `list-private`:
 		err = listPrivateKey(args, client)
 	case `set-private`:
@@ -100,6 +121,8 @@ func main() {
 		err = deleteCSR(args, client)
 	case `list-csr`:
 		err = listCSR(args, client)
+	case `import-csr`:
+		err = importCSR(args, client)
 	case `set-csr`:
 		err = setCSR(args, client)
 	case `show-csr`:
@@ -108,12 +131,54 @@ func main() {
 		err = createCertificate(args, client)
 	case `delete-cert`:
 		err = deleteCertificate(args, client)
+	case `import-cert`:
+		err = importCertificate(args, client)
 	case `list-cert`:
 		err = listCertificate(args, client)
 	case `set-cert`:
 		err = setCertificate(args, client)
 	case `show-cert`:
 		err = showCertificate(args, client)
+	case `revoke-cert`:
+		err = revokeCertificate(args, client)
+	case `find-cert`:
+		err = findCertificate(args, client)
+	case `export-index`:
+		err = exportIndex(args, client)
+	case `history-cert`:
+		err = historyCertificate(args, client)
+	case `rollback-cert`:
+		err = rollbackCertificate(args, client)
+	case `create-crl`:
+		err = createCRL(args, client)
+	case `delete-crl`:
+		err = deleteCRL(args, client)
+	case `list-crl`:
+		err = listCRL(args, client)
+	case `set-crl`:
+		err = setCRL(args, client)
+	case `show-crl`:
+		err = showCRL(args, client)
+	case `create-ocsp`:
+		err = createOCSP(args, client)
+	case `delete-ocsp`:
+		err = deleteOCSP(args, client)
+	case `list-ocsp`:
+		err = listOCSP(args, client)
+	case `set-ocsp`:
+		err = setOCSP(args, client)
+	case `show-ocsp`:
+		err = showOCSP(args, client)
+	case `create-profile`:
+		err = createProfile(args, client)
+	case `delete-profile`:
+		err = deleteProfile(args, client)
+	case `list-profile`:
+		err = listProfile(args, client)
+	case `set-profile`:
+		err = setProfile(args, client)
+	case `show-profile`:
+		err = showProfile(args, client)
 	default:
 		fmt.Printf("unknown subcommand '%s'\n", cmd)
 		printCommands()
@@ -129,51 +194,92 @@ func printCommands() {
 	fmt.Println(`Usage: pkiadm <subcommand> [options]
 where subcommand is one of:`)
 	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(out, "  %s\t%s\n", "audit", "show and verify the log of all changes")
+
 	fmt.Fprintf(out, "  %s\t%s\n", "create-ca", "create a new CA")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-cert", "create a new certificate")
+	fmt.Fprintf(out, "  %s\t%s\n", "create-crl", "create a new certificate revocation list")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-csr", "create a new certificate sign request")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-location", "create a new file export")
+	fmt.Fprintf(out, "  %s\t%s\n", "create-ocsp", "create a new OCSP responder")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-private", "create a new private key")
+	fmt.Fprintf(out, "  %s\t%s\n", "create-profile", "create a new certificate profile")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-public", "create a new public key")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-serial", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "create-subj", "")
 
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-ca", "delete a CA")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-cert", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "delete-crl", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-csr", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-location", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "delete-ocsp", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-private", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "delete-profile", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-public", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-serial", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "delete-subj", "")
 
+	fmt.Fprintf(out, "  %s\t%s\n", "export-index", "export the certificates issued by a CA as OpenSSL index.txt")
+	fmt.Fprintf(out, "  %s\t%s\n", "find-cert", "search the certificates issued by the CAs")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "history-cert", "list the issued versions of a certificate")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "import-ca", "import an existing CA with its private key")
+	fmt.Fprintf(out, "  %s\t%s\n", "import-cert", "import an externally issued certificate")
+	fmt.Fprintf(out, "  %s\t%s\n", "import-csr", "import an externally generated certificate sign request")
+	fmt.Fprintf(out, "  %s\t%s\n", "import-private", "import an externally generated private key")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "jobs", "list the jobs running in the background")
+
 	fmt.Fprintf(out, "  %s\t%s\n", "list", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-ca", "list all available CAs")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-cert", "list all available certificates")
+	fmt.Fprintf(out, "  %s\t%s\n", "list-crl", "list all certificate revocation lists")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-csr", "list all available certificate sign requests")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-location", "list all file exports")
+	fmt.Fprintf(out, "  %s\t%s\n", "list-ocsp", "list all OCSP responders")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-private", "list all private keys")
+	fmt.Fprintf(out, "  %s\t%s\n", "list-profile", "list all certificate profiles")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-public", "list all public keys")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-serial", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "list-subj", "")
 
+	fmt.Fprintf(out, "  %s\t%s\n", "plan", "show the order in which resources are refreshed on a change")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "rekey", "replace the master key encrypting the private keys")
+	fmt.Fprintf(out, "  %s\t%s\n", "revoke-cert", "revoke a certificate")
+	fmt.Fprintf(out, "  %s\t%s\n", "rollback-cert", "make an earlier version of a certificate current again")
+
 	fmt.Fprintf(out, "  %s\t%s\n", "set-ca", "change attributes of a CA")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-cert", "change attributes of a certificate")
+	fmt.Fprintf(out, "  %s\t%s\n", "set-crl", "change attributes of a certificate revocation list")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-csr", "change attributes of a certificate sign request")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-location", "change attributes of a location")
+	fmt.Fprintf(out, "  %s\t%s\n", "set-ocsp", "change attributes of an OCSP responder")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-private", "change attributes of a private key")
+	fmt.Fprintf(out, "  %s\t%s\n", "set-profile", "change attributes of a certificate profile")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-public", "change attributes of a public key")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-serial", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "set-subj", "")
 
 	fmt.Fprintf(out, "  %s\t%s\n", "show-ca", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-cert", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "show-crl", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-csr", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-location", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "show-ocsp", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-private", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "show-profile", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-public", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-serial", "")
 	fmt.Fprintf(out, "  %s\t%s\n", "show-subj", "")
+	fmt.Fprintf(out, "  %s\t%s\n", "status", "show the outcome of the last refresh of all resources")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "unlock", "unlock the encrypted private keys")
+
+	fmt.Fprintf(out, "  %s\t%s\n", "wait", "wait for a job to finish")
+	fmt.Fprintf(out, "  %s\t%s\n", "watch", "show the changes of resources as they happen")
 
 	out.Flush()
 }
@@ -186,12 +292,29 @@ func list(args []string, c *pkiadm.Client) error {
 	if err != nil {
 		return err
 	}
+	statuses, err := c.Status()
+	if err != nil {
+		return err
+	}
+	byName := map[string]pkiadm.RefreshStatus{}
+	for _, st := range statuses {
+		byName[st.Resource.String()] = st
+	}
 	sort.Sort(resources)
 	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
-	fmt.Fprintf(out, "%s\t%s\t\n", "type", "id")
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t\n", "type", "id", "status", "next refresh")
 	for _, res := range resources {
-		fmt.Fprintf(out, "%s\t%s\t\n", res.Type, res.ID)
+		st := byName[res.String()]
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t\n", res.Type, res.ID, statusLabel(st), formatTime(st.NextRefresh))
 	}
 	out.Flush()
 	return nil
 }
+
+// readInput returns the content of the file or stdin, when the path is '-'.
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stdin is shared, so that multiple passphrases can be read from a pipe.
+var stdin = bufio.NewReader(os.Stdin)
+
+func unlock(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm unlock")
+		fmt.Print(`
+Unlock the encrypted private keys of the server. Until the server is unlocked, no keys can be generated and no certificates signed. When no file is given, the passphrase is asked for.
+`)
+		fs.PrintDefaults()
+	}
+	file := fs.String("file", "", "the file containing the passphrase")
+	fs.Parse(args)
+
+	passphrase, err := readPassphrase("passphrase: ", *file)
+	if err != nil {
+		return err
+	}
+	if err := client.Unlock(passphrase); err != nil {
+		return errors.Wrap(err, "could not unlock")
+	}
+	return nil
+}
+
+func rekey(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm rekey")
+		fmt.Print(`
+Replace the master key encrypting the private keys with a new one protected by the new passphrase. When the private keys are not encrypted yet, this enables the encryption. When no files are given, the passphrases are asked for.
+`)
+		fs.PrintDefaults()
+	}
+	file := fs.String("file", "", "the file containing the current passphrase")
+	newFile := fs.String("new-file", "", "the file containing the new passphrase")
+	initial := fs.Bool("init", false, "enable the encryption, no current passphrase is asked for")
+	fs.Parse(args)
+
+	passphrase := []byte{}
+	if !*initial {
+		var err error
+		passphrase, err = readPassphrase("current passphrase: ", *file)
+		if err != nil {
+			return err
+		}
+	}
+	newPassphrase, err := readPassphrase("new passphrase: ", *newFile)
+	if err != nil {
+		return err
+	}
+	if *newFile == "" {
+		repeated, err := readPassphrase("repeat new passphrase: ", "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(newPassphrase, repeated) {
+			return fmt.Errorf("passphrases do not match")
+		}
+	}
+	if err := client.Rekey(passphrase, newPassphrase); err != nil {
+		return errors.Wrap(err, "could not change master key")
+	}
+	return nil
+}
+
+// readPassphrase reads the passphrase from the file. When no file is given,
+// it is asked for on the terminal or read as a line from stdin.
+func readPassphrase(prompt, path string) ([]byte, error) {
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(raw), "\r\n")), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return terminal.ReadPassword(fd)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
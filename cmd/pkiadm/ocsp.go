@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func createOCSP(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm create-ocsp", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm create-ocsp")
+		fmt.Print(`
+Create a new OCSP responder for the given CA. The responses are signed by a delegated certificate, which is created and renewed by the server. The delegated certificate can be exported using a location.
+`)
+		fs.PrintDefaults()
+	}
+	ocsp := pkiadm.OCSP{}
+	fs.StringVar(&ocsp.ID, "id", "", "set the unique id for the new OCSP responder")
+	parseOCSPArgs(fs, args, &ocsp)
+
+	if err := client.CreateOCSP(ocsp); err != nil {
+		return errors.Wrap(err, "could not create OCSP responder")
+	}
+	return nil
+}
+
+func setOCSP(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm set-ocsp", flag.ExitOnError)
+	ocsp := pkiadm.OCSP{}
+	fs.StringVar(&ocsp.ID, "id", "", "set the id of the OCSP responder to change")
+	parseOCSPArgs(fs, args, &ocsp)
+
+	fieldList := []string{}
+	for _, field := range []string{"ca", "duration"} {
+		flag := fs.Lookup(field)
+		if flag.Changed {
+			fieldList = append(fieldList, field)
+		}
+	}
+	if err := client.SetOCSP(ocsp, fieldList); err != nil {
+		return errors.Wrap(err, "could not change OCSP responder")
+	}
+	return nil
+}
+
+func parseOCSPArgs(fs *flag.FlagSet, args []string, ocsp *pkiadm.OCSP) {
+	ca := fs.String("ca", "", "the CA to answer status requests for")
+	fs.DurationVar(&ocsp.Duration, "duration", 24*time.Hour, "the time the responses are valid (in h, m, s)")
+	fs.Parse(args)
+
+	ocsp.CA = pkiadm.ResourceName{*ca, pkiadm.RTCA}
+}
+
+func deleteOCSP(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm delete-ocsp", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the OCSP responder to delete")
+	fs.Parse(args)
+
+	if err := client.DeleteOCSP(*id); err != nil {
+		return errors.Wrap(err, "could not delete OCSP responder")
+	}
+	return nil
+}
+
+func listOCSP(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm list-ocsp", flag.ExitOnError)
+	fs.Parse(args)
+
+	ocsps, err := client.ListOCSP()
+	if err != nil {
+		return err
+	}
+	if len(ocsps) == 0 {
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t\n", "id", "ca", "duration", "responses", "cert valid until")
+	for _, ocsp := range ocsps {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%d\t%s\t\n", ocsp.ID, ocsp.CA.ID, ocsp.Duration, ocsp.Responses, ocsp.CertificateNotAfter)
+	}
+	out.Flush()
+	return nil
+}
+
+func showOCSP(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm show-ocsp", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the OCSP responder to show")
+	fs.Parse(args)
+
+	ocsp, err := client.ShowOCSP(*id)
+	if err != nil {
+		return err
+	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: ocsp.ID, Type: pkiadm.RTOCSP})
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "id:\t%s\n", ocsp.ID)
+	fmt.Fprintf(out, "ca:\t%s\n", ocsp.CA.ID)
+	fmt.Fprintf(out, "duration:\t%s\n", ocsp.Duration)
+	fmt.Fprintf(out, "responses:\t%d\n", ocsp.Responses)
+	fmt.Fprintf(out, "cert valid until:\t%s\n", ocsp.CertificateNotAfter)
+	printStatus(out, st)
+	fmt.Fprintf(out, "checksum:\t%s\n", base64.StdEncoding.EncodeToString(ocsp.Checksum))
+	out.Flush()
+	return nil
+}
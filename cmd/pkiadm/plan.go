@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func plan(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm plan", flag.ExitOnError)
+	resource := fs.String("resource", "", "the resource to plan the refresh for, e.g. cert/www")
+	fs.Parse(args)
+
+	rn, err := parseResourceName(*resource)
+	if err != nil {
+		return err
+	}
+	steps, err := client.PlanRefresh(rn)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(out, "%s\t%s\t%s\t\n", "step", "resource", "after")
+	for i, step := range steps {
+		causes := []string{}
+		for _, cause := range step.Causes {
+			causes = append(causes, cause.String())
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t\n", i+1, step.Resource, ReplaceEmpty(strings.Join(causes, ", ")))
+	}
+	out.Flush()
+	return nil
+}
+
+// parseResourceName parses a resource name in the form type/id.
+func parseResourceName(in string) (pkiadm.ResourceName, error) {
+	parts := strings.SplitN(in, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return pkiadm.ResourceName{}, errors.Errorf("could not parse resource: '%s'", in)
+	}
+	resType, err := pkiadm.StringToResourceType(parts[0])
+	if err != nil {
+		return pkiadm.ResourceName{}, errors.Errorf("invalid resource type '%s'", parts[0])
+	}
+	return pkiadm.ResourceName{ID: parts[1], Type: resType}, nil
+}
@@ -26,6 +26,8 @@ for certificate generation.
 	fs.StringVar(&pk.ID, "id", "", "set the unique id for the new private key")
 	var pkType = fs.String("type", "rsa", "set the type of the private key (rsa, ecdsa, ed25519)")
 	fs.UintVar(&pk.Bits, "bits", 2048, "set the number of bits to use. For rsa it can be 1024 up to 32768, for ecdsa 224, 256, 384, 521. Ed25519 is set to 256 by default.")
+	addRenewalFlags(fs, &pk.Renewal, true)
+	wait := fs.Bool("wait", true, "wait until the key is generated (--wait=false continues in the background)")
 	fs.Parse(args)
 
 	pkT, err := pkiadm.StringToPrivateKeyType(*pkType)
@@ -33,10 +35,32 @@ for certificate generation.
 		return err
 	}
 	pk.Type = pkT
-	if err := client.CreatePrivateKey(pk); err != nil {
+	job, err := client.CreatePrivateKey(pk)
+	if err != nil {
 		return errors.Wrap(err, "could not create private key")
 	}
+	return followJob(client, job, *wait)
+}
+func importPrivateKey(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("import-private", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm import-private")
+		fmt.Print(`
+Import a private key generated outside of pkiadm. The key can be in PKCS#1, PKCS#8 or SEC1 format. Imported keys are not regenerated, until the type or bits are changed with set-private. Importing a key with the id of an already imported one replaces it.
+`)
+		fs.PrintDefaults()
+	}
+	id := fs.String("id", "", "set the unique id for the imported private key")
+	file := fs.String("file", "-", "the PEM file containing the private key (- for stdin)")
+	fs.Parse(args)
 
+	raw, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	if err := client.ImportPrivateKey(*id, raw); err != nil {
+		return errors.Wrap(err, "could not import private key")
+	}
 	return nil
 }
 func setPrivateKey(args []string, client *pkiadm.Client) error {
@@ -45,6 +69,8 @@ func setPrivateKey(args []string, client *pkiadm.Client) error {
 	fs.StringVar(&pk.ID, "id", "", "set the id of the private key to change")
 	var pkType = fs.String("type", "rsa", "set the type of the private key (rsa, ecdsa, ed25519)")
 	fs.UintVar(&pk.Bits, "bits", 2048, "set the number of bits to use. For rsa it can be 1024 up to 32768, for ecdsa 224, 256, 384, 521. Ed25519 is set to 256 by default.")
+	addRenewalFlags(fs, &pk.Renewal, true)
+	wait := fs.Bool("wait", true, "wait until a new key is generated (--wait=false continues in the background)")
 	fs.Parse(args)
 
 	pkT, err := pkiadm.StringToPrivateKeyType(*pkType)
@@ -53,7 +79,7 @@ func setPrivateKey(args []string, client *pkiadm.Client) error {
 	}
 	pk.Type = pkT
 
-	fieldList := []string{}
+	fieldList := changedRenewalFields(fs)
 	for _, field := range []string{"type", "bits"} {
 		flag := fs.Lookup(field)
 		if flag.Changed {
@@ -61,10 +87,11 @@ func setPrivateKey(args []string, client *pkiadm.Client) error {
 		}
 	}
 
-	if err := client.SetPrivateKey(pk, fieldList); err != nil {
+	job, err := client.SetPrivateKey(pk, fieldList)
+	if err != nil {
 		return err
 	}
-	return nil
+	return followJob(client, job, *wait)
 }
 func deletePrivateKey(args []string, client *pkiadm.Client) error {
 	fs := flag.NewFlagSet("delete-private", flag.ExitOnError)
@@ -89,9 +116,9 @@ func listPrivateKey(args []string, client *pkiadm.Client) error {
 		return nil
 	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
-	fmt.Fprintf(out, "%s\t%s\t%s\t\n", "id", "type", "bits")
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t\n", "id", "type", "bits", "imported")
 	for _, pk := range pks {
-		fmt.Fprintf(out, "%s\t%s\t%d\t\n", pk.ID, pk.Type.String(), pk.Bits)
+		fmt.Fprintf(out, "%s\t%s\t%d\t%t\t\n", pk.ID, pk.Type.String(), pk.Bits, pk.Imported)
 	}
 	out.Flush()
 
@@ -106,10 +133,17 @@ func showPrivateKey(args []string, client *pkiadm.Client) error {
 	if err != nil {
 		return err
 	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: pk.ID, Type: pkiadm.RTPrivateKey})
+	if err != nil {
+		return err
+	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", pk.ID)
 	fmt.Fprintf(out, "type:\t%s\t\n", pk.Type.String())
 	fmt.Fprintf(out, "bits:\t%d\t\n", pk.Bits)
+	fmt.Fprintf(out, "imported:\t%t\t\n", pk.Imported)
+	printRenewal(out, pk.Renewal, true)
+	printStatus(out, st)
 	fmt.Fprintf(out, "checksum:\t%s\t\n", base64.StdEncoding.EncodeToString(pk.Checksum))
 	out.Flush()
 	return nil
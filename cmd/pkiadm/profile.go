@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func createProfile(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm create-profile", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadm create-profile")
+		fmt.Print(`
+Create a new profile with the settings to issue certificates. Certificates referencing the profile are reissued, when the profile changes.
+`)
+		fs.PrintDefaults()
+	}
+	profile := pkiadm.Profile{}
+	fs.StringVar(&profile.ID, "id", "", "set the unique id for the new profile")
+	if err := parseProfileArgs(fs, args, &profile); err != nil {
+		return err
+	}
+
+	if err := client.CreateProfile(profile); err != nil {
+		return errors.Wrap(err, "could not create profile")
+	}
+	return nil
+}
+
+func setProfile(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm set-profile", flag.ExitOnError)
+	profile := pkiadm.Profile{}
+	fs.StringVar(&profile.ID, "id", "", "set the id of the profile to change")
+	if err := parseProfileArgs(fs, args, &profile); err != nil {
+		return err
+	}
+
+	fieldList := []string{}
+	for _, field := range []string{"duration", "key-usage", "ext-key-usage", "max-path-len", "path-len-critical", "policies", "crl-urls", "ocsp-urls", "issuer-urls", "allowed-names"} {
+		flag := fs.Lookup(field)
+		if flag.Changed {
+			fieldList = append(fieldList, field)
+		}
+	}
+	if err := client.SetProfile(profile, fieldList); err != nil {
+		return errors.Wrap(err, "could not change profile")
+	}
+	return nil
+}
+
+func parseProfileArgs(fs *flag.FlagSet, args []string, profile *pkiadm.Profile) error {
+	fs.DurationVar(&profile.Duration, "duration", 360*24*time.Hour, "the time the certificates are valid (in h, m, s)")
+	keyUsage := fs.StringSlice("key-usage", []string{}, "the key usages (digital-signature, content-commitment, key-encipherment, data-encipherment, key-agreement, cert-sign, crl-sign, encipher-only, decipher-only); cert-sign creates CA certificates")
+	extKeyUsage := fs.StringSlice("ext-key-usage", []string{}, "the extended key usages (server-auth, client-auth, code-signing, email-protection, ocsp-signing)")
+	fs.IntVar(&profile.MaxPathLen, "max-path-len", -1, "the maximum number of intermediate CAs below a CA certificate (-1 for no limit)")
+	fs.BoolVar(&profile.PathLenCritical, "path-len-critical", true, "mark the basic constraints of CA certificates as critical")
+	fs.StringSliceVar(&profile.Policies, "policies", []string{}, "the certificate policy OIDs")
+	fs.StringSliceVar(&profile.CRLURLs, "crl-urls", []string{}, "the URLs of the CRL distribution points")
+	fs.StringSliceVar(&profile.OCSPURLs, "ocsp-urls", []string{}, "the URLs of the OCSP responders")
+	fs.StringSliceVar(&profile.IssuerURLs, "issuer-urls", []string{}, "the URLs to fetch the issuing certificate from")
+	fs.StringSliceVar(&profile.AllowedNames, "allowed-names", []string{}, "the names (host.example.com, *.example.com, @example.com) or networks (10.0.0.0/8) allowed as subject alternative names")
+	fs.Parse(args)
+
+	// the default of -1 is only replaced by an explicit limit
+	profile.MaxPathLenZero = profile.MaxPathLen == 0
+
+	var err error
+	if profile.KeyUsage, err = pkiadm.StringsToKeyUsage(*keyUsage); err != nil {
+		return err
+	}
+	for _, name := range *extKeyUsage {
+		eku, err := pkiadm.StringToExtKeyUsage(name)
+		if err != nil {
+			return err
+		}
+		profile.ExtKeyUsage = append(profile.ExtKeyUsage, eku)
+	}
+	return nil
+}
+
+func deleteProfile(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm delete-profile", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the profile to delete")
+	fs.Parse(args)
+
+	if err := client.DeleteProfile(*id); err != nil {
+		return errors.Wrap(err, "could not delete profile")
+	}
+	return nil
+}
+
+func listProfile(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm list-profile", flag.ExitOnError)
+	fs.Parse(args)
+
+	profiles, err := client.ListProfile()
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t\n", "id", "duration", "key usage", "ext key usage")
+	for _, profile := range profiles {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t\n", profile.ID, profile.Duration, profile.KeyUsage, profile.ExtKeyUsage)
+	}
+	out.Flush()
+	return nil
+}
+
+func showProfile(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm show-profile", flag.ExitOnError)
+	id := fs.String("id", "", "set the id of the profile to show")
+	fs.Parse(args)
+
+	profile, err := client.ShowProfile(*id)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "id:\t%s\n", profile.ID)
+	fmt.Fprintf(out, "duration:\t%s\n", profile.Duration)
+	fmt.Fprintf(out, "key usage:\t%s\n", profile.KeyUsage)
+	fmt.Fprintf(out, "ext key usage:\t%s\n", profile.ExtKeyUsage)
+	fmt.Fprintf(out, "max path len:\t%d\n", profile.MaxPathLen)
+	fmt.Fprintf(out, "path len critical:\t%t\n", profile.PathLenCritical)
+	fmt.Fprintf(out, "policies:\t%s\n", strings.Join(profile.Policies, ", "))
+	fmt.Fprintf(out, "crl urls:\t%s\n", strings.Join(profile.CRLURLs, ", "))
+	fmt.Fprintf(out, "ocsp urls:\t%s\n", strings.Join(profile.OCSPURLs, ", "))
+	fmt.Fprintf(out, "issuer urls:\t%s\n", strings.Join(profile.IssuerURLs, ", "))
+	fmt.Fprintf(out, "allowed names:\t%s\n", strings.Join(profile.AllowedNames, ", "))
+	out.Flush()
+	return nil
+}
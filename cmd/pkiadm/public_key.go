@@ -83,10 +83,15 @@ func showPublicKey(args []string, client *pkiadm.Client) error {
 	if err != nil {
 		return err
 	}
+	st, err := client.ShowStatus(pkiadm.ResourceName{ID: pub.ID, Type: pkiadm.RTPublicKey})
+	if err != nil {
+		return err
+	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", pub.ID)
 	fmt.Fprintf(out, "type:\t%s\t\n", pub.Type.String())
 	fmt.Fprintf(out, "private:\t%s\t\n", pub.PrivateKey)
+	printStatus(out, st)
 	fmt.Fprintf(out, "checksum:\t%s\t\n", base64.StdEncoding.EncodeToString(pub.Checksum))
 	out.Flush()
 	return nil
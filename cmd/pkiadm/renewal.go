@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gibheer/pkiadm"
+	flag "github.com/spf13/pflag"
+)
+
+// renewalFields are the fields of the renewal settings in change sets.
+var renewalFields = []string{"lifetime", "renew-before", "renew-at", "jitter"}
+
+// addRenewalFlags registers the options for the renewal settings. The lifetime
+// is only offered for resources without an end of validity of their own.
+func addRenewalFlags(fs *flag.FlagSet, r *pkiadm.Renewal, lifetime bool) {
+	if lifetime {
+		fs.DurationVar(&r.Lifetime, "lifetime", 0, "the time after which a new one is generated (in h, m, s; 0 to keep it)")
+	}
+	fs.DurationVar(&r.Before, "renew-before", 0, "renew the given time before the end of the validity (in h, m, s)")
+	fs.Float64Var(&r.At, "renew-at", 0, "renew after the share of the lifetime, e.g. 0.5 (default 2/3)")
+	fs.DurationVar(&r.Jitter, "jitter", 0, "the maximum random time the renewal is moved forward (in h, m, s)")
+}
+
+// changedRenewalFields returns the renewal fields set on the command line.
+func changedRenewalFields(fs *flag.FlagSet) []string {
+	fieldList := []string{}
+	for _, field := range renewalFields {
+		if flag := fs.Lookup(field); flag != nil && flag.Changed {
+			fieldList = append(fieldList, field)
+		}
+	}
+	return fieldList
+}
+
+// printRenewal writes the renewal settings in the format of the show commands.
+func printRenewal(out io.Writer, r pkiadm.Renewal, lifetime bool) {
+	if lifetime {
+		fmt.Fprintf(out, "lifetime:\t%s\t\n", r.Lifetime)
+	}
+	fmt.Fprintf(out, "renew before:\t%s\t\n", r.Before)
+	fmt.Fprintf(out, "renew at:\t%g\t\n", r.At)
+	fmt.Fprintf(out, "jitter:\t%s\t\n", r.Jitter)
+	if r.NextRefresh.IsZero() {
+		fmt.Fprintf(out, "next refresh:\t%s\t\n", "never")
+	} else {
+		fmt.Fprintf(out, "next refresh:\t%s\t\n", r.NextRefresh)
+	}
+}
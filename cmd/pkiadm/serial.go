@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"math"
+	"math/big"
 	"os"
 	"text/tabwriter"
 
@@ -12,17 +12,17 @@ import (
 )
 
 func createSerial(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("create-private", flag.ExitOnError)
+	fs := flag.NewFlagSet("create-serial", flag.ExitOnError)
 	fs.Usage = func() {
-		fmt.Printf("Usage of %s:\n", "pkiadm create-private")
-		fmt.Println(`Create a new serial producer for certificate generation. New IDs will be generated by random in the defined limits.`)
+		fmt.Printf("Usage of %s:\n", "pkiadm create-serial")
+		fmt.Println(`Create a new serial producer for certificate generation. In the range mode, new IDs are picked by random in the defined limits. The random mode generates random IDs with the given number of bytes, the sequential mode counts up from the minimum.`)
 		fs.PrintDefaults()
 	}
 	ser := pkiadm.Serial{}
 	fs.StringVar(&ser.ID, "id", "", "set the unique id for the new serial")
-	fs.Int64Var(&ser.Min, "min", 0, "set the minimum id")
-	fs.Int64Var(&ser.Max, "max", math.MaxInt64, "set the maximum id")
-	fs.Parse(args)
+	if err := parseSerialArgs(fs, args, &ser); err != nil {
+		return err
+	}
 
 	if err := client.CreateSerial(ser); err != nil {
 		return errors.Wrap(err, "could not create serial")
@@ -31,15 +31,15 @@ func createSerial(args []string, client *pkiadm.Client) error {
 	return nil
 }
 func setSerial(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("set-private", flag.ExitOnError)
+	fs := flag.NewFlagSet("set-serial", flag.ExitOnError)
 	ser := pkiadm.Serial{}
 	fs.StringVar(&ser.ID, "id", "", "set the unique id for the serial to change")
-	fs.Int64Var(&ser.Min, "min", 0, "set the minimum id")
-	fs.Int64Var(&ser.Max, "max", math.MaxInt64, "set the maximum id")
-	fs.Parse(args)
+	if err := parseSerialArgs(fs, args, &ser); err != nil {
+		return err
+	}
 
 	fieldList := []string{}
-	for _, field := range []string{"type", "bits"} {
+	for _, field := range []string{"mode", "min", "max", "length"} {
 		flag := fs.Lookup(field)
 		if flag.Changed {
 			fieldList = append(fieldList, field)
@@ -51,8 +51,40 @@ func setSerial(args []string, client *pkiadm.Client) error {
 	}
 	return nil
 }
+func parseSerialArgs(fs *flag.FlagSet, args []string, ser *pkiadm.Serial) error {
+	mode := fs.String("mode", "range", "the way serials are generated (range, random, sequential)")
+	min := fs.String("min", "", "set the minimum id of the range and sequential mode (0x for hex)")
+	max := fs.String("max", "", "set the maximum id of the range and sequential mode, which is not used itself (0x for hex)")
+	fs.IntVar(&ser.Length, "length", 16, "the number of bytes of random serials (8 up to 20)")
+	fs.Parse(args)
+
+	if ser.Mode = pkiadm.StringToSerialMode(*mode); ser.Mode == pkiadm.SMUnknown {
+		return fmt.Errorf("unknown serial mode '%s'", *mode)
+	}
+	var err error
+	if ser.Min, err = parseBigInt(*min); err != nil {
+		return errors.Wrap(err, "invalid minimum")
+	}
+	if ser.Max, err = parseBigInt(*max); err != nil {
+		return errors.Wrap(err, "invalid maximum")
+	}
+	return nil
+}
+
+// parseBigInt parses the number in decimal or with the prefix 0x in hex. An
+// empty string results in nil.
+func parseBigInt(in string) (*big.Int, error) {
+	if in == "" {
+		return nil, nil
+	}
+	val, ok := new(big.Int).SetString(in, 0)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a number", in)
+	}
+	return val, nil
+}
 func deleteSerial(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("delete-private", flag.ExitOnError)
+	fs := flag.NewFlagSet("delete-serial", flag.ExitOnError)
 	var id = fs.String("id", "", "set the id of the serial to delete")
 	fs.Parse(args)
 
@@ -62,7 +94,7 @@ func deleteSerial(args []string, client *pkiadm.Client) error {
 	return nil
 }
 func listSerial(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("list-private", flag.ExitOnError)
+	fs := flag.NewFlagSet("list-serial", flag.ExitOnError)
 	fs.Parse(args)
 
 	sers, err := client.ListSerial()
@@ -74,16 +106,16 @@ func listSerial(args []string, client *pkiadm.Client) error {
 		return nil
 	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
-	fmt.Fprintf(out, "%s\t%s\t%s\t\n", "id", "min", "max")
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t\n", "id", "mode", "min", "max", "used")
 	for _, ser := range sers {
-		fmt.Fprintf(out, "%s\t%d\t%d\t\n", ser.ID, ser.Min, ser.Max)
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t\n", ser.ID, ser.Mode, ser.Min, ser.Max, utilisation(ser))
 	}
 	out.Flush()
 
 	return nil
 }
 func showSerial(args []string, client *pkiadm.Client) error {
-	fs := flag.NewFlagSet("show-private", flag.ExitOnError)
+	fs := flag.NewFlagSet("show-serial", flag.ExitOnError)
 	var id = fs.String("id", "", "set the id of the serial to show")
 	fs.Parse(args)
 
@@ -93,8 +125,26 @@ func showSerial(args []string, client *pkiadm.Client) error {
 	}
 	out := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', tabwriter.AlignRight)
 	fmt.Fprintf(out, "ID:\t%s\t\n", ser.ID)
-	fmt.Fprintf(out, "min:\t%d\t\n", ser.Min)
-	fmt.Fprintf(out, "max:\t%d\t\n", ser.Max)
+	fmt.Fprintf(out, "mode:\t%s\t\n", ser.Mode)
+	if ser.Mode == pkiadm.SMRandom {
+		fmt.Fprintf(out, "length:\t%d\t\n", ser.Length)
+	} else {
+		fmt.Fprintf(out, "min:\t%s\t\n", ser.Min)
+		fmt.Fprintf(out, "max:\t%s\t\n", ser.Max)
+	}
+	fmt.Fprintf(out, "used:\t%s\t\n", ser.Used)
+	fmt.Fprintf(out, "capacity:\t%s\t\n", ser.Capacity)
+	fmt.Fprintf(out, "utilisation:\t%s\t\n", utilisation(ser))
 	out.Flush()
 	return nil
 }
+
+// utilisation returns the share of the used serials in percent.
+func utilisation(ser pkiadm.Serial) string {
+	if ser.Used == nil || ser.Capacity == nil || ser.Capacity.Sign() <= 0 {
+		return "-"
+	}
+	share := new(big.Float).Quo(new(big.Float).SetInt(ser.Used), new(big.Float).SetInt(ser.Capacity))
+	share.Mul(share, big.NewFloat(100))
+	return share.Text('g', 4) + "%"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	flag "github.com/spf13/pflag"
+)
+
+func status(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm status", flag.ExitOnError)
+	failing := fs.Bool("failing", false, "only show resources whose last refresh failed")
+	fs.Parse(args)
+
+	statuses, err := client.Status()
+	if err != nil {
+		return err
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Resource.Type != statuses[j].Resource.Type {
+			return statuses[i].Resource.Type < statuses[j].Resource.Type
+		}
+		return statuses[i].Resource.ID < statuses[j].Resource.ID
+	})
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t\n", "type", "id", "status", "failures", "last success", "next refresh")
+	for _, st := range statuses {
+		if *failing && !st.Failed() {
+			continue
+		}
+		fmt.Fprintf(
+			out,
+			"%s\t%s\t%s\t%d\t%s\t%s\t\n",
+			st.Resource.Type,
+			st.Resource.ID,
+			statusLabel(st),
+			st.Failures,
+			formatTime(st.LastSuccess),
+			formatTime(st.NextRefresh),
+		)
+	}
+	out.Flush()
+	for _, st := range statuses {
+		if st.Failed() {
+			fmt.Printf("%s: %s\n", st.Resource, st.Error)
+		}
+	}
+	return nil
+}
+
+// statusLabel returns a short description of the outcome of the last
+// refresh.
+func statusLabel(st pkiadm.RefreshStatus) string {
+	switch {
+	case st.Failed():
+		return "failed"
+	case st.LastAttempt.IsZero():
+		return "-"
+	default:
+		return "ok"
+	}
+}
+
+// formatTime returns the time in the format of the list commands or '-' when
+// it is not set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// printStatus writes the refresh status in the format of the show commands.
+func printStatus(out io.Writer, st pkiadm.RefreshStatus) {
+	fmt.Fprintf(out, "status:\t%s\t\n", statusLabel(st))
+	fmt.Fprintf(out, "last attempt:\t%s\t\n", formatTime(st.LastAttempt))
+	fmt.Fprintf(out, "last success:\t%s\t\n", formatTime(st.LastSuccess))
+	if st.Failed() {
+		fmt.Fprintf(out, "failures:\t%d\t\n", st.Failures)
+		fmt.Fprintf(out, "error:\t%s\t\n", st.Error)
+		fmt.Fprintf(out, "next attempt:\t%s\t\n", formatTime(st.NextRefresh))
+	}
+}
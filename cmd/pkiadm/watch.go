@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+// errWatchDone ends the watch after the requested number of events.
+var errWatchDone = errors.New("all events seen")
+
+func watch(args []string, client *pkiadm.Client) error {
+	fs := flag.NewFlagSet("pkiadm watch", flag.ExitOnError)
+	req := pkiadm.WatchRequest{}
+	fs.StringSliceVar(&req.Resources, "resource", []string{}, "only show events of the resource, e.g. cert/www, or of all resources of a type, e.g. cert/ (can be repeated)")
+	fs.Uint64Var(&req.After, "after", 0, "show the events after the revision instead of only new ones, 0 shows all")
+	count := fs.Int("count", 0, "stop after the number of events (0 watches until interrupted)")
+	fs.Parse(args)
+	req.Current = !fs.Changed("after")
+
+	seen := 0
+	err := client.Watch(req, func(e pkiadm.Event) error {
+		fmt.Printf(
+			"%d %s %s %s %s %s\n",
+			e.Revision,
+			e.Time.Local().Format(time.RFC3339),
+			e.Kind,
+			e.Resource,
+			shortChecksum(e.Checksum),
+			e.Caller,
+		)
+		if e.Kind == pkiadm.EKFailed {
+			fmt.Printf("%d: %s\n", e.Revision, e.Error)
+		}
+		seen++
+		if *count > 0 && seen >= *count {
+			return errWatchDone
+		}
+		return nil
+	})
+	if err == errWatchDone {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ENoAccountKey      = Error("no account key given for the ACME account")
+	ENoChallengeAddr   = Error("no challenge address given to answer http-01 challenges")
+	ENoUsableChallenge = Error("no supported challenge offered by the ACME directory")
+	EUnsupportedKey    = Error("private key type is not supported for ACME accounts")
+	EOrderInvalid      = Error("ACME order became invalid")
+)
+
+// acmeTimeout is the maximum time an order may take from creation to the
+// download of the certificate.
+const acmeTimeout = 5 * time.Minute
+
+type (
+	// ACMESettings contains the information needed to order certificates from
+	// an ACME (RFC 8555) directory.
+	ACMESettings struct {
+		// DirectoryURL is the URL of the ACME directory. When empty the Let's
+		// Encrypt production directory is used.
+		DirectoryURL string
+		// DirectoryCA is the path to a PEM file with certificates to trust for
+		// the connection to the directory. When empty, the system roots are used.
+		DirectoryCA string
+		// AccountKey references the private key used for the ACME account.
+		AccountKey pkiadm.ResourceName
+		// AccountURL is filled in after the account was registered.
+		AccountURL string
+		// Email is used as the contact address of the account.
+		Email string
+		// ChallengeAddr is the listen address for answering http-01 challenges.
+		ChallengeAddr string
+	}
+
+	// acmeOrder contains everything needed to order a certificate, so that
+	// the order can run without holding the storage.
+	acmeOrder struct {
+		settings ACMESettings
+		client   *acme.Client
+		caID     string
+		csrID    string
+		ids      []acme.AuthzID
+		// csr is the DER encoded request.
+		csr []byte
+	}
+
+	// challengeResponder answers http-01 challenges while an order is
+	// authorized.
+	challengeResponder struct {
+		mu        sync.Mutex
+		responses map[string]string
+	}
+)
+
+// client builds a new ACME client using the account key from the storage.
+func (a *ACMESettings) client(lookup *Storage) (*acme.Client, error) {
+	if a.AccountKey.ID == "" {
+		return nil, ENoAccountKey
+	}
+	pkDef, err := lookup.GetPrivateKey(a.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	if pkDef.PKType == pkiadm.PKTED25519 {
+		return nil, EUnsupportedKey
+	}
+	signer, err := pkDef.GetSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := http.DefaultClient
+	if a.DirectoryCA != "" {
+		raw, err := ioutil.ReadFile(a.DirectoryCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read directory CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates found in '%s'", a.DirectoryCA)
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	directory := a.DirectoryURL
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	return &acme.Client{
+		Key:          signer,
+		HTTPClient:   httpClient,
+		DirectoryURL: directory,
+		KID:          acme.KeyID(a.AccountURL),
+	}, nil
+}
+
+// registerAccount creates the ACME account of the CA in a job, if it does not
+// exist yet.
+func (ca *CA) registerAccount(lookup *Storage) error {
+	client, err := ca.ACME.client(lookup)
+	if err != nil {
+		return err
+	}
+	if ca.ACME.AccountURL != "" {
+		return nil
+	}
+	settings := ca.ACME
+	description := fmt.Sprintf("register ACME account of ca '%s'", ca.ID)
+	return lookup.refreshInJob(ca, description, func() (func() error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+		defer cancel()
+		if err := settings.register(ctx, client); err != nil {
+			return nil, err
+		}
+		return func() error {
+			ca.ACME.AccountURL = settings.AccountURL
+			return nil
+		}, nil
+	})
+}
+
+func (a *ACMESettings) register(ctx context.Context, client *acme.Client) error {
+	if a.AccountURL != "" {
+		return nil
+	}
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	account, err := client.Register(ctx, account, acme.AcceptTOS)
+	if err == acme.ErrAccountAlreadyExists {
+		account, err = client.GetReg(ctx, "")
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not register ACME account")
+	}
+	a.AccountURL = account.URI
+	return nil
+}
+
+// order orders the certificate from the ACME directory of the CA in a job.
+// The storage is only held to prepare the order and to store the issued
+// certificate.
+func (c *Certificate) order(lookup *Storage, ca *CA) error {
+	csr, err := lookup.GetCSR(c.CSR)
+	if err != nil {
+		return err
+	}
+	order, err := ca.ACME.prepareOrder(lookup, ca.ID, csr)
+	if err != nil {
+		return err
+	}
+	description := fmt.Sprintf("order certificate '%s' from ca '%s'", c.ID, ca.ID)
+	return lookup.refreshInJob(c, description, func() (func() error, error) {
+		data, err := order.run()
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			// keep the account, unless the CA was moved to another one
+			if ca.ACME.AccountURL == "" && ca.ACME.AccountKey == order.settings.AccountKey &&
+				ca.ACME.DirectoryURL == order.settings.DirectoryURL {
+				ca.ACME.AccountURL = order.settings.AccountURL
+			}
+			return c.issued(lookup, ca, data)
+		}, nil
+	})
+}
+
+// prepareOrder collects everything needed to order a certificate for the CSR,
+// so that the order can run without the storage.
+func (a *ACMESettings) prepareOrder(lookup *Storage, caID string, csr *CSR) (*acmeOrder, error) {
+	if a.ChallengeAddr == "" {
+		return nil, ENoChallengeAddr
+	}
+	client, err := a.client(lookup)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(csr.Data)
+	if block == nil {
+		return nil, fmt.Errorf("CSR '%s' contains no data", csr.ID)
+	}
+	ids := acme.DomainIDs(csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		ids = append(ids, acme.IPIDs(ip.String())...)
+	}
+	return &acmeOrder{
+		settings: *a,
+		client:   client,
+		caID:     caID,
+		csrID:    csr.ID,
+		ids:      ids,
+		csr:      block.Bytes,
+	}, nil
+}
+
+// run requests a new certificate from the ACME directory. All identifiers of
+// the CSR get authorized through http-01 challenges. The returned data
+// contains the certificate and the chain in PEM format.
+func (o *acmeOrder) run() ([]byte, error) {
+	client := o.client
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	if err := o.settings.register(ctx, client); err != nil {
+		return nil, err
+	}
+
+	responder := &challengeResponder{responses: map[string]string{}}
+	listener, err := net.Listen("tcp", o.settings.ChallengeAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open challenge listener")
+	}
+	server := &http.Server{Handler: responder}
+	go server.Serve(listener)
+	defer server.Close()
+
+	log.Printf("ca '%s' ordering certificate for csr '%s' from '%s'", o.caID, o.csrID, client.DirectoryURL)
+	order, err := client.AuthorizeOrder(ctx, o.ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create order")
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := o.settings.authorize(ctx, client, responder, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, errors.Wrap(err, "order was not ready")
+	}
+	if order.Status != acme.StatusReady && order.Status != acme.StatusValid {
+		return nil, EOrderInvalid
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, o.csr, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not finalize order")
+	}
+	raw := []byte{}
+	for _, der := range chain {
+		raw = append(raw, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return raw, nil
+}
+
+// Revoke asks the ACME directory to revoke the certificate.
+func (a *ACMESettings) Revoke(lookup *Storage, der []byte, reason pkiadm.RevocationReason) error {
+	client, err := a.client(lookup)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	if err := a.register(ctx, client); err != nil {
+		return err
+	}
+	return client.RevokeCert(ctx, nil, der, acme.CRLReasonCode(reason))
+}
+
+// authorize fulfills the http-01 challenge of the authorization and waits
+// until it got validated.
+func (a *ACMESettings) authorize(ctx context.Context, client *acme.Client, responder *challengeResponder, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch authorization")
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return ENoUsableChallenge
+	}
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	responder.set(client.HTTP01ChallengePath(chal.Token), response)
+	defer responder.remove(client.HTTP01ChallengePath(chal.Token))
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return errors.Wrapf(err, "could not accept challenge for '%s'", authz.Identifier.Value)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return errors.Wrapf(err, "authorization for '%s' failed", authz.Identifier.Value)
+	}
+	return nil
+}
+
+func (c *challengeResponder) set(path, response string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[path] = response
+}
+
+func (c *challengeResponder) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.responses, path)
+}
+
+// ServeHTTP answers the challenge requests of the ACME directory.
+func (c *challengeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	response, found := c.responses[r.URL.Path]
+	c.mu.Unlock()
+	if !found || !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
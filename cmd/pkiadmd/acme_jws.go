@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+const (
+	EJWSMalformed      = Error("malformed JWS")
+	EJWSUnsupportedAlg = Error("unsupported JWS algorithm")
+	EJWSBadSignature   = Error("JWS signature is invalid")
+	EJWKUnsupported    = Error("unsupported JSON web key")
+)
+
+type (
+	// jwsMessage is the flattened JSON serialization of a JWS as used by ACME.
+	jwsMessage struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+
+	// jwsHeader contains the protected header fields required by ACME.
+	jwsHeader struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+	}
+
+	// jsonWebKey is the public part of a JSON web key (RFC 7517).
+	jsonWebKey struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+	}
+)
+
+// parseJWS decodes the message and its protected header.
+func parseJWS(raw []byte) (*jwsMessage, *jwsHeader, error) {
+	msg := &jwsMessage{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, nil, EJWSMalformed
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, nil, EJWSMalformed
+	}
+	header := &jwsHeader{}
+	if err := json.Unmarshal(rawHeader, header); err != nil {
+		return nil, nil, EJWSMalformed
+	}
+	if (header.KID == "") == (len(header.JWK) == 0) {
+		// exactly one of both must be set
+		return nil, nil, EJWSMalformed
+	}
+	return msg, header, nil
+}
+
+// Verify checks the signature of the message against the public key.
+func (m *jwsMessage) Verify(alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return EJWSMalformed
+	}
+	input := []byte(m.Protected + "." + m.Payload)
+
+	switch alg {
+	case "RS256":
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return EJWSUnsupportedAlg
+		}
+		hash := sha256.Sum256(input)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			return EJWSBadSignature
+		}
+		return nil
+	case "ES256", "ES384", "ES512":
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return EJWSUnsupportedAlg
+		}
+		var hash []byte
+		switch alg {
+		case "ES256":
+			h := sha256.Sum256(input)
+			hash = h[:]
+		case "ES384":
+			h := sha512.Sum384(input)
+			hash = h[:]
+		case "ES512":
+			h := sha512.Sum512(input)
+			hash = h[:]
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return EJWSBadSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, hash, r, s) {
+			return EJWSBadSignature
+		}
+		return nil
+	case "EdDSA":
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return EJWSUnsupportedAlg
+		}
+		if !ed25519.Verify(key, input, sig) {
+			return EJWSBadSignature
+		}
+		return nil
+	default:
+		return EJWSUnsupportedAlg
+	}
+}
+
+// DecodePayload returns the decoded payload. An empty payload marks a
+// POST-as-GET request.
+func (m *jwsMessage) DecodePayload() ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(m.Payload)
+	if err != nil {
+		return nil, EJWSMalformed
+	}
+	return raw, nil
+}
+
+// parseJWK decodes a JSON web key.
+func parseJWK(raw []byte) (*jsonWebKey, error) {
+	jwk := &jsonWebKey{}
+	if err := json.Unmarshal(raw, jwk); err != nil {
+		return nil, EJWKUnsupported
+	}
+	if _, err := jwk.PublicKey(); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+// PublicKey converts the JSON web key into a public key.
+func (k *jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	decode := func(in string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(in)
+		if err != nil || len(raw) == 0 {
+			return nil, EJWKUnsupported
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, EJWKUnsupported
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, EJWKUnsupported
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, EJWKUnsupported
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, EJWKUnsupported
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, EJWKUnsupported
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, EJWKUnsupported
+	}
+}
+
+// Thumbprint computes the JWK thumbprint (RFC 7638) used to build key
+// authorizations.
+func (k *jsonWebKey) Thumbprint() string {
+	var input string
+	switch k.Kty {
+	case "RSA":
+		input = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	case "EC":
+		input = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Crv, k.X, k.Y)
+	case "OKP":
+		input = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, k.Crv, k.X)
+	}
+	hash := sha256.Sum256([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
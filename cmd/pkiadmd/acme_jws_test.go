@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// signJWS builds a flattened JWS with the header and payload signed by the
+// key.
+func signJWS(t *testing.T, alg string, key crypto.Signer, header, payload string) []byte {
+	t.Helper()
+	protected := base64.RawURLEncoding.EncodeToString([]byte(header))
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	input := []byte(protected + "." + encoded)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(input)
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, hash[:])
+		err = signErr
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(input)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, input)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(jwsMessage{
+		Protected: protected,
+		Payload:   encoded,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestParseJWS(t *testing.T) {
+	encode := func(in string) string { return base64.RawURLEncoding.EncodeToString([]byte(in)) }
+	tests := []struct {
+		name string
+		raw  string
+		err  error
+	}{
+		{"kid", `{"protected":"` + encode(`{"alg":"ES256","kid":"acct"}`) + `"}`, nil},
+		{"jwk", `{"protected":"` + encode(`{"alg":"ES256","jwk":{"kty":"EC"}}`) + `"}`, nil},
+		{"no json", `protected`, EJWSMalformed},
+		{"bad base64", `{"protected":"%%%"}`, EJWSMalformed},
+		{"bad header", `{"protected":"` + encode(`{"alg":`) + `"}`, EJWSMalformed},
+		{"kid and jwk", `{"protected":"` + encode(`{"alg":"ES256","kid":"acct","jwk":{"kty":"EC"}}`) + `"}`, EJWSMalformed},
+		{"no key", `{"protected":"` + encode(`{"alg":"ES256"}`) + `"}`, EJWSMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := parseJWS([]byte(test.raw))
+			if err != test.err {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestJWSVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := `{"alg":"test","kid":"acct"}`
+
+	tests := []struct {
+		name   string
+		alg    string
+		signer crypto.Signer
+		pub    crypto.PublicKey
+		err    error
+	}{
+		{"ES256", "ES256", ecKey, ecKey.Public(), nil},
+		{"RS256", "RS256", rsaKey, rsaKey.Public(), nil},
+		{"EdDSA", "EdDSA", edKey, edKey.Public(), nil},
+		{"wrong key", "ES256", ecKey, otherEC.Public(), EJWSBadSignature},
+		{"key of other type", "RS256", ecKey, ecKey.Public(), EJWSUnsupportedAlg},
+		{"unknown alg", "HS256", ecKey, ecKey.Public(), EJWSUnsupportedAlg},
+		{"other hash", "ES384", ecKey, ecKey.Public(), EJWSBadSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, _, err := parseJWS(signJWS(t, test.alg, test.signer, header, `{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := msg.Verify(test.alg, test.pub); err != test.err {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	// changing the payload invalidates the signature
+	msg, _, err := parseJWS(signJWS(t, "ES256", ecKey, header, `{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Payload = base64.RawURLEncoding.EncodeToString([]byte(`{"changed":true}`))
+	if err := msg.Verify("ES256", ecKey.Public()); err != EJWSBadSignature {
+		t.Errorf("expected %s for a changed payload, got %v", EJWSBadSignature, err)
+	}
+}
@@ -0,0 +1,969 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gibheer/pki"
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	acmeErrorPrefix    = "urn:ietf:params:acme:error:"
+	acmeObjectLifetime = 7 * 24 * time.Hour
+	acmeNonceLifetime  = time.Hour
+	// acmeNonceSweep is the time between the removals of expired nonces.
+	acmeNonceSweep = time.Minute
+	// acmeMaxNonces limits the number of unused nonces. When reached, the
+	// oldest nonces are dropped and their clients have to get a new one.
+	acmeMaxNonces        = 10000
+	acmeValidateTimeout  = 30 * time.Second
+	acmeDefaultDuration  = 90 * 24 * time.Hour
+	acmeMaxRequestLength = 64 * 1024
+
+	acmeStatusPending     = "pending"
+	acmeStatusProcessing  = "processing"
+	acmeStatusReady       = "ready"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusDeactivated = "deactivated"
+)
+
+type (
+	// ACMEServerSettings define, if and how a local CA issues certificates
+	// through the built-in ACME directory.
+	ACMEServerSettings struct {
+		// Enabled exposes the directory of the CA.
+		Enabled bool
+		// Serial is the serial generator used for issued certificates.
+		Serial pkiadm.ResourceName
+		// Duration is the validity of issued certificates.
+		Duration time.Duration
+		// Allowed contains the identifiers which may be ordered. Names can
+		// be given as 'host.example.com' or '*.example.com' to allow all names
+		// below the domain. IP addresses are allowed by their network, e.g.
+		// '10.0.0.0/8'. When empty, no identifier is allowed.
+		Allowed []string
+	}
+
+	// ChallengeValidator checks that a challenge for the identifier was
+	// fulfilled using the key authorization.
+	ChallengeValidator interface {
+		Validate(ctx context.Context, id ACMEIdentifier, token, keyAuthorization string) error
+	}
+
+	// HTTP01Validator validates http-01 challenges by fetching the key
+	// authorization from the identifier.
+	HTTP01Validator struct {
+		Client *http.Client
+		// Port is the port to connect to, which is 80 by default.
+		Port string
+	}
+
+	// DNS01Validator validates dns-01 challenges by looking up the TXT record
+	// of the identifier.
+	DNS01Validator struct {
+		Resolver *net.Resolver
+	}
+
+	ACMEIdentifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+
+	// ACMEAccount is an account registered with the ACME directory of a CA.
+	ACMEAccount struct {
+		ID         string
+		CA         string
+		Key        json.RawMessage
+		Thumbprint string
+		Contact    []string
+		Status     string
+		Created    time.Time
+	}
+
+	// ACMEOrder is a request of an account to issue a certificate.
+	ACMEOrder struct {
+		ID             string
+		CA             string
+		Account        string
+		Status         string
+		Expires        time.Time
+		Identifiers    []ACMEIdentifier
+		Authorizations []string
+		Certificate    string
+		Error          string
+	}
+
+	// ACMEAuthorization contains the challenges to prove control over an
+	// identifier.
+	ACMEAuthorization struct {
+		ID         string
+		CA         string
+		Account    string
+		Identifier ACMEIdentifier
+		Wildcard   bool
+		Status     string
+		Expires    time.Time
+		Challenges []ACMEChallenge
+	}
+
+	ACMEChallenge struct {
+		Type      string
+		Token     string
+		Status    string
+		Validated time.Time
+		Error     string
+	}
+
+	// ACMECertificate is a certificate issued through the ACME directory.
+	ACMECertificate struct {
+		ID       string
+		CA       string
+		Account  string
+		Order    string
+		Serial   string
+		NotAfter time.Time
+		Data     []byte
+	}
+
+	// ACMEServer exposes the ACME directories of all CAs, which have the ACME
+	// server enabled.
+	ACMEServer struct {
+		server  *Server
+		baseURL string
+		// Validators contains the validators by challenge type. Only challenge
+		// types with a validator are offered to clients.
+		Validators map[string]ChallengeValidator
+
+		nonceMu    sync.Mutex
+		nonces     map[string]time.Time
+		nonceOrder []string
+		nonceSwept time.Time
+	}
+
+	// acmeRequest contains the verified content of a POST request.
+	acmeRequest struct {
+		ca      *CA
+		account *ACMEAccount
+		jwk     *jsonWebKey
+		payload []byte
+	}
+
+	acmeProblem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+		Status int    `json:"status"`
+	}
+)
+
+// NewACMEServer creates the handler for the ACME directories. The base URL
+// is the externally visible URL of the listener and is used to build links.
+func NewACMEServer(server *Server, baseURL string) *ACMEServer {
+	return &ACMEServer{
+		server:  server,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		Validators: map[string]ChallengeValidator{
+			"http-01": &HTTP01Validator{},
+			"dns-01":  &DNS01Validator{},
+		},
+		nonces: map[string]time.Time{},
+	}
+}
+
+// Allows checks, if the identifier may be issued by the CA.
+func (a ACMEServerSettings) Allows(id ACMEIdentifier) bool {
+	return matchesNamePattern(a.Allowed, id.Value)
+}
+
+// Validate fetches the key authorization over http.
+func (v *HTTP01Validator) Validate(ctx context.Context, id ACMEIdentifier, token, keyAuthorization string) error {
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	port := v.Port
+	if port == "" {
+		port = "80"
+	}
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", net.JoinHostPort(id.Value, port), token)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching '%s' returned status %d", url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return fmt.Errorf("key authorization at '%s' does not match", url)
+	}
+	return nil
+}
+
+// Validate looks up the TXT record for the identifier.
+func (v *DNS01Validator) Validate(ctx context.Context, id ACMEIdentifier, token, keyAuthorization string) error {
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	name := "_acme-challenge." + strings.TrimPrefix(id.Value, "*.")
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(keyAuthorization))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	for _, record := range records {
+		if record == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching TXT record found for '%s'", name)
+}
+
+// ServeHTTP dispatches the requests to the ACME endpoints. All paths have the
+// form /acme/<ca>/<endpoint>[/<id>].
+func (a *ACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/acme/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/acme/") || len(parts) < 2 {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown resource")
+		return
+	}
+	caID, endpoint, ids := parts[0], parts[1], parts[2:]
+	w.Header().Set("Cache-Control", "no-store")
+
+	a.server.lock()
+	defer a.server.unlock()
+
+	ca, err := a.server.storage.GetCA(pkiadm.ResourceName{ID: caID, Type: pkiadm.RTCA})
+	if err != nil || !ca.ACMEServer.Enabled || ca.Type != pkiadm.CALocal {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown directory")
+		return
+	}
+	// nonces are only handed out by existing directories
+	w.Header().Set("Replay-Nonce", a.newNonce())
+
+	switch endpoint {
+	case "directory":
+		a.respond(w, http.StatusOK, "", map[string]string{
+			"newNonce":   a.url(ca, "new-nonce"),
+			"newAccount": a.url(ca, "new-account"),
+			"newOrder":   a.url(ca, "new-order"),
+		})
+		return
+	case "new-nonce":
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if r.Method != "POST" {
+		a.problem(w, http.StatusMethodNotAllowed, "malformed", "only POST is supported")
+		return
+	}
+	req, problem := a.parseRequest(r, ca, endpoint == "new-account")
+	if problem != nil {
+		a.writeProblem(w, problem)
+		return
+	}
+	id := ""
+	if len(ids) > 0 {
+		id = ids[0]
+	}
+	switch endpoint {
+	case "new-account":
+		a.newAccount(w, req)
+	case "account":
+		a.updateAccount(w, req, id)
+	case "new-order":
+		a.newOrder(w, req)
+	case "order":
+		if len(ids) == 2 && ids[1] == "finalize" {
+			a.finalizeOrder(w, req, id)
+		} else {
+			a.showOrder(w, req, id)
+		}
+	case "authz":
+		a.showAuthorization(w, req, id)
+	case "chall":
+		if len(ids) != 2 {
+			a.problem(w, http.StatusNotFound, "malformed", "unknown challenge")
+			return
+		}
+		a.acceptChallenge(w, req, id, ids[1])
+	case "cert":
+		a.showCertificate(w, req, id)
+	default:
+		a.problem(w, http.StatusNotFound, "malformed", "unknown resource")
+	}
+}
+
+// parseRequest verifies the JWS of the request. New accounts must provide
+// the key, all other requests must reference an account.
+func (a *ACMEServer) parseRequest(r *http.Request, ca *CA, withJWK bool) (*acmeRequest, *acmeProblem) {
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, acmeMaxRequestLength))
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", "could not read request")
+	}
+	msg, header, err := parseJWS(raw)
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	if !a.useNonce(header.Nonce) {
+		return nil, newACMEProblem(http.StatusBadRequest, "badNonce", "nonce is invalid or was already used")
+	}
+	if header.URL != a.baseURL+r.URL.Path {
+		return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", "url in header does not match the request")
+	}
+
+	req := &acmeRequest{ca: ca}
+	if withJWK {
+		if len(header.JWK) == 0 {
+			return nil, newACMEProblem(http.StatusBadRequest, "malformed", "jwk is required")
+		}
+		req.jwk, err = parseJWK(header.JWK)
+		if err != nil {
+			return nil, newACMEProblem(http.StatusBadRequest, "badPublicKey", err.Error())
+		}
+	} else {
+		prefix := a.url(ca, "account") + "/"
+		if !strings.HasPrefix(header.KID, prefix) {
+			return nil, newACMEProblem(http.StatusBadRequest, "malformed", "kid is required")
+		}
+		account, found := a.server.storage.ACMEAccounts[strings.TrimPrefix(header.KID, prefix)]
+		if !found || account.CA != ca.ID {
+			return nil, newACMEProblem(http.StatusBadRequest, "accountDoesNotExist", "unknown account")
+		}
+		if account.Status != acmeStatusValid {
+			return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", "account is not valid")
+		}
+		req.account = account
+		req.jwk, err = parseJWK(account.Key)
+		if err != nil {
+			return nil, newACMEProblem(http.StatusInternalServerError, "serverInternal", "stored account key is broken")
+		}
+	}
+	pub, err := req.jwk.PublicKey()
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "badPublicKey", err.Error())
+	}
+	if err := msg.Verify(header.Alg, pub); err != nil {
+		if err == EJWSUnsupportedAlg {
+			return nil, newACMEProblem(http.StatusBadRequest, "badSignatureAlgorithm", err.Error())
+		}
+		return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", err.Error())
+	}
+	req.payload, err = msg.DecodePayload()
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", err.Error())
+	}
+	return req, nil
+}
+
+func (a *ACMEServer) newAccount(w http.ResponseWriter, req *acmeRequest) {
+	payload := struct {
+		Contact            []string `json:"contact"`
+		TermsOfService     bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "could not parse account")
+		return
+	}
+	thumbprint := req.jwk.Thumbprint()
+	for _, account := range a.server.storage.ACMEAccounts {
+		if account.CA == req.ca.ID && account.Thumbprint == thumbprint {
+			a.respond(w, http.StatusOK, a.url(req.ca, "account", account.ID), a.accountView(account))
+			return
+		}
+	}
+	if payload.OnlyReturnExisting {
+		a.problem(w, http.StatusBadRequest, "accountDoesNotExist", "no account exists for the key")
+		return
+	}
+	key, err := json.Marshal(req.jwk)
+	if err != nil {
+		a.problem(w, http.StatusInternalServerError, "serverInternal", "could not store key")
+		return
+	}
+	account := &ACMEAccount{
+		ID:         randomID(),
+		CA:         req.ca.ID,
+		Key:        key,
+		Thumbprint: thumbprint,
+		Contact:    payload.Contact,
+		Status:     acmeStatusValid,
+		Created:    a.now(),
+	}
+	a.server.storage.ACMEAccounts[account.ID] = account
+	a.store()
+	log.Printf("acme directory '%s' registered account '%s'", req.ca.ID, account.ID)
+	a.respond(w, http.StatusCreated, a.url(req.ca, "account", account.ID), a.accountView(account))
+}
+
+func (a *ACMEServer) updateAccount(w http.ResponseWriter, req *acmeRequest, id string) {
+	if req.account.ID != id {
+		a.problem(w, http.StatusUnauthorized, "unauthorized", "account does not match the key id")
+		return
+	}
+	if len(req.payload) > 0 {
+		payload := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			a.problem(w, http.StatusBadRequest, "malformed", "could not parse account")
+			return
+		}
+		if payload.Contact != nil {
+			req.account.Contact = payload.Contact
+		}
+		if payload.Status == acmeStatusDeactivated {
+			req.account.Status = acmeStatusDeactivated
+		}
+		a.store()
+	}
+	a.respond(w, http.StatusOK, "", a.accountView(req.account))
+}
+
+func (a *ACMEServer) newOrder(w http.ResponseWriter, req *acmeRequest) {
+	payload := struct {
+		Identifiers []ACMEIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		a.problem(w, http.StatusBadRequest, "malformed", "no identifiers given")
+		return
+	}
+	a.prune()
+
+	order := &ACMEOrder{
+		ID:      randomID(),
+		CA:      req.ca.ID,
+		Account: req.account.ID,
+		Status:  acmeStatusPending,
+		Expires: a.now().Add(acmeObjectLifetime),
+	}
+	authzs := []*ACMEAuthorization{}
+	for _, id := range payload.Identifiers {
+		id.Value = strings.ToLower(id.Value)
+		if id.Type != "dns" && id.Type != "ip" {
+			a.problem(w, http.StatusBadRequest, "unsupportedIdentifier", fmt.Sprintf("identifier type '%s' is not supported", id.Type))
+			return
+		}
+		if id.Type == "ip" && net.ParseIP(id.Value) == nil {
+			a.problem(w, http.StatusBadRequest, "malformed", fmt.Sprintf("'%s' is not an IP address", id.Value))
+			return
+		}
+		if !req.ca.ACMEServer.Allows(id) {
+			a.problem(w, http.StatusForbidden, "rejectedIdentifier", fmt.Sprintf("identifier '%s' is not allowed", id.Value))
+			return
+		}
+		authz := &ACMEAuthorization{
+			ID:         randomID(),
+			CA:         req.ca.ID,
+			Account:    req.account.ID,
+			Identifier: id,
+			Status:     acmeStatusPending,
+			Expires:    order.Expires,
+		}
+		if strings.HasPrefix(id.Value, "*.") {
+			authz.Identifier.Value = strings.TrimPrefix(id.Value, "*.")
+			authz.Wildcard = true
+		}
+		for _, chalType := range a.challengeTypes() {
+			if chalType == "http-01" && authz.Wildcard {
+				continue
+			}
+			if chalType == "dns-01" && id.Type == "ip" {
+				continue
+			}
+			authz.Challenges = append(authz.Challenges, ACMEChallenge{
+				Type:   chalType,
+				Token:  randomID(),
+				Status: acmeStatusPending,
+			})
+		}
+		if len(authz.Challenges) == 0 {
+			a.problem(w, http.StatusBadRequest, "unsupportedIdentifier", fmt.Sprintf("no challenge available for '%s'", id.Value))
+			return
+		}
+		order.Identifiers = append(order.Identifiers, id)
+		authzs = append(authzs, authz)
+	}
+	for _, authz := range authzs {
+		a.server.storage.ACMEAuthorizations[authz.ID] = authz
+		order.Authorizations = append(order.Authorizations, authz.ID)
+	}
+	a.server.storage.ACMEOrders[order.ID] = order
+	a.store()
+	a.respond(w, http.StatusCreated, a.url(req.ca, "order", order.ID), a.orderView(req.ca, order))
+}
+
+func (a *ACMEServer) showOrder(w http.ResponseWriter, req *acmeRequest, id string) {
+	order, found := a.server.storage.ACMEOrders[id]
+	if !found || order.Account != req.account.ID {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown order")
+		return
+	}
+	a.updateOrderStatus(order)
+	a.respond(w, http.StatusOK, "", a.orderView(req.ca, order))
+}
+
+func (a *ACMEServer) finalizeOrder(w http.ResponseWriter, req *acmeRequest, id string) {
+	order, found := a.server.storage.ACMEOrders[id]
+	if !found || order.Account != req.account.ID {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown order")
+		return
+	}
+	a.updateOrderStatus(order)
+	if order.Status != acmeStatusReady {
+		a.problem(w, http.StatusForbidden, "orderNotReady", "order is "+order.Status)
+		return
+	}
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "could not parse finalize request")
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "badCSR", "could not decode CSR")
+		return
+	}
+	csr, err := pki.LoadCertificateSignRequest(der)
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "badCSR", "could not parse CSR")
+		return
+	}
+	if err := (*x509.CertificateRequest)(csr).CheckSignature(); err != nil {
+		a.problem(w, http.StatusBadRequest, "badCSR", "CSR signature is invalid")
+		return
+	}
+	if !csrMatchesOrder(csr, order) {
+		a.problem(w, http.StatusBadRequest, "badCSR", "CSR does not match the order identifiers")
+		return
+	}
+
+	data, serial, notAfter, err := a.issue(req.ca, csr)
+	if err != nil {
+		log.Printf("acme directory '%s' could not sign order '%s': %s", req.ca.ID, order.ID, err)
+		order.Status = acmeStatusInvalid
+		order.Error = err.Error()
+		a.store()
+		a.problem(w, http.StatusInternalServerError, "serverInternal", "could not issue certificate")
+		return
+	}
+	cert := &ACMECertificate{
+		ID:       randomID(),
+		CA:       req.ca.ID,
+		Account:  req.account.ID,
+		Order:    order.ID,
+		Serial:   serial,
+		NotAfter: notAfter,
+		Data:     data,
+	}
+	a.server.storage.ACMECertificates[cert.ID] = cert
+	if err := a.server.storage.AddIssuance(req.ca, data, "acme-order/"+order.ID); err != nil {
+		log.Printf("acme directory '%s' could not record issuance: %s", req.ca.ID, err)
+	}
+	order.Status = acmeStatusValid
+	order.Certificate = cert.ID
+	a.store()
+	log.Printf("acme directory '%s' issued certificate '%s' for order '%s'", req.ca.ID, cert.ID, order.ID)
+	a.respond(w, http.StatusOK, a.url(req.ca, "order", order.ID), a.orderView(req.ca, order))
+}
+
+// issue signs the request with the CA and returns the certificate together
+// with the chain of the CA.
+func (a *ACMEServer) issue(ca *CA, csr *pki.CertificateRequest) ([]byte, string, time.Time, error) {
+	settings := ca.ACMEServer
+	serRes, err := a.server.storage.GetSerial(settings.Serial)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	serial, err := serRes.Generate()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	duration := settings.Duration
+	if duration <= 0 {
+		duration = acmeDefaultDuration
+	}
+	now := a.now()
+	opts := SignOptions{
+		SerialNumber: serial,
+		NotBefore:    now,
+		NotAfter:     now.Add(duration),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	data, err := ca.SignRequest(a.server.storage, csr, opts)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	caCert, err := a.server.storage.GetCertificate(ca.Certificate)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	data = append(data, caCert.Data...)
+	return data, serial.Text(16), opts.NotAfter, nil
+}
+
+func (a *ACMEServer) showAuthorization(w http.ResponseWriter, req *acmeRequest, id string) {
+	authz, found := a.server.storage.ACMEAuthorizations[id]
+	if !found || authz.Account != req.account.ID {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown authorization")
+		return
+	}
+	if len(req.payload) > 0 {
+		payload := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &payload); err == nil && payload.Status == acmeStatusDeactivated {
+			authz.Status = acmeStatusDeactivated
+			a.store()
+		}
+	}
+	a.respond(w, http.StatusOK, "", a.authorizationView(req.ca, authz))
+}
+
+// acceptChallenge starts the validation of the challenge, when the client
+// signals that the challenge is ready.
+func (a *ACMEServer) acceptChallenge(w http.ResponseWriter, req *acmeRequest, authzID, chalType string) {
+	authz, found := a.server.storage.ACMEAuthorizations[authzID]
+	if !found || authz.Account != req.account.ID {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown challenge")
+		return
+	}
+	var chal *ACMEChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == chalType {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown challenge")
+		return
+	}
+	if len(req.payload) > 0 && chal.Status == acmeStatusPending && authz.Status == acmeStatusPending {
+		validator, found := a.Validators[chal.Type]
+		if !found {
+			a.problem(w, http.StatusBadRequest, "malformed", "challenge type is not supported")
+			return
+		}
+		chal.Status = acmeStatusProcessing
+		keyAuth := chal.Token + "." + req.jwk.Thumbprint()
+		go a.validate(validator, authz.ID, authz.Identifier, chal.Type, chal.Token, keyAuth)
+	}
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", a.url(req.ca, "authz", authz.ID)))
+	a.respond(w, http.StatusOK, "", a.challengeView(req.ca, authz, *chal))
+}
+
+// validate runs the validator and updates the challenge and authorization
+// with the result.
+func (a *ACMEServer) validate(validator ChallengeValidator, authzID string, id ACMEIdentifier, chalType, token, keyAuth string) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeValidateTimeout)
+	defer cancel()
+	err := validator.Validate(ctx, id, token, keyAuth)
+
+	a.server.lock()
+	defer a.server.unlock()
+	authz, found := a.server.storage.ACMEAuthorizations[authzID]
+	if !found {
+		return
+	}
+	for i := range authz.Challenges {
+		chal := &authz.Challenges[i]
+		if chal.Type != chalType {
+			continue
+		}
+		if err != nil {
+			log.Printf("acme challenge %s for '%s' failed: %s", chalType, id.Value, err)
+			chal.Status = acmeStatusInvalid
+			chal.Error = err.Error()
+			authz.Status = acmeStatusInvalid
+		} else {
+			chal.Status = acmeStatusValid
+			chal.Validated = a.now()
+			authz.Status = acmeStatusValid
+		}
+	}
+	a.store()
+}
+
+func (a *ACMEServer) showCertificate(w http.ResponseWriter, req *acmeRequest, id string) {
+	cert, found := a.server.storage.ACMECertificates[id]
+	if !found || cert.Account != req.account.ID {
+		a.problem(w, http.StatusNotFound, "malformed", "unknown certificate")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(cert.Data)
+}
+
+// updateOrderStatus moves the order forward, when the authorizations changed.
+func (a *ACMEServer) updateOrderStatus(order *ACMEOrder) {
+	if order.Status != acmeStatusPending {
+		return
+	}
+	if a.now().After(order.Expires) {
+		order.Status = acmeStatusInvalid
+		return
+	}
+	ready := true
+	for _, id := range order.Authorizations {
+		authz, found := a.server.storage.ACMEAuthorizations[id]
+		if !found || authz.Status == acmeStatusInvalid || authz.Status == acmeStatusDeactivated {
+			order.Status = acmeStatusInvalid
+			return
+		}
+		if authz.Status != acmeStatusValid {
+			ready = false
+		}
+	}
+	if ready {
+		order.Status = acmeStatusReady
+	}
+}
+
+// prune removes expired orders and authorizations, which did not lead to a
+// certificate.
+func (a *ACMEServer) prune() {
+	now := a.now()
+	for id, order := range a.server.storage.ACMEOrders {
+		if now.After(order.Expires) && order.Status != acmeStatusValid {
+			delete(a.server.storage.ACMEOrders, id)
+		}
+	}
+	for id, authz := range a.server.storage.ACMEAuthorizations {
+		if now.After(authz.Expires) {
+			delete(a.server.storage.ACMEAuthorizations, id)
+		}
+	}
+}
+
+func (a *ACMEServer) challengeTypes() []string {
+	types := []string{}
+	for chalType := range a.Validators {
+		types = append(types, chalType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// csrMatchesOrder checks that the CSR requests exactly the identifiers of the
+// order.
+func csrMatchesOrder(csr *pki.CertificateRequest, order *ACMEOrder) bool {
+	requested := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		requested["dns:"+strings.ToLower(name)] = true
+	}
+	for _, ip := range csr.IPAddresses {
+		requested["ip:"+ip.String()] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		if ip := net.ParseIP(cn); ip != nil {
+			requested["ip:"+ip.String()] = true
+		} else {
+			requested["dns:"+cn] = true
+		}
+	}
+	ordered := map[string]bool{}
+	for _, id := range order.Identifiers {
+		value := id.Value
+		if id.Type == "ip" {
+			value = net.ParseIP(value).String()
+		}
+		ordered[id.Type+":"+value] = true
+	}
+	if len(requested) != len(ordered) {
+		return false
+	}
+	for id := range requested {
+		if !ordered[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *ACMEServer) accountView(account *ACMEAccount) interface{} {
+	return map[string]interface{}{
+		"status":  account.Status,
+		"contact": account.Contact,
+	}
+}
+
+func (a *ACMEServer) orderView(ca *CA, order *ACMEOrder) interface{} {
+	authzs := []string{}
+	for _, id := range order.Authorizations {
+		authzs = append(authzs, a.url(ca, "authz", id))
+	}
+	view := map[string]interface{}{
+		"status":         order.Status,
+		"expires":        order.Expires.UTC().Format(time.RFC3339),
+		"identifiers":    order.Identifiers,
+		"authorizations": authzs,
+		"finalize":       a.url(ca, "order", order.ID, "finalize"),
+	}
+	if order.Certificate != "" {
+		view["certificate"] = a.url(ca, "cert", order.Certificate)
+	}
+	if order.Error != "" {
+		view["error"] = acmeProblem{acmeErrorPrefix + "serverInternal", order.Error, http.StatusInternalServerError}
+	}
+	return view
+}
+
+func (a *ACMEServer) authorizationView(ca *CA, authz *ACMEAuthorization) interface{} {
+	chals := []interface{}{}
+	for _, chal := range authz.Challenges {
+		chals = append(chals, a.challengeView(ca, authz, chal))
+	}
+	view := map[string]interface{}{
+		"status":     authz.Status,
+		"expires":    authz.Expires.UTC().Format(time.RFC3339),
+		"identifier": authz.Identifier,
+		"challenges": chals,
+	}
+	if authz.Wildcard {
+		view["wildcard"] = true
+	}
+	return view
+}
+
+func (a *ACMEServer) challengeView(ca *CA, authz *ACMEAuthorization, chal ACMEChallenge) interface{} {
+	view := map[string]interface{}{
+		"type":   chal.Type,
+		"url":    a.url(ca, "chall", authz.ID, chal.Type),
+		"token":  chal.Token,
+		"status": chal.Status,
+	}
+	if !chal.Validated.IsZero() {
+		view["validated"] = chal.Validated.UTC().Format(time.RFC3339)
+	}
+	if chal.Error != "" {
+		view["error"] = acmeProblem{acmeErrorPrefix + "incorrectResponse", chal.Error, http.StatusForbidden}
+	}
+	return view
+}
+
+func (a *ACMEServer) url(ca *CA, parts ...string) string {
+	return a.baseURL + "/acme/" + ca.ID + "/" + strings.Join(parts, "/")
+}
+
+// store writes the changes to the database.
+func (a *ACMEServer) store() {
+	if err := a.server.storage.store(); err != nil {
+		log.Printf("could not store acme changes: %s", err)
+	}
+}
+
+func (a *ACMEServer) respond(w http.ResponseWriter, status int, location string, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		a.problem(w, http.StatusInternalServerError, "serverInternal", "could not encode response")
+		return
+	}
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+func (a *ACMEServer) problem(w http.ResponseWriter, status int, problemType, detail string) {
+	a.writeProblem(w, newACMEProblem(status, problemType, detail))
+}
+
+func (a *ACMEServer) writeProblem(w http.ResponseWriter, p *acmeProblem) {
+	raw, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(raw)
+}
+
+func newACMEProblem(status int, problemType, detail string) *acmeProblem {
+	return &acmeProblem{Type: acmeErrorPrefix + problemType, Detail: detail, Status: status}
+}
+
+// now returns the current time of the storage clock.
+func (a *ACMEServer) now() time.Time {
+	return a.server.storage.clock.Now()
+}
+
+// newNonce creates a new nonce. Expired nonces are removed periodically and
+// the oldest ones are dropped, when too many are unused.
+func (a *ACMEServer) newNonce() string {
+	a.nonceMu.Lock()
+	defer a.nonceMu.Unlock()
+	now := a.now()
+	if now.Sub(a.nonceSwept) >= acmeNonceSweep {
+		a.nonceSwept = now
+		for nonce, expires := range a.nonces {
+			if now.After(expires) {
+				delete(a.nonces, nonce)
+			}
+		}
+	}
+	// the order still contains used and expired nonces, which are skipped
+	for len(a.nonces) >= acmeMaxNonces || len(a.nonceOrder) >= 2*acmeMaxNonces {
+		delete(a.nonces, a.nonceOrder[0])
+		a.nonceOrder = a.nonceOrder[1:]
+	}
+	nonce := randomID()
+	a.nonces[nonce] = now.Add(acmeNonceLifetime)
+	a.nonceOrder = append(a.nonceOrder, nonce)
+	return nonce
+}
+
+// useNonce checks if the nonce is valid and invalidates it.
+func (a *ACMEServer) useNonce(nonce string) bool {
+	a.nonceMu.Lock()
+	defer a.nonceMu.Unlock()
+	expires, found := a.nonces[nonce]
+	if !found {
+		return false
+	}
+	delete(a.nonces, nonce)
+	return a.now().Before(expires)
+}
+
+// randomID returns a random url safe identifier.
+func randomID() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// fakeValidator accepts or rejects all challenges without contacting the
+// client and records the validated identifiers.
+type fakeValidator struct {
+	err error
+
+	mu        sync.Mutex
+	validated []string
+}
+
+func (v *fakeValidator) Validate(_ context.Context, id ACMEIdentifier, token, keyAuthorization string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.validated = append(v.validated, id.Value)
+	return v.err
+}
+
+// TestACMEServerValidator orders certificates from the ACME directory of a
+// local CA, whose challenges are decided by the validator.
+func TestACMEServerValidator(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		state pkiadm.JobState
+	}{
+		{"accepted", nil, pkiadm.JSDone},
+		{"rejected", errors.New("wrong key authorization"), pkiadm.JSFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			addTestCA(t, s, "root", "127.0.0.0/8")
+
+			validator := &fakeValidator{err: test.err}
+			directory := httptest.NewServer(nil)
+			defer directory.Close()
+			acmeServer := NewACMEServer(s, directory.URL)
+			acmeServer.Validators = map[string]ChallengeValidator{"http-01": validator}
+			directory.Config.Handler = acmeServer
+
+			addTestKey(t, s, "account")
+			res := &pkiadm.Result{}
+			err := s.CreateCA(pkiadm.CA{
+				ID:            "le",
+				Type:          pkiadm.CALetsEncrypt,
+				DirectoryURL:  directory.URL + "/acme/root/directory",
+				AccountKey:    pkiadm.ResourceName{ID: "account", Type: pkiadm.RTPrivateKey},
+				ChallengeAddr: freeAddr(t),
+			}, res)
+			checkResult(t, "create ca le", err, res)
+			waitForJob(t, s, res.Job)
+
+			addTestCSR(t, s, "www", "127.0.0.1", net.ParseIP("127.0.0.1"))
+			err = s.CreateCertificate(pkiadm.Certificate{
+				ID:         "www",
+				PrivateKey: pkiadm.ResourceName{ID: "www", Type: pkiadm.RTPrivateKey},
+				CSR:        pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCSR},
+				CA:         pkiadm.ResourceName{ID: "le", Type: pkiadm.RTCA},
+			}, res)
+			checkResult(t, "create certificate www", err, res)
+			job, err := s.jobs.Wait(res.Job, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.State != test.state {
+				t.Errorf("expected job state %s, got %s: %s", test.state, job.State, job.Error)
+			}
+			validator.mu.Lock()
+			defer validator.mu.Unlock()
+			if len(validator.validated) != 1 || validator.validated[0] != "127.0.0.1" {
+				t.Errorf("expected 127.0.0.1 to be validated, got %v", validator.validated)
+			}
+		})
+	}
+}
+
+// TestACMENonces checks that only existing directories hand out nonces and
+// that the number of unused nonces is limited.
+func TestACMENonces(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTestCA(t, s, "root", "127.0.0.0/8")
+	acmeServer := NewACMEServer(s, "http://localhost")
+
+	for path, expected := range map[string]bool{
+		"/acme/root/new-nonce":    true,
+		"/acme/unknown/new-nonce": false,
+		"/other":                  false,
+	} {
+		w := httptest.NewRecorder()
+		acmeServer.ServeHTTP(w, httptest.NewRequest("HEAD", path, nil))
+		if got := w.Header().Get("Replay-Nonce") != ""; got != expected {
+			t.Errorf("%s: expected nonce %t, got %t", path, expected, got)
+		}
+	}
+
+	first := acmeServer.newNonce()
+	var last string
+	for i := 0; i < acmeMaxNonces; i++ {
+		last = acmeServer.newNonce()
+	}
+	if len(acmeServer.nonces) > acmeMaxNonces {
+		t.Errorf("expected at most %d nonces, got %d", acmeMaxNonces, len(acmeServer.nonces))
+	}
+	if acmeServer.useNonce(first) {
+		t.Errorf("oldest nonce was not dropped")
+	}
+	if !acmeServer.useNonce(last) {
+		t.Errorf("newest nonce was dropped")
+	}
+
+	clock.Advance(acmeNonceLifetime + acmeNonceSweep)
+	acmeServer.newNonce()
+	if len(acmeServer.nonces) != 1 {
+		t.Errorf("expired nonces were not removed, %d left", len(acmeServer.nonces))
+	}
+}
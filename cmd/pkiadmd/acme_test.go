@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// checkResult fails the test, when the request returned an error.
+func checkResult(t *testing.T, what string, err error, res *pkiadm.Result) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("could not %s: %s", what, err)
+	}
+	if res.HasError {
+		t.Fatalf("could not %s: %s (%s)", what, res.Message, res.Error)
+	}
+}
+
+// waitForJob waits until the job is finished and fails the test, when the
+// job failed.
+func waitForJob(t *testing.T, s *Server, id string) {
+	t.Helper()
+	if id == "" {
+		t.Fatalf("no job was started")
+	}
+	job, err := s.jobs.Wait(id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != pkiadm.JSDone {
+		t.Fatalf("job %s '%s' did not finish: %s", job.ID, job.Description, job.Error)
+	}
+}
+
+// addTestKey creates an ECDSA private key and waits for it.
+func addTestKey(t *testing.T, s *Server, id string) {
+	t.Helper()
+	res := &pkiadm.Result{}
+	err := s.CreatePrivateKey(pkiadm.PrivateKey{ID: id, Type: pkiadm.PKTECDSA, Bits: 256}, res)
+	checkResult(t, "create private key "+id, err, res)
+	waitForJob(t, s, res.Job)
+}
+
+// addTestCSR creates a private key, a subject and a CSR for the names, all
+// with the given id.
+func addTestCSR(t *testing.T, s *Server, id string, cn string, ips ...net.IP) {
+	t.Helper()
+	addTestKey(t, s, id)
+	res := &pkiadm.Result{}
+	err := s.CreateSubject(pkiadm.Subject{ID: id, Name: pkix.Name{CommonName: cn}}, res)
+	checkResult(t, "create subject "+id, err, res)
+	err = s.CreateCSR(pkiadm.CSR{
+		ID:          id,
+		IPAddresses: ips,
+		PrivateKey:  pkiadm.ResourceName{ID: id, Type: pkiadm.RTPrivateKey},
+		Subject:     pkiadm.ResourceName{ID: id, Type: pkiadm.RTSubject},
+	}, res)
+	checkResult(t, "create csr "+id, err, res)
+}
+
+// addTestCA creates a self signed CA certificate and a local CA using it.
+// The CA issues certificates through its ACME directory for the allowed
+// identifiers.
+func addTestCA(t *testing.T, s *Server, id string, allowed ...string) {
+	t.Helper()
+	addTestCSR(t, s, id, id)
+	res := &pkiadm.Result{}
+	err := s.CreateSerial(pkiadm.Serial{
+		ID:   id,
+		Mode: pkiadm.SMSequential,
+		Min:  big.NewInt(1),
+		Max:  big.NewInt(1000),
+	}, res)
+	checkResult(t, "create serial "+id, err, res)
+	err = s.CreateCertificate(pkiadm.Certificate{
+		ID:         id,
+		IsCA:       true,
+		Duration:   24 * time.Hour,
+		PrivateKey: pkiadm.ResourceName{ID: id, Type: pkiadm.RTPrivateKey},
+		Serial:     pkiadm.ResourceName{ID: id, Type: pkiadm.RTSerial},
+		CSR:        pkiadm.ResourceName{ID: id, Type: pkiadm.RTCSR},
+	}, res)
+	checkResult(t, "create certificate "+id, err, res)
+	err = s.CreateCA(pkiadm.CA{
+		ID:          id,
+		Type:        pkiadm.CALocal,
+		Certificate: pkiadm.ResourceName{ID: id, Type: pkiadm.RTCertificate},
+		ACMEServer:  len(allowed) > 0,
+		ACMESerial:  pkiadm.ResourceName{ID: id, Type: pkiadm.RTSerial},
+		ACMEAllowed: allowed,
+	}, res)
+	checkResult(t, "create ca "+id, err, res)
+}
+
+// freeAddr returns a local address, which is currently not in use.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestACMEOrder orders a certificate from the ACME directory of a local CA.
+// Both run in the same server, so the order only finishes, when the storage
+// is not held while talking to the directory.
+func TestACMEOrder(t *testing.T) {
+	s, _ := newTestServer(t)
+	addTestCA(t, s, "root", "127.0.0.0/8")
+
+	challengeAddr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(challengeAddr)
+	directory := httptest.NewServer(nil)
+	defer directory.Close()
+	acmeServer := NewACMEServer(s, directory.URL)
+	acmeServer.Validators = map[string]ChallengeValidator{
+		"http-01": &HTTP01Validator{Port: port},
+	}
+	directory.Config.Handler = acmeServer
+
+	addTestKey(t, s, "account")
+	res := &pkiadm.Result{}
+	err := s.CreateCA(pkiadm.CA{
+		ID:            "le",
+		Type:          pkiadm.CALetsEncrypt,
+		DirectoryURL:  directory.URL + "/acme/root/directory",
+		AccountKey:    pkiadm.ResourceName{ID: "account", Type: pkiadm.RTPrivateKey},
+		ChallengeAddr: challengeAddr,
+	}, res)
+	checkResult(t, "create ca le", err, res)
+	waitForJob(t, s, res.Job)
+
+	addTestCSR(t, s, "www", "127.0.0.1", net.ParseIP("127.0.0.1"))
+	err = s.CreateCertificate(pkiadm.Certificate{
+		ID:         "www",
+		PrivateKey: pkiadm.ResourceName{ID: "www", Type: pkiadm.RTPrivateKey},
+		CSR:        pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCSR},
+		CA:         pkiadm.ResourceName{ID: "le", Type: pkiadm.RTCA},
+	}, res)
+	checkResult(t, "create certificate www", err, res)
+	waitForJob(t, s, res.Job)
+
+	s.lock()
+	defer s.unlock()
+	ca, err := s.storage.GetCA(pkiadm.ResourceName{ID: "le", Type: pkiadm.RTCA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.ACME.AccountURL == "" {
+		t.Errorf("account url of the CA was not stored")
+	}
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(cert.Data)
+	if block == nil {
+		t.Fatalf("no certificate was stored")
+	}
+	issued, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Issuer.CommonName != "root" {
+		t.Errorf("expected issuer 'root', got '%s'", issued.Issuer.CommonName)
+	}
+	if len(issued.IPAddresses) != 1 || !issued.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected ip 127.0.0.1, got %v", issued.IPAddresses)
+	}
+	if st := s.storage.statusOf(cert); st.Failed() || st.LastSuccess.IsZero() {
+		t.Errorf("refresh was not recorded: %+v", st)
+	}
+}
+
+// TestACMEOrderFailure checks that a failed challenge fails the job and is
+// recorded in the refresh status of the certificate.
+func TestACMEOrderFailure(t *testing.T) {
+	s, _ := newTestServer(t)
+	addTestCA(t, s, "root", "127.0.0.0/8")
+
+	directory := httptest.NewServer(nil)
+	defer directory.Close()
+	acmeServer := NewACMEServer(s, directory.URL)
+	// nothing answers on the port of the validator
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	acmeServer.Validators = map[string]ChallengeValidator{
+		"http-01": &HTTP01Validator{Port: port},
+	}
+	directory.Config.Handler = acmeServer
+
+	addTestKey(t, s, "account")
+	res := &pkiadm.Result{}
+	err := s.CreateCA(pkiadm.CA{
+		ID:            "le",
+		Type:          pkiadm.CALetsEncrypt,
+		DirectoryURL:  directory.URL + "/acme/root/directory",
+		AccountKey:    pkiadm.ResourceName{ID: "account", Type: pkiadm.RTPrivateKey},
+		ChallengeAddr: freeAddr(t),
+	}, res)
+	checkResult(t, "create ca le", err, res)
+	waitForJob(t, s, res.Job)
+
+	addTestCSR(t, s, "www", "127.0.0.1", net.ParseIP("127.0.0.1"))
+	err = s.CreateCertificate(pkiadm.Certificate{
+		ID:         "www",
+		PrivateKey: pkiadm.ResourceName{ID: "www", Type: pkiadm.RTPrivateKey},
+		CSR:        pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCSR},
+		CA:         pkiadm.ResourceName{ID: "le", Type: pkiadm.RTCA},
+	}, res)
+	checkResult(t, "create certificate www", err, res)
+	job, err := s.jobs.Wait(res.Job, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != pkiadm.JSFailed {
+		t.Fatalf("expected the order to fail, got state %s", job.State)
+	}
+	st := showStatus(t, s, pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCertificate})
+	if !st.Failed() {
+		t.Errorf("failed order was not recorded: %+v", st)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	ETornAuditEntry = Error("incomplete entry at the end of the audit log")
+
+	// daemonCaller is the caller of the changes made by the daemon itself.
+	daemonCaller = "pkiadmd"
+)
+
+type (
+	// AuditLog is an append-only log of all changes to the storage. Every
+	// entry contains the hash of the one before, so that changed or removed
+	// entries are detected.
+	AuditLog struct {
+		mu   sync.Mutex
+		path string
+		file *os.File
+		seq  uint64
+		// last is the hash of the last entry.
+		last []byte
+		// recent contains the last entries for the watchers, which are woken
+		// up through appended.
+		recent   []pkiadm.AuditEntry
+		appended *sync.Cond
+	}
+
+	// auditCodec wraps the codec of a connection and records the changing
+	// requests with their outcome in the audit log.
+	auditCodec struct {
+		rpc.ServerCodec
+		server *Server
+		caller Caller
+		method string
+		reqSeq uint64
+
+		mu sync.Mutex
+		// pending maps the RPC sequence to the entry of the request.
+		pending map[uint64]*pkiadm.AuditEntry
+	}
+)
+
+// resourceTypes maps the resource part of the method names to the resource
+// types.
+var resourceTypes = map[string]pkiadm.ResourceType{
+	"PrivateKey":  pkiadm.RTPrivateKey,
+	"PublicKey":   pkiadm.RTPublicKey,
+	"CSR":         pkiadm.RTCSR,
+	"Certificate": pkiadm.RTCertificate,
+	"Location":    pkiadm.RTLocation,
+	"Serial":      pkiadm.RTSerial,
+	"Subject":     pkiadm.RTSubject,
+	"CA":          pkiadm.RTCA,
+	"CRL":         pkiadm.RTCRL,
+	"OCSP":        pkiadm.RTOCSP,
+	"Profile":     pkiadm.RTProfile,
+}
+
+// audited returns true for the requests changing the storage. Unlocking
+// only makes the private keys usable.
+func audited(method string) bool {
+	return method != "Unlock" && (journaled(method) || unjournaled[method])
+}
+
+// OpenAuditLog opens the audit log at path and continues the chain of its
+// entries. An entry torn by a crash is removed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	entries, offset, err := readAudit(path)
+	if err == ETornAuditEntry {
+		log.Printf("removing incomplete entry at the end of the audit log '%s'", path)
+		if err := os.Truncate(path, offset); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		// the log is kept as it is, so that the damage can be inspected
+		log.Printf("audit log '%s' is damaged: %s", path, err)
+	}
+	if v := pkiadm.VerifyAudit(entries); !v.Intact {
+		log.Printf("audit log '%s' is broken at entry %d: %s", path, v.Broken, v.Reason)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &AuditLog{path: path, file: file}
+	l.appended = sync.NewCond(&l.mu)
+	if len(entries) > 0 {
+		l.seq = entries[len(entries)-1].Seq
+		l.last = entries[len(entries)-1].Hash
+	}
+	if len(entries) > keepEvents {
+		entries = entries[len(entries)-keepEvents:]
+	}
+	l.recent = entries
+	return l, nil
+}
+
+// readAudit reads the entries of the audit log up to the first line, which
+// is not an entry. The offset after the last entry read is returned too.
+func readAudit(path string) ([]pkiadm.AuditEntry, int64, error) {
+	entries := []pkiadm.AuditEntry{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, 0, nil
+	} else if err != nil {
+		return entries, 0, err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	r := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if err == io.EOF && len(raw) == 0 {
+			return entries, offset, nil
+		} else if err != nil && err != io.EOF {
+			return entries, offset, err
+		}
+		entry := pkiadm.AuditEntry{}
+		if jsonErr := json.Unmarshal(raw, &entry); jsonErr != nil {
+			if err == io.EOF {
+				return entries, offset, ETornAuditEntry
+			}
+			return entries, offset, fmt.Errorf("line %d is not an entry: %s", line, jsonErr)
+		}
+		entries = append(entries, entry)
+		offset += int64(len(raw))
+	}
+}
+
+// Record appends the entry to the log. The sequence, time and hashes are set
+// by the log.
+func (l *AuditLog) Record(e pkiadm.AuditEntry) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = l.last
+	e.Hash = e.ComputeHash()
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = e.Seq
+	l.last = e.Hash
+	l.recent = append(l.recent, e)
+	if len(l.recent) > 2*keepEvents {
+		l.recent = append([]pkiadm.AuditEntry{}, l.recent[len(l.recent)-keepEvents:]...)
+	}
+	l.appended.Broadcast()
+	return nil
+}
+
+// record appends the entry and logs the failure, as a change can't be undone
+// when it could not be recorded.
+func (l *AuditLog) record(e pkiadm.AuditEntry) {
+	if err := l.Record(e); err != nil {
+		log.Printf("could not record '%s' of '%s' in the audit log: %s", e.Action, e.Resource, err)
+	}
+}
+
+// Entries returns all entries of the log.
+func (l *AuditLog) Entries() ([]pkiadm.AuditEntry, error) {
+	if l == nil {
+		return []pkiadm.AuditEntry{}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries, _, err := readAudit(l.path)
+	return entries, err
+}
+
+// Close closes the audit log.
+func (l *AuditLog) Close() error { return l.file.Close() }
+
+// auditRefresh records the refresh of the resource.
+func (s *Storage) auditRefresh(r Resource, old []byte, err error) {
+	entry := pkiadm.AuditEntry{
+		Caller:      daemonCaller,
+		Action:      "Refresh",
+		Resource:    r.Name(),
+		OldChecksum: old,
+		NewChecksum: r.Checksum(),
+	}
+	if err != nil {
+		entry.Outcome = pkiadm.AOFailed
+		entry.Error = err.Error()
+	}
+	s.audit.record(entry)
+}
+
+// auditedResource returns the resource changed by the request. The type is
+// taken from the method name, the id from the arguments or the resource they
+// contain.
+func auditedResource(method string, args interface{}) pkiadm.ResourceName {
+	rn := pkiadm.ResourceName{Type: pkiadm.RTUnknown}
+	for _, prefix := range changePrefixes {
+		if t, found := resourceTypes[strings.TrimPrefix(method, prefix)]; found {
+			rn.Type = t
+		}
+	}
+	v := reflect.Indirect(reflect.ValueOf(args))
+	if v.Kind() != reflect.Struct {
+		return rn
+	}
+	if id := v.FieldByName("ID"); id.Kind() == reflect.String && id.String() != "" {
+		rn.ID = id.String()
+		return rn
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Struct || !field.CanInterface() {
+			continue
+		}
+		if other, ok := field.Interface().(pkiadm.ResourceName); ok {
+			// revocations by serial only name the CA
+			if other.ID != "" {
+				return other
+			}
+			continue
+		}
+		if id := field.FieldByName("ID"); id.Kind() == reflect.String && id.String() != "" {
+			rn.ID = id.String()
+			return rn
+		}
+	}
+	return rn
+}
+
+// changedFields returns the field list of set requests.
+func changedFields(args interface{}) []string {
+	v := reflect.Indirect(reflect.ValueOf(args))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := v.FieldByName("FieldList")
+	if !fields.IsValid() {
+		return nil
+	}
+	res, _ := fields.Interface().([]string)
+	return res
+}
+
+// checksum returns the checksum of the resource or nil, when it doesn't exist.
+func (s *Server) checksum(rn pkiadm.ResourceName) []byte {
+	if rn.ID == "" {
+		return nil
+	}
+	s.lock()
+	defer s.unlock()
+	r, err := s.storage.Get(rn)
+	if err != nil {
+		return nil
+	}
+	return r.Checksum()
+}
+
+// auditJob records the outcome of the job continuing a request, when it is
+// finished.
+func (s *Server) auditJob(entry pkiadm.AuditEntry) {
+	for {
+		job, err := s.jobs.Wait(entry.Job, maxJobWait)
+		if err != nil {
+			log.Printf("could not record outcome of job %s in the audit log: %s", entry.Job, err)
+			return
+		}
+		if !job.Done() {
+			continue
+		}
+		entry.Outcome = pkiadm.AOSuccess
+		if job.State == pkiadm.JSFailed {
+			entry.Outcome = pkiadm.AOFailed
+			entry.Error = job.Error
+		}
+		break
+	}
+	entry.NewChecksum = s.checksum(entry.Resource)
+	s.storage.audit.record(entry)
+}
+
+func newAuditCodec(codec rpc.ServerCodec, server *Server, caller Caller) *auditCodec {
+	return &auditCodec{
+		ServerCodec: codec,
+		server:      server,
+		caller:      caller,
+		pending:     map[uint64]*pkiadm.AuditEntry{},
+	}
+}
+
+func (c *auditCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = strings.TrimPrefix(r.ServiceMethod, pkiadm.ProtoIdent+".")
+	c.reqSeq = r.Seq
+	return err
+}
+
+// ReadRequestBody records the checksum of the resource before the change.
+// Rejected requests are recorded too.
+func (c *auditCodec) ReadRequestBody(body interface{}) error {
+	err := c.ServerCodec.ReadRequestBody(body)
+	if body == nil || !audited(c.method) || (err != nil && err != pkiadm.EPermissionDenied) {
+		return err
+	}
+	entry := &pkiadm.AuditEntry{
+		Caller:   c.caller.String(),
+		Action:   c.method,
+		Resource: auditedResource(c.method, body),
+		Fields:   changedFields(body),
+	}
+	if err == nil {
+		entry.OldChecksum = c.server.checksum(entry.Resource)
+	}
+	c.mu.Lock()
+	c.pending[c.reqSeq] = entry
+	c.mu.Unlock()
+	return err
+}
+
+// WriteResponse records the outcome of the request.
+func (c *auditCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	entry, found := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	if !found {
+		return c.ServerCodec.WriteResponse(r, body)
+	}
+
+	res := resultOf(body)
+	switch {
+	case r.Error != "":
+		entry.Outcome = pkiadm.AOFailed
+		entry.Error = r.Error
+	case res != nil && res.HasError:
+		entry.Outcome = pkiadm.AOFailed
+		entry.Error = fmt.Sprintf("%s: %s", res.Message, res.Error)
+	case res != nil && res.Job != "":
+		entry.Outcome = pkiadm.AOQueued
+		entry.Job = res.Job
+	default:
+		entry.NewChecksum = c.server.checksum(entry.Resource)
+	}
+	c.server.storage.audit.record(*entry)
+	if entry.Outcome == pkiadm.AOQueued {
+		go c.server.auditJob(*entry)
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// ListAudit returns the entries of the audit log selected by the filter. It
+// doesn't wait for the storage.
+func (s *Server) ListAudit(filter pkiadm.AuditFilter, res *pkiadm.ResultAudit) error {
+	entries, err := s.storage.audit.Entries()
+	if err != nil {
+		res.Result.SetError(err, "Could not read audit log")
+		return nil
+	}
+	res.Entries = []pkiadm.AuditEntry{}
+	for _, e := range entries {
+		if filter.Match(e) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return nil
+}
+
+// VerifyAudit checks the chain of the whole audit log.
+func (s *Server) VerifyAudit(filter pkiadm.Filter, res *pkiadm.ResultAuditVerification) error {
+	entries, err := s.storage.audit.Entries()
+	res.Verification = pkiadm.VerifyAudit(entries)
+	if err != nil && res.Verification.Intact {
+		// the chain ends in a line, which is not an entry
+		res.Verification.Intact = false
+		res.Verification.Broken = uint64(len(entries)) + 1
+		res.Verification.Reason = err.Error()
+	}
+	return nil
+}
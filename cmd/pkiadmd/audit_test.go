@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// recordAudit opens the audit log at path and records an entry for each of
+// the subjects.
+func recordAudit(t *testing.T, path string, ids ...string) {
+	l, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("could not open audit log: %s", err)
+	}
+	defer l.Close()
+	for _, id := range ids {
+		err := l.Record(pkiadm.AuditEntry{
+			Caller:   "user 'test'",
+			Action:   "CreateSubject",
+			Resource: pkiadm.ResourceName{ID: id, Type: pkiadm.RTSubject},
+		})
+		if err != nil {
+			t.Fatalf("could not record '%s': %s", id, err)
+		}
+	}
+}
+
+// readAuditLines returns the lines of the audit log.
+func readAuditLines(t *testing.T, path string) [][]byte {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	return lines[:len(lines)-1]
+}
+
+// checkAudit reads the audit log and checks that it contains an intact chain
+// of count entries.
+func checkAudit(t *testing.T, path string, count int) []pkiadm.AuditEntry {
+	entries, _, err := readAudit(path)
+	if err != nil {
+		t.Fatalf("could not read audit log: %s", err)
+	}
+	if len(entries) != count {
+		t.Fatalf("expected %d entries, got %d", count, len(entries))
+	}
+	if v := pkiadm.VerifyAudit(entries); !v.Intact || v.Entries != count {
+		t.Fatalf("expected intact chain of %d entries, got %+v", count, v)
+	}
+	return entries
+}
+
+// TestAuditReopen checks that the chain continues, when the log is opened
+// again.
+func TestAuditReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	recordAudit(t, path, "a", "b")
+	recordAudit(t, path, "c")
+
+	entries := checkAudit(t, path, 3)
+	if entries[2].Seq != 3 || !bytes.Equal(entries[2].Prev, entries[1].Hash) {
+		t.Errorf("entry after reopen doesn't continue the chain: %+v", entries[2])
+	}
+}
+
+// TestAuditTornTail checks that an incomplete entry at the end of the log is
+// removed and the chain continues after it.
+func TestAuditTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	recordAudit(t, path, "a", "b")
+	intact, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte(`{"Seq":3,"Caller":"user 'te`)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, _, err := readAudit(path); err != ETornAuditEntry {
+		t.Fatalf("expected %s, got %v", ETornAuditEntry, err)
+	}
+	l, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("could not open audit log: %s", err)
+	}
+	l.Close()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, intact) {
+		t.Fatalf("torn entry was not removed:\n%s", raw)
+	}
+
+	recordAudit(t, path, "c")
+	entries := checkAudit(t, path, 3)
+	if entries[2].Resource.ID != "c" {
+		t.Errorf("expected entry of 'c', got '%s'", entries[2].Resource.ID)
+	}
+}
+
+// TestAuditTampered checks that changed and removed entries in the middle of
+// the log are detected.
+func TestAuditTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, lines [][]byte) [][]byte
+		broken uint64
+	}{
+		{"modified", func(t *testing.T, lines [][]byte) [][]byte {
+			entry := pkiadm.AuditEntry{}
+			if err := json.Unmarshal(lines[1], &entry); err != nil {
+				t.Fatal(err)
+			}
+			entry.Caller = "user 'other'"
+			raw, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[1] = append(raw, '\n')
+			return lines
+		}, 2},
+		{"removed", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, 3},
+		{"rehashed", func(t *testing.T, lines [][]byte) [][]byte {
+			// recomputing the hash of the changed entry breaks the next one
+			entry := pkiadm.AuditEntry{}
+			if err := json.Unmarshal(lines[1], &entry); err != nil {
+				t.Fatal(err)
+			}
+			entry.Caller = "user 'other'"
+			entry.Hash = entry.ComputeHash()
+			raw, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[1] = append(raw, '\n')
+			return lines
+		}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			recordAudit(t, path, "a", "b", "c", "d")
+			lines := test.change(t, readAuditLines(t, path))
+			if err := ioutil.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, _, err := readAudit(path)
+			if err != nil {
+				t.Fatalf("could not read audit log: %s", err)
+			}
+			v := pkiadm.VerifyAudit(entries)
+			if v.Intact || v.Broken != test.broken {
+				t.Errorf("expected chain broken at %d, got %+v", test.broken, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+const (
+	EUnknownRole = Error("unknown role")
+)
+
+const (
+	// RoleNone can't call any method.
+	RoleNone Role = iota
+	// RoleReadOnly can list and show resources.
+	RoleReadOnly
+	// RoleOperator can additionally create, change and refresh resources
+	// and issue certificates.
+	RoleOperator
+	// RoleAdmin can additionally delete resources, change CAs and manage the
+	// master key.
+	RoleAdmin
+)
+
+type (
+	// Role defines the methods a caller may call. Every role includes the
+	// roles below it.
+	Role uint
+
+	// Caller is the identity of the other end of a connection.
+	Caller struct {
+		// Users contains the uid and name of a local caller.
+		Users []string
+		// Groups contains the ids and names of all groups of a local caller.
+		Groups []string
+		// Subject is the subject of the certificate of a remote caller.
+		Subject string
+	}
+
+	// Policy maps the callers to their roles. A caller gets the highest role
+	// of all entries matching it.
+	Policy struct {
+		// Default is the role of callers not matching any entry.
+		Default Role
+		// Users maps uids or user names to roles.
+		Users map[string]Role
+		// Groups maps gids or group names to roles.
+		Groups map[string]Role
+		// Subjects maps certificate subjects, e.g. 'CN=admin,O=Example', to
+		// roles.
+		Subjects map[string]Role
+	}
+
+	// authCodec wraps the codec of a connection and rejects the requests the
+	// caller is not allowed to make.
+	authCodec struct {
+		rpc.ServerCodec
+		caller Caller
+		role   Role
+		method string
+		reqSeq uint64
+
+		mu sync.Mutex
+		// denied maps the RPC sequence of rejected requests to the method.
+		denied map[uint64]string
+	}
+)
+
+// readOnlyPrefixes are the prefixes of the methods, which don't change
+// anything.
+var readOnlyPrefixes = []string{"List", "Show", "Find", "History", "Status", "Plan", "Wait", "Verify", "Watch"}
+
+// adminMethods contains the changing methods, which need the admin role in
+// addition to the delete methods.
+var adminMethods = map[string]bool{
+	"CreateCA": true,
+	"SetCA":    true,
+	"ImportCA": true,
+	"Unlock":   true,
+	"Rekey":    true,
+}
+
+// requiredRole returns the role needed to call the method. Unknown methods
+// need the admin role.
+func requiredRole(method string) Role {
+	if adminMethods[method] || strings.HasPrefix(method, "Delete") {
+		return RoleAdmin
+	}
+	if journaled(method) || unjournaled[method] {
+		return RoleOperator
+	}
+	for _, prefix := range readOnlyPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return RoleReadOnly
+		}
+	}
+	return RoleAdmin
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleNone:
+		return "none"
+	case RoleReadOnly:
+		return "read-only"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+func (r Role) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *Role) UnmarshalText(raw []byte) error {
+	for _, role := range []Role{RoleNone, RoleReadOnly, RoleOperator, RoleAdmin} {
+		if role.String() == string(raw) {
+			*r = role
+			return nil
+		}
+	}
+	return errors.Wrapf(EUnknownRole, "'%s'", raw)
+}
+
+func (c Caller) String() string {
+	if c.Subject != "" {
+		return fmt.Sprintf("subject '%s'", c.Subject)
+	}
+	if len(c.Users) > 0 {
+		return fmt.Sprintf("user '%s'", strings.Join(c.Users, "/"))
+	}
+	return "unknown caller"
+}
+
+// LoadPolicy reads the policy from the JSON file at path.
+func LoadPolicy(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, errors.Wrapf(err, "could not parse policy '%s'", path)
+	}
+	return p, nil
+}
+
+// Role returns the highest role of all entries matching the caller. Without a
+// policy, every caller is admin.
+func (p *Policy) Role(c Caller) Role {
+	if p == nil {
+		return RoleAdmin
+	}
+	role := p.Default
+	raise := func(roles map[string]Role, keys ...string) {
+		for _, key := range keys {
+			if r, found := roles[key]; found && r > role {
+				role = r
+			}
+		}
+	}
+	raise(p.Users, c.Users...)
+	raise(p.Groups, c.Groups...)
+	if c.Subject != "" {
+		raise(p.Subjects, c.Subject)
+	}
+	return role
+}
+
+// identify returns the caller on the other end of the connection. Local
+// callers are identified by the credentials of their process, remote callers
+// by their certificate.
+func identify(conn net.Conn) (Caller, error) {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.Handshake(); err != nil {
+			return Caller{}, err
+		}
+		certs := c.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return Caller{}, errors.Errorf("no client certificate")
+		}
+		return Caller{Subject: certs[0].Subject.String()}, nil
+	case *net.UnixConn:
+		uid, gid, err := peerCredentials(c)
+		if err != nil {
+			return Caller{}, err
+		}
+		return localCaller(uid, gid), nil
+	default:
+		return Caller{}, errors.Errorf("can't identify callers on %s connections", conn.LocalAddr().Network())
+	}
+}
+
+// localCaller returns the caller with the uid and gid and adds the names and
+// supplementary groups known to the system.
+func localCaller(uid, gid uint32) Caller {
+	c := Caller{
+		Users:  []string{strconv.FormatUint(uint64(uid), 10)},
+		Groups: []string{strconv.FormatUint(uint64(gid), 10)},
+	}
+	if u, err := user.LookupId(c.Users[0]); err == nil {
+		c.Users = append(c.Users, u.Username)
+		if gids, err := u.GroupIds(); err == nil {
+			for _, id := range gids {
+				if id != c.Groups[0] {
+					c.Groups = append(c.Groups, id)
+				}
+			}
+		}
+	}
+	ids := c.Groups
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			c.Groups = append(c.Groups, g.Name)
+		}
+	}
+	return c
+}
+
+// newAuthCodec wraps the codec, so that the caller can only call the methods
+// allowed by the policy.
+func newAuthCodec(codec rpc.ServerCodec, caller Caller, policy *Policy) *authCodec {
+	return &authCodec{
+		ServerCodec: codec,
+		caller:      caller,
+		role:        policy.Role(caller),
+		denied:      map[uint64]string{},
+	}
+}
+
+func (c *authCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = strings.TrimPrefix(r.ServiceMethod, pkiadm.ProtoIdent+".")
+	c.reqSeq = r.Seq
+	return err
+}
+
+// ReadRequestBody consumes the body of rejected requests and returns an error,
+// so that the method is not called.
+func (c *authCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	// requests for unknown methods are rejected by the rpc server
+	if body == nil || c.role >= requiredRole(c.method) {
+		return nil
+	}
+	log.Printf("denied '%s' to %s with role '%s'", c.method, c.caller, c.role)
+	c.mu.Lock()
+	c.denied[c.reqSeq] = c.method
+	c.mu.Unlock()
+	return pkiadm.EPermissionDenied
+}
+
+// WriteResponse answers rejected requests with a result containing
+// EPermissionDenied, so that clients can tell them from other errors.
+func (c *authCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	method, found := c.denied[r.Seq]
+	delete(c.denied, r.Seq)
+	c.mu.Unlock()
+	if found {
+		msg := fmt.Sprintf("%s with role '%s' is not allowed to call '%s'", c.caller, c.role, method)
+		if reply := deniedReply(method, msg); reply != nil {
+			r.Error = ""
+			body = reply
+		}
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// deniedReply returns a new reply of the method with the permission error set
+// in its result. When the reply has no result, nil is returned.
+func deniedReply(method, msg string) interface{} {
+	m, found := serverType.MethodByName(method)
+	if !found || m.Type.NumIn() != 3 {
+		return nil
+	}
+	reply := reflect.New(m.Type.In(2).Elem()).Interface()
+	res := resultOf(reply)
+	if res == nil {
+		return nil
+	}
+	res.SetError(pkiadm.EPermissionDenied, msg)
+	return reply
+}
+
+// resultOf returns the result of the reply, which is either the reply itself
+// or its Result field. When the reply has no result, nil is returned.
+func resultOf(reply interface{}) *pkiadm.Result {
+	if res, ok := reply.(*pkiadm.Result); ok {
+		return res
+	}
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	field := v.Elem().FieldByName("Result")
+	if !field.IsValid() {
+		return nil
+	}
+	res, _ := field.Addr().Interface().(*pkiadm.Result)
+	return res
+}
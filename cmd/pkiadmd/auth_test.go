@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// readOnlyMethods contains all methods of the server, which don't change
+// anything. A method not in this list must never be callable with the
+// read-only role.
+var readOnlyMethods = map[string]bool{
+	"List":                   true,
+	"ListAudit":              true,
+	"ListCA":                 true,
+	"ListCRL":                true,
+	"ListCSR":                true,
+	"ListCertificate":        true,
+	"ListJobs":               true,
+	"ListLocation":           true,
+	"ListOCSP":               true,
+	"ListPrivateKey":         true,
+	"ListProfile":            true,
+	"ListPublicKey":          true,
+	"ListSerial":             true,
+	"ListSubjects":           true,
+	"ShowCA":                 true,
+	"ShowCRL":                true,
+	"ShowCSR":                true,
+	"ShowCertificate":        true,
+	"ShowCertificateVersion": true,
+	"ShowLocation":           true,
+	"ShowOCSP":               true,
+	"ShowPrivateKey":         true,
+	"ShowProfile":            true,
+	"ShowPublicKey":          true,
+	"ShowSerial":             true,
+	"ShowStatus":             true,
+	"ShowSubject":            true,
+	"FindCertificate":        true,
+	"HistoryCertificate":     true,
+	"PlanRefresh":            true,
+	"Status":                 true,
+	"VerifyAudit":            true,
+	"WaitJob":                true,
+	"Watch":                  true,
+}
+
+// TestRequiredRoleServerMethods checks the role of every method of the
+// server, so that new changing methods can't be called by read-only callers.
+func TestRequiredRoleServerMethods(t *testing.T) {
+	server := &Server{}
+	typ := reflect.TypeOf(server)
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		role := requiredRole(name)
+		switch {
+		case readOnlyMethods[name] && role != RoleReadOnly:
+			t.Errorf("%s: expected role %s, got %s", name, RoleReadOnly, role)
+		case !readOnlyMethods[name] && role < RoleOperator:
+			t.Errorf("%s: changing method needs at least role %s, got %s", name, RoleOperator, role)
+		}
+	}
+	for name := range readOnlyMethods {
+		if _, found := typ.MethodByName(name); !found {
+			t.Errorf("read-only method %s does not exist", name)
+		}
+	}
+}
+
+// TestRequiredRole checks the role resolution by name and prefix.
+func TestRequiredRole(t *testing.T) {
+	tests := []struct {
+		method   string
+		expected Role
+	}{
+		{"ListCertificate", RoleReadOnly},
+		{"ShowSomething", RoleReadOnly},
+		{"WaitJob", RoleReadOnly},
+		{"CreateCertificate", RoleOperator},
+		{"SetSerial", RoleOperator},
+		{"ImportPrivateKey", RoleOperator},
+		{"RevokeCertificate", RoleOperator},
+		{"RollbackCertificate", RoleOperator},
+		{"CreateCA", RoleAdmin},
+		{"SetCA", RoleAdmin},
+		{"ImportCA", RoleAdmin},
+		{"DeleteSubject", RoleAdmin},
+		{"DeleteSomething", RoleAdmin},
+		{"Unlock", RoleAdmin},
+		{"Rekey", RoleAdmin},
+		{"Frobnicate", RoleAdmin},
+		{"", RoleAdmin},
+	}
+	for _, test := range tests {
+		if role := requiredRole(test.method); role != test.expected {
+			t.Errorf("%s: expected role %s, got %s", test.method, test.expected, role)
+		}
+	}
+}
+
+// TestPolicyRole checks that callers get the highest role of all matching
+// entries.
+func TestPolicyRole(t *testing.T) {
+	policy := &Policy{
+		Default: RoleReadOnly,
+		Users: map[string]Role{
+			"1000":   RoleOperator,
+			"backup": RoleNone,
+			"root":   RoleAdmin,
+		},
+		Groups: map[string]Role{
+			"100":   RoleNone,
+			"pki":   RoleOperator,
+			"wheel": RoleAdmin,
+		},
+		Subjects: map[string]Role{
+			"":                   RoleAdmin,
+			"CN=admin,O=Example": RoleAdmin,
+			"CN=web,O=Example":   RoleNone,
+		},
+	}
+	tests := []struct {
+		name     string
+		policy   *Policy
+		caller   Caller
+		expected Role
+	}{
+		{"no policy", nil, Caller{}, RoleAdmin},
+		{"unknown caller", policy, Caller{}, RoleReadOnly},
+		{"unknown user", policy, Caller{Users: []string{"1001", "guest"}, Groups: []string{"1001"}}, RoleReadOnly},
+		{"user by uid", policy, Caller{Users: []string{"1000", "dev"}}, RoleOperator},
+		{"user by name", policy, Caller{Users: []string{"0", "root"}}, RoleAdmin},
+		{"group", policy, Caller{Users: []string{"1001"}, Groups: []string{"1001", "pki"}}, RoleOperator},
+		{"group beats user", policy, Caller{Users: []string{"1000"}, Groups: []string{"wheel"}}, RoleAdmin},
+		{"user beats group", policy, Caller{Users: []string{"root"}, Groups: []string{"pki"}}, RoleAdmin},
+		{"lower entries don't lower default", policy, Caller{Users: []string{"backup"}, Groups: []string{"100"}}, RoleReadOnly},
+		{"subject", policy, Caller{Subject: "CN=admin,O=Example"}, RoleAdmin},
+		{"unknown subject", policy, Caller{Subject: "CN=other,O=Example"}, RoleReadOnly},
+		{"subject below default", policy, Caller{Subject: "CN=web,O=Example"}, RoleReadOnly},
+		{"empty subject", &Policy{Subjects: map[string]Role{"": RoleAdmin}}, Caller{Users: []string{"1000"}}, RoleNone},
+	}
+	for _, test := range tests {
+		if role := test.policy.Role(test.caller); role != test.expected {
+			t.Errorf("%s: expected role %s, got %s", test.name, test.expected, role)
+		}
+	}
+}
+
+// TestAuthCodecDenied sends requests through the codecs of a connection and
+// checks that the denied request is answered with EPermissionDenied without
+// reaching the server.
+func TestAuthCodecDenied(t *testing.T) {
+	s, _ := newTestServer(t)
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName(pkiadm.ProtoIdent, s); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	caller := Caller{Users: []string{"1000", "dev"}}
+	go rpcServer.ServeCodec(s.wrapCodec(newGobServerCodec(serverConn), caller, &Policy{Default: RoleReadOnly}))
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	res := &pkiadm.Result{}
+	subject := pkiadm.Subject{ID: "web", Name: pkix.Name{CommonName: "web"}}
+	if err := client.Call(pkiadm.ProtoIdent+".CreateSubject", subject, res); err != nil {
+		t.Fatalf("expected the denial in the result, got: %s", err)
+	}
+	if !res.HasError || res.Error != pkiadm.EPermissionDenied {
+		t.Fatalf("expected %s, got %+v", pkiadm.EPermissionDenied, res)
+	}
+
+	// the connection is still usable for allowed requests
+	list := &pkiadm.ResultSubjects{}
+	if err := client.Call(pkiadm.ProtoIdent+".ListSubjects", pkiadm.Filter{}, list); err != nil {
+		t.Fatalf("could not list subjects: %s", err)
+	}
+	if list.Result.HasError {
+		t.Fatalf("could not list subjects: %s", list.Result.Error)
+	}
+	if len(list.Subjects) != 0 {
+		t.Errorf("denied request created subjects %+v", list.Subjects)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	EUnknownBackend = Error("unknown storage backend")
+
+	// BackendJSON stores all resources in a single JSON file.
+	BackendJSON = "json"
+	// BackendBolt stores every resource as its own entry in a bbolt database.
+	BackendBolt = "bolt"
+
+	// bucketSettings contains the records, which are not resources.
+	bucketSettings   = "Settings"
+	settingMasterKey = "MasterKey"
+)
+
+type (
+	// Backend persists the resources of the storage. Every resource is stored
+	// as a record in the bucket of its type.
+	Backend interface {
+		// Load returns all records by bucket and id.
+		Load() (map[string]map[string][]byte, error)
+		// Write applies all changes at once. Records without data get
+		// deleted.
+		Write(changes []Record) error
+		// Backup writes a consistent copy of the storage to the path.
+		Backup(path string) error
+		// Close releases the resources of the backend.
+		Close() error
+	}
+
+	// Record is a single resource in its serialized form.
+	Record struct {
+		Bucket string
+		ID     string
+		Data   []byte
+	}
+
+	// JSONBackend keeps all records in one JSON file, which is replaced on
+	// every change.
+	JSONBackend struct {
+		path string
+		data map[string]map[string]json.RawMessage
+	}
+
+	// BoltBackend keeps the records in a bbolt database with one bucket per
+	// resource type. Changes are written in a single transaction.
+	BoltBackend struct {
+		db *bolt.DB
+	}
+)
+
+// OpenBackend opens the storage backend of the type at the path. An empty type
+// selects the JSON file.
+func OpenBackend(backendType, path string) (Backend, error) {
+	switch backendType {
+	case BackendJSON, "":
+		return NewJSONBackend(path)
+	case BackendBolt:
+		return NewBoltBackend(path)
+	default:
+		return nil, errors.Wrapf(EUnknownBackend, "type '%s'", backendType)
+	}
+}
+
+// NewJSONBackend reads the JSON file at the path. A missing file results in an
+// empty backend.
+func NewJSONBackend(path string) (*JSONBackend, error) {
+	b := &JSONBackend{
+		path: path,
+		data: map[string]map[string]json.RawMessage{},
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	top := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return nil, err
+	}
+	for bucket, content := range top {
+		records := map[string]json.RawMessage{}
+		if err := json.Unmarshal(content, &records); err != nil {
+			return nil, errors.Wrapf(err, "could not parse '%s'", bucket)
+		}
+		b.data[bucket] = records
+	}
+	// older versions stored the master key next to the resources
+	if mk, found := b.data["MasterKey"]; found {
+		delete(b.data, "MasterKey")
+		raw, err := json.Marshal(mk)
+		if err != nil {
+			return nil, err
+		}
+		if b.data[bucketSettings] == nil {
+			b.data[bucketSettings] = map[string]json.RawMessage{}
+		}
+		b.data[bucketSettings][settingMasterKey] = raw
+	}
+	return b, nil
+}
+
+func (b *JSONBackend) Load() (map[string]map[string][]byte, error) {
+	res := map[string]map[string][]byte{}
+	for bucket, records := range b.data {
+		res[bucket] = map[string][]byte{}
+		for id, raw := range records {
+			res[bucket][id] = []byte(raw)
+		}
+	}
+	return res, nil
+}
+
+func (b *JSONBackend) Write(changes []Record) error {
+	for _, rec := range changes {
+		if rec.Data == nil {
+			delete(b.data[rec.Bucket], rec.ID)
+			continue
+		}
+		if b.data[rec.Bucket] == nil {
+			b.data[rec.Bucket] = map[string]json.RawMessage{}
+		}
+		b.data[rec.Bucket][rec.ID] = json.RawMessage(rec.Data)
+	}
+	return b.Backup(b.path)
+}
+
+func (b *JSONBackend) Backup(path string) error {
+	raw, err := json.MarshalIndent(b.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, raw, 0600)
+}
+
+func (b *JSONBackend) Close() error { return nil }
+
+// writeFileAtomic replaces the file at the path with the data. The data is
+// written to a temporary file first, which is then renamed, so that a crash
+// leaves either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// NewBoltBackend opens or creates the bbolt database at the path.
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open database '%s'", path)
+	}
+	return &BoltBackend{db}, nil
+}
+
+func (b *BoltBackend) Load() (map[string]map[string][]byte, error) {
+	res := map[string]map[string][]byte{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			records := map[string][]byte{}
+			res[string(name)] = records
+			return bucket.ForEach(func(id, data []byte) error {
+				// the data is only valid during the transaction
+				records[string(id)] = append([]byte{}, data...)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (b *BoltBackend) Write(changes []Record) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, rec := range changes {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(rec.Bucket))
+			if err != nil {
+				return err
+			}
+			if rec.Data == nil {
+				err = bucket.Delete([]byte(rec.ID))
+			} else {
+				err = bucket.Put([]byte(rec.ID), rec.Data)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "could not write '%s/%s'", rec.Bucket, rec.ID)
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) Backup(path string) error {
+	buf := &bytes.Buffer{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0600)
+}
+
+func (b *BoltBackend) Close() error { return b.db.Close() }
+
+// migrate copies all records from one backend into the other.
+func migrate(from, to Backend) error {
+	data, err := from.Load()
+	if err != nil {
+		return errors.Wrap(err, "could not load source")
+	}
+	changes := []Record{}
+	for bucket, records := range data {
+		for id, raw := range records {
+			changes = append(changes, Record{Bucket: bucket, ID: id, Data: raw})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Bucket != changes[j].Bucket {
+			return changes[i].Bucket < changes[j].Bucket
+		}
+		return changes[i].ID < changes[j].ID
+	})
+	if err := to.Write(changes); err != nil {
+		return errors.Wrap(err, "could not write destination")
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	ENoGoodBackup = Error("no usable backup found")
+
+	backupTimeFormat = "20060102T150405"
+	// defaultBackups is the number of backups kept, when none is configured.
+	defaultBackups        = 5
+	defaultBackupInterval = time.Hour
+)
+
+type (
+	// Backups keeps a rolling set of timestamped copies of the storage next
+	// to it.
+	Backups struct {
+		path     string
+		keep     int
+		interval time.Duration
+		last     time.Time
+	}
+)
+
+// NewBackups creates the backup rotation for the storage at the path, taking
+// a backup at most once per interval and keeping the newest ones. When keep
+// is negative, no backups are taken.
+func NewBackups(path string, keep int, interval time.Duration) *Backups {
+	if keep == 0 {
+		keep = defaultBackups
+	}
+	if interval <= 0 {
+		interval = defaultBackupInterval
+	}
+	b := &Backups{path: path, keep: keep, interval: interval}
+	if names := b.list(); len(names) > 0 {
+		b.last, _ = b.timeOf(names[len(names)-1])
+	}
+	return b
+}
+
+// list returns the names of all backups from the oldest to the newest.
+func (b *Backups) list() []string {
+	names, _ := filepath.Glob(b.path + ".*.bak")
+	valid := []string{}
+	for _, name := range names {
+		if _, err := b.timeOf(name); err == nil {
+			valid = append(valid, name)
+		}
+	}
+	sort.Strings(valid)
+	return valid
+}
+
+// timeOf returns the time the backup was taken.
+func (b *Backups) timeOf(name string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, b.path+"."), ".bak")
+	return time.ParseInLocation(backupTimeFormat, stamp, time.UTC)
+}
+
+// Take writes a new backup of the backend, when the last one is older than
+// the interval, and removes the oldest backups.
+func (b *Backups) Take(backend Backend) error {
+	if b == nil || b.keep < 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	if now.Sub(b.last) < b.interval {
+		return nil
+	}
+	name := fmt.Sprintf("%s.%s.bak", b.path, now.Format(backupTimeFormat))
+	if err := backend.Backup(name); err != nil {
+		return errors.Wrapf(err, "could not write backup '%s'", name)
+	}
+	b.last = now
+	names := b.list()
+	for len(names) > b.keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// NewestGood returns the newest backup, which can be loaded with the backend
+// type.
+func (b *Backups) NewestGood(backendType string) (string, error) {
+	names := b.list()
+	for i := len(names) - 1; i >= 0; i-- {
+		backend, err := OpenBackend(backendType, names[i])
+		if err != nil {
+			log.Printf("backup '%s' is not usable: %s", names[i], err)
+			continue
+		}
+		_, err = backend.Load()
+		backend.Close()
+		if err != nil {
+			log.Printf("backup '%s' is not usable: %s", names[i], err)
+			continue
+		}
+		return names[i], nil
+	}
+	return "", ENoGoodBackup
+}
+
+// Restore replaces the storage with the backup. The replaced storage is kept
+// next to it with the suffix '.corrupt'.
+func (b *Backups) Restore(name string) error {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(b.path); err == nil {
+		if err := os.Rename(b.path, b.path+".corrupt"); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(b.path, raw, 0600)
+}
+
+// restoreCommand replaces a corrupted storage with a backup.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadmd restore")
+		fmt.Print(`
+Replace the storage from the config with a backup. When no backup is given, the newest one which can be loaded is used. The replaced storage is kept with the suffix '.corrupt'. The daemon must not be running.
+`)
+		fs.PrintDefaults()
+	}
+	name := fs.String("backup", "", "the backup to restore")
+	fs.Parse(args)
+
+	cfg, err := pkiadm.LoadConfig()
+	if err != nil {
+		log.Printf("could not load config: %s", err)
+		return 2
+	}
+	backups := NewBackups(cfg.Storage, cfg.Backups, 0)
+	if *name == "" {
+		*name, err = backups.NewestGood(cfg.StorageType)
+		if err != nil {
+			log.Printf("could not find backup of '%s': %s", cfg.Storage, err)
+			return 1
+		}
+	}
+	if err := backups.Restore(*name); err != nil {
+		log.Printf("could not restore '%s': %s", *name, err)
+		return 1
+	}
+	log.Printf("restored '%s' from '%s'", cfg.Storage, *name)
+	return 0
+}
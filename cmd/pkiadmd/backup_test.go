@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestNewestGood checks that corrupted backups are skipped and the newest
+// loadable one is returned.
+func TestNewestGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	backups := NewBackups(path, 0, 0)
+	if _, err := backups.NewestGood(BackendJSON); err != ENoGoodBackup {
+		t.Fatalf("expected %s without backups, got %v", ENoGoodBackup, err)
+	}
+
+	files := map[string]string{
+		"20240101T000000": `{"subject": {"old": {}}}`,
+		"20240102T000000": `{"subject": {"good": {}}}`,
+		"20240103T000000": `{"subject": {"cut`,
+	}
+	for stamp, raw := range files {
+		if err := ioutil.WriteFile(path+"."+stamp+".bak", []byte(raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not a backup of the storage
+	if err := ioutil.WriteFile(path+".latest.bak", []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := backups.NewestGood(BackendJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != path+".20240102T000000.bak" {
+		t.Errorf("expected the backup of 2024-01-02, got '%s'", name)
+	}
+}
@@ -1,13 +1,33 @@
 package main
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
 	"log"
+	"math/big"
+	"time"
 
 	"github.com/gibheer/pki"
 	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+const (
+	EAlreadyRevoked  = Error("certificate is already revoked")
+	ENotOnHold       = Error("certificate is not on hold")
+	ENeedCertificate = Error("the certificate is needed to revoke it")
+	ENotIssuedByCA   = Error("certificate was not issued by the CA")
+	ENotACACert      = Error("certificate is not a CA certificate")
 )
 
 var (
+	oidBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+
 	CASelfSign = &CA{
 		ID:   "self-sign",
 		Type: pkiadm.CALocal,
@@ -23,64 +43,288 @@ type (
 		Type        pkiadm.CAType
 		Certificate pkiadm.ResourceName
 		Interval    Interval
+
+		// ACME contains the settings for CAs of type LetsEncrypt.
+		ACME ACMESettings
+		// ACMEServer contains the settings for issuing certificates through
+		// the built-in ACME directory.
+		ACMEServer ACMEServerSettings
+		// Revocations contains all certificates revoked by this CA.
+		Revocations []Revocation
+	}
+
+	// Revocation records a certificate revoked by the CA.
+	Revocation struct {
+		// Serial is the serial number of the certificate in hex.
+		Serial string
+		// Certificate is the id of the certificate resource, if known.
+		Certificate string
+		RevokedAt   time.Time
+		// NotAfter is the end of the validity of the certificate. When it is
+		// reached, the certificate does not need to be listed in the CRL anymore.
+		NotAfter time.Time
+		Reason   pkiadm.RevocationReason
+	}
+
+	// SignOptions contains the settings applied to a certificate when it gets
+	// signed.
+	SignOptions struct {
+		SerialNumber *big.Int
+		NotBefore    time.Time
+		NotAfter     time.Time
+		IsCA         bool
+		KeyUsage     x509.KeyUsage
+		ExtKeyUsage  []x509.ExtKeyUsage
+		// MaxPathLen is the maximum number of intermediate CAs for CA
+		// certificates. A negative value means no limit, 0 only limits when
+		// MaxPathLenZero is set.
+		MaxPathLen     int
+		MaxPathLenZero bool
+		// NonCriticalPathLen marks the basic constraints as non critical.
+		NonCriticalPathLen bool
+		PolicyIdentifiers  []asn1.ObjectIdentifier
+		// The following URLs are added as CRL distribution points and
+		// authority information access.
+		CRLDistributionPoints []string
+		OCSPServer            []string
+		IssuingCertificateURL []string
 	}
 )
 
-func NewCA(id string, caType pkiadm.CAType, cert pkiadm.ResourceName) (*CA, error) {
+func NewCA(id string, caType pkiadm.CAType, cert pkiadm.ResourceName, acme ACMESettings, acmeServer ACMEServerSettings) (*CA, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	switch caType {
+	case pkiadm.CALocal, pkiadm.CALetsEncrypt:
+	default:
+		return nil, EUnknownType
+	}
 	ca := &CA{
 		ID:          id,
 		Type:        caType,
 		Certificate: cert,
+		ACME:        acme,
+		ACMEServer:  acmeServer,
 	}
 	return ca, nil
 }
 
-// Sign the certificate sign request with this CA
-func (ca *CA) Sign(lookup *Storage, csr pkiadm.ResourceName, opts pki.CertificateOptions) (*pki.Certificate, error) {
-	var caCert *pki.Certificate
-	var pk pki.PrivateKey
-	var caCertDef *Certificate
-
+// Sign the certificate sign request with this CA. The result is the PEM
+// encoded certificate, followed by the chain if the CA provided one.
+func (ca *CA) Sign(lookup *Storage, csr pkiadm.ResourceName, opts SignOptions) ([]byte, error) {
 	csrRes, err := lookup.GetCSR(csr)
 	if err != nil {
 		return nil, err
 	}
+	if ca.Type == pkiadm.CALetsEncrypt {
+		// ACME directories are asked in a job, see Certificate.order
+		return nil, EWrongType
+	}
+
 	csrIns, err := csrRes.GetCSR()
 	if err != nil {
 		return nil, err
 	}
+	if ca != CASelfSign {
+		return ca.SignRequest(lookup, csrIns, opts)
+	}
+
+	pkDef, err := lookup.GetPrivateKey(csrRes.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := pkDef.GetSigner()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ca '%s' signing csr '%s' using cert '%s'", ca.ID, csr.ID, "self-signed")
+	return signToPem(csrIns, signer, opts, nil)
+}
+
+// SignRequest signs the certificate sign request with the certificate and
+// private key of a local CA.
+func (ca *CA) SignRequest(lookup *Storage, csr *pki.CertificateRequest, opts SignOptions) ([]byte, error) {
+	caCert, signer, err := ca.signer(lookup)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ca '%s' signing request for '%s' using cert '%s'", ca.ID, csr.Subject.CommonName, ca.Certificate.ID)
+	return signToPem(csr, signer, opts, caCert)
+}
+
+// signToPem creates the certificate and returns it PEM encoded. Without a CA
+// certificate, the certificate is self signed.
+func signToPem(csr *pki.CertificateRequest, signer crypto.Signer, opts SignOptions, caCert *x509.Certificate) ([]byte, error) {
+	request := (*x509.CertificateRequest)(csr)
+	if err := request.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "signature of the certificate sign request is invalid")
+	}
+	template := &x509.Certificate{
+		SerialNumber:   opts.SerialNumber,
+		Subject:        request.Subject,
+		DNSNames:       request.DNSNames,
+		EmailAddresses: request.EmailAddresses,
+		IPAddresses:    request.IPAddresses,
+		URIs:           request.URIs,
+		NotBefore:      opts.NotBefore,
+		NotAfter:       opts.NotAfter,
+		KeyUsage:       opts.KeyUsage,
+		ExtKeyUsage:    opts.ExtKeyUsage,
 
-	if ca == CASelfSign {
-		pkDef, err := lookup.GetPrivateKey(csrRes.PrivateKey)
-		if err != nil {
-			return nil, err
+		PolicyIdentifiers:     opts.PolicyIdentifiers,
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+		OCSPServer:            opts.OCSPServer,
+		IssuingCertificateURL: opts.IssuingCertificateURL,
+	}
+	if opts.IsCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.MaxPathLen = pathLen(opts.MaxPathLen, opts.MaxPathLenZero)
+		template.MaxPathLenZero = template.MaxPathLen == 0
+		if opts.NonCriticalPathLen {
+			ext, err := basicConstraintsExtension(template.MaxPathLen, false)
+			if err != nil {
+				return nil, err
+			}
+			// extra extensions replace the ones generated by crypto/x509
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
 		}
-		pk, err = pkDef.GetKey()
-		if err != nil {
-			return nil, err
+	}
+	parent := caCert
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, request.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// pathLen returns the path length limit, which is -1 for no limit. A maximum
+// of 0 is only used, when it was explicitly requested, as it is also the value
+// of certificates stored before the limit existed.
+func pathLen(max int, zero bool) int {
+	if max > 0 || (max == 0 && zero) {
+		return max
+	}
+	return -1
+}
+
+// basicConstraintsExtension builds the basic constraints extension of a CA
+// certificate.
+func basicConstraintsExtension(maxPathLen int, critical bool) (pkix.Extension, error) {
+	raw, err := asn1.Marshal(struct {
+		IsCA       bool `asn1:"optional"`
+		MaxPathLen int  `asn1:"optional,default:-1"`
+	}{true, maxPathLen})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidBasicConstraints, Critical: critical, Value: raw}, nil
+}
+
+// signer returns the certificate and key of a local CA to be used with the
+// crypto/x509 functions.
+func (ca *CA) signer(lookup *Storage) (*x509.Certificate, crypto.Signer, error) {
+	caCert, err := ca.certificate(lookup)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCertDef, err := lookup.GetCertificate(ca.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkDef, err := lookup.GetPrivateKey(caCertDef.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := pkDef.GetSigner()
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, signer, nil
+}
+
+// certificate returns the parsed certificate of a local CA.
+func (ca *CA) certificate(lookup *Storage) (*x509.Certificate, error) {
+	if ca.Type != pkiadm.CALocal {
+		return nil, EWrongType
+	}
+	caCertDef, err := lookup.GetCertificate(ca.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := caCertDef.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return (*x509.Certificate)(caCert), nil
+}
+
+// Revoke adds the certificate with the serial to the revocation list. When the
+// certificate is known, it must have been issued by this CA.
+func (ca *CA) Revoke(lookup *Storage, serial *big.Int, cert *x509.Certificate, certID string, reason pkiadm.RevocationReason) error {
+	hexSerial := serial.Text(16)
+	if reason == pkiadm.RRRemoveFromCRL {
+		for i, rev := range ca.Revocations {
+			if rev.Serial == hexSerial && rev.Reason == pkiadm.RRCertificateHold {
+				ca.Revocations = append(ca.Revocations[:i], ca.Revocations[i+1:]...)
+				log.Printf("ca '%s' released hold on serial '%s'", ca.ID, hexSerial)
+				return nil
+			}
 		}
-		caCertDef = &Certificate{ID: "self-signed"}
-	} else {
-		caCertDef, err = lookup.GetCertificate(ca.Certificate)
-		if err != nil {
-			return nil, err
+		return ENotOnHold
+	}
+
+	var existing *Revocation
+	for i, rev := range ca.Revocations {
+		if rev.Serial == hexSerial {
+			if rev.Reason != pkiadm.RRCertificateHold {
+				return EAlreadyRevoked
+			}
+			existing = &ca.Revocations[i]
 		}
-		caCert, err = caCertDef.GetCertificate()
-		if err != nil {
-			return nil, err
+	}
+
+	switch ca.Type {
+	case pkiadm.CALetsEncrypt:
+		if cert == nil {
+			return ENeedCertificate
 		}
-		pkDef, err := lookup.GetPrivateKey(caCertDef.PrivateKey)
-		if err != nil {
-			return nil, err
+		if err := ca.ACME.Revoke(lookup, cert.Raw, reason); err != nil {
+			return err
 		}
-		pk, err = pkDef.GetKey()
-		if err != nil {
-			return nil, err
+	default:
+		if cert != nil {
+			caCert, err := ca.certificate(lookup)
+			if err != nil {
+				return err
+			}
+			if err := cert.CheckSignatureFrom(caCert); err != nil {
+				return ENotIssuedByCA
+			}
 		}
 	}
 
-	log.Printf("ca '%s' signing csr '%s' using cert '%s'", ca.ID, csr.ID, caCertDef.ID)
-	return csrIns.ToCertificate(pk, opts, caCert)
+	log.Printf("ca '%s' revoked serial '%s' with reason %s", ca.ID, hexSerial, reason)
+	if existing != nil {
+		existing.Reason = reason
+		existing.RevokedAt = lookup.clock.Now()
+		return nil
+	}
+	rev := Revocation{
+		Serial:      hexSerial,
+		Certificate: certID,
+		RevokedAt:   lookup.clock.Now(),
+		Reason:      reason,
+	}
+	if cert != nil {
+		rev.NotAfter = cert.NotAfter
+	}
+	ca.Revocations = append(ca.Revocations, rev)
+	return nil
 }
 
 // Return the unique ResourceName
@@ -88,8 +332,12 @@ func (ca *CA) Name() pkiadm.ResourceName {
 	return pkiadm.ResourceName{ca.ID, pkiadm.RTCA}
 }
 
-// Refresh must trigger a rebuild of the resource. In this case, this is a NOOP.
-func (ca *CA) Refresh(*Storage) error {
+// Refresh must trigger a rebuild of the resource. For local CAs this is a
+// NOOP. ACME based CAs make sure the account is registered.
+func (ca *CA) Refresh(lookup *Storage) error {
+	if ca.Type == pkiadm.CALetsEncrypt {
+		return ca.registerAccount(lookup)
+	}
 	return nil
 }
 
@@ -106,16 +354,52 @@ func (ca *CA) Checksum() []byte     { return []byte{} }
 
 // DependsOn must return the resource names it is depending on.
 func (ca *CA) DependsOn() []pkiadm.ResourceName {
-	return []pkiadm.ResourceName{
+	if ca.Type == pkiadm.CALetsEncrypt {
+		return []pkiadm.ResourceName{ca.ACME.AccountKey}
+	}
+	res := []pkiadm.ResourceName{
 		ca.Certificate,
 	}
+	if ca.ACMEServer.Enabled {
+		res = append(res, ca.ACMEServer.Serial)
+	}
+	return res
+}
+
+// toPkiadm converts the CA into the representation used by the RPC interface.
+func (ca *CA) toPkiadm() pkiadm.CA {
+	return pkiadm.CA{
+		ID:            ca.ID,
+		Type:          ca.Type,
+		Certificate:   ca.Certificate,
+		DirectoryURL:  ca.ACME.DirectoryURL,
+		DirectoryCA:   ca.ACME.DirectoryCA,
+		AccountKey:    ca.ACME.AccountKey,
+		Email:         ca.ACME.Email,
+		ChallengeAddr: ca.ACME.ChallengeAddr,
+		ACMEServer:    ca.ACMEServer.Enabled,
+		ACMESerial:    ca.ACMEServer.Serial,
+		ACMEDuration:  ca.ACMEServer.Duration,
+		ACMEAllowed:   ca.ACMEServer.Allowed,
+	}
 }
 
 func (s *Server) CreateCA(inCA pkiadm.CA, res *pkiadm.Result) error {
 	s.lock()
 	defer s.unlock()
 
-	ca, err := NewCA(inCA.ID, inCA.Type, inCA.Certificate)
+	ca, err := NewCA(inCA.ID, inCA.Type, inCA.Certificate, ACMESettings{
+		DirectoryURL:  inCA.DirectoryURL,
+		DirectoryCA:   inCA.DirectoryCA,
+		AccountKey:    inCA.AccountKey,
+		Email:         inCA.Email,
+		ChallengeAddr: inCA.ChallengeAddr,
+	}, ACMEServerSettings{
+		Enabled:  inCA.ACMEServer,
+		Serial:   inCA.ACMESerial,
+		Duration: inCA.ACMEDuration,
+		Allowed:  inCA.ACMEAllowed,
+	})
 	if err != nil {
 		res.SetError(err, "could not create CA '%s'", inCA.ID)
 		return nil
@@ -124,6 +408,7 @@ func (s *Server) CreateCA(inCA pkiadm.CA, res *pkiadm.Result) error {
 		res.SetError(err, "could not add CA '%s'", inCA.ID)
 		return nil
 	}
+	res.Job = s.storage.pendingJob(ca.Name())
 	return s.store(res)
 }
 
@@ -136,14 +421,122 @@ func (s *Server) SetCA(change pkiadm.CAChange, res *pkiadm.Result) error {
 		res.SetError(err, "could not find CA '%s'", change.CA.ID)
 		return nil
 	}
+	// rejected changes must not stay in memory, as the next store would
+	// persist them
+	orig := *ca
+	restore := true
+	defer func() {
+		if restore {
+			*ca = orig
+		}
+	}()
 	for _, field := range change.FieldList {
 		switch field {
 		case "type":
 			ca.Type = change.CA.Type
 		case "certificate":
 			ca.Certificate = change.CA.Certificate
+		case "directory":
+			ca.ACME.DirectoryURL = change.CA.DirectoryURL
+			ca.ACME.AccountURL = ""
+		case "directory-ca":
+			ca.ACME.DirectoryCA = change.CA.DirectoryCA
+		case "account-key":
+			ca.ACME.AccountKey = change.CA.AccountKey
+			ca.ACME.AccountURL = ""
+		case "email":
+			ca.ACME.Email = change.CA.Email
+		case "challenge-addr":
+			ca.ACME.ChallengeAddr = change.CA.ChallengeAddr
+		case "acme-server":
+			ca.ACMEServer.Enabled = change.CA.ACMEServer
+		case "acme-serial":
+			ca.ACMEServer.Serial = change.CA.ACMESerial
+		case "acme-duration":
+			ca.ACMEServer.Duration = change.CA.ACMEDuration
+		case "acme-allow":
+			ca.ACMEServer.Allowed = change.CA.ACMEAllowed
+		default:
+			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
+			return nil
 		}
 	}
+	if err := s.storage.checkCycle(ca); err != nil {
+		res.SetError(err, "could not set CA '%s'", change.CA.ID)
+		return nil
+	}
+	restore = false
+	if err := s.storage.Update(ca.Name()); err != nil {
+		res.SetError(err, "could not update CA '%s'", change.CA.ID)
+		return nil
+	}
+	res.Job = s.storage.pendingJob(ca.Name())
+	return s.store(res)
+}
+
+// ImportCA creates a local CA from an existing certificate and private key.
+// The private key, the certificate and the CA get the id of the import and are
+// all kept as they are, until they are changed.
+func (s *Server) ImportCA(in pkiadm.CAImport, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	if s.storage.Locked() {
+		res.SetError(ELocked, "Could not import CA '%s'", in.ID)
+		return nil
+	}
+
+	keyName := pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTPrivateKey}
+	for _, rn := range []pkiadm.ResourceName{
+		keyName,
+		pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCertificate},
+		pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCA},
+	} {
+		if _, err := s.storage.Get(rn); err == nil {
+			res.SetError(EAlreadyExist, "Could not import CA '%s'", in.ID)
+			return nil
+		}
+	}
+	certs, _, err := parseCertificates(in.Certificate)
+	if err != nil {
+		res.SetError(err, "Could not import CA '%s'", in.ID)
+		return nil
+	}
+	if !certs[0].IsCA {
+		res.SetError(ENotACACert, "Could not import CA '%s'", in.ID)
+		return nil
+	}
+
+	pk, err := NewImportedPrivateKey(s.storage, in.ID, in.PrivateKey)
+	if err != nil {
+		res.SetError(err, "Could not import private key '%s'", in.ID)
+		return nil
+	}
+	if err := s.storage.AddPrivateKey(pk); err != nil {
+		res.SetError(err, "Could not add private key '%s'", in.ID)
+		return nil
+	}
+	cert, err := NewImportedCertificate(s.storage, in.ID, keyName, in.Certificate)
+	if err != nil {
+		s.storage.Remove(pk)
+		res.SetError(err, "Could not import certificate '%s'", in.ID)
+		return nil
+	}
+	if err := s.storage.AddCertificate(cert); err != nil {
+		s.storage.Remove(pk)
+		res.SetError(err, "Could not add certificate '%s'", in.ID)
+		return nil
+	}
+	ca, err := NewCA(in.ID, pkiadm.CALocal, cert.Name(), ACMESettings{}, ACMEServerSettings{})
+	if err == nil {
+		err = s.storage.AddCA(ca)
+	}
+	if err != nil {
+		s.storage.Remove(cert)
+		s.storage.Remove(pk)
+		res.SetError(err, "could not add CA '%s'", in.ID)
+		return nil
+	}
 	return s.store(res)
 }
 
@@ -173,11 +566,7 @@ func (s *Server) ShowCA(inCA pkiadm.CA, res *pkiadm.ResultCA) error {
 		res.Result.SetError(err, "Could not find CA '%s'", inCA.ID)
 		return nil
 	}
-	res.CAs = []pkiadm.CA{pkiadm.CA{
-		ID:          ca.ID,
-		Type:        ca.Type,
-		Certificate: ca.Certificate,
-	}}
+	res.CAs = []pkiadm.CA{ca.toPkiadm()}
 	return nil
 }
 
@@ -186,11 +575,7 @@ func (s *Server) ListCA(filter pkiadm.Filter, res *pkiadm.ResultCA) error {
 	defer s.unlock()
 
 	for _, ca := range s.storage.CAs {
-		res.CAs = append(res.CAs, pkiadm.CA{
-			ID:          ca.ID,
-			Type:        ca.Type,
-			Certificate: ca.Certificate,
-		})
+		res.CAs = append(res.CAs, ca.toPkiadm())
 	}
 	return nil
 }
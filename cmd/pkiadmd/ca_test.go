@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestMaxPathLen checks that CA certificates are only limited to no
+// intermediate CAs, when it was requested explicitly.
+func TestMaxPathLen(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		zero     bool
+		expected int
+	}{
+		{"unset", 0, false, -1},
+		{"unlimited", -1, false, -1},
+		{"zero", 0, true, 0},
+		{"two", 2, false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			addTestCSR(t, s, "root", "root")
+			res := &pkiadm.Result{}
+			err := s.CreateSerial(pkiadm.Serial{ID: "root", Mode: pkiadm.SMSequential}, res)
+			checkResult(t, "create serial", err, res)
+			err = s.CreateCertificate(pkiadm.Certificate{
+				ID:             "root",
+				IsCA:           true,
+				Duration:       time.Hour,
+				MaxPathLen:     test.max,
+				MaxPathLenZero: test.zero,
+				PrivateKey:     pkiadm.ResourceName{ID: "root", Type: pkiadm.RTPrivateKey},
+				Serial:         pkiadm.ResourceName{ID: "root", Type: pkiadm.RTSerial},
+				CSR:            pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCSR},
+			}, res)
+			checkResult(t, "create certificate", err, res)
+
+			s.lock()
+			defer s.unlock()
+			cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCertificate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode(cert.Data)
+			issued, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			max := issued.MaxPathLen
+			if max == 0 && !issued.MaxPathLenZero {
+				max = -1
+			}
+			if max != test.expected {
+				t.Errorf("expected path length %d, got %d", test.expected, max)
+			}
+			if shown := cert.toPkiadm(); shown.MaxPathLen != test.expected {
+				t.Errorf("expected path length %d to be shown, got %d", test.expected, shown.MaxPathLen)
+			}
+		})
+	}
+}
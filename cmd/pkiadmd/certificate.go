@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"time"
@@ -27,8 +28,30 @@ type (
 		Serial     pkiadm.ResourceName
 		CSR        pkiadm.ResourceName
 		CA         pkiadm.ResourceName
+		// Profile contains the settings to issue the certificate with. When set,
+		// the usage and duration settings of the certificate are ignored.
+		Profile pkiadm.ResourceName
+
+		KeyUsage    pkiadm.KeyUsage
+		ExtKeyUsage []pkiadm.ExtKeyUsage
+		// MaxPathLen of 0 means no limit, unless MaxPathLenZero is set. This
+		// way certificates stored before the limit existed stay unlimited.
+		MaxPathLen     int
+		MaxPathLenZero bool
+		// NonCriticalPathLen is stored inverted, so that certificates created
+		// before the option existed keep the critical basic constraints.
+		NonCriticalPathLen bool
+		// Imported certificates were issued outside of pkiadm and are kept
+		// as they are, until one of the signing settings is changed.
+		Imported bool
+		// KeepVersions is the number of issued certificates kept in the
+		// history. When 0, the default is used.
+		KeepVersions int
 
 		Data []byte
+		// Version is the version in the history, which is currently used.
+		Version int
+		History []CertificateVersion
 	}
 )
 
@@ -53,6 +76,57 @@ func NewCertificate(id string, privateKey, serial, csr, ca pkiadm.ResourceName,
 	}, nil
 }
 
+// NewImportedCertificate creates a certificate from an externally issued
+// certificate and its chain in PEM format. When a private key is given, it
+// must match the certificate.
+func NewImportedCertificate(lookup *Storage, id string, privateKey pkiadm.ResourceName, data []byte) (*Certificate, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	c := &Certificate{
+		ID:       id,
+		Imported: true,
+		Interval: Interval{Created: lookup.clock.Now()},
+	}
+	if err := c.setImported(lookup, privateKey, data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setImported replaces the data and private key of an imported certificate.
+func (c *Certificate) setImported(lookup *Storage, privateKey pkiadm.ResourceName, data []byte) error {
+	certs, raw, err := parseCertificates(data)
+	if err != nil {
+		return err
+	}
+	if privateKey.ID != "" {
+		pk, err := lookup.GetPrivateKey(privateKey)
+		if err != nil {
+			return err
+		}
+		signer, err := pk.GetSigner()
+		if err != nil {
+			return err
+		}
+		if err := keyMatches(certs[0], signer); err != nil {
+			return err
+		}
+	}
+	now := lookup.clock.Now()
+	c.seedHistory(now)
+	if err := c.addVersion(raw, "", now); err != nil {
+		return err
+	}
+	c.PrivateKey = privateKey
+	c.Data = raw
+	c.Duration = certs[0].NotAfter.Sub(certs[0].NotBefore)
+	c.KeyUsage = pkiadm.KeyUsage(certs[0].KeyUsage)
+	c.Created = now
+	c.Interval.LastRefresh = now
+	return nil
+}
+
 // Return the unique ResourceName
 func (c *Certificate) Name() pkiadm.ResourceName {
 	return pkiadm.ResourceName{c.ID, pkiadm.RTCertificate}
@@ -61,6 +135,9 @@ func (c *Certificate) Name() pkiadm.ResourceName {
 // AddDependency registers a depending resource to be retuened by Dependencies()
 // Refresh must trigger a rebuild of the resource.
 func (c *Certificate) Refresh(lookup *Storage) error {
+	if c.Imported {
+		return nil
+	}
 	var err error
 	ca := CASelfSign
 	if !c.IsCA {
@@ -69,42 +146,123 @@ func (c *Certificate) Refresh(lookup *Storage) error {
 			return err
 		}
 	}
-	serRes, err := lookup.GetSerial(c.Serial)
+	now := lookup.clock.Now()
+	opts := SignOptions{
+		NotBefore:          now,
+		NotAfter:           now.Add(c.Duration),
+		IsCA:               c.IsCA || c.KeyUsage&pkiadm.KUCertSign != 0,
+		KeyUsage:           x509.KeyUsage(c.KeyUsage),
+		ExtKeyUsage:        extKeyUsages(c.ExtKeyUsage),
+		MaxPathLen:         c.MaxPathLen,
+		MaxPathLenZero:     c.MaxPathLenZero,
+		NonCriticalPathLen: c.NonCriticalPathLen,
+	}
+	if c.IsCA && c.KeyUsage == 0 {
+		// CAs need to sign certificates as well as revocation lists
+		opts.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	}
+	if c.Profile.ID != "" {
+		if err := c.applyProfile(lookup, &opts); err != nil {
+			return err
+		}
+	}
+	// ACME directories choose the serial themselves
+	if ca.Type != pkiadm.CALetsEncrypt {
+		serRes, err := lookup.GetSerial(c.Serial)
+		if err != nil {
+			return err
+		}
+		opts.SerialNumber, err = serRes.Generate()
+		if err != nil {
+			return err
+		}
+	}
+	if ca.Type == pkiadm.CALetsEncrypt {
+		return c.order(lookup, ca)
+	}
+	data, err := ca.Sign(lookup, c.CSR, opts)
 	if err != nil {
 		return err
 	}
-	serial, err := serRes.Generate()
-	if err != nil {
+	return c.issued(lookup, ca, data)
+}
+
+// issued makes the certificate issued by the CA the current version.
+func (c *Certificate) issued(lookup *Storage, ca *CA, data []byte) error {
+	now := lookup.clock.Now()
+	c.seedHistory(now)
+	if err := c.addVersion(data, ca.ID, now); err != nil {
 		return err
 	}
+	c.Data = data
+	c.Interval.refreshed(now, c.History[len(c.History)-1].NotAfter)
+	if ca != CASelfSign {
+		if err := lookup.AddIssuance(ca, data, c.Name().String()); err != nil {
+			return err
+		}
+	}
+	// TODO remove obsolete field
+	c.Created = now
+	return nil
+}
 
-	// now we can start with the real interesting stuff
-	// TODO add key usage and that stuff
-	opts := pki.CertificateOptions{
-		SerialNumber: serial,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(c.Duration),
-		IsCA:         c.IsCA,
-		CALength:     0, // TODO make this an option
+// applyProfile replaces the options with the ones from the profile and checks
+// that the CSR is allowed by it.
+func (c *Certificate) applyProfile(lookup *Storage, opts *SignOptions) error {
+	profile, err := lookup.GetProfile(c.Profile)
+	if err != nil {
+		return err
 	}
-	//cert, err := csr.ToCertificate(pk, opts, ca)
-	cert, err := ca.Sign(lookup, c.CSR, opts)
+	csrRes, err := lookup.GetCSR(c.CSR)
 	if err != nil {
 		return err
 	}
-	block, err := cert.ToPem()
+	csr, err := csrRes.GetCSR()
 	if err != nil {
 		return err
 	}
-	c.Data = pem.EncodeToMemory(&block)
-	// TODO remove obsolete field
-	c.Created = time.Now()
-	c.Interval.LastRefresh = time.Now()
+	if err := profile.Check(csr); err != nil {
+		return err
+	}
+	if err := profile.Apply(opts); err != nil {
+		return err
+	}
+	c.Interval.RefreshAfter = profile.Duration
 	return nil
 }
 
+// extKeyUsages converts the extended key usages to the crypto/x509 ones.
+func extKeyUsages(in []pkiadm.ExtKeyUsage) []x509.ExtKeyUsage {
+	res := []x509.ExtKeyUsage{}
+	for _, eku := range in {
+		switch eku {
+		case pkiadm.EKUServerAuth:
+			res = append(res, x509.ExtKeyUsageServerAuth)
+		case pkiadm.EKUClientAuth:
+			res = append(res, x509.ExtKeyUsageClientAuth)
+		case pkiadm.EKUCodeSigning:
+			res = append(res, x509.ExtKeyUsageCodeSigning)
+		case pkiadm.EKUEmailProtection:
+			res = append(res, x509.ExtKeyUsageEmailProtection)
+		case pkiadm.EKUOCSPSigning:
+			res = append(res, x509.ExtKeyUsageOCSPSigning)
+		}
+	}
+	return res
+}
+
 func (c *Certificate) RefreshInterval() Interval {
-	return c.Interval
+	if c.Imported {
+		return NoInterval
+	}
+	interval := c.Interval
+	// certificates issued by older versions don't know their end yet
+	if interval.NotAfter.IsZero() && c.Version > 0 {
+		if v, err := c.getVersion(c.Version); err == nil {
+			interval.NotAfter = v.NotAfter
+		}
+	}
+	return interval
 }
 
 func (c *Certificate) GetCertificate() (*pki.Certificate, error) {
@@ -123,17 +281,53 @@ func (c *Certificate) Checksum() []byte     { return Hash(c.Data) }
 
 // DependsOn must return the resource names it is depending on.
 func (c *Certificate) DependsOn() []pkiadm.ResourceName {
-	res := []pkiadm.ResourceName{
-		c.PrivateKey,
-		c.Serial,
-		c.CSR,
+	res := []pkiadm.ResourceName{}
+	// certificates for imported CSRs have no private key
+	if c.PrivateKey.ID != "" {
+		res = append(res, c.PrivateKey)
+	}
+	if c.Imported {
+		return res
+	}
+	res = append(res, c.CSR)
+	if c.Serial.ID != "" {
+		res = append(res, c.Serial)
 	}
 	if !c.IsCA {
 		res = append(res, c.CA)
 	}
+	if c.Profile.ID != "" {
+		res = append(res, c.Profile)
+	}
 	return res
 }
 
+// toPkiadm converts the certificate into the representation used by the RPC
+// interface.
+func (c *Certificate) toPkiadm() pkiadm.Certificate {
+	return pkiadm.Certificate{
+		ID:              c.ID,
+		IsCA:            c.IsCA,
+		Duration:        c.Duration,
+		Created:         c.Created,
+		PrivateKey:      c.PrivateKey,
+		Serial:          c.Serial,
+		CA:              c.CA,
+		CSR:             c.CSR,
+		Profile:         c.Profile,
+		KeyUsage:        c.KeyUsage,
+		ExtKeyUsage:     c.ExtKeyUsage,
+		MaxPathLen:      pathLen(c.MaxPathLen, c.MaxPathLenZero),
+		MaxPathLenZero:  pathLen(c.MaxPathLen, c.MaxPathLenZero) == 0,
+		PathLenCritical: !c.NonCriticalPathLen,
+		Imported:        c.Imported,
+		KeepVersions:    c.KeepVersions,
+		Version:         c.Version,
+		Renewal:         c.RefreshInterval().renewal(),
+		Checksum:        c.Checksum(),
+	}
+}
+
 func (s *Server) CreateCertificate(inCert pkiadm.Certificate, res *pkiadm.Result) error {
 	s.lock()
 	defer s.unlock()
@@ -151,10 +345,57 @@ func (s *Server) CreateCertificate(inCert pkiadm.Certificate, res *pkiadm.Result
 		res.SetError(err, "Could not create new certificate '%s'", inCert.ID)
 		return nil
 	}
+	cert.Profile = inCert.Profile
+	cert.KeyUsage = inCert.KeyUsage
+	cert.ExtKeyUsage = inCert.ExtKeyUsage
+	cert.MaxPathLen = inCert.MaxPathLen
+	cert.MaxPathLenZero = inCert.MaxPathLenZero
+	cert.NonCriticalPathLen = !inCert.PathLenCritical
+	cert.KeepVersions = inCert.KeepVersions
+	if err := cert.Interval.setRenewal(inCert.Renewal, "renew-before", "renew-at", "jitter"); err != nil {
+		res.SetError(err, "Could not create new certificate '%s'", inCert.ID)
+		return nil
+	}
 	if err := s.storage.AddCertificate(cert); err != nil {
 		res.SetError(err, "Could not add certificate '%s'", inCert.ID)
 		return nil
 	}
+	res.Job = s.storage.pendingJob(cert.Name())
+	return s.store(res)
+}
+
+// ImportCertificate stores an externally issued certificate. Importing a
+// certificate with the id of an already imported one replaces it and
+// refreshes all depending resources.
+func (s *Server) ImportCertificate(in pkiadm.CertificateImport, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	if cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCertificate}); err == nil {
+		if !cert.Imported {
+			res.SetError(EAlreadyExist, "Could not import certificate '%s'", in.ID)
+			return nil
+		}
+		if err := cert.setImported(s.storage, in.PrivateKey, in.Pem); err != nil {
+			res.SetError(err, "Could not import certificate '%s'", in.ID)
+			return nil
+		}
+		if err := s.storage.Update(cert.Name()); err != nil {
+			res.SetError(err, "Could not update certificate '%s'", in.ID)
+			return nil
+		}
+		return s.store(res)
+	}
+
+	cert, err := NewImportedCertificate(s.storage, in.ID, in.PrivateKey, in.Pem)
+	if err != nil {
+		res.SetError(err, "Could not import certificate '%s'", in.ID)
+		return nil
+	}
+	if err := s.storage.AddCertificate(cert); err != nil {
+		res.SetError(err, "Could not add certificate '%s'", in.ID)
+		return nil
+	}
 	return s.store(res)
 }
 
@@ -168,6 +409,16 @@ func (s *Server) SetCertificate(changeset pkiadm.CertificateChange, res *pkiadm.
 		return nil
 	}
 
+	// rejected changes must not stay in memory, as the next store would
+	// persist them
+	orig := *cert
+	orig.History = append([]CertificateVersion(nil), cert.History...)
+	restore := true
+	defer func() {
+		if restore {
+			*cert = orig
+		}
+	}()
 	change := changeset.Certificate
 	for _, field := range changeset.FieldList {
 		switch field {
@@ -184,15 +435,49 @@ func (s *Server) SetCertificate(changeset pkiadm.CertificateChange, res *pkiadm.
 			cert.CA = change.CA
 		case "self-sign":
 			cert.IsCA = change.IsCA
+		case "profile":
+			cert.Profile = change.Profile
+		case "key-usage":
+			cert.KeyUsage = change.KeyUsage
+		case "ext-key-usage":
+			cert.ExtKeyUsage = change.ExtKeyUsage
+		case "max-path-len":
+			cert.MaxPathLen = change.MaxPathLen
+			cert.MaxPathLenZero = change.MaxPathLenZero
+		case "path-len-critical":
+			cert.NonCriticalPathLen = !change.PathLenCritical
+		case "keep-versions":
+			cert.KeepVersions = change.KeepVersions
+			cert.pruneHistory()
+		case "renew-before", "renew-at", "jitter":
+			if err := cert.Interval.setRenewalField(field, change.Renewal); err != nil {
+				res.SetError(err, "Could not set renewal of certificate '%s'", cert.ID)
+				return nil
+			}
 		default:
 			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
 			return nil
 		}
 	}
+	if err := s.storage.checkCycle(cert); err != nil {
+		res.SetError(err, "Could not set certificate '%s'", cert.ID)
+		return nil
+	}
+	restore = false
+	// the retention and renewal settings alone don't need a new certificate
+	if onlyFields(changeset.FieldList, "keep-versions", "renew-before", "renew-at", "jitter") {
+		s.storage.scanForRefresh()
+		return s.store(res)
+	}
+	// changing the settings hands the certificate over to pkiadm
+	if len(changeset.FieldList) > 0 {
+		cert.Imported = false
+	}
 	if err := s.storage.Update(cert.Name()); err != nil {
 		res.SetError(err, "Could not update certificate '%s'", changeset.Certificate.ID)
 		return nil
 	}
+	res.Job = s.storage.pendingJob(cert.Name())
 	return s.store(res)
 }
 
@@ -221,16 +506,7 @@ func (s *Server) ShowCertificate(inCert pkiadm.ResourceName, res *pkiadm.ResultC
 		res.Result.SetError(err, "Could not find certificate '%s'", inCert.ID)
 		return nil
 	}
-	res.Certificates = []pkiadm.Certificate{pkiadm.Certificate{
-		ID:         cert.ID,
-		Duration:   cert.Duration,
-		Created:    cert.Created,
-		PrivateKey: cert.PrivateKey,
-		Serial:     cert.Serial,
-		CA:         cert.CA,
-		CSR:        cert.CSR,
-		Checksum:   cert.Checksum(),
-	}}
+	res.Certificates = []pkiadm.Certificate{cert.toPkiadm()}
 	return nil
 }
 func (s *Server) ListCertificate(filter pkiadm.Filter, res *pkiadm.ResultCertificate) error {
@@ -238,16 +514,7 @@ func (s *Server) ListCertificate(filter pkiadm.Filter, res *pkiadm.ResultCertifi
 	defer s.unlock()
 
 	for _, cert := range s.storage.Certificates {
-		res.Certificates = append(res.Certificates, pkiadm.Certificate{
-			ID:         cert.ID,
-			Duration:   cert.Duration,
-			Created:    cert.Created,
-			PrivateKey: cert.PrivateKey,
-			Serial:     cert.Serial,
-			CA:         cert.CA,
-			CSR:        cert.CSR,
-			Checksum:   cert.Checksum(),
-		})
+		res.Certificates = append(res.Certificates, cert.toPkiadm())
 	}
 	return nil
 }
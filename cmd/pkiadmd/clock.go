@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+type (
+	// Clock provides the time and the timers used by the scheduler, so that
+	// they can be replaced in tests.
+	Clock interface {
+		Now() time.Time
+		// AfterFunc calls the function in its own goroutine after the
+		// duration has passed.
+		AfterFunc(d time.Duration, f func()) Timer
+	}
+
+	// Timer is a pending call of a function planned by a Clock.
+	Timer interface {
+		// Stop prevents the call, if it did not happen yet. It returns
+		// false, when the call already happened or the timer was stopped.
+		Stop() bool
+	}
+
+	// systemClock uses the time of the system.
+	systemClock struct{}
+)
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
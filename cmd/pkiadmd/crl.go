@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	EDurationTooShort = Error("duration must be at least one minute")
+	ESelfSigned       = Error("self signed certificates can not be revoked")
+)
+
+type (
+	// CRL is a certificate revocation list signed by a CA. It is regenerated
+	// before the next update announced in the list is reached.
+	CRL struct {
+		ID       string
+		CA       pkiadm.ResourceName
+		Duration time.Duration
+		// Number is the sequence number of the last generated list.
+		Number   int64
+		Interval Interval
+
+		// Data contains the PEM encoded revocation list.
+		Data []byte
+	}
+)
+
+// NewCRL creates a new CRL resource for the CA.
+func NewCRL(lookup *Storage, id string, ca pkiadm.ResourceName, duration time.Duration) (*CRL, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	if duration < time.Minute {
+		return nil, EDurationTooShort
+	}
+	return &CRL{
+		ID:       id,
+		CA:       ca,
+		Duration: duration,
+		Interval: Interval{
+			Created:      lookup.clock.Now(),
+			RefreshAfter: refreshBeforeUpdate(duration),
+		},
+	}, nil
+}
+
+// refreshBeforeUpdate returns the time after which a new list or response
+// must be generated, so that it is available before the next update of the
+// current one.
+func refreshBeforeUpdate(duration time.Duration) time.Duration {
+	return duration * 3 / 4
+}
+
+// Return the unique ResourceName
+func (c *CRL) Name() pkiadm.ResourceName {
+	return pkiadm.ResourceName{c.ID, pkiadm.RTCRL}
+}
+
+// Refresh generates a new revocation list from the revocations of the CA.
+func (c *CRL) Refresh(lookup *Storage) error {
+	ca, err := lookup.GetCA(c.CA)
+	if err != nil {
+		return err
+	}
+	caCert, signer, err := ca.signer(lookup)
+	if err != nil {
+		return err
+	}
+
+	now := lookup.clock.Now()
+	entries := []x509.RevocationListEntry{}
+	for _, rev := range ca.Revocations {
+		if !rev.NotAfter.IsZero() && rev.NotAfter.Before(now) {
+			// expired certificates don't need to be listed anymore
+			continue
+		}
+		serial, ok := new(big.Int).SetString(rev.Serial, 16)
+		if !ok {
+			return fmt.Errorf("revocation of CA '%s' has invalid serial '%s'", ca.ID, rev.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: rev.RevokedAt,
+			ReasonCode:     int(rev.Reason),
+		})
+	}
+
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(c.Number + 1),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(c.Duration),
+		RevokedCertificateEntries: entries,
+	}
+	raw, err := x509.CreateRevocationList(rand.Reader, template, caCert, signer)
+	if err != nil {
+		return err
+	}
+	log.Printf("crl '%s' generated list %d with %d entries for ca '%s'", c.ID, c.Number+1, len(entries), ca.ID)
+	c.Number++
+	c.Data = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: raw})
+	c.Interval.refreshed(lookup.clock.Now(), template.NextUpdate)
+	return nil
+}
+
+// RefreshInterval returns the dates and interval settings which are used to
+// decide when to trigger a refresh for the resource.
+func (c *CRL) RefreshInterval() Interval {
+	return c.Interval
+}
+
+// Return the PEM output of the contained resource.
+func (c *CRL) Pem() ([]byte, error) { return c.Data, nil }
+func (c *CRL) Checksum() []byte     { return Hash(c.Data) }
+
+// DependsOn must return the resource names it is depending on.
+func (c *CRL) DependsOn() []pkiadm.ResourceName {
+	return []pkiadm.ResourceName{c.CA}
+}
+
+// GetCRL returns the parsed revocation list.
+func (c *CRL) GetCRL() (*x509.RevocationList, error) {
+	block, _ := pem.Decode(c.Data)
+	if block == nil {
+		return nil, fmt.Errorf("CRL '%s' contains no data", c.ID)
+	}
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+// toPkiadm converts the CRL into the representation used by the RPC interface.
+func (c *CRL) toPkiadm() pkiadm.CRL {
+	res := pkiadm.CRL{
+		ID:       c.ID,
+		CA:       c.CA,
+		Duration: c.Duration,
+		Number:   c.Number,
+		Renewal:  c.Interval.renewal(),
+		Checksum: c.Checksum(),
+	}
+	if list, err := c.GetCRL(); err == nil {
+		res.NextUpdate = list.NextUpdate
+		res.Revoked = len(list.RevokedCertificateEntries)
+	}
+	return res
+}
+
+func (s *Server) CreateCRL(inCRL pkiadm.CRL, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	crl, err := NewCRL(s.storage, inCRL.ID, inCRL.CA, inCRL.Duration)
+	if err != nil {
+		res.SetError(err, "Could not create new CRL '%s'", inCRL.ID)
+		return nil
+	}
+	if err := crl.Interval.setRenewal(inCRL.Renewal, "renew-before", "renew-at", "jitter"); err != nil {
+		res.SetError(err, "Could not create new CRL '%s'", inCRL.ID)
+		return nil
+	}
+	if err := s.storage.AddCRL(crl); err != nil {
+		res.SetError(err, "Could not add CRL '%s'", inCRL.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) SetCRL(changeset pkiadm.CRLChange, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	crl, err := s.storage.GetCRL(pkiadm.ResourceName{ID: changeset.CRL.ID, Type: pkiadm.RTCRL})
+	if err != nil {
+		res.SetError(err, "Could not find CRL '%s'", changeset.CRL.ID)
+		return nil
+	}
+
+	change := changeset.CRL
+	for _, field := range changeset.FieldList {
+		switch field {
+		case "ca":
+			crl.CA = change.CA
+		case "duration":
+			if change.Duration < time.Minute {
+				res.SetError(EDurationTooShort, "Could not set duration of CRL '%s'", crl.ID)
+				return nil
+			}
+			crl.Duration = change.Duration
+			crl.Interval.RefreshAfter = refreshBeforeUpdate(change.Duration)
+		case "renew-before", "renew-at", "jitter":
+			if err := crl.Interval.setRenewalField(field, change.Renewal); err != nil {
+				res.SetError(err, "Could not set renewal of CRL '%s'", crl.ID)
+				return nil
+			}
+		default:
+			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
+			return nil
+		}
+	}
+	// the renewal settings alone don't need a new list
+	if onlyFields(changeset.FieldList, renewalFields...) {
+		s.storage.scanForRefresh()
+		return s.store(res)
+	}
+	if err := s.storage.Update(crl.Name()); err != nil {
+		res.SetError(err, "Could not update CRL '%s'", changeset.CRL.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) DeleteCRL(inCRL pkiadm.ResourceName, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	crl, err := s.storage.GetCRL(pkiadm.ResourceName{ID: inCRL.ID, Type: pkiadm.RTCRL})
+	if err != nil {
+		res.SetError(err, "Could not find CRL '%s'", inCRL.ID)
+		return nil
+	}
+
+	if err := s.storage.Remove(crl); err != nil {
+		res.SetError(err, "Could not remove CRL '%s'", crl.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) ShowCRL(inCRL pkiadm.ResourceName, res *pkiadm.ResultCRL) error {
+	s.lock()
+	defer s.unlock()
+
+	crl, err := s.storage.GetCRL(pkiadm.ResourceName{ID: inCRL.ID, Type: pkiadm.RTCRL})
+	if err != nil {
+		res.Result.SetError(err, "Could not find CRL '%s'", inCRL.ID)
+		return nil
+	}
+	res.CRLs = []pkiadm.CRL{crl.toPkiadm()}
+	return nil
+}
+
+func (s *Server) ListCRL(filter pkiadm.Filter, res *pkiadm.ResultCRL) error {
+	s.lock()
+	defer s.unlock()
+
+	for _, crl := range s.storage.CRLs {
+		res.CRLs = append(res.CRLs, crl.toPkiadm())
+	}
+	return nil
+}
+
+// RevokeCertificate is the RPC endpoint to revoke a certificate. The CRLs and
+// OCSP responses of the issuing CA are regenerated afterwards.
+func (s *Server) RevokeCertificate(rev pkiadm.Revocation, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	var (
+		ca     *CA
+		cert   *x509.Certificate
+		serial *big.Int
+		err    error
+	)
+	if rev.ID != "" {
+		certRes, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: rev.ID, Type: pkiadm.RTCertificate})
+		if err != nil {
+			res.SetError(err, "Could not find certificate '%s'", rev.ID)
+			return nil
+		}
+		if certRes.IsCA {
+			res.SetError(ESelfSigned, "Could not revoke certificate '%s'", rev.ID)
+			return nil
+		}
+		if ca, err = s.storage.GetCA(certRes.CA); err != nil {
+			res.SetError(err, "Could not find CA of certificate '%s'", rev.ID)
+			return nil
+		}
+		pkiCert, err := certRes.GetCertificate()
+		if err != nil {
+			res.SetError(err, "Could not parse certificate '%s'", rev.ID)
+			return nil
+		}
+		cert = (*x509.Certificate)(pkiCert)
+		serial = cert.SerialNumber
+	} else {
+		if ca, err = s.storage.GetCA(rev.CA); err != nil {
+			res.SetError(err, "Could not find CA '%s'", rev.CA.ID)
+			return nil
+		}
+		var ok bool
+		if serial, ok = new(big.Int).SetString(rev.Serial, 16); !ok {
+			res.SetError(fmt.Errorf("invalid serial"), "Could not parse serial '%s'", rev.Serial)
+			return nil
+		}
+		// certificates issued through the ACME directory are known by serial
+		for _, issued := range s.storage.ACMECertificates {
+			if issued.CA != ca.ID || issued.Serial != serial.Text(16) {
+				continue
+			}
+			if block, _ := pem.Decode(issued.Data); block != nil {
+				cert, _ = x509.ParseCertificate(block.Bytes)
+			}
+		}
+	}
+
+	if err := ca.Revoke(s.storage, serial, cert, rev.ID, rev.Reason); err != nil {
+		res.SetError(err, "Could not revoke serial '%s' of CA '%s'", serial.Text(16), ca.ID)
+		return nil
+	}
+	for _, dep := range s.storage.RevocationPublishers(ca.Name()) {
+		if err := s.storage.Update(dep.Name()); err != nil {
+			res.SetError(err, "Could not update '%s'", dep.Name())
+			return nil
+		}
+	}
+	return s.store(res)
+}
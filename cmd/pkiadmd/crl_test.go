@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestCRL revokes a certificate and checks the generated revocation list.
+// Expired certificates are removed from the list again.
+func TestCRL(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTestCA(t, s, "root")
+	addTestCSR(t, s, "www", "127.0.0.1", net.ParseIP("127.0.0.1"))
+	res := &pkiadm.Result{}
+	err := s.CreateCertificate(pkiadm.Certificate{
+		ID:         "www",
+		Duration:   time.Hour,
+		PrivateKey: pkiadm.ResourceName{ID: "www", Type: pkiadm.RTPrivateKey},
+		Serial:     pkiadm.ResourceName{ID: "root", Type: pkiadm.RTSerial},
+		CSR:        pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCSR},
+		CA:         pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA},
+	}, res)
+	checkResult(t, "create certificate www", err, res)
+	err = s.CreateCRL(pkiadm.CRL{
+		ID:       "root",
+		CA:       pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA},
+		Duration: 24 * time.Hour,
+	}, res)
+	checkResult(t, "create crl", err, res)
+	err = s.RevokeCertificate(pkiadm.Revocation{ID: "www", Reason: pkiadm.RRKeyCompromise}, res)
+	checkResult(t, "revoke certificate www", err, res)
+
+	s.lock()
+	defer s.unlock()
+	crl, err := s.storage.GetCRL(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCRL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := crl.GetCRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(caCert.Data)
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.CheckSignatureFrom(issuer); err != nil {
+		t.Errorf("list is not signed by the CA: %s", err)
+	}
+	if !list.ThisUpdate.Equal(clock.Now().Truncate(time.Second)) {
+		t.Errorf("expected the list to be issued at %s, got %s", clock.Now(), list.ThisUpdate)
+	}
+	if !list.NextUpdate.Equal(list.ThisUpdate.Add(24 * time.Hour)) {
+		t.Errorf("expected the next update after 24h, got %s", list.NextUpdate)
+	}
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ = pem.Decode(cert.Data)
+	revoked, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.RevokedCertificateEntries) != 1 {
+		t.Fatalf("expected 1 revoked certificate, got %d", len(list.RevokedCertificateEntries))
+	}
+	entry := list.RevokedCertificateEntries[0]
+	if entry.SerialNumber.Cmp(revoked.SerialNumber) != 0 {
+		t.Errorf("expected serial %s, got %s", revoked.SerialNumber, entry.SerialNumber)
+	}
+	if entry.ReasonCode != int(pkiadm.RRKeyCompromise) {
+		t.Errorf("expected reason %d, got %d", pkiadm.RRKeyCompromise, entry.ReasonCode)
+	}
+
+	// the revoked certificate expires before the next list, the scheduler
+	// needs the storage when the clock moves
+	s.unlock()
+	clock.Advance(2 * time.Hour)
+	s.lock()
+	number := crl.Number
+	if err := crl.Refresh(s.storage); err != nil {
+		t.Fatal(err)
+	}
+	if crl.Number != number+1 {
+		t.Errorf("expected list number %d, got %d", number+1, crl.Number)
+	}
+	if list, err = crl.GetCRL(); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.RevokedCertificateEntries) != 0 {
+		t.Errorf("expired certificate is still listed")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"net"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/gibheer/pki"
 	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
 )
 
 type (
@@ -27,11 +29,57 @@ type (
 		PrivateKey pkiadm.ResourceName
 		Subject    pkiadm.ResourceName
 
+		// Imported marks CSRs generated outside of pkiadm. These only contain
+		// the data and are never regenerated.
+		Imported bool
+
 		// Data contains the pem representation of the CSR.
 		Data []byte
 	}
 )
 
+const (
+	EImportedCSR = Error("imported CSRs can not be changed, import a new one instead")
+)
+
+// NewImportedCSR creates a CSR from an externally generated request in PEM
+// format. The signature of the request must be valid.
+func NewImportedCSR(lookup *Storage, id string, data []byte) (*CSR, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	c := &CSR{
+		ID:       id,
+		Imported: true,
+		Interval: Interval{Created: lookup.clock.Now()},
+	}
+	if err := c.setImported(lookup, data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setImported replaces the data of an imported CSR.
+func (c *CSR) setImported(lookup *Storage, data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("no certificate request found in PEM data")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return errors.Wrap(err, "signature of the certificate sign request is invalid")
+	}
+	c.DNSNames = csr.DNSNames
+	c.EmailAddresses = csr.EmailAddresses
+	c.IPAddresses = csr.IPAddresses
+	c.Data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: block.Bytes})
+	c.Interval.LastRefresh = lookup.clock.Now()
+	return nil
+}
+
 // NewCSR creates a new CSR.
 func NewCSR(id string, pk, subject pkiadm.ResourceName, dnsNames []string,
 	emailAddresses []string, iPAddresses []net.IP, refreshAfter time.Duration,
@@ -59,6 +107,10 @@ func (c *CSR) Name() pkiadm.ResourceName {
 // AddDependency registers a depending resource to be retuened by Dependencies()
 // Refresh must trigger a rebuild of the resource.
 func (c *CSR) Refresh(lookup *Storage) error {
+	if c.Imported {
+		// there is no key to generate a new request, so keep the data
+		return nil
+	}
 	pk, err := lookup.GetPrivateKey(c.PrivateKey)
 	if err != nil {
 		return err
@@ -88,7 +140,7 @@ func (c *CSR) Refresh(lookup *Storage) error {
 		return err
 	}
 	c.Data = pem.EncodeToMemory(&block)
-	c.Interval.LastRefresh = time.Now()
+	c.Interval.refreshed(lookup.clock.Now(), time.Time{})
 	return nil
 }
 
@@ -102,6 +154,9 @@ func (c *CSR) Checksum() []byte     { return Hash(c.Data) }
 
 // DependsOn must return the resource names it is depending on.
 func (c *CSR) DependsOn() []pkiadm.ResourceName {
+	if c.Imported {
+		return []pkiadm.ResourceName{}
+	}
 	return []pkiadm.ResourceName{c.PrivateKey}
 }
 
@@ -132,12 +187,52 @@ func (s *Server) CreateCSR(inCSR pkiadm.CSR, res *pkiadm.Result) error {
 		res.SetError(err, "Could not create new private key '%s'", inCSR.ID)
 		return nil
 	}
+	if err := csr.Interval.setRenewal(inCSR.Renewal, renewalFields...); err != nil {
+		res.SetError(err, "Could not create new CSR '%s'", inCSR.ID)
+		return nil
+	}
 	if err := s.storage.AddCSR(csr); err != nil {
 		res.SetError(err, "Could not add private key '%s'", inCSR.ID)
 		return nil
 	}
 	return s.store(res)
 }
+
+// ImportCSR is the RPC endpoint to store an externally generated CSR. When an
+// imported CSR with the same id exists, it is replaced and all depending
+// resources get refreshed.
+func (s *Server) ImportCSR(in pkiadm.CSRImport, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	if csr, err := s.storage.GetCSR(pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCSR}); err == nil {
+		if !csr.Imported {
+			res.SetError(EAlreadyExist, "Could not import CSR '%s'", in.ID)
+			return nil
+		}
+		if err := csr.setImported(s.storage, in.Pem); err != nil {
+			res.SetError(err, "Could not import CSR '%s'", in.ID)
+			return nil
+		}
+		if err := s.storage.Update(csr.Name()); err != nil {
+			res.SetError(err, "Could not update CSR '%s'", in.ID)
+			return nil
+		}
+		return s.store(res)
+	}
+
+	csr, err := NewImportedCSR(s.storage, in.ID, in.Pem)
+	if err != nil {
+		res.SetError(err, "Could not import CSR '%s'", in.ID)
+		return nil
+	}
+	if err := s.storage.AddCSR(csr); err != nil {
+		res.SetError(err, "Could not add CSR '%s'", in.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
 func (s *Server) SetCSR(changeset pkiadm.CSRChange, res *pkiadm.Result) error {
 	s.lock()
 	defer s.unlock()
@@ -148,6 +243,10 @@ func (s *Server) SetCSR(changeset pkiadm.CSRChange, res *pkiadm.Result) error {
 		return nil
 	}
 
+	if csr.Imported && len(changeset.FieldList) > 0 {
+		res.SetError(EImportedCSR, "Could not change CSR '%s'", changeset.CSR.ID)
+		return nil
+	}
 	change := changeset.CSR
 	for _, field := range changeset.FieldList {
 		switch field {
@@ -161,11 +260,21 @@ func (s *Server) SetCSR(changeset pkiadm.CSRChange, res *pkiadm.Result) error {
 			csr.DNSNames = change.DNSNames
 		case "mail":
 			csr.EmailAddresses = change.EmailAddresses
+		case "lifetime", "renew-before", "renew-at", "jitter":
+			if err := csr.Interval.setRenewalField(field, change.Renewal); err != nil {
+				res.SetError(err, "Could not set renewal of CSR '%s'", csr.ID)
+				return nil
+			}
 		default:
 			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
 			return nil
 		}
 	}
+	// the renewal settings alone don't need a new request
+	if onlyFields(changeset.FieldList, renewalFields...) {
+		s.storage.scanForRefresh()
+		return s.store(res)
+	}
 	if err := s.storage.Update(pkiadm.ResourceName{ID: csr.ID, Type: pkiadm.RTCSR}); err != nil {
 		res.SetError(err, "Could not update private key '%s'", changeset.CSR.ID)
 		return nil
@@ -204,6 +313,8 @@ func (s *Server) ShowCSR(inCSR pkiadm.ResourceName, res *pkiadm.ResultCSR) error
 		EmailAddresses: csr.EmailAddresses,
 		DNSNames:       csr.DNSNames,
 		IPAddresses:    csr.IPAddresses,
+		Imported:       csr.Imported,
+		Renewal:        csr.Interval.renewal(),
 		Checksum:       csr.Checksum(),
 	}}
 	return nil
@@ -220,6 +331,8 @@ func (s *Server) ListCSR(filter pkiadm.Filter, res *pkiadm.ResultCSR) error {
 			EmailAddresses: csr.EmailAddresses,
 			DNSNames:       csr.DNSNames,
 			IPAddresses:    csr.IPAddresses,
+			Imported:       csr.Imported,
+			Renewal:        csr.Interval.renewal(),
 			Checksum:       csr.Checksum(),
 		})
 	}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	ENoAuditLog = Error("no audit log to watch")
+
+	// keepEvents is the number of entries of the audit log kept in memory for
+	// the watchers. Older entries are read from the log.
+	keepEvents = 1000
+	// maxWatchWait is the longest time a client waits for events in one
+	// request.
+	maxWatchWait = 5 * time.Minute
+)
+
+// Revision returns the sequence of the last entry.
+func (l *AuditLog) Revision() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Since waits until there are entries after the sequence or the timeout is
+// hit. It returns the entries after the sequence and the sequence of the last
+// entry. When the sequence is ahead of the log, no entries are returned, so
+// that the caller can continue with the sequence of the log.
+func (l *AuditLog) Since(after uint64, timeout time.Duration) ([]pkiadm.AuditEntry, uint64, error) {
+	if l == nil {
+		return []pkiadm.AuditEntry{}, after, ENoAuditLog
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		l.mu.Lock()
+		expired = true
+		l.appended.Broadcast()
+		l.mu.Unlock()
+	})
+	defer timer.Stop()
+	for l.seq == after && !expired {
+		l.appended.Wait()
+	}
+	if l.seq <= after {
+		return []pkiadm.AuditEntry{}, l.seq, nil
+	}
+
+	if len(l.recent) > 0 && l.recent[0].Seq <= after+1 {
+		start := after + 1 - l.recent[0].Seq
+		return append([]pkiadm.AuditEntry{}, l.recent[start:]...), l.seq, nil
+	}
+	// the watcher is behind the entries kept in memory
+	entries, _, err := readAudit(l.path)
+	if err != nil {
+		return []pkiadm.AuditEntry{}, after, err
+	}
+	res := []pkiadm.AuditEntry{}
+	for _, e := range entries {
+		if e.Seq > after {
+			res = append(res, e)
+		}
+	}
+	return res, l.seq, nil
+}
+
+// eventOf returns the event of the change recorded by the entry. Rejected
+// requests and requests continued by a job didn't change anything yet and
+// have no event.
+func eventOf(e pkiadm.AuditEntry) (pkiadm.Event, bool) {
+	event := pkiadm.Event{
+		Revision: e.Seq,
+		Time:     e.Time,
+		Resource: e.Resource,
+		Checksum: e.NewChecksum,
+		Caller:   e.Caller,
+		Error:    e.Error,
+	}
+	if e.Resource.Type == pkiadm.RTUnknown || e.Outcome == pkiadm.AOQueued {
+		return event, false
+	}
+	if e.Outcome == pkiadm.AOFailed {
+		// only failures of the daemon and of jobs concern the resource
+		event.Kind = pkiadm.EKFailed
+		return event, e.Action == "Refresh" || e.Job != ""
+	}
+	switch {
+	case e.Action == "Refresh":
+		event.Kind = pkiadm.EKRefreshed
+	case strings.HasPrefix(e.Action, "Create"), strings.HasPrefix(e.Action, "Import"):
+		event.Kind = pkiadm.EKCreated
+	case strings.HasPrefix(e.Action, "Set"), strings.HasPrefix(e.Action, "Rollback"):
+		event.Kind = pkiadm.EKUpdated
+	case strings.HasPrefix(e.Action, "Delete"):
+		event.Kind = pkiadm.EKDeleted
+	case strings.HasPrefix(e.Action, "Revoke"):
+		event.Kind = pkiadm.EKRevoked
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// Watch waits for the events selected by the request. The events are taken
+// from the audit log, the revision of an event is the sequence of its entry.
+// It doesn't hold the storage while waiting.
+func (s *Server) Watch(in pkiadm.WatchRequest, res *pkiadm.ResultEvents) error {
+	timeout := in.Timeout
+	if timeout <= 0 || timeout > maxWatchWait {
+		timeout = maxWatchWait
+	}
+	deadline := time.Now().Add(timeout)
+
+	res.Events = []pkiadm.Event{}
+	if in.Current {
+		res.Revision = s.storage.audit.Revision()
+		return nil
+	}
+	after := in.After
+	for {
+		entries, revision, err := s.storage.audit.Since(after, time.Until(deadline))
+		if err != nil {
+			res.Result.SetError(err, "Could not read events")
+			return nil
+		}
+		for _, e := range entries {
+			if event, ok := eventOf(e); ok && in.Match(event) {
+				res.Events = append(res.Events, event)
+			}
+		}
+		res.Revision = revision
+		// entries not selected by the request don't end the wait
+		if len(res.Events) > 0 || revision <= after || !time.Now().Before(deadline) {
+			return nil
+		}
+		after = revision
+	}
+}
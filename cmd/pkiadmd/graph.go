@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	EDependencyCycle = Error("dependency cycle")
+)
+
+// checkCycle returns an error, when the resource would depend on itself
+// through the resources it depends on. The resource doesn't need to be added
+// to the storage yet, so that it can be checked before.
+func (s *Storage) checkCycle(r Resource) error {
+	target := r.Name().String()
+	visited := map[string]bool{}
+	var walk func(path []pkiadm.ResourceName, deps []pkiadm.ResourceName) []pkiadm.ResourceName
+	walk = func(path []pkiadm.ResourceName, deps []pkiadm.ResourceName) []pkiadm.ResourceName {
+		for _, rn := range deps {
+			next := append(path[:len(path):len(path)], rn)
+			if rn.String() == target {
+				return next
+			}
+			if visited[rn.String()] {
+				continue
+			}
+			visited[rn.String()] = true
+			dep, err := s.Get(rn)
+			if err != nil {
+				// missing dependencies are reported when adding the resource
+				continue
+			}
+			if cycle := walk(next, dep.DependsOn()); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	cycle := walk([]pkiadm.ResourceName{r.Name()}, r.DependsOn())
+	if cycle == nil {
+		return nil
+	}
+	names := make([]string, len(cycle))
+	for i, rn := range cycle {
+		names[i] = rn.String()
+	}
+	return fmt.Errorf("%s: %s", EDependencyCycle, strings.Join(names, " -> "))
+}
+
+// relink replaces the dependencies of the resource in the dependency graph
+// with the ones it currently has.
+func (s *Storage) relink(r Resource) error {
+	for _, deps := range s.dependencies {
+		delete(deps, r.Name().String())
+	}
+	return s.addDependency(r)
+}
+
+// refreshPlan returns the resource and all resources depending on it in the
+// order they have to be refreshed. Every resource comes after all resources
+// of the plan it depends on.
+func (s *Storage) refreshPlan(r Resource) ([]Resource, error) {
+	members := map[string]Resource{r.Name().String(): r}
+	queue := []Resource{r}
+	for len(queue) > 0 {
+		var next Resource
+		next, queue = queue[0], queue[1:]
+		for name, dep := range s.dependencies[next.Name().String()] {
+			if _, found := members[name]; found {
+				continue
+			}
+			members[name] = dep
+			queue = append(queue, dep)
+		}
+	}
+
+	// count the dependencies of every resource within the plan
+	pending := map[string]int{}
+	for name := range members {
+		pending[name] = 0
+	}
+	for name := range members {
+		for dep := range s.dependencies[name] {
+			if _, found := members[dep]; found {
+				pending[dep]++
+			}
+		}
+	}
+	ready := []string{}
+	for name, count := range pending {
+		if count == 0 {
+			ready = append(ready, name)
+		}
+	}
+	plan := []Resource{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		var name string
+		name, ready = ready[0], ready[1:]
+		plan = append(plan, members[name])
+		for dep := range s.dependencies[name] {
+			if _, found := members[dep]; !found {
+				continue
+			}
+			pending[dep]--
+			if pending[dep] == 0 {
+				ready = append(ready, dep)
+			}
+		}
+	}
+	if len(plan) < len(members) {
+		names := []string{}
+		for name, count := range pending {
+			if count > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%s between '%s'", EDependencyCycle, strings.Join(names, "', '"))
+	}
+	return plan, nil
+}
+
+// causes returns the resources of the plan, the resource depends on.
+func causes(r Resource, planned map[string]bool) []pkiadm.ResourceName {
+	res := []pkiadm.ResourceName{}
+	for _, rn := range r.DependsOn() {
+		if planned[rn.String()] {
+			res = append(res, rn)
+		}
+	}
+	return res
+}
+
+// PlanRefresh returns the order in which the resource and all resources
+// depending on it are refreshed on a change.
+func (s *Server) PlanRefresh(rn pkiadm.ResourceName, res *pkiadm.ResultPlan) error {
+	s.lock()
+	defer s.unlock()
+
+	r, err := s.storage.Get(rn)
+	if err != nil {
+		res.Result.SetError(err, "Could not find resource '%s'", rn)
+		return nil
+	}
+	plan, err := s.storage.refreshPlan(r)
+	if err != nil {
+		res.Result.SetError(err, "Could not plan refresh of '%s'", rn)
+		return nil
+	}
+	planned := map[string]bool{}
+	for _, step := range plan {
+		res.Steps = append(res.Steps, pkiadm.PlanStep{
+			Resource: step.Name(),
+			Causes:   causes(step, planned),
+		})
+		planned[step.Name().String()] = true
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestSetRejectedKeepsResource checks that a change rejected by a later field
+// leaves the fields applied before it untouched.
+func TestSetRejectedKeepsResource(t *testing.T) {
+	s, _ := newTestServer(t)
+	addTestCA(t, s, "root")
+	addTestCA(t, s, "other")
+
+	res := &pkiadm.Result{}
+	if err := s.SetCertificate(pkiadm.CertificateChange{
+		Certificate: pkiadm.Certificate{
+			ID:      "root",
+			CA:      pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA},
+			Renewal: pkiadm.Renewal{At: 2},
+		},
+		FieldList: []string{"ca", "renew-at"},
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.HasError {
+		t.Errorf("invalid renewal was accepted")
+	}
+	res = &pkiadm.Result{}
+	if err := s.SetCA(pkiadm.CAChange{
+		CA:        pkiadm.CA{ID: "root", Certificate: pkiadm.ResourceName{ID: "other", Type: pkiadm.RTCertificate}},
+		FieldList: []string{"certificate", "bogus"},
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.HasError {
+		t.Errorf("unknown field was accepted")
+	}
+
+	s.lock()
+	defer s.unlock()
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.CA.ID != "" {
+		t.Errorf("ca of the rejected change was kept: %s", cert.CA)
+	}
+	ca, err := s.storage.GetCA(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Certificate.ID != "root" {
+		t.Errorf("certificate of the rejected change was kept: %s", ca.Certificate)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+const (
+	EUnknownVersion = Error("unknown certificate version")
+	EVersionExpired = Error("certificate version is expired")
+
+	// defaultKeepVersions is the number of certificate versions kept, when
+	// the certificate has no retention configured.
+	defaultKeepVersions = 10
+)
+
+type (
+	// CertificateVersion is a certificate issued for a certificate resource.
+	// Versions are numbered from 1 in the order they were issued.
+	CertificateVersion struct {
+		Version int
+		// Serial is the serial number of the certificate in hex.
+		Serial    string
+		NotBefore time.Time
+		NotAfter  time.Time
+		Checksum  []byte
+		// CA is the id of the issuing CA. It is empty for imported
+		// certificates.
+		CA     string
+		Issued time.Time
+		Data   []byte
+	}
+)
+
+// addVersion records the data as the newest version of the certificate and
+// makes it the current one. The oldest versions beyond the retention are
+// removed.
+func (c *Certificate) addVersion(data []byte, caID string, issued time.Time) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.Errorf("no certificate found to record for '%s'", c.ID)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse certificate of '%s'", c.ID)
+	}
+	version := 1
+	if len(c.History) > 0 {
+		version = c.History[len(c.History)-1].Version + 1
+	}
+	c.History = append(c.History, CertificateVersion{
+		Version:   version,
+		Serial:    cert.SerialNumber.Text(16),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Checksum:  Hash(data),
+		CA:        caID,
+		Issued:    issued,
+		Data:      data,
+	})
+	c.Version = version
+	c.pruneHistory()
+	return nil
+}
+
+// seedHistory records the current data of certificates issued before the
+// history existed, so that they can be rolled back to.
+func (c *Certificate) seedHistory(now time.Time) {
+	if len(c.History) > 0 || len(c.Data) == 0 {
+		return
+	}
+	caID := c.CA.ID
+	if c.IsCA {
+		caID = CASelfSign.ID
+	}
+	if c.Imported {
+		caID = ""
+	}
+	if err := c.addVersion(c.Data, caID, now); err != nil {
+		log.Printf("could not record current version of certificate '%s': %s", c.ID, err)
+	}
+}
+
+// pruneHistory removes the oldest versions, until only the configured number
+// is left. The current version is always kept.
+func (c *Certificate) pruneHistory() {
+	keep := c.KeepVersions
+	if keep <= 0 {
+		keep = defaultKeepVersions
+	}
+	for i := 0; len(c.History) > keep && i < len(c.History); {
+		if c.History[i].Version == c.Version {
+			i++
+			continue
+		}
+		c.History = append(c.History[:i], c.History[i+1:]...)
+	}
+}
+
+// getVersion returns the version of the certificate.
+func (c *Certificate) getVersion(version int) (CertificateVersion, error) {
+	for _, v := range c.History {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+	return CertificateVersion{}, EUnknownVersion
+}
+
+// rollback makes the version the current certificate again. The signing
+// settings are not touched, so the next renewal issues a new version.
+// Expired versions and versions issued for another private key are rejected.
+func (c *Certificate) rollback(lookup *Storage, version int) error {
+	v, err := c.getVersion(version)
+	if err != nil {
+		return err
+	}
+	if !lookup.clock.Now().Before(v.NotAfter) {
+		return EVersionExpired
+	}
+	if c.PrivateKey.ID != "" {
+		certs, _, err := parseCertificates(v.Data)
+		if err != nil {
+			return err
+		}
+		pk, err := lookup.GetPrivateKey(c.PrivateKey)
+		if err != nil {
+			return err
+		}
+		signer, err := pk.GetSigner()
+		if err != nil {
+			return err
+		}
+		if err := keyMatches(certs[0], signer); err != nil {
+			return err
+		}
+	}
+	c.Data = v.Data
+	c.Version = v.Version
+	c.Interval.NotAfter = v.NotAfter
+	return nil
+}
+
+// toPkiadm converts the version into the representation used by the RPC
+// interface. The certificate itself is only included when withData is set.
+func (v CertificateVersion) toPkiadm(current int, withData bool) pkiadm.CertificateVersion {
+	res := pkiadm.CertificateVersion{
+		Version:   v.Version,
+		Serial:    v.Serial,
+		NotBefore: v.NotBefore,
+		NotAfter:  v.NotAfter,
+		Checksum:  v.Checksum,
+		CA:        v.CA,
+		Issued:    v.Issued,
+		Current:   v.Version == current,
+	}
+	if withData {
+		res.Pem = v.Data
+	}
+	return res
+}
+
+// PushLocations writes the resource to all locations exporting it, without
+// refreshing the resource itself.
+func (s *Storage) PushLocations(rn pkiadm.ResourceName) error {
+	for _, dep := range s.dependencies[rn.String()] {
+		if dep.Name().Type != pkiadm.RTLocation {
+			continue
+		}
+		log.Printf("refreshing resource '%s' because of '%s'", dep.Name(), rn.String())
+		if err := s.refreshResource(dep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) HistoryCertificate(inCert pkiadm.ResourceName, res *pkiadm.ResultCertificateVersion) error {
+	s.lock()
+	defer s.unlock()
+
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: inCert.ID, Type: pkiadm.RTCertificate})
+	if err != nil {
+		res.Result.SetError(err, "Could not find certificate '%s'", inCert.ID)
+		return nil
+	}
+	for _, v := range cert.History {
+		res.Versions = append(res.Versions, v.toPkiadm(cert.Version, false))
+	}
+	return nil
+}
+
+func (s *Server) ShowCertificateVersion(in pkiadm.CertificateVersionName, res *pkiadm.ResultCertificateVersion) error {
+	s.lock()
+	defer s.unlock()
+
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCertificate})
+	if err != nil {
+		res.Result.SetError(err, "Could not find certificate '%s'", in.ID)
+		return nil
+	}
+	v, err := cert.getVersion(in.Version)
+	if err != nil {
+		res.Result.SetError(err, "Could not find version %d of certificate '%s'", in.Version, in.ID)
+		return nil
+	}
+	res.Versions = []pkiadm.CertificateVersion{v.toPkiadm(cert.Version, true)}
+	return nil
+}
+
+// RollbackCertificate makes an earlier version of the certificate the current
+// one and writes it to all locations exporting the certificate.
+func (s *Server) RollbackCertificate(in pkiadm.CertificateVersionName, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTCertificate})
+	if err != nil {
+		res.SetError(err, "Could not find certificate '%s'", in.ID)
+		return nil
+	}
+	if err := cert.rollback(s.storage, in.Version); err != nil {
+		res.SetError(err, "Could not roll back certificate '%s' to version %d", in.ID, in.Version)
+		return nil
+	}
+	log.Printf("certificate '%s' rolled back to version %d", cert.ID, cert.Version)
+	if err := s.storage.PushLocations(cert.Name()); err != nil {
+		res.SetError(err, "Could not update locations of certificate '%s'", in.ID)
+		return nil
+	}
+	s.storage.scanForRefresh()
+	return s.store(res)
+}
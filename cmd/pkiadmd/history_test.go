@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestRollbackCertificate checks that only unexpired versions issued for the
+// private key of the certificate can be rolled back to.
+func TestRollbackCertificate(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTestCA(t, s, "root")
+	addTestCA(t, s, "other")
+
+	s.lock()
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCertificate})
+	if err != nil {
+		s.unlock()
+		t.Fatal(err)
+	}
+	other, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: "other", Type: pkiadm.RTCertificate})
+	if err != nil {
+		s.unlock()
+		t.Fatal(err)
+	}
+	// version 2 was issued for another key
+	if err := cert.addVersion(other.Data, "other", clock.Now()); err != nil {
+		s.unlock()
+		t.Fatal(err)
+	}
+	expires := cert.History[0].NotAfter
+	s.unlock()
+
+	rollback := func(version int) *pkiadm.Result {
+		res := &pkiadm.Result{}
+		in := pkiadm.CertificateVersionName{ID: "root", Version: version}
+		if err := s.RollbackCertificate(in, res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := rollback(2); !res.HasError || res.Error.Error() != EKeyMismatch.Error() {
+		t.Errorf("expected %s, got '%s'", EKeyMismatch, res.Message)
+	}
+	res := rollback(1)
+	checkResult(t, "roll back to version 1", nil, res)
+
+	clock.Advance(expires.Sub(clock.Now()))
+	if res := rollback(1); !res.HasError || res.Error.Error() != EVersionExpired.Error() {
+		t.Errorf("expected %s, got '%s'", EVersionExpired, res.Message)
+	}
+}
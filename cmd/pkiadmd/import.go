@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/gibheer/pki"
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	ENoPrivateKeyFound  = Error("no private key found in PEM data")
+	ENoCertificateFound = Error("no certificate found in PEM data")
+	EKeyMismatch        = Error("private key does not match the certificate")
+)
+
+// parsePrivateKey reads a private key in PKCS#1, SEC1, PKCS#8 or the ed25519
+// format of pki from the PEM data.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, ENoPrivateKeyFound
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case pki.PemLabelEd25519:
+			if len(block.Bytes) != ed25519.PrivateKeySize {
+				return nil, fmt.Errorf("ed25519 private key has wrong size")
+			}
+			return ed25519.PrivateKey(block.Bytes), nil
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, EUnsupportedKey
+			}
+			return signer, nil
+		}
+	}
+}
+
+// encodePrivateKey converts the key into the PEM format used by the private
+// key resources and returns its type and size.
+func encodePrivateKey(key crypto.Signer) (pkiadm.PrivateKeyType, uint, []byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block := &pem.Block{Type: pki.PemLabelRsa, Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		return pkiadm.PKTRSA, uint(k.N.BitLen()), pem.EncodeToMemory(block), nil
+	case *ecdsa.PrivateKey:
+		raw, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return pkiadm.PKTUnknown, 0, nil, err
+		}
+		block := &pem.Block{Type: pki.PemLabelEcdsa, Bytes: raw}
+		return pkiadm.PKTECDSA, uint(k.Curve.Params().BitSize), pem.EncodeToMemory(block), nil
+	case ed25519.PrivateKey:
+		block := &pem.Block{Type: pki.PemLabelEd25519, Bytes: []byte(k)}
+		return pkiadm.PKTED25519, 256, pem.EncodeToMemory(block), nil
+	default:
+		return pkiadm.PKTUnknown, 0, nil, EUnsupportedKey
+	}
+}
+
+// parseCertificates reads all certificates from the PEM data. The first one
+// is the certificate itself, the following ones form the chain. The result
+// contains the certificates PEM encoded without any other blocks.
+func parseCertificates(data []byte) ([]*x509.Certificate, []byte, error) {
+	certs := []*x509.Certificate{}
+	raw := []byte{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+		raw = append(raw, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes})...)
+	}
+	if len(certs) == 0 {
+		return nil, nil, ENoCertificateFound
+	}
+	return certs, raw, nil
+}
+
+// keyMatches checks that the private key belongs to the certificate.
+func keyMatches(cert *x509.Certificate, key crypto.Signer) error {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return EKeyMismatch
+	}
+	return nil
+}
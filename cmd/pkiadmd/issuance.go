@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Issuance records a certificate signed by a CA. It is used to answer
+	// status requests for the serial and to find out which certificate got
+	// a serial.
+	Issuance struct {
+		CA string
+		// Serial is the serial number of the certificate in hex.
+		Serial  string
+		Subject string
+		// SANs contains the DNS names, IP addresses, email addresses and URIs
+		// of the certificate.
+		SANs      []string
+		Issuer    string
+		NotBefore time.Time
+		NotAfter  time.Time
+		Issued    time.Time
+		// Requester describes the resource the certificate was issued for, e.g.
+		// cert/www or acme-order/<id>.
+		Requester string
+	}
+)
+
+// issuanceKey returns the key of the issuance in the storage.
+func issuanceKey(caID, serial string) string { return caID + "/" + serial }
+
+// AddIssuance records the first certificate of the PEM data as issued by the
+// CA.
+func (s *Storage) AddIssuance(ca *CA, data []byte, requester string) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.Errorf("no certificate found to record for '%s'", requester)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse certificate of '%s'", requester)
+	}
+	iss := &Issuance{
+		CA:        ca.ID,
+		Serial:    cert.SerialNumber.Text(16),
+		Subject:   cert.Subject.String(),
+		SANs:      subjectAltNames(cert),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Issued:    s.clock.Now(),
+		Requester: requester,
+	}
+	s.Issuances[issuanceKey(iss.CA, iss.Serial)] = iss
+	return nil
+}
+
+// subjectAltNames returns all alternative names of the certificate as
+// strings.
+func subjectAltNames(cert *x509.Certificate) []string {
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// completeIssuances fills in the subject and alternative names of issuances
+// recorded by older versions, as far as the certificates are still known.
+func (s *Storage) completeIssuances() {
+	certs := map[string]*x509.Certificate{}
+	for _, c := range s.Certificates {
+		datas := [][]byte{c.Data}
+		for _, v := range c.History {
+			datas = append(datas, v.Data)
+		}
+		for _, data := range datas {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+			certs[c.Name().String()+"/"+cert.SerialNumber.Text(16)] = cert
+		}
+	}
+	for _, iss := range s.Issuances {
+		if iss.Subject != "" {
+			continue
+		}
+		if cert, found := certs[iss.Requester+"/"+iss.Serial]; found {
+			iss.Subject = cert.Subject.String()
+			iss.SANs = subjectAltNames(cert)
+			iss.Issuer = cert.Issuer.String()
+		}
+	}
+}
+
+// GetIssuance returns the issuance of the serial by the CA.
+func (s *Storage) GetIssuance(caID, serial string) (*Issuance, bool) {
+	iss, found := s.Issuances[issuanceKey(caID, serial)]
+	return iss, found
+}
+
+// matches returns true, when the issuance is selected by the filter.
+func (iss *Issuance) matches(filter pkiadm.IssuanceFilter) bool {
+	if filter.CA != "" && filter.CA != iss.CA {
+		return false
+	}
+	if filter.Serial != "" {
+		serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(filter.Serial), "0x"), 16)
+		if !ok || serial.Text(16) != iss.Serial {
+			return false
+		}
+	}
+	if filter.Subject != "" && !strings.Contains(strings.ToLower(iss.Subject), strings.ToLower(filter.Subject)) {
+		return false
+	}
+	if filter.SAN != "" {
+		found := false
+		for _, san := range iss.SANs {
+			if strings.EqualFold(san, filter.SAN) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// toPkiadm converts the issuance into the representation used by the RPC
+// interface. The status is taken from the revocations of the CA.
+func (iss *Issuance) toPkiadm(lookup *Storage, now time.Time) pkiadm.Issuance {
+	res := pkiadm.Issuance{
+		CA:        iss.CA,
+		Serial:    iss.Serial,
+		Subject:   iss.Subject,
+		SANs:      iss.SANs,
+		Issuer:    iss.Issuer,
+		NotBefore: iss.NotBefore,
+		NotAfter:  iss.NotAfter,
+		Issued:    iss.Issued,
+		Requester: iss.Requester,
+		Status:    pkiadm.ISValid,
+	}
+	if now.After(iss.NotAfter) {
+		res.Status = pkiadm.ISExpired
+	}
+	ca, err := lookup.GetCA(pkiadm.ResourceName{ID: iss.CA, Type: pkiadm.RTCA})
+	if err != nil {
+		return res
+	}
+	for _, rev := range ca.Revocations {
+		if rev.Serial == iss.Serial {
+			res.Status = pkiadm.ISRevoked
+			res.RevokedAt = rev.RevokedAt
+			res.Reason = rev.Reason
+		}
+	}
+	return res
+}
+
+func (s *Server) FindCertificate(filter pkiadm.IssuanceFilter, res *pkiadm.ResultIssuance) error {
+	s.lock()
+	defer s.unlock()
+
+	now := s.storage.clock.Now()
+	for _, iss := range s.storage.Issuances {
+		if iss.matches(filter) {
+			res.Issuances = append(res.Issuances, iss.toPkiadm(s.storage, now))
+		}
+	}
+	sort.Slice(res.Issuances, func(i, j int) bool {
+		a, b := res.Issuances[i], res.Issuances[j]
+		if !a.Issued.Equal(b.Issued) {
+			return a.Issued.Before(b.Issued)
+		}
+		return a.NotBefore.Before(b.NotBefore)
+	})
+	return nil
+}
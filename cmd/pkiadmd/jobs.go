@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	EUnknownJob = Error("unknown job")
+
+	// keepJobs is the number of finished jobs kept for the clients to look
+	// up.
+	keepJobs = 100
+	// maxJobWait is the longest time a client waits for a job in one
+	// request.
+	maxJobWait = 5 * time.Minute
+)
+
+type (
+	// Jobs runs slow operations one after another in the background, so that
+	// requests don't have to wait for them. Jobs are only kept in memory,
+	// a job interrupted by a restart has to be started again.
+	Jobs struct {
+		clock Clock
+		mu    sync.Mutex
+		seq   uint64
+		jobs  map[string]*job
+		order []string
+		// queue contains the jobs waiting to be run. The worker is woken up
+		// through added.
+		queue []*job
+		added *sync.Cond
+	}
+
+	job struct {
+		pkiadm.Job
+		run  func() error
+		done chan struct{}
+	}
+)
+
+// NewJobs starts the worker running the jobs. The times of the jobs are
+// taken from the clock.
+func NewJobs(clock Clock) *Jobs {
+	j := &Jobs{
+		clock: clock,
+		jobs:  map[string]*job{},
+	}
+	j.added = sync.NewCond(&j.mu)
+	go j.work()
+	return j
+}
+
+// Submit queues the function as a job and returns the id of the job. The
+// function is called without any lock held.
+func (j *Jobs) Submit(description string, rn pkiadm.ResourceName, run func() error) string {
+	j.mu.Lock()
+	j.seq++
+	next := &job{
+		Job: pkiadm.Job{
+			ID:          strconv.FormatUint(j.seq, 10),
+			Description: description,
+			Resource:    rn,
+			State:       pkiadm.JSQueued,
+			Created:     j.clock.Now(),
+		},
+		run:  run,
+		done: make(chan struct{}),
+	}
+	j.jobs[next.ID] = next
+	j.order = append(j.order, next.ID)
+	j.queue = append(j.queue, next)
+	j.prune()
+	j.added.Signal()
+	j.mu.Unlock()
+
+	log.Printf("job %s queued: %s", next.ID, description)
+	return next.ID
+}
+
+// work runs the queued jobs.
+func (j *Jobs) work() {
+	for {
+		j.mu.Lock()
+		for len(j.queue) == 0 {
+			j.added.Wait()
+		}
+		next := j.queue[0]
+		j.queue = j.queue[1:]
+		next.State = pkiadm.JSRunning
+		next.Started = j.clock.Now()
+		j.mu.Unlock()
+
+		err := next.run()
+
+		j.mu.Lock()
+		next.Finished = j.clock.Now()
+		if err != nil {
+			next.State = pkiadm.JSFailed
+			next.Error = err.Error()
+			log.Printf("job %s failed: %s", next.ID, err)
+		} else {
+			next.State = pkiadm.JSDone
+			log.Printf("job %s done: %s", next.ID, next.Description)
+		}
+		close(next.done)
+		j.mu.Unlock()
+	}
+}
+
+// prune removes the oldest finished jobs beyond the ones to keep.
+func (j *Jobs) prune() {
+	for i := 0; len(j.order) > keepJobs && i < len(j.order); {
+		id := j.order[i]
+		if state := j.jobs[id].State; state != pkiadm.JSDone && state != pkiadm.JSFailed {
+			i++
+			continue
+		}
+		delete(j.jobs, id)
+		j.order = append(j.order[:i], j.order[i+1:]...)
+	}
+}
+
+// List returns all known jobs in the order they were submitted.
+func (j *Jobs) List() []pkiadm.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	res := []pkiadm.Job{}
+	for _, id := range j.order {
+		res = append(res, j.jobs[id].Job)
+	}
+	return res
+}
+
+// Wait waits until the job is finished or the timeout is hit and returns the
+// state of the job.
+func (j *Jobs) Wait(id string, timeout time.Duration) (pkiadm.Job, error) {
+	j.mu.Lock()
+	found, ok := j.jobs[id]
+	j.mu.Unlock()
+	if !ok {
+		return pkiadm.Job{}, EUnknownJob
+	}
+	if timeout <= 0 || timeout > maxJobWait {
+		timeout = maxJobWait
+	}
+	select {
+	case <-found.done:
+	case <-time.After(timeout):
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return found.Job, nil
+}
+
+// ListJobs returns all known jobs. It doesn't wait for the storage.
+func (s *Server) ListJobs(filter pkiadm.Filter, res *pkiadm.ResultJob) error {
+	res.Jobs = s.jobs.List()
+	return nil
+}
+
+// WaitJob waits for the job to finish. It doesn't hold the storage, so that
+// the job can make progress.
+func (s *Server) WaitJob(in pkiadm.JobWait, res *pkiadm.ResultJob) error {
+	job, err := s.jobs.Wait(in.ID, in.Timeout)
+	if err != nil {
+		res.Result.SetError(err, "Could not find job '%s'", in.ID)
+		return nil
+	}
+	res.Jobs = []pkiadm.Job{job}
+	return nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Journal records the RPC requests changing the storage before they are
+	// executed. A request is completed, when its changes were stored. Requests
+	// without a completion were interrupted by a crash and get replayed on the
+	// next start.
+	Journal struct {
+		// turn is held by the request changing the storage, so that a store
+		// completes the right request.
+		turn sync.Mutex
+		// current is the request holding the turn.
+		current uint64
+
+		mu   sync.Mutex
+		file *os.File
+		seq  uint64
+		// pending contains the requests currently executed.
+		pending map[uint64]bool
+		// unfinished contains the interrupted requests found at startup.
+		unfinished []journalEntry
+		replaying  bool
+	}
+
+	journalEntry struct {
+		Seq    uint64
+		Method string          `json:",omitempty"`
+		Args   json.RawMessage `json:",omitempty"`
+		Done   bool            `json:",omitempty"`
+	}
+
+	// journalCodec wraps the codec of a connection and records all changing
+	// requests in the journal.
+	journalCodec struct {
+		rpc.ServerCodec
+		journal *Journal
+		method  string
+		reqSeq  uint64
+
+		mu sync.Mutex
+		// entries maps the RPC sequence to the sequence in the journal.
+		entries map[uint64]uint64
+	}
+
+	// gobServerCodec is the codec used by rpc.ServeConn.
+	gobServerCodec struct {
+		rwc    io.ReadWriteCloser
+		dec    *gob.Decoder
+		enc    *gob.Encoder
+		encBuf *bufio.Writer
+		closed bool
+	}
+)
+
+// unjournaled contains the changing requests, which are not journaled as they
+// contain passphrases or private keys.
+var unjournaled = map[string]bool{
+	"Unlock":           true,
+	"Rekey":            true,
+	"ImportPrivateKey": true,
+	"ImportCA":         true,
+}
+
+// changePrefixes are the prefixes of the methods changing the storage.
+var changePrefixes = []string{"Create", "Set", "Delete", "Import", "Revoke", "Rollback"}
+
+// journaled returns true for requests changing the storage.
+func journaled(method string) bool {
+	if unjournaled[method] {
+		return false
+	}
+	for _, prefix := range changePrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenJournal opens the journal at the path and reads the requests, which were
+// not finished.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{file: file, pending: map[uint64]bool{}}
+	entries := map[uint64]journalEntry{}
+	order := []uint64{}
+	dec := json.NewDecoder(file)
+	for {
+		entry := journalEntry{}
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			// the last entry may be incomplete after a crash
+			log.Printf("ignoring rest of journal '%s': %s", path, err)
+			break
+		}
+		if entry.Seq > j.seq {
+			j.seq = entry.Seq
+		}
+		if entry.Done {
+			delete(entries, entry.Seq)
+			continue
+		}
+		entries[entry.Seq] = entry
+		order = append(order, entry.Seq)
+	}
+	for _, seq := range order {
+		if entry, found := entries[seq]; found {
+			j.unfinished = append(j.unfinished, entry)
+		}
+	}
+	if len(j.unfinished) == 0 {
+		if err := j.truncate(); err != nil {
+			return nil, err
+		}
+	} else if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Turn waits until no other request changes the storage. Requests changing
+// the storage without a journal entry must hold the turn too, as their store
+// would complete the request of another one.
+func (j *Journal) Turn() {
+	j.turn.Lock()
+	j.current = 0
+}
+
+// Begin waits for the turn and records the request before it is executed.
+func (j *Journal) Begin(method string, args interface{}) (uint64, error) {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+	j.turn.Lock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	if err := j.write(journalEntry{Seq: j.seq, Method: method, Args: raw}); err != nil {
+		j.turn.Unlock()
+		return 0, err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.turn.Unlock()
+		return 0, err
+	}
+	j.pending[j.seq] = true
+	j.current = j.seq
+	return j.seq, nil
+}
+
+// Commit completes the request holding the turn after its changes were
+// stored.
+func (j *Journal) Commit() error {
+	if j == nil || j.current == 0 {
+		return nil
+	}
+	seq := j.current
+	j.current = 0
+	return j.Done(seq)
+}
+
+// Continue hands the request holding the turn over to a job, which must call
+// Done after storing its changes. It returns the sequence of the request.
+func (j *Journal) Continue() uint64 {
+	if j == nil {
+		return 0
+	}
+	seq := j.current
+	j.current = 0
+	return seq
+}
+
+// End releases the turn. A request, which did not store anything, is
+// completed.
+func (j *Journal) End() error {
+	seq := j.current
+	j.current = 0
+	j.turn.Unlock()
+	if seq == 0 {
+		return nil
+	}
+	return j.Done(seq)
+}
+
+// Done marks the request as finished. When no requests are left, the journal
+// is emptied.
+func (j *Journal) Done(seq uint64) error {
+	if j == nil || seq == 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.pending[seq] {
+		return nil
+	}
+	delete(j.pending, seq)
+	if len(j.pending) == 0 && len(j.unfinished) == 0 {
+		return j.truncate()
+	}
+	if err := j.write(journalEntry{Seq: seq, Done: true}); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) write(entry journalEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(raw, '\n'))
+	return err
+}
+
+func (j *Journal) truncate() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error { return j.file.Close() }
+
+// replayJournal executes the requests interrupted by a crash. As private keys
+// may be needed, the replay waits until the storage is unlocked.
+func (s *Server) replayJournal() {
+	j := s.journal
+	s.lock()
+	locked := s.storage.Locked()
+	s.unlock()
+
+	j.mu.Lock()
+	entries := j.unfinished
+	if len(entries) == 0 || j.replaying {
+		j.mu.Unlock()
+		return
+	}
+	if locked {
+		j.mu.Unlock()
+		log.Printf("%d interrupted requests will be replayed after unlock", len(entries))
+		return
+	}
+	j.replaying = true
+	j.mu.Unlock()
+
+	for _, entry := range entries {
+		log.Printf("replaying interrupted request '%s'", entry.Method)
+		j.turn.Lock()
+		j.mu.Lock()
+		j.pending[entry.Seq] = true
+		j.mu.Unlock()
+		j.current = entry.Seq
+		if err := s.replay(entry); err != nil {
+			log.Printf("replay of request '%s' failed: %s", entry.Method, err)
+		}
+		if err := j.End(); err != nil {
+			log.Printf("could not update journal: %s", err)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.unfinished = nil
+	j.replaying = false
+	if len(j.pending) == 0 {
+		if err := j.truncate(); err != nil {
+			log.Printf("could not empty journal: %s", err)
+		}
+	}
+}
+
+// replay calls the RPC method of the entry and records it in the audit log.
+func (s *Server) replay(entry journalEntry) error {
+	method := reflect.ValueOf(s).MethodByName(entry.Method)
+	if !method.IsValid() || method.Type().NumIn() != 2 {
+		return errors.Errorf("unknown method")
+	}
+	arg := reflect.New(method.Type().In(0))
+	if err := json.Unmarshal(entry.Args, arg.Interface()); err != nil {
+		return err
+	}
+	reply := reflect.New(method.Type().In(1).Elem())
+	record := pkiadm.AuditEntry{
+		Caller:   daemonCaller,
+		Action:   entry.Method,
+		Resource: auditedResource(entry.Method, arg.Interface()),
+		Fields:   changedFields(arg.Interface()),
+	}
+	// the request may have been stored before the crash
+	if strings.HasPrefix(entry.Method, "Create") && record.Resource.ID != "" {
+		s.lock()
+		_, err := s.storage.Get(record.Resource)
+		s.unlock()
+		if err == nil {
+			return EAlreadyExist
+		}
+	}
+	record.OldChecksum = s.checksum(record.Resource)
+	out := method.Call([]reflect.Value{arg.Elem(), reply})
+	err, _ := out[0].Interface().(error)
+	if res, ok := reply.Interface().(*pkiadm.Result); ok && res.HasError && err == nil {
+		err = res.Error
+	}
+	if err != nil {
+		record.Outcome = pkiadm.AOFailed
+		record.Error = err.Error()
+	} else {
+		record.NewChecksum = s.checksum(record.Resource)
+	}
+	s.storage.audit.record(record)
+	return err
+}
+
+// serveJournaled accepts connections on the listener and records the
+// changing requests in the journal and the audit log. Requests not allowed by
+// the policy are rejected before they reach the journal.
+func serveJournaled(rpcServer *rpc.Server, listener net.Listener, server *Server, policy *Policy) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("rpc listener stopped: %s", err)
+			return
+		}
+		go func(conn net.Conn) {
+			// identifying the caller may need a TLS handshake, so it must
+			// not block the listener
+			caller, err := identify(conn)
+			if err != nil {
+				log.Printf("could not identify caller from '%s': %s", conn.RemoteAddr(), err)
+			}
+			rpcServer.ServeCodec(server.wrapCodec(newGobServerCodec(conn), caller, policy))
+		}(conn)
+	}
+}
+
+// wrapCodec wraps the codec of a connection from the caller, so that the
+// requests are checked against the policy and recorded in the audit log and
+// the journal.
+func (s *Server) wrapCodec(codec rpc.ServerCodec, caller Caller, policy *Policy) rpc.ServerCodec {
+	return &journalCodec{
+		ServerCodec: newAuditCodec(newAuthCodec(codec, caller, policy), s, caller),
+		journal:     s.journal,
+		entries:     map[uint64]uint64{},
+	}
+}
+
+func (c *journalCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = strings.TrimPrefix(r.ServiceMethod, pkiadm.ProtoIdent+".")
+	c.reqSeq = r.Seq
+	return err
+}
+
+func (c *journalCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if body == nil || !audited(c.method) {
+		return nil
+	}
+	var seq uint64
+	if journaled(c.method) {
+		var err error
+		if seq, err = c.journal.Begin(c.method, body); err != nil {
+			return errors.Wrap(err, "could not write journal")
+		}
+	} else {
+		c.journal.Turn()
+	}
+	c.mu.Lock()
+	c.entries[c.reqSeq] = seq
+	c.mu.Unlock()
+	return nil
+}
+
+// WriteResponse ends the turn of the request. The journal entry was already
+// completed, when the request stored its changes.
+func (c *journalCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	_, found := c.entries[r.Seq]
+	delete(c.entries, r.Seq)
+	c.mu.Unlock()
+	if found {
+		if err := c.journal.End(); err != nil {
+			log.Printf("could not update journal: %s", err)
+		}
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the response could not be encoded, so the connection is broken
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
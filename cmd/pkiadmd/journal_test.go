@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestOpenJournalTruncatedTail checks that an entry cut off by a crash is
+// ignored, while the complete unfinished entries are kept.
+func TestOpenJournalTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.journal")
+	raw := `{"Seq":1,"Method":"CreateSubject","Args":{"ID":"a"}}
+{"Seq":1,"Done":true}
+{"Seq":2,"Method":"CreateSubject","Args":{"ID":"b"}}
+{"Seq":3,"Method":"CreateSubj`
+	if err := ioutil.WriteFile(path, []byte(raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if len(j.unfinished) != 1 || j.unfinished[0].Seq != 2 {
+		t.Fatalf("expected only request 2 to be unfinished, got %+v", j.unfinished)
+	}
+	// new requests must not reuse the sequence of a replayed one
+	seq, err := j.Begin("CreateSubject", pkiadm.Subject{ID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.End()
+	if seq <= 2 {
+		t.Errorf("expected a sequence after 2, got %d", seq)
+	}
+}
+
+// TestJournalCommit checks that a request is completed by storing its
+// changes and that a request continued in a job stays unfinished until the
+// job is done.
+func TestJournalCommit(t *testing.T) {
+	s, _ := newTestServer(t)
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "storage.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	s.journal = j
+
+	if _, err := j.Begin("CreateSubject", pkiadm.Subject{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	res := &pkiadm.Result{}
+	err = s.CreateSubject(pkiadm.Subject{ID: "a", Name: pkix.Name{CommonName: "a"}}, res)
+	checkResult(t, "create subject", err, res)
+	if len(j.pending) != 0 {
+		t.Errorf("stored request is still pending")
+	}
+	j.End()
+
+	if _, err := j.Begin("CreatePrivateKey", pkiadm.PrivateKey{ID: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreatePrivateKey(pkiadm.PrivateKey{ID: "key", Type: pkiadm.PKTECDSA, Bits: 256}, res)
+	checkResult(t, "create private key", err, res)
+	j.End()
+	waitForJob(t, s, res.Job)
+	if len(j.pending) != 0 {
+		t.Errorf("request is still pending after the job")
+	}
+	if info, err := j.file.Stat(); err != nil || info.Size() != 0 {
+		t.Errorf("expected the journal to be emptied: %v", err)
+	}
+}
+
+// TestReplaySkipsExisting checks that an interrupted create is not replayed,
+// when the resource was stored before the crash.
+func TestReplaySkipsExisting(t *testing.T) {
+	s, _ := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "storage.journal")
+	raw := `{"Seq":1,"Method":"CreateSubject","Args":{"ID":"a","Name":{"CommonName":"new"}}}
+{"Seq":2,"Method":"CreateSubject","Args":{"ID":"b","Name":{"CommonName":"b"}}}
+`
+	if err := ioutil.WriteFile(path, []byte(raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	res := &pkiadm.Result{}
+	err = s.CreateSubject(pkiadm.Subject{ID: "a", Name: pkix.Name{CommonName: "old"}}, res)
+	checkResult(t, "create subject", err, res)
+	s.journal = j
+	s.replayJournal()
+
+	s.lock()
+	defer s.unlock()
+	a, err := s.storage.GetSubject(pkiadm.ResourceName{ID: "a", Type: pkiadm.RTSubject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Data.CommonName != "old" {
+		t.Errorf("existing subject was replaced by the replay")
+	}
+	if _, err := s.storage.GetSubject(pkiadm.ResourceName{ID: "b", Type: pkiadm.RTSubject}); err != nil {
+		t.Errorf("interrupted request was not replayed: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("expected the journal to be emptied: %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"time"
 
 	"github.com/gibheer/pkiadm"
 )
@@ -83,7 +82,7 @@ func (l *Location) Refresh(lookup *Storage) error {
 			return err
 		}
 	}
-	l.Interval.LastRefresh = time.Now()
+	l.Interval.LastRefresh = lookup.clock.Now()
 	return nil
 }
 
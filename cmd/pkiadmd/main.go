@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/gibheer/pkiadm"
+	flag "github.com/spf13/pflag"
 )
 
 const (
@@ -54,6 +58,18 @@ type (
 		// and the duration. When the refresh duration is less than the invalid
 		// duration, then the resource will never be invalid.
 		InvalidAfter time.Duration
+		// NotAfter is the end of the validity of the current content. When
+		// known, the refresh is planned relative to it.
+		NotAfter time.Time
+		// RenewBefore refreshes the resource the given time before NotAfter.
+		RenewBefore time.Duration
+		// RenewAt refreshes the resource after the share of its lifetime, when
+		// RenewBefore is not set.
+		RenewAt float64
+		// Jitter is the maximum random time a refresh is moved forward.
+		Jitter time.Duration
+		// Delay is the jitter chosen for the next refresh.
+		Delay time.Duration
 	}
 
 	Error string
@@ -66,6 +82,16 @@ func main() {
 }
 
 func _main() int {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		return migrateCommand(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		return restoreCommand(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		return openAPICommand(os.Args[2:])
+	}
+
 	cfg, err := pkiadm.LoadConfig()
 	if err != nil {
 		log.Fatalf("could not load config: %s", err)
@@ -76,21 +102,94 @@ func _main() int {
 		log.Fatalf("could not parse unix path: %s", err)
 	}
 
-	storage, err := NewStorage(cfg.Storage)
+	backupInterval := time.Duration(0)
+	if cfg.BackupInterval != "" {
+		backupInterval, err = time.ParseDuration(cfg.BackupInterval)
+		if err != nil {
+			log.Fatalf("could not parse backup interval: %s", err)
+		}
+	}
+	backups := NewBackups(cfg.Storage, cfg.Backups, backupInterval)
+	backend, err := OpenBackend(cfg.StorageType, cfg.Storage)
+	if err != nil {
+		offerRestore(backups, cfg)
+		log.Fatalf("could not open storage: %s", err)
+	}
+	defer backend.Close()
+	storage, err := NewStorage(backend, backups)
 	if err != nil {
+		offerRestore(backups, cfg)
 		log.Fatalf("error when loading: %s\n", err)
 	}
+	journal, err := OpenJournal(cfg.Storage + ".journal")
+	if err != nil {
+		log.Fatalf("could not open journal: %s", err)
+	}
+	defer journal.Close()
+	audit, err := OpenAuditLog(cfg.Storage + ".audit")
+	if err != nil {
+		log.Fatalf("could not open audit log: %s", err)
+	}
+	defer audit.Close()
+	passphrase, err := readPassphrase(cfg)
+	if err != nil {
+		log.Fatalf("could not read passphrase: %s", err)
+	}
+	// the scheduler may already be running
+	storage.mu.Lock()
+	storage.audit = audit
+	if storage.Locked() && passphrase == nil {
+		log.Printf("storage is locked, waiting for 'pkiadm unlock'")
+	} else if storage.Locked() {
+		if err := storage.Unlock(passphrase); err != nil {
+			log.Fatalf("could not unlock storage: %s", err)
+		}
+	}
+	storage.mu.Unlock()
 
-	server, err := NewServer(storage)
+	server, err := NewServer(storage, journal)
 	if err != nil {
 		log.Fatalf("error when loading server: %s\n", err)
 	}
+	server.replayJournal()
+
+	var policy *Policy
+	if cfg.PolicyFile != "" {
+		policy, err = LoadPolicy(cfg.PolicyFile)
+		if err != nil {
+			log.Fatalf("could not load policy: %s", err)
+		}
+	}
 
 	rpcServer := rpc.NewServer()
 	if err := rpcServer.RegisterName(pkiadm.ProtoIdent, server); err != nil {
 		log.Fatalf("could not bind rpc interface: %s\n", err)
 	}
 
+	if cfg.ACMEListen != "" {
+		if err := startACMEServer(cfg, server); err != nil {
+			log.Fatalf("could not start acme server: %s", err)
+		}
+	}
+
+	if cfg.OCSPListen != "" {
+		if err := startOCSPServer(cfg, server); err != nil {
+			log.Fatalf("could not start ocsp server: %s", err)
+		}
+	}
+
+	if cfg.AdminListen != "" {
+		if err := startAdminServer(cfg, server, rpcServer, policy); err != nil {
+			log.Fatalf("could not start admin listener: %s", err)
+		}
+	}
+
+	if cfg.RESTListen != "" {
+		if err := startRESTServer(cfg, server, rpcServer, policy); err != nil {
+			log.Fatalf("could not start rest server: %s", err)
+		}
+	}
+
 	listener, err := net.ListenUnix("unix", addr)
 	if err != nil {
 		log.Fatalf("could not open listen socket: %s", err)
@@ -108,7 +207,100 @@ func _main() int {
 		os.Exit(1)
 	}()
 
-	rpcServer.Accept(listener)
+	serveJournaled(rpcServer, listener, server, policy)
 
 	return 0
 }
+
+// offerRestore points to the newest backup, which can replace a corrupted
+// storage.
+func offerRestore(backups *Backups, cfg *pkiadm.Config) {
+	name, err := backups.NewestGood(cfg.StorageType)
+	if err != nil {
+		return
+	}
+	log.Printf("the storage '%s' may be corrupted, restore the backup '%s' with 'pkiadmd restore'", cfg.Storage, name)
+}
+
+// migrateCommand converts a storage from one backend type into another.
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadmd migrate")
+		fmt.Print(`
+Copy all resources from one storage into another one, e.g. to switch from the JSON file to a bbolt database. The daemon must not be running. Afterwards, set Storage and StorageType in the config to the new storage.
+`)
+		fs.PrintDefaults()
+	}
+	fromType := fs.String("from-type", BackendJSON, "the backend type of the existing storage (json, bolt)")
+	from := fs.String("from", "pkiadm.db", "the path to the existing storage")
+	toType := fs.String("to-type", BackendBolt, "the backend type of the new storage (json, bolt)")
+	to := fs.String("to", "", "the path to the new storage, which must not exist yet")
+	fs.Parse(args)
+
+	if *to == "" {
+		log.Printf("no destination given")
+		return 2
+	}
+	if _, err := os.Stat(*to); err == nil {
+		log.Printf("destination '%s' already exists", *to)
+		return 2
+	}
+	src, err := OpenBackend(*fromType, *from)
+	if err != nil {
+		log.Printf("could not open source: %s", err)
+		return 1
+	}
+	defer src.Close()
+	dst, err := OpenBackend(*toType, *to)
+	if err != nil {
+		log.Printf("could not open destination: %s", err)
+		return 1
+	}
+	defer dst.Close()
+	if err := migrate(src, dst); err != nil {
+		log.Printf("migration failed: %s", err)
+		return 1
+	}
+	log.Printf("migrated '%s' to '%s'", *from, *to)
+	return 0
+}
+
+// startACMEServer opens the listener for the ACME directories and serves them
+// in the background.
+func startACMEServer(cfg *pkiadm.Config, server *Server) error {
+	listener, err := net.Listen("tcp", cfg.ACMEListen)
+	if err != nil {
+		return err
+	}
+	baseURL := cfg.ACMEURL
+	if baseURL == "" && cfg.ACMECertificate == "" {
+		baseURL = "http://" + cfg.ACMEListen
+	} else if baseURL == "" {
+		baseURL = "https://" + cfg.ACMEListen
+	}
+	httpServer := &http.Server{Handler: NewACMEServer(server, baseURL)}
+	if cfg.ACMECertificate == "" {
+		go func() { log.Printf("acme server stopped: %s", httpServer.Serve(listener)) }()
+		return nil
+	}
+	httpServer.TLSConfig = &tls.Config{
+		GetCertificate: server.tlsCertificate(
+			pkiadm.ResourceName{ID: cfg.ACMECertificate, Type: pkiadm.RTCertificate},
+		),
+	}
+	go func() { log.Printf("acme server stopped: %s", httpServer.ServeTLS(listener, "", "")) }()
+	return nil
+}
+
+// startOCSPServer opens the listener for OCSP requests and serves them in the
+// background.
+func startOCSPServer(cfg *pkiadm.Config, server *Server) error {
+	listener, err := net.Listen("tcp", cfg.OCSPListen)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: NewOCSPServer(server)}
+	go func() { log.Printf("ocsp server stopped: %s", httpServer.Serve(listener)) }()
+	return nil
+}
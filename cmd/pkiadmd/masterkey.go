@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gibheer/pkiadm"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ELocked             = Error("storage is locked, unlock it with the passphrase first")
+	ENotEncrypted       = Error("storage is not encrypted")
+	EWrongPassphrase    = Error("wrong passphrase")
+	EEmptyPassphrase    = Error("passphrase must not be empty")
+	ECiphertextTooShort = Error("encrypted data is too short")
+
+	// passphraseEnv is the environment variable to read the passphrase from
+	// at startup.
+	passphraseEnv = "PKIADM_PASSPHRASE"
+)
+
+type (
+	// MasterKey encrypts the private key material in the storage file. The
+	// master key is random and stored wrapped with a key derived from the
+	// passphrase, so that changing the passphrase does not need to touch
+	// every private key.
+	MasterKey struct {
+		// Salt and the scrypt parameters N, R and P derive the wrapping key
+		// from the passphrase.
+		Salt []byte
+		N    int
+		R    int
+		P    int
+		// Wrapped is the master key encrypted with the wrapping key.
+		Wrapped []byte
+		// key is the unwrapped master key. It is nil while locked.
+		key []byte
+	}
+)
+
+// NewMasterKey creates a new random master key protected by the passphrase.
+// The new master key is unlocked.
+func NewMasterKey(passphrase []byte) (*MasterKey, error) {
+	if len(passphrase) == 0 {
+		return nil, EEmptyPassphrase
+	}
+	m := &MasterKey{
+		Salt: make([]byte, 32),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+		key:  make([]byte, 32),
+	}
+	if _, err := io.ReadFull(rand.Reader, m.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, m.key); err != nil {
+		return nil, err
+	}
+	kek, err := m.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	m.Wrapped, err = encrypt(kek, m.key)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// deriveKey returns the key to wrap the master key with.
+func (m *MasterKey) deriveKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, m.Salt, m.N, m.R, m.P, 32)
+}
+
+// Unlock unwraps the master key with the passphrase.
+func (m *MasterKey) Unlock(passphrase []byte) error {
+	kek, err := m.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	key, err := decrypt(kek, m.Wrapped)
+	if err != nil {
+		return EWrongPassphrase
+	}
+	m.key = key
+	return nil
+}
+
+// Locked returns true, when the master key was not yet unlocked.
+func (m *MasterKey) Locked() bool { return m.key == nil }
+
+// Seal encrypts the data with the master key.
+func (m *MasterKey) Seal(plain []byte) ([]byte, error) {
+	if m.Locked() {
+		return nil, ELocked
+	}
+	return encrypt(m.key, plain)
+}
+
+// Open decrypts data sealed with the master key.
+func (m *MasterKey) Open(sealed []byte) ([]byte, error) {
+	if m.Locked() {
+		return nil, ELocked
+	}
+	return decrypt(m.key, sealed)
+}
+
+// encrypt seals the data with AES-GCM. The nonce is prepended to the result.
+func encrypt(key, plain []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// decrypt opens data sealed by encrypt.
+func decrypt(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ECiphertextTooShort
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Locked returns true, when the private keys in the storage are encrypted and
+// the master key was not unlocked yet.
+func (s *Storage) Locked() bool {
+	return s.MasterKey != nil && s.MasterKey.Locked()
+}
+
+// Unlock unwraps the master key and decrypts all private keys.
+func (s *Storage) Unlock(passphrase []byte) error {
+	if s.MasterKey == nil {
+		return ENotEncrypted
+	}
+	if err := s.MasterKey.Unlock(passphrase); err != nil {
+		return err
+	}
+	for _, pk := range s.PrivateKeys {
+		if err := pk.open(s.MasterKey); err != nil {
+			s.lockKeys()
+			return err
+		}
+	}
+	for _, o := range s.OCSPs {
+		if err := o.open(s.MasterKey); err != nil {
+			s.lockKeys()
+			return err
+		}
+	}
+	log.Printf("storage unlocked")
+	s.scanForRefresh()
+	return nil
+}
+
+// lockKeys removes the master key and all decrypted keys from memory.
+func (s *Storage) lockKeys() {
+	s.MasterKey.key = nil
+	for _, pk := range s.PrivateKeys {
+		if len(pk.Sealed) > 0 {
+			pk.Key = nil
+		}
+	}
+	for _, o := range s.OCSPs {
+		if len(o.Sealed) > 0 {
+			o.Key = nil
+		}
+	}
+}
+
+// Rekey replaces the master key with a new one protected by the new
+// passphrase. When the storage is not encrypted yet, encryption gets enabled.
+// The private keys are encrypted with the new master key on the next store.
+func (s *Storage) Rekey(passphrase, newPassphrase []byte) error {
+	if s.MasterKey != nil {
+		if s.MasterKey.Locked() {
+			return ELocked
+		}
+		check := *s.MasterKey
+		if err := check.Unlock(passphrase); err != nil {
+			return err
+		}
+	}
+	m, err := NewMasterKey(newPassphrase)
+	if err != nil {
+		return err
+	}
+	s.MasterKey = m
+	log.Printf("master key rotated")
+	return nil
+}
+
+// sealKeys encrypts all private keys with the master key before they are
+// written to disk.
+func (s *Storage) sealKeys() error {
+	if s.MasterKey == nil {
+		return nil
+	}
+	for _, pk := range s.PrivateKeys {
+		if err := pk.seal(s.MasterKey); err != nil {
+			return err
+		}
+	}
+	for _, o := range s.OCSPs {
+		if err := o.seal(s.MasterKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPassphrase returns the passphrase to unlock the storage at startup. It
+// is read from the configured file or the environment. When none is
+// available, nil is returned.
+func readPassphrase(cfg *pkiadm.Config) ([]byte, error) {
+	if cfg.PassphraseFile != "" {
+		raw, err := ioutil.ReadFile(cfg.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(raw), "\r\n")), nil
+	}
+	if passphrase, found := os.LookupEnv(passphraseEnv); found {
+		// don't leak the passphrase to the commands of locations
+		os.Unsetenv(passphraseEnv)
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+func (s *Server) Unlock(in pkiadm.MasterKeyUnlock, res *pkiadm.Result) error {
+	s.lock()
+	err := s.storage.Unlock(in.Passphrase)
+	s.unlock()
+	if err != nil {
+		res.SetError(err, "Could not unlock storage")
+		return nil
+	}
+	// requests interrupted while locked can only be replayed now
+	s.replayJournal()
+	return nil
+}
+
+func (s *Server) Rekey(in pkiadm.MasterKeyChange, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	if err := s.storage.Rekey(in.Passphrase, in.NewPassphrase); err != nil {
+		res.SetError(err, "Could not change master key")
+		return nil
+	}
+	return s.store(res)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	EUnknownIssuer     = Error("no OCSP responder found for the issuer")
+	EUnsupportedHash   = Error("hash algorithm of the request is not supported")
+	ENoOCSPCertificate = Error("OCSP responder has no signing certificate")
+)
+
+const (
+	// ocspCertLifetime is the minimal lifetime of a delegated OCSP signing
+	// certificate.
+	ocspCertLifetime = 30 * 24 * time.Hour
+	// ocspMaxRequestSize limits the size of requests sent per POST.
+	ocspMaxRequestSize = 10 * 1024
+)
+
+// ocspNoCheck is the id-pkix-ocsp-nocheck extension (RFC 6960 4.2.2.2.1). It
+// tells clients not to ask for the status of the delegated certificate.
+var ocspNoCheck = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5},
+	Value: []byte{0x05, 0x00},
+}
+
+type (
+	// OCSPResponder answers status requests for the certificates of a CA. The
+	// responses are signed by a delegated certificate, which is renewed
+	// together with the pre-generated responses.
+	OCSPResponder struct {
+		ID       string
+		CA       pkiadm.ResourceName
+		Duration time.Duration
+		Interval Interval
+
+		// Key and Certificate contain the delegated signing key and certificate
+		// in PEM format.
+		Key         []byte
+		Certificate []byte
+		// Sealed contains the key encrypted with the master key of the
+		// storage. When set, Key is not written to disk.
+		Sealed []byte
+		// Responses contains the signed responses by serial in hex.
+		Responses map[string][]byte
+		// NextUpdate is the end of the validity of the pre-generated responses.
+		NextUpdate time.Time
+	}
+
+	// OCSPServer answers OCSP requests over HTTP (RFC 6960 appendix A) using
+	// the responders found in the storage.
+	OCSPServer struct {
+		server *Server
+	}
+)
+
+// NewOCSPResponder creates a new OCSP responder for the CA.
+func NewOCSPResponder(lookup *Storage, id string, ca pkiadm.ResourceName, duration time.Duration) (*OCSPResponder, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	if duration < time.Minute {
+		return nil, EDurationTooShort
+	}
+	return &OCSPResponder{
+		ID:        id,
+		CA:        ca,
+		Duration:  duration,
+		Responses: map[string][]byte{},
+		Interval: Interval{
+			Created:      lookup.clock.Now(),
+			RefreshAfter: refreshBeforeUpdate(duration),
+		},
+	}, nil
+}
+
+// Return the unique ResourceName
+func (o *OCSPResponder) Name() pkiadm.ResourceName {
+	return pkiadm.ResourceName{o.ID, pkiadm.RTOCSP}
+}
+
+// Refresh renews the delegated certificate when needed and generates the
+// responses for all certificates of the CA.
+func (o *OCSPResponder) Refresh(lookup *Storage) error {
+	ca, err := lookup.GetCA(o.CA)
+	if err != nil {
+		return err
+	}
+	caCert, err := ca.certificate(lookup)
+	if err != nil {
+		return err
+	}
+	if o.needsNewCertificate(caCert, lookup.clock.Now()) {
+		if err := o.renewCertificate(lookup, ca); err != nil {
+			return err
+		}
+	}
+	cert, signer, err := o.signer()
+	if err != nil {
+		return err
+	}
+
+	now := lookup.clock.Now()
+	serials := map[string]bool{}
+	for _, iss := range lookup.Issuances {
+		if iss.CA == ca.ID && iss.NotAfter.After(now) {
+			serials[iss.Serial] = true
+		}
+	}
+	for _, rev := range ca.Revocations {
+		if rev.NotAfter.IsZero() || rev.NotAfter.After(now) {
+			serials[rev.Serial] = true
+		}
+	}
+	responses := map[string][]byte{}
+	for hexSerial := range serials {
+		serial, ok := new(big.Int).SetString(hexSerial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial '%s' found for CA '%s'", hexSerial, ca.ID)
+		}
+		raw, err := o.createResponse(lookup, ca, caCert, cert, signer, serial, now)
+		if err != nil {
+			return err
+		}
+		responses[hexSerial] = raw
+	}
+	log.Printf("ocsp responder '%s' generated %d responses for ca '%s'", o.ID, len(responses), ca.ID)
+	o.Responses = responses
+	o.NextUpdate = now.Add(o.Duration)
+	o.Interval.LastRefresh = now
+	return nil
+}
+
+// needsNewCertificate returns true, when the delegated certificate is missing,
+// expires before the next responses or was not signed by the current CA
+// certificate.
+func (o *OCSPResponder) needsNewCertificate(caCert *x509.Certificate, now time.Time) bool {
+	cert, err := o.getCertificate()
+	if err != nil {
+		return true
+	}
+	if cert.NotAfter.Before(now.Add(2 * o.Duration)) {
+		return true
+	}
+	return cert.CheckSignatureFrom(caCert) != nil
+}
+
+// renewCertificate creates a new key and lets the CA sign a delegated OCSP
+// signing certificate for it.
+func (o *OCSPResponder) renewCertificate(lookup *Storage, ca *CA) error {
+	caCert, caSigner, err := ca.signer(lookup)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return err
+	}
+	lifetime := 4 * o.Duration
+	if lifetime < ocspCertLifetime {
+		lifetime = ocspCertLifetime
+	}
+	now := lookup.clock.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: fmt.Sprintf("%s OCSP responder", caCert.Subject.CommonName),
+		},
+		NotBefore:       now,
+		NotAfter:        now.Add(lifetime),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{ocspNoCheck},
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caSigner)
+	if err != nil {
+		return err
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	o.Key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	o.Certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	log.Printf("ocsp responder '%s' got new signing certificate from ca '%s'", o.ID, ca.ID)
+	return lookup.AddIssuance(ca, o.Certificate, o.Name().String())
+}
+
+// seal encrypts the key with the master key.
+func (o *OCSPResponder) seal(m *MasterKey) error {
+	if len(o.Key) == 0 {
+		return nil
+	}
+	// keep the sealed key, so that it is only written when changed
+	if plain, err := m.Open(o.Sealed); err == nil && bytes.Equal(plain, o.Key) {
+		return nil
+	}
+	sealed, err := m.Seal(o.Key)
+	if err != nil {
+		return err
+	}
+	o.Sealed = sealed
+	return nil
+}
+
+// open decrypts the key with the master key.
+func (o *OCSPResponder) open(m *MasterKey) error {
+	if len(o.Sealed) == 0 {
+		return nil
+	}
+	key, err := m.Open(o.Sealed)
+	if err != nil {
+		return err
+	}
+	o.Key = key
+	return nil
+}
+
+// MarshalJSON leaves out the plain key, when an encrypted version exists.
+func (o *OCSPResponder) MarshalJSON() ([]byte, error) {
+	type ocspResponder OCSPResponder
+	out := ocspResponder(*o)
+	if len(out.Sealed) > 0 {
+		out.Key = nil
+	}
+	return json.Marshal(out)
+}
+
+// getCertificate returns the parsed delegated certificate.
+func (o *OCSPResponder) getCertificate() (*x509.Certificate, error) {
+	block, _ := pem.Decode(o.Certificate)
+	if block == nil {
+		return nil, ENoOCSPCertificate
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// signer returns the delegated certificate and its key.
+func (o *OCSPResponder) signer() (*x509.Certificate, crypto.Signer, error) {
+	cert, err := o.getCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(o.Key) == 0 && len(o.Sealed) > 0 {
+		return nil, nil, ELocked
+	}
+	block, _ := pem.Decode(o.Key)
+	if block == nil {
+		return nil, nil, ENoOCSPCertificate
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// createResponse signs the status of the serial. Serials neither issued nor
+// revoked by the CA are reported as unknown.
+func (o *OCSPResponder) createResponse(lookup *Storage, ca *CA, caCert, cert *x509.Certificate, signer crypto.Signer, serial *big.Int, now time.Time) ([]byte, error) {
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.Duration),
+		Certificate:  cert,
+	}
+	hexSerial := serial.Text(16)
+	if _, found := lookup.GetIssuance(ca.ID, hexSerial); found {
+		template.Status = ocsp.Good
+	}
+	for _, rev := range ca.Revocations {
+		if rev.Serial == hexSerial {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = rev.RevokedAt
+			template.RevocationReason = int(rev.Reason)
+		}
+	}
+	return ocsp.CreateResponse(caCert, cert, template, signer)
+}
+
+// Respond returns the response for the serial. Pre-generated responses are
+// used while they are valid.
+func (o *OCSPResponder) Respond(lookup *Storage, serial *big.Int) ([]byte, error) {
+	hexSerial := serial.Text(16)
+	now := lookup.clock.Now()
+	if raw, found := o.Responses[hexSerial]; found && now.Before(o.NextUpdate) {
+		return raw, nil
+	}
+	ca, err := lookup.GetCA(o.CA)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := ca.certificate(lookup)
+	if err != nil {
+		return nil, err
+	}
+	cert, signer, err := o.signer()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := o.createResponse(lookup, ca, caCert, cert, signer, serial, now)
+	if err != nil {
+		return nil, err
+	}
+	// only cache known serials, so that random requests don't fill the storage
+	if _, found := lookup.GetIssuance(ca.ID, hexSerial); found && now.Before(o.NextUpdate) {
+		o.Responses[hexSerial] = raw
+	}
+	return raw, nil
+}
+
+// Matches returns true, when the request was made for the CA of the
+// responder.
+func (o *OCSPResponder) Matches(lookup *Storage, req *ocsp.Request) bool {
+	ca, err := lookup.GetCA(o.CA)
+	if err != nil {
+		return false
+	}
+	caCert, err := ca.certificate(lookup)
+	if err != nil {
+		return false
+	}
+	nameHash, keyHash, err := issuerHashes(caCert, req.HashAlgorithm)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+// issuerHashes computes the hashes of the subject and the public key of the
+// issuer used to identify it in OCSP requests.
+func issuerHashes(cert *x509.Certificate, hash crypto.Hash) ([]byte, []byte, error) {
+	if !hash.Available() {
+		return nil, nil, EUnsupportedHash
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+	h := hash.New()
+	h.Write(cert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return nameHash, h.Sum(nil), nil
+}
+
+// RefreshInterval returns the dates and interval settings which are used to
+// decide when to trigger a refresh for the resource.
+func (o *OCSPResponder) RefreshInterval() Interval {
+	return o.Interval
+}
+
+// Return the PEM output of the contained resource. This is the delegated
+// signing certificate.
+func (o *OCSPResponder) Pem() ([]byte, error) { return o.Certificate, nil }
+func (o *OCSPResponder) Checksum() []byte     { return Hash(o.Certificate) }
+
+// DependsOn must return the resource names it is depending on.
+func (o *OCSPResponder) DependsOn() []pkiadm.ResourceName {
+	return []pkiadm.ResourceName{o.CA}
+}
+
+// toPkiadm converts the responder into the representation used by the RPC
+// interface.
+func (o *OCSPResponder) toPkiadm() pkiadm.OCSP {
+	res := pkiadm.OCSP{
+		ID:        o.ID,
+		CA:        o.CA,
+		Duration:  o.Duration,
+		Responses: len(o.Responses),
+		Checksum:  o.Checksum(),
+	}
+	if cert, err := o.getCertificate(); err == nil {
+		res.CertificateNotAfter = cert.NotAfter
+	}
+	return res
+}
+
+// OCSPResponse returns the signed response to the request from the matching
+// responder.
+func (s *Storage) OCSPResponse(req *ocsp.Request) ([]byte, error) {
+	for _, o := range s.OCSPs {
+		if o.Matches(s, req) {
+			return o.Respond(s, req.SerialNumber)
+		}
+	}
+	return nil, EUnknownIssuer
+}
+
+// NewOCSPServer creates a new http handler answering OCSP requests.
+func NewOCSPServer(server *Server) *OCSPServer {
+	return &OCSPServer{server: server}
+}
+
+// ServeHTTP answers OCSP requests sent per GET or POST.
+func (o *OCSPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		raw []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		raw, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+	case http.MethodPost:
+		raw, err = ioutil.ReadAll(io.LimitReader(r.Body, ocspMaxRequestSize))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		o.write(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		o.write(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	o.server.lock()
+	defer o.server.unlock()
+	resp, err := o.server.storage.OCSPResponse(req)
+	switch err {
+	case nil:
+		o.write(w, resp)
+	case EUnknownIssuer:
+		o.write(w, ocsp.UnauthorizedErrorResponse)
+	default:
+		log.Printf("could not answer ocsp request for serial '%s': %s", req.SerialNumber.Text(16), err)
+		o.write(w, ocsp.InternalErrorErrorResponse)
+	}
+}
+
+func (o *OCSPServer) write(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+func (s *Server) CreateOCSP(inOCSP pkiadm.OCSP, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	o, err := NewOCSPResponder(s.storage, inOCSP.ID, inOCSP.CA, inOCSP.Duration)
+	if err != nil {
+		res.SetError(err, "Could not create new OCSP responder '%s'", inOCSP.ID)
+		return nil
+	}
+	if err := s.storage.AddOCSP(o); err != nil {
+		res.SetError(err, "Could not add OCSP responder '%s'", inOCSP.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) SetOCSP(changeset pkiadm.OCSPChange, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	o, err := s.storage.GetOCSP(pkiadm.ResourceName{ID: changeset.OCSP.ID, Type: pkiadm.RTOCSP})
+	if err != nil {
+		res.SetError(err, "Could not find OCSP responder '%s'", changeset.OCSP.ID)
+		return nil
+	}
+
+	change := changeset.OCSP
+	for _, field := range changeset.FieldList {
+		switch field {
+		case "ca":
+			o.CA = change.CA
+		case "duration":
+			if change.Duration < time.Minute {
+				res.SetError(EDurationTooShort, "Could not set duration of OCSP responder '%s'", o.ID)
+				return nil
+			}
+			o.Duration = change.Duration
+			o.Interval.RefreshAfter = refreshBeforeUpdate(change.Duration)
+		default:
+			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
+			return nil
+		}
+	}
+	if err := s.storage.Update(o.Name()); err != nil {
+		res.SetError(err, "Could not update OCSP responder '%s'", changeset.OCSP.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) DeleteOCSP(inOCSP pkiadm.ResourceName, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	o, err := s.storage.GetOCSP(pkiadm.ResourceName{ID: inOCSP.ID, Type: pkiadm.RTOCSP})
+	if err != nil {
+		res.SetError(err, "Could not find OCSP responder '%s'", inOCSP.ID)
+		return nil
+	}
+
+	if err := s.storage.Remove(o); err != nil {
+		res.SetError(err, "Could not remove OCSP responder '%s'", o.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) ShowOCSP(inOCSP pkiadm.ResourceName, res *pkiadm.ResultOCSP) error {
+	s.lock()
+	defer s.unlock()
+
+	o, err := s.storage.GetOCSP(pkiadm.ResourceName{ID: inOCSP.ID, Type: pkiadm.RTOCSP})
+	if err != nil {
+		res.Result.SetError(err, "Could not find OCSP responder '%s'", inOCSP.ID)
+		return nil
+	}
+	res.OCSPs = []pkiadm.OCSP{o.toPkiadm()}
+	return nil
+}
+
+func (s *Server) ListOCSP(filter pkiadm.Filter, res *pkiadm.ResultOCSP) error {
+	s.lock()
+	defer s.unlock()
+
+	for _, o := range s.storage.OCSPs {
+		res.OCSPs = append(res.OCSPs, o.toPkiadm())
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"golang.org/x/crypto/ocsp"
+)
+
+// addTestCertificate issues a certificate for a new CSR by the CA.
+func addTestCertificate(t *testing.T, s *Server, id, ca string) {
+	t.Helper()
+	addTestCSR(t, s, id, id, net.ParseIP("127.0.0.1"))
+	res := &pkiadm.Result{}
+	err := s.CreateCertificate(pkiadm.Certificate{
+		ID:         id,
+		Duration:   time.Hour,
+		PrivateKey: pkiadm.ResourceName{ID: id, Type: pkiadm.RTPrivateKey},
+		Serial:     pkiadm.ResourceName{ID: ca, Type: pkiadm.RTSerial},
+		CSR:        pkiadm.ResourceName{ID: id, Type: pkiadm.RTCSR},
+		CA:         pkiadm.ResourceName{ID: ca, Type: pkiadm.RTCA},
+	}, res)
+	checkResult(t, "create certificate "+id, err, res)
+}
+
+// parsedCertificate returns the current certificate of the certificate
+// resource. The storage must be locked.
+func parsedCertificate(t *testing.T, s *Server, id string) *x509.Certificate {
+	t.Helper()
+	cert, err := s.storage.GetCertificate(pkiadm.ResourceName{ID: id, Type: pkiadm.RTCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(cert.Data)
+	if block == nil {
+		t.Fatalf("certificate '%s' has no data", id)
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// queryOCSP asks the responders of the storage for the status of the serial
+// issued by the issuer. The storage must be locked.
+func queryOCSP(t *testing.T, s *Server, serial *big.Int, issuer *x509.Certificate) (*ocsp.Response, error) {
+	t.Helper()
+	raw, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: serial}, issuer, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawResp, err := s.storage.OCSPResponse(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ocsp.ParseResponse(rawResp, issuer)
+	if err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	if resp.SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("expected response for serial %s, got %s", serial, resp.SerialNumber)
+	}
+	return resp, nil
+}
+
+// TestOCSPStatus checks the status reported for issued, revoked and unknown
+// certificates and that only the responder of the issuer answers.
+func TestOCSPStatus(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTestCA(t, s, "root")
+	addTestCA(t, s, "other")
+	addTestCertificate(t, s, "www", "root")
+	res := &pkiadm.Result{}
+	err := s.CreateOCSP(pkiadm.OCSP{
+		ID:       "root",
+		CA:       pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA},
+		Duration: 24 * time.Hour,
+	}, res)
+	checkResult(t, "create ocsp responder", err, res)
+
+	s.lock()
+	root := parsedCertificate(t, s, "root")
+	other := parsedCertificate(t, s, "other")
+	www := parsedCertificate(t, s, "www")
+
+	resp, err := queryOCSP(t, s, www.SerialNumber, root)
+	if err != nil {
+		t.Fatalf("could not query status of www: %s", err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("expected status good, got %d", resp.Status)
+	}
+	if !resp.ThisUpdate.Equal(clock.Now().Truncate(time.Second)) || !resp.NextUpdate.Equal(resp.ThisUpdate.Add(24*time.Hour)) {
+		t.Errorf("expected response valid from %s for 24h, got %s to %s", clock.Now(), resp.ThisUpdate, resp.NextUpdate)
+	}
+
+	unknown := new(big.Int).Add(www.SerialNumber, big.NewInt(100))
+	if resp, err = queryOCSP(t, s, unknown, root); err != nil {
+		t.Fatalf("could not query status of unknown serial: %s", err)
+	}
+	if resp.Status != ocsp.Unknown {
+		t.Errorf("expected status unknown, got %d", resp.Status)
+	}
+	o, err := s.storage.GetOCSP(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTOCSP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := o.Responses[unknown.Text(16)]; found {
+		t.Errorf("response for unknown serial was cached")
+	}
+
+	// the same serial from another issuer must not be answered by the
+	// responder of root
+	if _, err := queryOCSP(t, s, www.SerialNumber, other); err != EUnknownIssuer {
+		t.Errorf("expected %s for other issuer, got %v", EUnknownIssuer, err)
+	}
+	cached := o.Responses[www.SerialNumber.Text(16)]
+	s.unlock()
+
+	// revoking the certificate replaces the cached response
+	err = s.RevokeCertificate(pkiadm.Revocation{ID: "www", Reason: pkiadm.RRKeyCompromise}, res)
+	checkResult(t, "revoke certificate www", err, res)
+	s.lock()
+	defer s.unlock()
+	if string(o.Responses[www.SerialNumber.Text(16)]) == string(cached) {
+		t.Errorf("cached response was not replaced")
+	}
+	if resp, err = queryOCSP(t, s, www.SerialNumber, root); err != nil {
+		t.Fatalf("could not query status of revoked www: %s", err)
+	}
+	if resp.Status != ocsp.Revoked || resp.RevocationReason != int(pkiadm.RRKeyCompromise) {
+		t.Errorf("expected status revoked for key compromise, got %d with reason %d", resp.Status, resp.RevocationReason)
+	}
+}
+
+// TestOCSPRenewCertificate checks that the delegated certificate is renewed,
+// when it expires before the next responses.
+func TestOCSPRenewCertificate(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTestCA(t, s, "root")
+	res := &pkiadm.Result{}
+	err := s.CreateOCSP(pkiadm.OCSP{
+		ID:       "root",
+		CA:       pkiadm.ResourceName{ID: "root", Type: pkiadm.RTCA},
+		Duration: 24 * time.Hour,
+	}, res)
+	checkResult(t, "create ocsp responder", err, res)
+
+	s.lock()
+	o, err := s.storage.GetOCSP(pkiadm.ResourceName{ID: "root", Type: pkiadm.RTOCSP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := o.getCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the delegated certificate ends with the CA certificate
+	if root := parsedCertificate(t, s, "root"); !old.NotAfter.Equal(root.NotAfter) {
+		t.Errorf("expected delegated certificate to end with the CA at %s, got %s", root.NotAfter, old.NotAfter)
+	}
+	s.unlock()
+
+	// the responder is refreshed with the new CA certificate, which lives
+	// long enough for a delegated certificate with its full lifetime
+	err = s.SetCertificate(pkiadm.CertificateChange{
+		Certificate: pkiadm.Certificate{ID: "root", Duration: 365 * 24 * time.Hour},
+		FieldList:   []string{"duration"},
+	}, res)
+	checkResult(t, "extend ca certificate", err, res)
+
+	s.lock()
+	defer s.unlock()
+	renewed, err := o.getCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.SerialNumber.Cmp(old.SerialNumber) == 0 {
+		t.Fatalf("delegated certificate was not renewed")
+	}
+	if !renewed.NotAfter.Equal(clock.Now().Add(ocspCertLifetime).Truncate(time.Second)) {
+		t.Errorf("expected delegated certificate valid until %s, got %s", clock.Now().Add(ocspCertLifetime), renewed.NotAfter)
+	}
+	if err := renewed.CheckSignatureFrom(parsedCertificate(t, s, "root")); err != nil {
+		t.Errorf("delegated certificate is not signed by the CA: %s", err)
+	}
+
+	// a valid certificate is kept
+	if err := o.Refresh(s.storage); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := o.getCertificate(); err != nil || kept.SerialNumber.Cmp(renewed.SerialNumber) != 0 {
+		t.Errorf("valid delegated certificate was renewed")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+type (
+	// schemaRegistry collects the schemas of the named types referenced by
+	// the OpenAPI document.
+	schemaRegistry map[string]interface{}
+
+	// object is a JSON object of the OpenAPI document.
+	object map[string]interface{}
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	durationType      = reflect.TypeOf(time.Duration(0))
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// openAPI returns the OpenAPI document of the REST API. The schemas of the
+// requests and responses are generated from the types of the RPC methods.
+func openAPI(routes []restRoute) object {
+	reg := schemaRegistry{}
+	paths := map[string]object{}
+	for _, route := range routes {
+		m, _ := serverType.MethodByName(route.RPC)
+		arg, reply := m.Type.In(1), m.Type.In(2).Elem()
+		replySchema := object{"content": object{"application/json": object{"schema": reg.schema(reply)}}}
+
+		responses := object{
+			strconv.Itoa(restSuccess(route)): withDescription(replySchema, "the result of the call"),
+			"default":                        withDescription(replySchema, "the error is contained in the result"),
+		}
+		if route.Method != "GET" {
+			responses[strconv.Itoa(http.StatusAccepted)] = withDescription(replySchema, "the call is continued by the job in the result")
+		}
+		op := object{
+			"operationId": route.RPC,
+			"responses":   responses,
+		}
+
+		params := []object{}
+		inPath := map[string]bool{}
+		for _, part := range strings.Split(route.Path, "/") {
+			if !strings.HasPrefix(part, "{") {
+				continue
+			}
+			name := strings.Trim(part, "{}")
+			inPath[strings.ToLower(name)] = true
+			params = append(params, object{"name": name, "in": "path", "required": true, "schema": object{"type": "string"}})
+		}
+		if route.Query {
+			for i := 0; i < arg.NumField(); i++ {
+				field := arg.Field(i)
+				if field.PkgPath != "" || inPath[strings.ToLower(field.Name)] {
+					continue
+				}
+				params = append(params, object{"name": field.Name, "in": "query", "schema": reg.schema(field.Type)})
+			}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Method == "POST" || route.Method == "PATCH" {
+			op["requestBody"] = object{
+				"required": true,
+				"content":  object{"application/json": object{"schema": reg.schema(arg)}},
+			}
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = object{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+	return object{
+		"openapi": "3.1.0",
+		"info": object{
+			"title":       "pkiadm",
+			"version":     "v1",
+			"description": "Every call returns the result of the RPC method. Errors are reported in its Result field.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": reg,
+			"securitySchemes": object{
+				"clientCertificate": object{"type": "mutualTLS"},
+			},
+		},
+		"security": []object{{"clientCertificate": []string{}}},
+	}
+}
+
+// openAPICommand writes the OpenAPI document of the REST API.
+func openAPICommand(args []string) int {
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s:\n", "pkiadmd openapi")
+		fmt.Print(`
+Print the OpenAPI document of the REST API, which is also served at /v1/openapi.json.
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	raw, err := json.MarshalIndent(openAPI(restRoutes()), "", "  ")
+	if err != nil {
+		log.Printf("could not encode document: %s", err)
+		return 1
+	}
+	fmt.Println(string(raw))
+	return 0
+}
+
+// withDescription returns a copy of the response with the description.
+func withDescription(response object, description string) object {
+	res := object{"description": description}
+	for k, v := range response {
+		res[k] = v
+	}
+	return res
+}
+
+// schema returns the JSON schema of the type as encoded by encoding/json.
+// Named structs are added to the registry and referenced.
+func (reg schemaRegistry) schema(t reflect.Type) object {
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return object{"type": "integer", "description": "duration in nanoseconds"}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return object{"type": "string"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		return object{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return object{"type": "string", "contentEncoding": "base64"}
+		}
+		return object{"type": "array", "items": reg.schema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": reg.schema(t.Elem())}
+	case reflect.Ptr:
+		return reg.schema(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return reg.object(t)
+		}
+		name := t.Name()
+		if pkg := path.Base(t.PkgPath()); pkg != "pkiadm" {
+			name = pkg + "." + name
+		}
+		if _, found := reg[name]; !found {
+			// the placeholder stops the recursion of self-referencing types
+			reg[name] = object{}
+			reg[name] = reg.object(t)
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	default:
+		return object{}
+	}
+}
+
+// object returns the schema of the struct with all fields encoded by
+// encoding/json.
+func (reg schemaRegistry) object(t reflect.Type) object {
+	props := object{}
+	reg.fields(t, props)
+	return object{"type": "object", "properties": props}
+}
+
+func (reg schemaRegistry) fields(t reflect.Type, props object) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		// embedded structs are flattened like encoding/json does
+		if field.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			reg.fields(ft, props)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		props[name] = reg.schema(field.Type)
+	}
+}
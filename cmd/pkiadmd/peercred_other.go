@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// peerCredentials is only supported on linux. Elsewhere local callers get the
+// default role of the policy.
+func peerCredentials(conn *net.UnixConn) (uint32, uint32, error) {
+	return 0, 0, errors.Errorf("peer credentials are not supported on this platform")
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/elliptic"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"time"
@@ -23,6 +26,12 @@ type (
 		Bits     uint
 		Key      []byte
 		Interval Interval
+		// Imported keys were generated outside of pkiadm and are kept as they
+		// are, until the type or size is changed.
+		Imported bool
+		// Sealed contains the key encrypted with the master key of the
+		// storage. When set, Key is not written to disk.
+		Sealed []byte
 	}
 )
 
@@ -42,23 +51,127 @@ func NewPrivateKey(id string, pkType pkiadm.PrivateKeyType, bits uint, interval
 	return &pk, nil
 }
 
+// NewImportedPrivateKey creates a private key from an externally generated
+// key in PEM format.
+func NewImportedPrivateKey(lookup *Storage, id string, data []byte) (*PrivateKey, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	pk := &PrivateKey{
+		ID:       id,
+		Imported: true,
+		Interval: NoInterval,
+	}
+	if err := pk.setImported(lookup, data); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// setImported replaces the key with the one from the PEM data.
+func (p *PrivateKey) setImported(lookup *Storage, data []byte) error {
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return err
+	}
+	pkType, bits, raw, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	p.PKType = pkType
+	p.Bits = bits
+	p.Key = raw
+	p.Interval.LastRefresh = lookup.clock.Now()
+	return nil
+}
+
 func (p *PrivateKey) Name() pkiadm.ResourceName {
 	return pkiadm.ResourceName{p.ID, pkiadm.RTPrivateKey}
 }
 
 func (p *PrivateKey) Checksum() []byte {
+	if p.locked() {
+		return []byte{}
+	}
 	return Hash(p.Key)
 }
 
 func (p *PrivateKey) Pem() ([]byte, error) {
+	if p.locked() {
+		return nil, ELocked
+	}
 	return p.Key, nil
 }
 
+// locked returns true, when the key is only available encrypted.
+func (p *PrivateKey) locked() bool {
+	return len(p.Key) == 0 && len(p.Sealed) > 0
+}
+
+// seal encrypts the key with the master key.
+func (p *PrivateKey) seal(m *MasterKey) error {
+	if len(p.Key) == 0 {
+		return nil
+	}
+	// keep the sealed key, so that it is only written when changed
+	if plain, err := m.Open(p.Sealed); err == nil && bytes.Equal(plain, p.Key) {
+		return nil
+	}
+	sealed, err := m.Seal(p.Key)
+	if err != nil {
+		return err
+	}
+	p.Sealed = sealed
+	return nil
+}
+
+// open decrypts the key with the master key.
+func (p *PrivateKey) open(m *MasterKey) error {
+	if len(p.Sealed) == 0 {
+		return nil
+	}
+	key, err := m.Open(p.Sealed)
+	if err != nil {
+		return err
+	}
+	p.Key = key
+	return nil
+}
+
+// MarshalJSON leaves out the plain key, when an encrypted version exists.
+func (p *PrivateKey) MarshalJSON() ([]byte, error) {
+	type privateKey PrivateKey
+	out := privateKey(*p)
+	if len(out.Sealed) > 0 {
+		out.Key = nil
+	}
+	return json.Marshal(out)
+}
+
 func (p *PrivateKey) DependsOn() []pkiadm.ResourceName {
 	return []pkiadm.ResourceName{}
 }
 
-func (p *PrivateKey) Refresh(_ *Storage) error {
+func (p *PrivateKey) Refresh(lookup *Storage) error {
+	if p.Imported {
+		return nil
+	}
+	// a new key could not be stored encrypted
+	if lookup.Locked() {
+		return ELocked
+	}
+	raw, err := p.generate()
+	if err != nil {
+		return err
+	}
+	p.setKey(raw, lookup.clock.Now())
+	return nil
+}
+
+// generate returns a new key of the type and size of the private key in PEM
+// format. It doesn't need the storage, so that slow keys can be generated
+// without holding it.
+func (p *PrivateKey) generate() ([]byte, error) {
 	var (
 		key pki.PrivateKey
 		err error
@@ -83,21 +196,28 @@ func (p *PrivateKey) Refresh(_ *Storage) error {
 		key, err = pki.NewPrivateKeyEcdsa(curve)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// set pem into the dump
 	block, err := key.ToPem()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	p.Key = pem.EncodeToMemory(&block)
-	p.Interval.LastRefresh = time.Now()
-	return nil
+	return pem.EncodeToMemory(&block), nil
+}
+
+// setKey replaces the key with the generated one.
+func (p *PrivateKey) setKey(raw []byte, now time.Time) {
+	p.Key = raw
+	p.Interval.refreshed(now, time.Time{})
 }
 
 // RefreshInterval returns the dates and interval settings which are used to
 // decide when to trigger a refresh for the resource.
 func (p *PrivateKey) RefreshInterval() Interval {
+	if p.Imported {
+		return NoInterval
+	}
 	return p.Interval
 }
 
@@ -106,6 +226,9 @@ func (p *PrivateKey) GetKey() (pki.PrivateKey, error) {
 		err error
 		key pki.PrivateKey
 	)
+	if p.locked() {
+		return nil, ELocked
+	}
 	block, _ := pem.Decode(p.Key)
 	switch block.Type {
 	case pki.PemLabelRsa:
@@ -123,6 +246,20 @@ func (p *PrivateKey) GetKey() (pki.PrivateKey, error) {
 	return key, nil
 }
 
+// GetSigner returns the private key as a crypto.Signer to be used with the
+// crypto/x509 functions.
+func (p *PrivateKey) GetSigner() (crypto.Signer, error) {
+	key, err := p.GetKey()
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.PrivateKey().(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key '%s' can not be used for signing", p.ID)
+	}
+	return signer, nil
+}
+
 func verifyPK(pkType pkiadm.PrivateKeyType, bits uint) error {
 	switch pkType {
 	case pkiadm.PKTRSA:
@@ -149,13 +286,82 @@ func (s *Server) CreatePrivateKey(inPk pkiadm.PrivateKey, res *pkiadm.Result) er
 	s.lock()
 	defer s.unlock()
 
-	pk, err := NewPrivateKey(inPk.ID, inPk.Type, inPk.Bits, NoInterval)
+	interval := Interval{Created: s.storage.clock.Now()}
+	if err := interval.setRenewal(inPk.Renewal, renewalFields...); err != nil {
+		res.SetError(err, "Could not create new private key '%s'", inPk.ID)
+		return nil
+	}
+	pk, err := NewPrivateKey(inPk.ID, inPk.Type, inPk.Bits, interval)
 	if err != nil {
 		res.SetError(err, "Could not create new private key '%s'", inPk.ID)
 		return nil
 	}
+	// a new key could not be stored encrypted
+	if s.storage.Locked() {
+		res.SetError(ELocked, "Could not create new private key '%s'", inPk.ID)
+		return nil
+	}
+	if _, err := s.storage.Get(pk.Name()); err == nil {
+		res.SetError(EAlreadyExist, "Could not create new private key '%s'", inPk.ID)
+		return nil
+	}
+	// the request is completed, when the key is stored
+	seq := s.journal.Continue()
+	res.Job = s.jobs.Submit(fmt.Sprintf("create private key '%s'", pk.ID), pk.Name(), func() error {
+		defer s.done(seq)
+		raw, err := pk.generate()
+		if err != nil {
+			return err
+		}
+		s.lock()
+		defer s.unlock()
+		if s.storage.Locked() {
+			return ELocked
+		}
+		pk.setKey(raw, s.storage.clock.Now())
+		if err := s.storage.insertPrivateKey(pk); err != nil {
+			return err
+		}
+		return s.storage.store()
+	})
+	return nil
+}
+
+// ImportPrivateKey stores an externally generated private key. Importing a key
+// with the id of an already imported one replaces it and refreshes all
+// depending resources.
+func (s *Server) ImportPrivateKey(in pkiadm.PrivateKeyImport, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	if s.storage.Locked() {
+		res.SetError(ELocked, "Could not import private key '%s'", in.ID)
+		return nil
+	}
+
+	if pk, err := s.storage.GetPrivateKey(pkiadm.ResourceName{ID: in.ID, Type: pkiadm.RTPrivateKey}); err == nil {
+		if !pk.Imported {
+			res.SetError(EAlreadyExist, "Could not import private key '%s'", in.ID)
+			return nil
+		}
+		if err := pk.setImported(s.storage, in.Pem); err != nil {
+			res.SetError(err, "Could not import private key '%s'", in.ID)
+			return nil
+		}
+		if err := s.storage.Update(pk.Name()); err != nil {
+			res.SetError(err, "Could not update private key '%s'", in.ID)
+			return nil
+		}
+		return s.store(res)
+	}
+
+	pk, err := NewImportedPrivateKey(s.storage, in.ID, in.Pem)
+	if err != nil {
+		res.SetError(err, "Could not import private key '%s'", in.ID)
+		return nil
+	}
 	if err := s.storage.AddPrivateKey(pk); err != nil {
-		res.SetError(err, "Could not add private key '%s'", inPk.ID)
+		res.SetError(err, "Could not add private key '%s'", in.ID)
 		return nil
 	}
 	return s.store(res)
@@ -170,22 +376,71 @@ func (s *Server) SetPrivateKey(changeset pkiadm.PrivateKeyChange, res *pkiadm.Re
 		return nil
 	}
 
+	// the type and size are only changed together with the key
+	next := &PrivateKey{ID: pk.ID, PKType: pk.PKType, Bits: pk.Bits}
 	for _, field := range changeset.FieldList {
 		switch field {
 		case "type":
-			pk.PKType = changeset.PrivateKey.Type
+			next.PKType = changeset.PrivateKey.Type
 		case "bits":
-			pk.Bits = changeset.PrivateKey.Bits
+			next.Bits = changeset.PrivateKey.Bits
+		case "lifetime", "renew-before", "renew-at", "jitter":
+			if err := pk.Interval.setRenewalField(field, changeset.PrivateKey.Renewal); err != nil {
+				res.SetError(err, "Could not set renewal of private key '%s'", pk.ID)
+				return nil
+			}
 		default:
 			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
 			return nil
 		}
 	}
-	if err := s.storage.Update(pkiadm.ResourceName{ID: pk.ID, Type: pkiadm.RTPrivateKey}); err != nil {
-		res.SetError(err, "Could not update private key '%s'", changeset.PrivateKey.ID)
+	// the renewal settings alone don't need a new key
+	if onlyFields(changeset.FieldList, renewalFields...) {
+		s.storage.scanForRefresh()
+		return s.store(res)
+	}
+	if err := verifyPK(next.PKType, next.Bits); err != nil {
+		res.SetError(err, "Could not set private key '%s'", pk.ID)
 		return nil
 	}
-	return s.store(res)
+	if s.storage.Locked() {
+		res.SetError(ELocked, "Could not set private key '%s'", pk.ID)
+		return nil
+	}
+	// the request is completed, when the new key is stored
+	seq := s.journal.Continue()
+	if err := s.store(res); err != nil || res.HasError {
+		s.done(seq)
+		return err
+	}
+	res.Job = s.jobs.Submit(fmt.Sprintf("generate private key '%s'", pk.ID), pk.Name(), func() error {
+		defer s.done(seq)
+		raw, err := next.generate()
+		if err != nil {
+			return err
+		}
+		s.lock()
+		defer s.unlock()
+		if s.storage.Locked() {
+			return ELocked
+		}
+		// the key might have been removed in the meantime
+		pk, err := s.storage.GetPrivateKey(next.Name())
+		if err != nil {
+			return err
+		}
+		pk.PKType = next.PKType
+		pk.Bits = next.Bits
+		pk.Imported = false
+		pk.setKey(raw, s.storage.clock.Now())
+		err = s.storage.Propagate(pk.Name())
+		// the new key is kept, even when not all dependencies could use it
+		if storeErr := s.storage.store(); storeErr != nil {
+			return storeErr
+		}
+		return err
+	})
+	return nil
 }
 func (s *Server) DeletePrivateKey(inPk pkiadm.ResourceName, res *pkiadm.Result) error {
 	s.lock()
@@ -216,6 +471,8 @@ func (s *Server) ShowPrivateKey(inPk pkiadm.ResourceName, res *pkiadm.ResultPriv
 		ID:       pk.ID,
 		Type:     pk.PKType,
 		Bits:     pk.Bits,
+		Imported: pk.Imported,
+		Renewal:  pk.Interval.renewal(),
 		Checksum: pk.Checksum(),
 	}}
 	return nil
@@ -229,6 +486,8 @@ func (s *Server) ListPrivateKey(filter pkiadm.Filter, res *pkiadm.ResultPrivateK
 			ID:       pk.ID,
 			Type:     pk.PKType,
 			Bits:     pk.Bits,
+			Imported: pk.Imported,
+			Renewal:  pk.Interval.renewal(),
 			Checksum: pk.Checksum(),
 		})
 	}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestCreatePrivateKeyExisting checks that creating a key with a used id is
+// rejected without starting a job.
+func TestCreatePrivateKeyExisting(t *testing.T) {
+	s, _ := newTestServer(t)
+	addTestKey(t, s, "key")
+
+	res := &pkiadm.Result{}
+	err := s.CreatePrivateKey(pkiadm.PrivateKey{ID: "key", Type: pkiadm.PKTECDSA, Bits: 256}, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.HasError || res.Error.Error() != EAlreadyExist.Error() {
+		t.Errorf("expected %s, got '%s'", EAlreadyExist, res.Message)
+	}
+	if res.Job != "" {
+		t.Errorf("job %s was started for an existing key", res.Job)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gibheer/pki"
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	EInvalidOID = Error("invalid policy OID")
+)
+
+type (
+	// Profile contains the settings to issue certificates with. All
+	// certificates referencing the profile get reissued, when it changes.
+	Profile struct {
+		ID                 string
+		Duration           time.Duration
+		KeyUsage           pkiadm.KeyUsage
+		ExtKeyUsage        []pkiadm.ExtKeyUsage
+		MaxPathLen         int
+		MaxPathLenZero     bool
+		NonCriticalPathLen bool
+		Policies           []string
+		CRLURLs            []string
+		OCSPURLs           []string
+		IssuerURLs         []string
+		AllowedNames       []string
+	}
+)
+
+// NewProfile creates a new profile from the settings.
+func NewProfile(in pkiadm.Profile) (*Profile, error) {
+	if in.ID == "" {
+		return nil, ENoIDGiven
+	}
+	p := &Profile{ID: in.ID}
+	if err := p.set(in, []string{
+		"duration", "key-usage", "ext-key-usage", "max-path-len",
+		"path-len-critical", "policies", "crl-urls", "ocsp-urls", "issuer-urls",
+		"allowed-names",
+	}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// set copies the fields from the field list into the profile.
+func (p *Profile) set(in pkiadm.Profile, fieldList []string) error {
+	for _, field := range fieldList {
+		switch field {
+		case "duration":
+			if in.Duration < time.Minute {
+				return EDurationTooShort
+			}
+			p.Duration = in.Duration
+		case "key-usage":
+			p.KeyUsage = in.KeyUsage
+		case "ext-key-usage":
+			p.ExtKeyUsage = in.ExtKeyUsage
+		case "max-path-len":
+			p.MaxPathLen = in.MaxPathLen
+			p.MaxPathLenZero = in.MaxPathLenZero
+		case "path-len-critical":
+			p.NonCriticalPathLen = !in.PathLenCritical
+		case "policies":
+			if _, err := parseOIDs(in.Policies); err != nil {
+				return err
+			}
+			p.Policies = in.Policies
+		case "crl-urls":
+			p.CRLURLs = in.CRLURLs
+		case "ocsp-urls":
+			p.OCSPURLs = in.OCSPURLs
+		case "issuer-urls":
+			p.IssuerURLs = in.IssuerURLs
+		case "allowed-names":
+			p.AllowedNames = in.AllowedNames
+		default:
+			return fmt.Errorf("unknown field '%s'", field)
+		}
+	}
+	return nil
+}
+
+// Return the unique ResourceName
+func (p *Profile) Name() pkiadm.ResourceName {
+	return pkiadm.ResourceName{p.ID, pkiadm.RTProfile}
+}
+
+// Refresh is a NOOP, as profiles only hold settings.
+func (p *Profile) Refresh(*Storage) error { return nil }
+
+// RefreshInterval is a NOOP here, as profiles can't be refreshed.
+func (p *Profile) RefreshInterval() Interval { return NoInterval }
+
+// Return the PEM output of the contained resource.
+func (p *Profile) Pem() ([]byte, error) { return []byte{}, nil }
+func (p *Profile) Checksum() []byte     { return []byte{} }
+
+// DependsOn must return the resource names it is depending on.
+func (p *Profile) DependsOn() []pkiadm.ResourceName { return []pkiadm.ResourceName{} }
+
+// Apply sets the options to sign a certificate with this profile.
+func (p *Profile) Apply(opts *SignOptions) error {
+	policies, err := parseOIDs(p.Policies)
+	if err != nil {
+		return err
+	}
+	opts.NotAfter = opts.NotBefore.Add(p.Duration)
+	opts.IsCA = p.KeyUsage&pkiadm.KUCertSign != 0
+	opts.KeyUsage = x509.KeyUsage(p.KeyUsage)
+	opts.ExtKeyUsage = extKeyUsages(p.ExtKeyUsage)
+	opts.MaxPathLen = p.MaxPathLen
+	opts.MaxPathLenZero = p.MaxPathLenZero
+	opts.NonCriticalPathLen = p.NonCriticalPathLen
+	opts.PolicyIdentifiers = policies
+	opts.CRLDistributionPoints = p.CRLURLs
+	opts.OCSPServer = p.OCSPURLs
+	opts.IssuingCertificateURL = p.IssuerURLs
+	return nil
+}
+
+// Check verifies that all subject alternative names of the request are
+// allowed by the profile.
+func (p *Profile) Check(csr *pki.CertificateRequest) error {
+	if len(p.AllowedNames) == 0 {
+		return nil
+	}
+	names := append([]string{}, csr.DNSNames...)
+	names = append(names, csr.EmailAddresses...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		if !matchesNamePattern(p.AllowedNames, name) {
+			return fmt.Errorf("name '%s' is not allowed by profile '%s'", name, p.ID)
+		}
+	}
+	return nil
+}
+
+// matchesNamePattern returns true, when the name matches one of the patterns.
+// Patterns can be names like 'host.example.com', '*.example.com' for all names
+// below a domain, networks like '10.0.0.0/8' or mail domains like
+// '@example.com'.
+func matchesNamePattern(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	ip := net.ParseIP(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case ip != nil:
+			_, network, err := net.ParseCIDR(pattern)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "@"):
+			if strings.HasSuffix(name, pattern) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "*."):
+			suffix := pattern[1:]
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				return true
+			}
+		default:
+			if name == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseOIDs converts the dotted OIDs.
+func parseOIDs(in []string) ([]asn1.ObjectIdentifier, error) {
+	oids := []asn1.ObjectIdentifier{}
+	for _, raw := range in {
+		parts := strings.Split(raw, ".")
+		if len(parts) < 2 {
+			return nil, EInvalidOID
+		}
+		oid := asn1.ObjectIdentifier{}
+		for _, part := range parts {
+			val, err := strconv.Atoi(part)
+			if err != nil || val < 0 {
+				return nil, EInvalidOID
+			}
+			oid = append(oid, val)
+		}
+		oids = append(oids, oid)
+	}
+	return oids, nil
+}
+
+// toPkiadm converts the profile into the representation used by the RPC
+// interface.
+func (p *Profile) toPkiadm() pkiadm.Profile {
+	return pkiadm.Profile{
+		ID:              p.ID,
+		Duration:        p.Duration,
+		KeyUsage:        p.KeyUsage,
+		ExtKeyUsage:     p.ExtKeyUsage,
+		MaxPathLen:      pathLen(p.MaxPathLen, p.MaxPathLenZero),
+		MaxPathLenZero:  pathLen(p.MaxPathLen, p.MaxPathLenZero) == 0,
+		PathLenCritical: !p.NonCriticalPathLen,
+		Policies:        p.Policies,
+		CRLURLs:         p.CRLURLs,
+		OCSPURLs:        p.OCSPURLs,
+		IssuerURLs:      p.IssuerURLs,
+		AllowedNames:    p.AllowedNames,
+	}
+}
+
+func (s *Server) CreateProfile(inProfile pkiadm.Profile, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	profile, err := NewProfile(inProfile)
+	if err != nil {
+		res.SetError(err, "Could not create new profile '%s'", inProfile.ID)
+		return nil
+	}
+	if err := s.storage.AddProfile(profile); err != nil {
+		res.SetError(err, "Could not add profile '%s'", inProfile.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) SetProfile(changeset pkiadm.ProfileChange, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	profile, err := s.storage.GetProfile(pkiadm.ResourceName{ID: changeset.Profile.ID, Type: pkiadm.RTProfile})
+	if err != nil {
+		res.SetError(err, "Could not find profile '%s'", changeset.Profile.ID)
+		return nil
+	}
+	if err := profile.set(changeset.Profile, changeset.FieldList); err != nil {
+		res.SetError(err, "Could not change profile '%s'", changeset.Profile.ID)
+		return nil
+	}
+	if err := s.storage.Update(profile.Name()); err != nil {
+		res.SetError(err, "Could not update profile '%s'", changeset.Profile.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) DeleteProfile(inProfile pkiadm.ResourceName, res *pkiadm.Result) error {
+	s.lock()
+	defer s.unlock()
+
+	profile, err := s.storage.GetProfile(pkiadm.ResourceName{ID: inProfile.ID, Type: pkiadm.RTProfile})
+	if err != nil {
+		res.SetError(err, "Could not find profile '%s'", inProfile.ID)
+		return nil
+	}
+
+	if err := s.storage.Remove(profile); err != nil {
+		res.SetError(err, "Could not remove profile '%s'", profile.ID)
+		return nil
+	}
+	return s.store(res)
+}
+
+func (s *Server) ShowProfile(inProfile pkiadm.ResourceName, res *pkiadm.ResultProfile) error {
+	s.lock()
+	defer s.unlock()
+
+	profile, err := s.storage.GetProfile(pkiadm.ResourceName{ID: inProfile.ID, Type: pkiadm.RTProfile})
+	if err != nil {
+		res.Result.SetError(err, "Could not find profile '%s'", inProfile.ID)
+		return nil
+	}
+	res.Profiles = []pkiadm.Profile{profile.toPkiadm()}
+	return nil
+}
+
+func (s *Server) ListProfile(filter pkiadm.Filter, res *pkiadm.ResultProfile) error {
+	s.lock()
+	defer s.unlock()
+
+	for _, profile := range s.storage.Profiles {
+		res.Profiles = append(res.Profiles, profile.toPkiadm())
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestProfileDuration checks that profiles can't issue certificates which are
+// not valid for at least a minute.
+func TestProfileDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		err      error
+	}{
+		{"negative", -time.Hour, EDurationTooShort},
+		{"zero", 0, EDurationTooShort},
+		{"second", time.Second, EDurationTooShort},
+		{"day", 24 * time.Hour, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewProfile(pkiadm.Profile{ID: "web", Duration: test.duration}); err != test.err {
+				t.Errorf("create: expected error %v, got %v", test.err, err)
+			}
+
+			p, err := NewProfile(pkiadm.Profile{ID: "web", Duration: time.Hour})
+			if err != nil {
+				t.Fatalf("could not create profile: %s", err)
+			}
+			err = p.set(pkiadm.Profile{Duration: test.duration}, []string{"duration"})
+			if err != test.err {
+				t.Errorf("set: expected error %v, got %v", test.err, err)
+			}
+			if err != nil && p.Duration != time.Hour {
+				t.Errorf("rejected duration was set to %s", p.Duration)
+			}
+		})
+	}
+}
+
+// TestProfileMaxPathLen checks that profiles pass an explicit limit of no
+// intermediate CAs on and keep the path length unlimited otherwise.
+func TestProfileMaxPathLen(t *testing.T) {
+	for _, zero := range []bool{false, true} {
+		p, err := NewProfile(pkiadm.Profile{ID: "ca", Duration: time.Hour, MaxPathLenZero: zero})
+		if err != nil {
+			t.Fatalf("could not create profile: %s", err)
+		}
+		opts := &SignOptions{}
+		if err := p.Apply(opts); err != nil {
+			t.Fatalf("could not apply profile: %s", err)
+		}
+		expected := -1
+		if zero {
+			expected = 0
+		}
+		if l := pathLen(opts.MaxPathLen, opts.MaxPathLenZero); l != expected {
+			t.Errorf("zero %t: expected path length %d, got %d", zero, expected, l)
+		}
+		if l := p.toPkiadm().MaxPathLen; l != expected {
+			t.Errorf("zero %t: expected shown path length %d, got %d", zero, expected, l)
+		}
+	}
+}
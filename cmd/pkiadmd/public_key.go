@@ -54,7 +54,7 @@ func (p *PublicKey) Refresh(lookup *Storage) error {
 		return err
 	}
 	p.Key = pem.EncodeToMemory(&block)
-	p.Interval.LastRefresh = time.Now()
+	p.Interval.LastRefresh = lookup.clock.Now()
 	return nil
 }
 
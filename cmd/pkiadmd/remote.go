@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/rpc"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+const (
+	EAdminTLS = Error("the admin listener needs a certificate and a client CA")
+)
+
+// startAdminServer opens the TCP listener for remote administration and
+// serves the RPC interface on it in the background. Clients must present a
+// certificate issued by the client CA. While the storage is locked, it must be
+// unlocked through the unix socket.
+func startAdminServer(cfg *pkiadm.Config, server *Server, rpcServer *rpc.Server, policy *Policy) error {
+	tlsConfig, err := adminTLSConfig(cfg, server)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", cfg.AdminListen)
+	if err != nil {
+		return err
+	}
+	server.lock()
+	if server.storage.Locked() {
+		log.Printf("admin listener accepts connections after 'pkiadm unlock' on the unix socket")
+	}
+	server.unlock()
+	go serveJournaled(rpcServer, tls.NewListener(listener, tlsConfig), server, policy)
+	return nil
+}
+
+// adminTLSConfig returns the TLS config for the listeners used for remote
+// administration. Clients must present a certificate issued by the client CA.
+func adminTLSConfig(cfg *pkiadm.Config, server *Server) (*tls.Config, error) {
+	if cfg.AdminCertificate == "" || cfg.AdminClientCA == "" {
+		return nil, EAdminTLS
+	}
+	certificate := server.tlsCertificate(
+		pkiadm.ResourceName{ID: cfg.AdminCertificate, Type: pkiadm.RTCertificate},
+	)
+	clientCAs := server.tlsClientCAs(pkiadm.ResourceName{ID: cfg.AdminClientCA, Type: pkiadm.RTCA})
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the config is built for every connection, so that renewed
+		// certificates are used right away
+		GetConfigForClient: func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			pool, err := clientCAs()
+			if err != nil {
+				log.Printf("could not load client CA for admin listener: %s", err)
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certificate,
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				ClientCAs:      pool,
+			}, nil
+		},
+	}
+	return tlsConfig, nil
+}
+
+// tlsClientCAs returns a function to look up the certificates of the CA, which
+// can be used to verify clients. All versions of the CA certificate in its
+// history are trusted, so that clients keep working while the CA is renewed.
+func (s *Server) tlsClientCAs(name pkiadm.ResourceName) func() (*x509.CertPool, error) {
+	return func() (*x509.CertPool, error) {
+		s.lock()
+		defer s.unlock()
+
+		ca, err := s.storage.GetCA(name)
+		if err != nil {
+			return nil, err
+		}
+		if ca.Type != pkiadm.CALocal {
+			return nil, EWrongType
+		}
+		cert, err := s.storage.GetCertificate(ca.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cert.Data) {
+			return nil, errors.Errorf("no certificate found for CA '%s'", ca.ID)
+		}
+		now := s.storage.clock.Now()
+		for _, v := range cert.History {
+			if v.NotAfter.After(now) {
+				pool.AppendCertsFromPEM(v.Data)
+			}
+		}
+		return pool, nil
+	}
+}
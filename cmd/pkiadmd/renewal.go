@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	ERenewAt        = Error("renew-at must be between 0 and 1")
+	ENegativeRenew  = Error("renewal durations must not be negative")
+	EUnknownRenewal = Error("unknown renewal setting")
+
+	// defaultRenewAt is the share of the lifetime after which resources
+	// with a known end of validity are renewed.
+	defaultRenewAt = 2.0 / 3.0
+)
+
+// renewalFields are the fields of the change sets setting the renewal.
+var renewalFields = []string{"lifetime", "renew-before", "renew-at", "jitter"}
+
+// NextRefresh returns the time the resource should be refreshed. When the end
+// of the validity is known, the refresh is planned relative to it, moved
+// forward by the jitter chosen at the last refresh. Otherwise RefreshAfter is
+// used. A zero time means, that the resource is never refreshed.
+func (i Interval) NextRefresh() time.Time {
+	notAfter := i.NotAfter
+	if notAfter.IsZero() && i.InvalidAfter > 0 {
+		notAfter = i.LastRefresh.Add(i.InvalidAfter)
+	}
+	if notAfter.IsZero() {
+		if i.RefreshAfter <= 0 {
+			return time.Time{}
+		}
+		return i.LastRefresh.Add(i.RefreshAfter)
+	}
+
+	start := i.LastRefresh
+	lifetime := notAfter.Sub(start)
+	due := start.Add(time.Duration(float64(lifetime) * defaultRenewAt))
+	switch {
+	case i.RenewBefore > 0 && i.RenewBefore < lifetime:
+		due = notAfter.Add(-i.RenewBefore)
+	case i.RenewAt > 0 && i.RenewAt < 1:
+		due = start.Add(time.Duration(float64(lifetime) * i.RenewAt))
+	}
+	// a shorter refresh interval is still honoured
+	if i.RefreshAfter > 0 && start.Add(i.RefreshAfter).Before(due) {
+		due = start.Add(i.RefreshAfter)
+	}
+	due = due.Add(-i.Delay)
+	if due.Before(start) {
+		due = start
+	}
+	return due
+}
+
+// refreshed records the refresh of the resource at now. notAfter is the end of
+// the validity of the new content, it is zero for resources without one. A new
+// jitter is chosen for the next refresh.
+func (i *Interval) refreshed(now, notAfter time.Time) {
+	i.LastRefresh = now
+	i.NotAfter = notAfter
+	i.Delay = randomDuration(i.Jitter)
+}
+
+// setRenewalField applies the renewal setting named by the field.
+func (i *Interval) setRenewalField(field string, r pkiadm.Renewal) error {
+	switch field {
+	case "lifetime":
+		if r.Lifetime < 0 {
+			return ENegativeRenew
+		}
+		i.InvalidAfter = r.Lifetime
+	case "renew-before":
+		if r.Before < 0 {
+			return ENegativeRenew
+		}
+		i.RenewBefore = r.Before
+	case "renew-at":
+		if r.At < 0 || r.At >= 1 {
+			return ERenewAt
+		}
+		i.RenewAt = r.At
+	case "jitter":
+		if r.Jitter < 0 {
+			return ENegativeRenew
+		}
+		i.Jitter = r.Jitter
+		i.Delay = randomDuration(i.Jitter)
+	default:
+		return EUnknownRenewal
+	}
+	return nil
+}
+
+// setRenewal applies all renewal settings.
+func (i *Interval) setRenewal(r pkiadm.Renewal, fields ...string) error {
+	for _, field := range fields {
+		if err := i.setRenewalField(field, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewal returns the renewal settings in the representation used by the RPC
+// interface.
+func (i Interval) renewal() pkiadm.Renewal {
+	return pkiadm.Renewal{
+		Lifetime:    i.InvalidAfter,
+		Before:      i.RenewBefore,
+		At:          i.RenewAt,
+		Jitter:      i.Jitter,
+		NextRefresh: i.NextRefresh(),
+	}
+}
+
+// onlyFields returns true, when the field list contains only allowed fields.
+// Changes to these fields don't need the resource to be refreshed.
+func onlyFields(fieldList []string, allowed ...string) bool {
+	if len(fieldList) == 0 {
+		return false
+	}
+	for _, field := range fieldList {
+		found := false
+		for _, a := range allowed {
+			if field == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// randomDuration returns a random duration smaller than max.
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	val, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(val.Int64())
+}
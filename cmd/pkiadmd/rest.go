@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+const (
+	EUnknownParameter = Error("unknown parameter")
+
+	restMaxRequestLength = 1024 * 1024
+)
+
+type (
+	// RESTServer serves the RPC methods as a JSON API over HTTP. The requests
+	// pass the same policy, journal and audit log as RPC requests.
+	RESTServer struct {
+		rpcServer *rpc.Server
+		server    *Server
+		policy    *Policy
+		routes    []restRoute
+	}
+
+	// restRoute maps a path to a RPC method. Path segments in braces are
+	// parameters, which are set in the fields of the arguments with the same
+	// name.
+	restRoute struct {
+		Method string
+		Path   string
+		RPC    string
+		// Type is set in arguments of the type ResourceName.
+		Type pkiadm.ResourceType
+		// Query allows to set the fields of the arguments through query
+		// parameters.
+		Query bool
+	}
+
+	// restCodec passes a single HTTP request to the RPC server and keeps the
+	// reply.
+	restCodec struct {
+		route  restRoute
+		params map[string]string
+		query  url.Values
+		body   []byte
+
+		err   string
+		reply interface{}
+	}
+)
+
+var (
+	serverType = reflect.TypeOf(&Server{})
+
+	// restCollections maps the paths of the collections to the resource part
+	// of the method names.
+	restCollections = []struct{ Path, Name string }{
+		{"private-keys", "PrivateKey"},
+		{"public-keys", "PublicKey"},
+		{"csrs", "CSR"},
+		{"certificates", "Certificate"},
+		{"locations", "Location"},
+		{"serials", "Serial"},
+		{"subjects", "Subject"},
+		{"cas", "CA"},
+		{"crls", "CRL"},
+		{"ocsp-responders", "OCSP"},
+		{"profiles", "Profile"},
+	}
+)
+
+// startRESTServer opens the listener for the REST API and serves it in the
+// background. Clients authenticate like on the admin listener.
+func startRESTServer(cfg *pkiadm.Config, server *Server, rpcServer *rpc.Server, policy *Policy) error {
+	tlsConfig, err := adminTLSConfig(cfg, server)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", cfg.RESTListen)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: NewRESTServer(rpcServer, server, policy)}
+	go func() {
+		log.Printf("rest server stopped: %s", httpServer.Serve(tls.NewListener(listener, tlsConfig)))
+	}()
+	return nil
+}
+
+func NewRESTServer(rpcServer *rpc.Server, server *Server, policy *Policy) *RESTServer {
+	return &RESTServer{
+		rpcServer: rpcServer,
+		server:    server,
+		policy:    policy,
+		routes:    restRoutes(),
+	}
+}
+
+// restRoutes returns the routes of all methods available through the REST
+// API.
+func restRoutes() []restRoute {
+	// unlocking is not offered, as the listener only accepts connections
+	// after the storage was unlocked through the unix socket
+	routes := []restRoute{
+		{Method: "GET", Path: "/v1/resources", RPC: "List"},
+		{Method: "GET", Path: "/v1/status", RPC: "Status"},
+		{Method: "GET", Path: "/v1/jobs", RPC: "ListJobs"},
+		{Method: "GET", Path: "/v1/jobs/{id}/wait", RPC: "WaitJob", Query: true},
+		{Method: "GET", Path: "/v1/audit", RPC: "ListAudit", Query: true},
+		{Method: "GET", Path: "/v1/audit/verify", RPC: "VerifyAudit"},
+		{Method: "GET", Path: "/v1/events", RPC: "Watch", Query: true},
+		{Method: "GET", Path: "/v1/issuances", RPC: "FindCertificate", Query: true},
+		{Method: "POST", Path: "/v1/rekey", RPC: "Rekey"},
+		{Method: "GET", Path: "/v1/certificates/{id}/versions", RPC: "HistoryCertificate", Type: pkiadm.RTCertificate},
+		{Method: "GET", Path: "/v1/certificates/{id}/versions/{version}", RPC: "ShowCertificateVersion"},
+		{Method: "POST", Path: "/v1/certificates/{id}/rollback", RPC: "RollbackCertificate"},
+		{Method: "POST", Path: "/v1/certificates/{id}/revoke", RPC: "RevokeCertificate"},
+	}
+	for _, c := range restCollections {
+		t := resourceTypes[c.Name]
+		list := "List" + c.Name
+		if c.Name == "Subject" {
+			list = "ListSubjects"
+		}
+		collection := "/v1/" + c.Path
+		for _, route := range []restRoute{
+			{Method: "GET", Path: collection, RPC: list},
+			{Method: "POST", Path: collection, RPC: "Create" + c.Name},
+			{Method: "POST", Path: collection + "/import", RPC: "Import" + c.Name},
+			{Method: "GET", Path: collection + "/{id}", RPC: "Show" + c.Name, Type: t},
+			{Method: "PATCH", Path: collection + "/{id}", RPC: "Set" + c.Name},
+			{Method: "DELETE", Path: collection + "/{id}", RPC: "Delete" + c.Name, Type: t},
+			{Method: "GET", Path: collection + "/{id}/status", RPC: "ShowStatus", Type: t},
+			{Method: "GET", Path: collection + "/{id}/plan", RPC: "PlanRefresh", Type: t},
+		} {
+			if _, found := serverType.MethodByName(route.RPC); found {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// ServeHTTP passes the request to the RPC method of the matching route.
+func (rs *RESTServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/v1/openapi.json" {
+		rs.respond(w, http.StatusOK, openAPI(rs.routes))
+		return
+	}
+	route, params, found := rs.match(r.Method, r.URL.Path)
+	if !found {
+		rs.problem(w, http.StatusNotFound, ENotFound, "unknown path '%s'", r.URL.Path)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, restMaxRequestLength))
+	if err != nil {
+		rs.problem(w, http.StatusBadRequest, err, "could not read request")
+		return
+	}
+	caller := Caller{}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		caller.Subject = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	codec := &restCodec{route: route, params: params, query: r.URL.Query(), body: body}
+	rs.rpcServer.ServeRequest(rs.server.wrapCodec(codec, caller, rs.policy))
+	if codec.err != "" {
+		rs.problem(w, http.StatusBadRequest, Error(codec.err), "Could not call '%s'", route.RPC)
+		return
+	}
+	res := resultOf(codec.reply)
+	if res != nil && res.Job != "" {
+		w.Header().Set("Location", "/v1/jobs/"+res.Job+"/wait")
+	}
+	rs.respond(w, restStatus(route, res), codec.reply)
+}
+
+// match returns the route for the method and path and the values of its
+// parameters.
+func (rs *RESTServer) match(method, path string) (restRoute, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range rs.routes {
+		pattern := strings.Split(strings.Trim(route.Path, "/"), "/")
+		if route.Method != method || len(pattern) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		for i, part := range pattern {
+			if strings.HasPrefix(part, "{") {
+				params[strings.Trim(part, "{}")] = segments[i]
+			} else if part != segments[i] {
+				params = nil
+				break
+			}
+		}
+		if params != nil {
+			return route, params, true
+		}
+	}
+	return restRoute{}, nil, false
+}
+
+// restStatus returns the HTTP status for the result of the route.
+func restStatus(route restRoute, res *pkiadm.Result) int {
+	switch {
+	case res == nil:
+		return http.StatusOK
+	case res.HasError:
+		return errorStatus(res.Error)
+	case res.Job != "":
+		return http.StatusAccepted
+	default:
+		return restSuccess(route)
+	}
+}
+
+// restSuccess returns the HTTP status of a successful call of the route.
+func restSuccess(route restRoute) int {
+	if strings.HasPrefix(route.RPC, "Create") {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+// errorStatus returns the HTTP status for the error of a result. The error
+// may be wrapped.
+func errorStatus(err pkiadm.Error) int {
+	msg := err.Error()
+	switch {
+	case err == pkiadm.EPermissionDenied:
+		return http.StatusForbidden
+	case strings.HasSuffix(msg, ENotFound.Error()), msg == EUnknownJob.Error():
+		return http.StatusNotFound
+	case strings.HasSuffix(msg, EAlreadyExist.Error()):
+		return http.StatusConflict
+	case strings.HasSuffix(msg, ELocked.Error()):
+		return http.StatusLocked
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (rs *RESTServer) respond(w http.ResponseWriter, status int, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		rs.problem(w, http.StatusInternalServerError, err, "could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+// problem answers with a result containing the error, so that all responses
+// have the form of the RPC replies.
+func (rs *RESTServer) problem(w http.ResponseWriter, status int, err error, msg string, args ...interface{}) {
+	res := pkiadm.Result{}
+	res.SetError(err, fmt.Sprintf(msg, args...))
+	raw, _ := json.Marshal(struct{ Result pkiadm.Result }{res})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+func (c *restCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = pkiadm.ProtoIdent + "." + c.route.RPC
+	r.Seq = 0
+	return nil
+}
+
+// ReadRequestBody decodes the JSON body into the arguments and sets the
+// parameters of the path and query.
+func (c *restCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	if len(strings.TrimSpace(string(c.body))) > 0 {
+		if err := json.Unmarshal(c.body, body); err != nil {
+			return errors.Wrap(err, "could not parse body")
+		}
+	}
+	v := reflect.ValueOf(body).Elem()
+	if c.route.Query {
+		for name, values := range c.query {
+			if err := setParam(v, name, values[0]); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range c.params {
+		if err := setParam(v, name, value); err != nil {
+			return err
+		}
+	}
+	if rn, ok := body.(*pkiadm.ResourceName); ok {
+		rn.Type = c.route.Type
+	}
+	return nil
+}
+
+func (c *restCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.err = r.Error
+	c.reply = body
+	return nil
+}
+
+func (c *restCodec) Close() error { return nil }
+
+// setParam sets the field of the arguments with the name of the parameter.
+// When the arguments have no such field, it is set in the resource they
+// contain, e.g. the id of a change.
+func setParam(v reflect.Value, name, value string) error {
+	if v.Kind() != reflect.Struct {
+		return errors.Wrapf(EUnknownParameter, "'%s'", name)
+	}
+	match := func(field string) bool { return strings.EqualFold(field, name) }
+	if field := v.FieldByNameFunc(match); field.IsValid() {
+		return setValue(field, value)
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() != reflect.Struct {
+			continue
+		}
+		if field := v.Field(i).FieldByNameFunc(match); field.IsValid() {
+			return setValue(field, value)
+		}
+	}
+	return errors.Wrapf(EUnknownParameter, "'%s'", name)
+}
+
+// setValue parses the value into the field.
+func setValue(field reflect.Value, value string) error {
+	if !field.CanSet() {
+		return errors.Errorf("field can't be set")
+	}
+	switch field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Slice:
+		// lists are separated by commas, e.g. resources=cert/,private/ca
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("parameters of type %s are not supported", field.Type())
+		}
+		field.Set(reflect.ValueOf(strings.Split(value, ",")).Convert(field.Type()))
+	default:
+		return errors.Errorf("parameters of type %s are not supported", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+	"github.com/pkg/errors"
+)
+
+// TestRESTMatch checks that the paths are mapped to the methods and the path
+// parameters are extracted.
+func TestRESTMatch(t *testing.T) {
+	rs := NewRESTServer(nil, nil, nil)
+	tests := []struct {
+		method string
+		path   string
+		rpc    string
+		params map[string]string
+	}{
+		{"GET", "/v1/certificates", "ListCertificate", map[string]string{}},
+		{"GET", "/v1/subjects", "ListSubjects", map[string]string{}},
+		{"POST", "/v1/certificates/import", "ImportCertificate", map[string]string{}},
+		{"GET", "/v1/certificates/www", "ShowCertificate", map[string]string{"id": "www"}},
+		{"PATCH", "/v1/subjects/web/", "SetSubject", map[string]string{"id": "web"}},
+		{"DELETE", "/v1/cas/root", "DeleteCA", map[string]string{"id": "root"}},
+		{"GET", "/v1/certificates/www/versions/3", "ShowCertificateVersion", map[string]string{"id": "www", "version": "3"}},
+		{"GET", "/v1/jobs/42/wait", "WaitJob", map[string]string{"id": "42"}},
+		{"GET", "/v1/certificates/www/status", "ShowStatus", map[string]string{"id": "www"}},
+		{"PUT", "/v1/certificates/www", "", nil},
+		{"GET", "/v1/certificates/www/versions", "HistoryCertificate", map[string]string{"id": "www"}},
+		{"GET", "/v1/certificates/www/versions/3/pem", "", nil},
+		{"GET", "/v1/unknown", "", nil},
+		{"POST", "/v1/unlock", "", nil},
+	}
+	for _, test := range tests {
+		route, params, found := rs.match(test.method, test.path)
+		if found != (test.rpc != "") {
+			t.Errorf("%s %s: expected found %t, got %t", test.method, test.path, test.rpc != "", found)
+			continue
+		}
+		if route.RPC != test.rpc || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s %s: expected %s with %v, got %s with %v", test.method, test.path, test.rpc, test.params, route.RPC, params)
+		}
+	}
+	for _, route := range rs.routes {
+		if route.RPC == "Unlock" {
+			t.Errorf("unlock is offered at %s %s", route.Method, route.Path)
+		}
+	}
+}
+
+// TestRESTParams checks that path and query parameters are set in the
+// arguments of the methods.
+func TestRESTParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    restRoute
+		params   map[string]string
+		query    string
+		body     string
+		args     interface{}
+		expected interface{}
+		err      error
+	}{
+		{
+			name:     "path",
+			route:    restRoute{RPC: "ShowCertificateVersion"},
+			params:   map[string]string{"id": "www", "version": "3"},
+			args:     &pkiadm.CertificateVersionName{},
+			expected: &pkiadm.CertificateVersionName{ID: "www", Version: 3},
+		},
+		{
+			name:     "resource type",
+			route:    restRoute{RPC: "ShowCertificate", Type: pkiadm.RTCertificate},
+			params:   map[string]string{"id": "www"},
+			args:     &pkiadm.ResourceName{},
+			expected: &pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCertificate},
+		},
+		{
+			name:   "nested",
+			route:  restRoute{RPC: "SetSubject"},
+			params: map[string]string{"id": "web"},
+			body:   `{"Subject": {"ID": "other"}, "FieldList": ["name"]}`,
+			args:   &pkiadm.SubjectChange{},
+			expected: &pkiadm.SubjectChange{
+				Subject:   pkiadm.Subject{ID: "web"},
+				FieldList: []string{"name"},
+			},
+		},
+		{
+			name:     "query",
+			route:    restRoute{RPC: "WaitJob", Query: true},
+			params:   map[string]string{"id": "42"},
+			query:    "timeout=30s",
+			args:     &pkiadm.JobWait{},
+			expected: &pkiadm.JobWait{ID: "42", Timeout: 30 * time.Second},
+		},
+		{
+			name:  "query types",
+			route: restRoute{RPC: "ListAudit", Query: true},
+			query: "resource=cert/&failed=true&since=2020-01-02T03:04:05Z",
+			args:  &pkiadm.AuditFilter{},
+			expected: &pkiadm.AuditFilter{
+				Resource: "cert/",
+				Failed:   true,
+				Since:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+		},
+		{
+			name:     "query not allowed",
+			route:    restRoute{RPC: "ShowCertificate", Type: pkiadm.RTCertificate},
+			params:   map[string]string{"id": "www"},
+			query:    "id=other",
+			args:     &pkiadm.ResourceName{},
+			expected: &pkiadm.ResourceName{ID: "www", Type: pkiadm.RTCertificate},
+		},
+		{
+			name:     "path beats query",
+			route:    restRoute{RPC: "WaitJob", Query: true},
+			params:   map[string]string{"id": "42"},
+			query:    "id=43",
+			args:     &pkiadm.JobWait{},
+			expected: &pkiadm.JobWait{ID: "42"},
+		},
+		{
+			name:  "unknown parameter",
+			route: restRoute{RPC: "ListAudit", Query: true},
+			query: "owner=root",
+			args:  &pkiadm.AuditFilter{},
+			err:   EUnknownParameter,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codec := &restCodec{route: test.route, params: test.params, query: query, body: []byte(test.body)}
+			err = codec.ReadRequestBody(test.args)
+			if errors.Cause(err) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err == nil && !reflect.DeepEqual(test.args, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, test.args)
+			}
+		})
+	}
+}
+
+// TestRESTParamValues checks that invalid values are rejected.
+func TestRESTParamValues(t *testing.T) {
+	for _, query := range []string{"timeout=30", "timeout=soon"} {
+		values, _ := url.ParseQuery(query)
+		codec := &restCodec{route: restRoute{RPC: "WaitJob", Query: true}, query: values}
+		if err := codec.ReadRequestBody(&pkiadm.JobWait{}); err == nil {
+			t.Errorf("%s: invalid value was accepted", query)
+		}
+	}
+	codec := &restCodec{route: restRoute{RPC: "ShowCertificateVersion"}, params: map[string]string{"version": "latest"}}
+	if err := codec.ReadRequestBody(&pkiadm.CertificateVersionName{}); err == nil {
+		t.Errorf("invalid version was accepted")
+	}
+}
+
+// TestErrorStatus checks the HTTP status of the errors in results.
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err      pkiadm.Error
+		expected int
+	}{
+		{pkiadm.EPermissionDenied, http.StatusForbidden},
+		{pkiadm.Error(ENotFound.Error()), http.StatusNotFound},
+		{pkiadm.Error(errors.Wrapf(ENotFound, "'cert/www'").Error()), http.StatusNotFound},
+		{pkiadm.Error(EUnknownJob.Error()), http.StatusNotFound},
+		{pkiadm.Error(errors.Wrapf(EAlreadyExist, "'cert/www'").Error()), http.StatusConflict},
+		{pkiadm.Error(ELocked.Error()), http.StatusLocked},
+		{pkiadm.Error(EDurationTooShort.Error()), http.StatusBadRequest},
+		{pkiadm.Error(ENotFound.Error() + " in the journal"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if status := errorStatus(test.err); status != test.expected {
+			t.Errorf("'%s': expected status %d, got %d", test.err, test.expected, status)
+		}
+	}
+}
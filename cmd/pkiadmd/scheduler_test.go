@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+type (
+	// fakeClock only moves forward, when advanced by the test. Timers are
+	// called by the goroutine advancing the clock.
+	fakeClock struct {
+		mu     sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock   *fakeClock
+		when    time.Time
+		f       func()
+		stopped bool
+	}
+)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and calls all timers which became due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	due := []*fakeTimer{}
+	pending := []*fakeTimer{}
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case t.when.After(c.now):
+			pending = append(pending, t)
+		default:
+			t.stopped = true
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+func newTestServer(t *testing.T) (*Server, *fakeClock) {
+	backend, err := NewJSONBackend(filepath.Join(t.TempDir(), "storage.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	storage, err := newStorage(backend, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, clock
+}
+
+// addTimedLocation adds a subject and a location exporting it, which is
+// refreshed every hour.
+func addTimedLocation(t *testing.T, s *Server, id string) {
+	res := &pkiadm.Result{}
+	if err := s.CreateSubject(pkiadm.Subject{ID: id, Name: pkix.Name{CommonName: id}}, res); err != nil || res.HasError {
+		t.Fatalf("could not create subject '%s': %v %s", id, err, res.Message)
+	}
+	loc, err := NewLocation(
+		id,
+		filepath.Join(t.TempDir(), id),
+		"", "",
+		[]pkiadm.ResourceName{{ID: id, Type: pkiadm.RTSubject}},
+		Interval{RefreshAfter: time.Hour},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lock()
+	defer s.unlock()
+	if err := s.storage.AddLocation(loc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func showStatus(t *testing.T, s *Server, rn pkiadm.ResourceName) pkiadm.RefreshStatus {
+	res := &pkiadm.ResultStatus{}
+	if err := s.ShowStatus(rn, res); err != nil || res.Result.HasError {
+		t.Fatalf("could not get status of '%s': %v %s", rn, err, res.Result.Message)
+	}
+	return res.Statuses[0]
+}
+
+func TestScheduledRefresh(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTimedLocation(t, s, "www")
+	rn := pkiadm.ResourceName{ID: "www", Type: pkiadm.RTLocation}
+	start := clock.Now()
+
+	if st := showStatus(t, s, rn); !st.NextRefresh.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected next refresh at %s, got %s", start.Add(time.Hour), st.NextRefresh)
+	}
+	clock.Advance(30 * time.Minute)
+	if st := showStatus(t, s, rn); !st.LastAttempt.IsZero() {
+		t.Fatalf("refreshed before it was due at %s", st.LastAttempt)
+	}
+	clock.Advance(30 * time.Minute)
+	st := showStatus(t, s, rn)
+	if !st.LastSuccess.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected refresh at %s, got %s", start.Add(time.Hour), st.LastSuccess)
+	}
+	if !st.NextRefresh.Equal(start.Add(2 * time.Hour)) {
+		t.Fatalf("expected next refresh at %s, got %s", start.Add(2*time.Hour), st.NextRefresh)
+	}
+}
+
+func TestStaleTimer(t *testing.T) {
+	s, clock := newTestServer(t)
+	addTimedLocation(t, s, "www")
+
+	// a timer firing after the plan was replaced must not refresh early
+	s.storage.tick()
+	st := showStatus(t, s, pkiadm.ResourceName{ID: "www", Type: pkiadm.RTLocation})
+	if !st.LastAttempt.IsZero() {
+		t.Fatalf("refreshed before it was due at %s", st.LastAttempt)
+	}
+	if !st.NextRefresh.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("next refresh moved to %s", st.NextRefresh)
+	}
+}
+
+func TestConcurrentRequestsAndRefreshes(t *testing.T) {
+	s, clock := newTestServer(t)
+	for i := 0; i < 4; i++ {
+		addTimedLocation(t, s, fmt.Sprintf("loc%d", i))
+	}
+
+	done := make(chan struct{})
+	ticker := sync.WaitGroup{}
+	ticker.Add(1)
+	go func() {
+		defer ticker.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				clock.Advance(10 * time.Minute)
+			}
+		}
+	}()
+
+	workers := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			for i := 0; i < 25; i++ {
+				id := fmt.Sprintf("subj%d-%d", w, i)
+				res := &pkiadm.Result{}
+				if err := s.CreateSubject(pkiadm.Subject{ID: id, Name: pkix.Name{CommonName: id}}, res); err != nil || res.HasError {
+					t.Errorf("could not create subject '%s': %v %s", id, err, res.Message)
+					return
+				}
+				change := pkiadm.SubjectChange{
+					Subject:   pkiadm.Subject{ID: fmt.Sprintf("loc%d", w), Name: pkix.Name{CommonName: id}},
+					FieldList: []string{"common-name"},
+				}
+				if err := s.SetSubject(change, res); err != nil || res.HasError {
+					t.Errorf("could not set subject: %v %s", err, res.Message)
+					return
+				}
+				list := &pkiadm.ResultResource{}
+				if err := s.List(pkiadm.Filter{}, list); err != nil {
+					t.Error(err)
+					return
+				}
+				status := &pkiadm.ResultStatus{}
+				if err := s.Status(pkiadm.Filter{}, status); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	workers.Wait()
+	close(done)
+	ticker.Wait()
+
+	res := &pkiadm.ResultStatus{}
+	if err := s.Status(pkiadm.Filter{}, res); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range res.Statuses {
+		if st.Failed() {
+			t.Errorf("refresh of '%s' failed: %s", st.Resource, st.Error)
+		}
+	}
+}
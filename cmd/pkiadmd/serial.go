@@ -3,31 +3,103 @@ package main
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"math/big"
 
 	"github.com/gibheer/pkiadm"
 )
 
 const (
-	ELengthTooSmall = Error("Length must not be smaller than 1")
+	ELengthTooSmall    = Error("Length must not be smaller than 1")
+	ESerialLength      = Error("length of random serials must be between 8 and 20 bytes")
+	ESerialExhausted   = Error("no serials left")
+	ESerialInUse       = Error("mode, min and max of a serial can't be narrowed after serials were issued")
+	EUnknownSerialMode = Error("unknown serial mode")
+
+	// defaultSerialLength is the number of bytes of random serials, when no
+	// length is given.
+	defaultSerialLength = 16
+	// minSerialLength is the minimum number of bytes of random serials. It
+	// keeps collisions unlikely, as issued random serials are not tracked.
+	minSerialLength = 8
+	// maxSerialLength is the maximum number of bytes of a serial allowed by
+	// RFC 5280.
+	maxSerialLength = 20
+	// rangeAttempts is the number of random serials tried in the range mode,
+	// before searching the range for a free one.
+	rangeAttempts = 100
 )
 
 type (
 	Serial struct {
-		ID      string
-		Min     int64
-		Max     int64
-		UsedIDs map[int64]bool
+		ID   string
+		Mode pkiadm.SerialMode
+		// Min and Max limit the range and sequential serials. Max is not
+		// included.
+		Min *big.Int
+		Max *big.Int
+		// Length is the number of bytes of random serials.
+		Length int
+		// UsedIDs contains the offsets from Min used by the range mode.
+		UsedIDs map[string]bool
+		// Next is the next serial of the sequential mode.
+		Next *big.Int
+		// Count is the number of random serials generated.
+		Count uint64
 	}
 )
 
-// NewSerial generates a new serial generator.
-func NewSerial(id string, min, max int64) (*Serial, error) {
-	if max-min < 1 {
-		return nil, ELengthTooSmall
+// NewSerial generates a new serial generator. When min or max are nil, the
+// smallest and largest serials allowed are used.
+func NewSerial(id string, mode pkiadm.SerialMode, min, max *big.Int, length int) (*Serial, error) {
+	if id == "" {
+		return nil, ENoIDGiven
+	}
+	s := &Serial{
+		ID:      id,
+		Mode:    mode,
+		Min:     min,
+		Max:     max,
+		Length:  length,
+		UsedIDs: map[string]bool{},
 	}
-	// TODO check maximum length for certificate serial
-	return &Serial{ID: id, Min: min, Max: max, UsedIDs: map[int64]bool{}}, nil
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// check fills in the defaults and validates the settings.
+func (s *Serial) check() error {
+	if s.Min == nil {
+		s.Min = big.NewInt(0)
+		if s.Mode == pkiadm.SMSequential {
+			s.Min = big.NewInt(1)
+		}
+	}
+	if s.Max == nil {
+		// serials are positive, so one bit is needed for the sign
+		s.Max = new(big.Int).Lsh(big.NewInt(1), maxSerialLength*8-1)
+	}
+	if s.Length == 0 {
+		s.Length = defaultSerialLength
+	}
+	if s.UsedIDs == nil {
+		s.UsedIDs = map[string]bool{}
+	}
+	switch s.Mode {
+	case pkiadm.SMRange, pkiadm.SMSequential:
+		if new(big.Int).Sub(s.Max, s.Min).Cmp(big.NewInt(1)) < 0 {
+			return ELengthTooSmall
+		}
+	case pkiadm.SMRandom:
+		if s.Length < minSerialLength || s.Length > maxSerialLength {
+			return ESerialLength
+		}
+	default:
+		return EUnknownSerialMode
+	}
+	return nil
 }
 
 // Return the unique ResourceName
@@ -53,25 +125,145 @@ func (s *Serial) Checksum() []byte     { return []byte{} }
 func (s *Serial) DependsOn() []pkiadm.ResourceName { return []pkiadm.ResourceName{} }
 
 // Generate generates a new serial number and stores it to avoid double
-// assigning.
+// assigning. When no serial is left, ESerialExhausted is returned.
 func (s *Serial) Generate() (*big.Int, error) {
+	switch s.Mode {
+	case pkiadm.SMRandom:
+		return s.generateRandom()
+	case pkiadm.SMSequential:
+		return s.generateSequential()
+	case pkiadm.SMRange:
+		return s.generateRange()
+	default:
+		return nil, EUnknownSerialMode
+	}
+}
+
+// generateRange picks a random unused serial between Min and Max.
+func (s *Serial) generateRange() (*big.Int, error) {
+	size := new(big.Int).Sub(s.Max, s.Min)
+	if size.Cmp(big.NewInt(int64(len(s.UsedIDs)))) <= 0 {
+		return nil, ESerialExhausted
+	}
+	val, err := rand.Int(rand.Reader, size)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < rangeAttempts && s.UsedIDs[val.String()]; i++ {
+		if val, err = rand.Int(rand.Reader, size); err != nil {
+			return nil, err
+		}
+	}
+	// the range is nearly used up, so take the next free one
+	one := big.NewInt(1)
+	for s.UsedIDs[val.String()] {
+		val.Add(val, one)
+		if val.Cmp(size) >= 0 {
+			val.SetInt64(0)
+		}
+	}
+	s.UsedIDs[val.String()] = true
+	return val.Add(val, s.Min), nil
+}
+
+// generateRandom returns a random positive serial with the configured number
+// of bytes.
+func (s *Serial) generateRandom() (*big.Int, error) {
+	if new(big.Int).SetUint64(s.Count).Cmp(s.capacity()) >= 0 {
+		return nil, ESerialExhausted
+	}
+	raw := make([]byte, s.Length)
 	for {
-		val, err := rand.Int(rand.Reader, big.NewInt(s.Max-s.Min))
-		if err != nil {
-			return big.NewInt(-1), err
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return nil, err
 		}
-		if _, found := s.UsedIDs[val.Int64()]; !found {
-			s.UsedIDs[val.Int64()] = true
-			return big.NewInt(val.Int64() + s.Min), nil
+		// clear the sign bit, so that the serial fits into the length
+		raw[0] &= 0x7f
+		val := new(big.Int).SetBytes(raw)
+		if val.Sign() > 0 {
+			s.Count++
+			return val, nil
 		}
 	}
 }
 
+// generateSequential returns the next serial of the sequence.
+func (s *Serial) generateSequential() (*big.Int, error) {
+	if s.Next == nil || s.Next.Cmp(s.Min) < 0 {
+		s.Next = new(big.Int).Set(s.Min)
+	}
+	if s.Next.Cmp(s.Max) >= 0 {
+		return nil, ESerialExhausted
+	}
+	val := new(big.Int).Set(s.Next)
+	s.Next.Add(s.Next, big.NewInt(1))
+	return val, nil
+}
+
+// used returns the number of serials generated.
+func (s *Serial) used() *big.Int {
+	switch s.Mode {
+	case pkiadm.SMRandom:
+		return new(big.Int).SetUint64(s.Count)
+	case pkiadm.SMSequential:
+		if s.Next == nil || s.Next.Cmp(s.Min) < 0 {
+			return big.NewInt(0)
+		}
+		return new(big.Int).Sub(s.Next, s.Min)
+	default:
+		return big.NewInt(int64(len(s.UsedIDs)))
+	}
+}
+
+// capacity returns the number of serials, which can be generated in total.
+func (s *Serial) capacity() *big.Int {
+	if s.Mode == pkiadm.SMRandom {
+		max := new(big.Int).Lsh(big.NewInt(1), uint(s.Length*8-1))
+		return max.Sub(max, big.NewInt(1))
+	}
+	return new(big.Int).Sub(s.Max, s.Min)
+}
+
+// compatible returns true, when the changed settings keep the serials already
+// issued from being issued again. The used serials are tracked as offsets from
+// Min, so neither the mode nor Min can change after the first serial.
+func (s *Serial) compatible(changed *Serial) bool {
+	if s.used().Sign() == 0 {
+		return true
+	}
+	if changed.Mode != s.Mode {
+		return false
+	}
+	switch s.Mode {
+	case pkiadm.SMRandom:
+		return true
+	case pkiadm.SMRange:
+		// used offsets outside of the range would break the exhaustion check
+		return changed.Min.Cmp(s.Min) == 0 && changed.Max.Cmp(s.Max) >= 0
+	default:
+		return changed.Min.Cmp(s.Min) == 0
+	}
+}
+
+// toPkiadm converts the serial into the representation used by the RPC
+// interface.
+func (s *Serial) toPkiadm() pkiadm.Serial {
+	return pkiadm.Serial{
+		ID:       s.ID,
+		Mode:     s.Mode,
+		Min:      s.Min,
+		Max:      s.Max,
+		Length:   s.Length,
+		Used:     s.used(),
+		Capacity: s.capacity(),
+	}
+}
+
 func (s *Server) CreateSerial(inSer pkiadm.Serial, res *pkiadm.Result) error {
 	s.lock()
 	defer s.unlock()
 
-	ser, err := NewSerial(inSer.ID, inSer.Min, inSer.Max)
+	ser, err := NewSerial(inSer.ID, inSer.Mode, inSer.Min, inSer.Max, inSer.Length)
 	if err != nil {
 		res.SetError(err, "Could not create new serial '%s'", inSer.ID)
 		return nil
@@ -92,17 +284,32 @@ func (s *Server) SetSerial(changeset pkiadm.SerialChange, res *pkiadm.Result) er
 		return nil
 	}
 
+	// the changes are applied to a copy, so that invalid settings are not kept
+	changed := *ser
 	for _, field := range changeset.FieldList {
 		switch field {
+		case "mode":
+			changed.Mode = changeset.Serial.Mode
 		case "min":
-			ser.Min = changeset.Serial.Min
+			changed.Min = changeset.Serial.Min
 		case "max":
-			ser.Max = changeset.Serial.Max
+			changed.Max = changeset.Serial.Max
+		case "length":
+			changed.Length = changeset.Serial.Length
 		default:
 			res.SetError(fmt.Errorf("unknown field"), "unknown field '%s'", field)
 			return nil
 		}
 	}
+	if err := changed.check(); err != nil {
+		res.SetError(err, "Could not change serial '%s'", changeset.Serial.ID)
+		return nil
+	}
+	if !ser.compatible(&changed) {
+		res.SetError(ESerialInUse, "Could not change serial '%s'", changeset.Serial.ID)
+		return nil
+	}
+	*ser = changed
 	if err := s.storage.Update(pkiadm.ResourceName{ID: ser.ID, Type: pkiadm.RTSerial}); err != nil {
 		res.SetError(err, "Could not update serial '%s'", changeset.Serial.ID)
 		return nil
@@ -134,11 +341,7 @@ func (s *Server) ShowSerial(inSer pkiadm.ResourceName, res *pkiadm.ResultSerial)
 		res.Result.SetError(err, "Could not find serial '%s'", inSer.ID)
 		return nil
 	}
-	res.Serials = []pkiadm.Serial{pkiadm.Serial{
-		ID:  ser.ID,
-		Min: ser.Min,
-		Max: ser.Max,
-	}}
+	res.Serials = []pkiadm.Serial{ser.toPkiadm()}
 	return nil
 }
 func (s *Server) ListSerial(filter pkiadm.Filter, res *pkiadm.ResultSerial) error {
@@ -146,11 +349,7 @@ func (s *Server) ListSerial(filter pkiadm.Filter, res *pkiadm.ResultSerial) erro
 	defer s.unlock()
 
 	for _, ser := range s.storage.Serials {
-		res.Serials = append(res.Serials, pkiadm.Serial{
-			ID:  ser.ID,
-			Min: ser.Min,
-			Max: ser.Max,
-		})
+		res.Serials = append(res.Serials, ser.toPkiadm())
 	}
 	return nil
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/gibheer/pkiadm"
+)
+
+// TestSerialExhausted generates all serials of small generators and checks
+// that every serial is only issued once.
+func TestSerialExhausted(t *testing.T) {
+	tests := []struct {
+		name string
+		ser  *Serial
+		// count is the number of serials, which can be generated.
+		count int
+	}{
+		{"range", &Serial{Mode: pkiadm.SMRange, Min: big.NewInt(10), Max: big.NewInt(20)}, 10},
+		{"range of one", &Serial{Mode: pkiadm.SMRange, Min: big.NewInt(5), Max: big.NewInt(6)}, 1},
+		{"sequential", &Serial{Mode: pkiadm.SMSequential, Min: big.NewInt(1), Max: big.NewInt(8)}, 7},
+		// random serials are not tracked, so only the count is limited
+		{"random", &Serial{Mode: pkiadm.SMRandom, Length: minSerialLength, Count: 1<<63 - 4}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.ser.check(); err != nil {
+				t.Fatal(err)
+			}
+			seen := map[string]bool{}
+			for i := 0; i < test.count; i++ {
+				val, err := test.ser.Generate()
+				if err != nil {
+					t.Fatalf("serial %d: %s", i, err)
+				}
+				if seen[val.String()] {
+					t.Fatalf("serial %s was issued twice", val)
+				}
+				seen[val.String()] = true
+				if test.ser.Mode != pkiadm.SMRandom && (val.Cmp(test.ser.Min) < 0 || val.Cmp(test.ser.Max) >= 0) {
+					t.Errorf("serial %s is out of range", val)
+				}
+			}
+			if val, err := test.ser.Generate(); err != ESerialExhausted {
+				t.Errorf("expected %s, got %v and %v", ESerialExhausted, val, err)
+			}
+			if test.ser.used().Cmp(test.ser.capacity()) != 0 {
+				t.Errorf("expected all %s serials to be used, got %s", test.ser.capacity(), test.ser.used())
+			}
+		})
+	}
+}
+
+// TestSerialLength checks the limits of the length of random serials.
+func TestSerialLength(t *testing.T) {
+	for length, valid := range map[int]bool{1: false, 7: false, 8: true, 20: true, 21: false} {
+		_, err := NewSerial("random", pkiadm.SMRandom, nil, nil, length)
+		if valid && err != nil {
+			t.Errorf("length %d: %s", length, err)
+		} else if !valid && err != ESerialLength {
+			t.Errorf("length %d: expected %s, got %v", length, ESerialLength, err)
+		}
+	}
+}
+
+// TestSetSerialInUse checks that serials can't be moved, once they were used.
+func TestSetSerialInUse(t *testing.T) {
+	s, _ := newTestServer(t)
+	res := &pkiadm.Result{}
+	err := s.CreateSerial(pkiadm.Serial{ID: "ser", Mode: pkiadm.SMRange, Min: big.NewInt(1), Max: big.NewInt(100)}, res)
+	checkResult(t, "create serial", err, res)
+
+	// unused serials can be changed freely
+	change := pkiadm.SerialChange{
+		Serial:    pkiadm.Serial{ID: "ser", Min: big.NewInt(10)},
+		FieldList: []string{"min"},
+	}
+	err = s.SetSerial(change, res)
+	checkResult(t, "change min of unused serial", err, res)
+
+	s.lock()
+	ser, err := s.storage.GetSerial(pkiadm.ResourceName{ID: "ser", Type: pkiadm.RTSerial})
+	if err == nil {
+		_, err = ser.Generate()
+	}
+	s.unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []pkiadm.SerialChange{
+		{Serial: pkiadm.Serial{ID: "ser", Mode: pkiadm.SMSequential}, FieldList: []string{"mode"}},
+		{Serial: pkiadm.Serial{ID: "ser", Min: big.NewInt(20)}, FieldList: []string{"min"}},
+		{Serial: pkiadm.Serial{ID: "ser", Max: big.NewInt(50)}, FieldList: []string{"max"}},
+	}
+	for _, change := range changes {
+		res := &pkiadm.Result{}
+		if err := s.SetSerial(change, res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.HasError || res.Error.Error() != ESerialInUse.Error() {
+			t.Errorf("change of %v was not rejected: %s", change.FieldList, res.Message)
+		}
+	}
+	// growing the range keeps the issued serials
+	res = &pkiadm.Result{}
+	err = s.SetSerial(pkiadm.SerialChange{
+		Serial:    pkiadm.Serial{ID: "ser", Max: big.NewInt(200)},
+		FieldList: []string{"max"},
+	}, res)
+	checkResult(t, "grow range of used serial", err, res)
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
-	"sync"
 
 	"github.com/gibheer/pkiadm"
 )
@@ -10,29 +10,48 @@ import (
 type (
 	Server struct {
 		storage *Storage
-		mu      *sync.Mutex
+		// journal records the changing requests until they are finished.
+		journal *Journal
+		// jobs runs the slow parts of requests in the background.
+		jobs *Jobs
 	}
 )
 
-func NewServer(storage *Storage) (*Server, error) {
-	return &Server{storage, &sync.Mutex{}}, nil
+func NewServer(storage *Storage, journal *Journal) (*Server, error) {
+	return &Server{storage: storage, journal: journal, jobs: storage.jobs}, nil
 }
 
+// lock waits for the storage, so that requests and the scheduler don't
+// change it at the same time.
 func (s *Server) lock() {
-	s.mu.Lock()
+	s.storage.mu.Lock()
 }
 func (s *Server) unlock() {
-	s.mu.Unlock()
+	s.storage.mu.Unlock()
 }
 func (s *Server) store(res *pkiadm.Result) error {
 	if err := s.storage.store(); err != nil {
 		log.Printf("error when storing changes: %+v", err)
 		res.SetError(err, "could not save database")
+		return nil
+	}
+	if err := s.journal.Commit(); err != nil {
+		log.Printf("could not update journal: %s", err)
 	}
 	return nil
 }
 
+// done completes the request continued in a job.
+func (s *Server) done(seq uint64) {
+	if err := s.journal.Done(seq); err != nil {
+		log.Printf("could not update journal: %s", err)
+	}
+}
+
 func (s *Server) List(filter pkiadm.Filter, result *pkiadm.ResultResource) error {
+	s.lock()
+	defer s.unlock()
+
 	resources := s.storage.List()
 	result.Resources = make([]pkiadm.ResourceName, len(resources))
 	for i, res := range resources {
@@ -40,3 +59,32 @@ func (s *Server) List(filter pkiadm.Filter, result *pkiadm.ResultResource) error
 	}
 	return nil
 }
+
+// tlsCertificate returns a function to look up the current version of the
+// certificate resource, which can be used in a tls.Config. This way renewed
+// certificates are picked up without restarting the listener.
+// As the private key is sealed with the master key, no handshake succeeds
+// while the storage is locked.
+func (s *Server) tlsCertificate(name pkiadm.ResourceName) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.lock()
+		defer s.unlock()
+
+		if s.storage.Locked() {
+			return nil, ELocked
+		}
+		cert, err := s.storage.GetCertificate(name)
+		if err != nil {
+			return nil, err
+		}
+		pk, err := s.storage.GetPrivateKey(cert.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCert, err := tls.X509KeyPair(cert.Data, pk.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsCert, nil
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gibheer/pkiadm"
+)
+
+const (
+	ERefreshPending    = Error("refresh is continued in a job")
+	ERefreshSuperseded = Error("refresh was superseded by a newer one")
+
+	// retryMin is the time to wait after the first failed refresh. It is
+	// doubled with every further failure up to retryMax.
+	retryMin = time.Minute
+	retryMax = 24 * time.Hour
+)
+
+type (
+	// RefreshStatus records the outcome of the refreshes of a resource.
+	RefreshStatus struct {
+		Resource    pkiadm.ResourceName
+		LastAttempt time.Time
+		LastSuccess time.Time
+		// Error is the message of the last refresh, when it failed.
+		Error string
+		// Failures is the number of failed refreshes since the last success.
+		Failures int
+		// RetryAt is the time of the next attempt after a failure.
+		RetryAt time.Time
+	}
+)
+
+// refreshResource refreshes the resource and records the outcome in its
+// status and the audit log. Refreshes continued in a job are recorded, when
+// the job is finished.
+func (s *Storage) refreshResource(r Resource) error {
+	old := r.Checksum()
+	err := r.Refresh(s)
+	if err == ERefreshPending {
+		return err
+	}
+	s.recordRefresh(r.Name(), err)
+	s.auditRefresh(r, old, err)
+	return err
+}
+
+// refreshInJob continues the refresh of the resource in a job, so that slow
+// network requests don't hold the storage. run is called without the lock and
+// returns the function, which stores the result while holding the lock.
+// Afterwards the depending resources are refreshed. A newer refresh of the
+// same resource supersedes the running one.
+// It always returns ERefreshPending.
+func (s *Storage) refreshInJob(r Resource, description string, run func() (func() error, error)) error {
+	rn := r.Name()
+	old := r.Checksum()
+	var id string
+	id = s.jobs.Submit(description, rn, func() error {
+		apply, err := run()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pending[rn.String()] != id {
+			return ERefreshSuperseded
+		}
+		delete(s.pending, rn.String())
+		current, getErr := s.Get(rn)
+		if getErr != nil {
+			return getErr
+		}
+		if current != r {
+			return ERefreshSuperseded
+		}
+		if err == nil {
+			err = apply()
+		}
+		s.recordRefresh(rn, err)
+		s.auditRefresh(r, old, err)
+		if err == nil {
+			err = s.cascade(r, "refresh job", false)
+		}
+		s.scanForRefresh()
+		if storeErr := s.store(); storeErr != nil {
+			return storeErr
+		}
+		return err
+	})
+	s.pending[rn.String()] = id
+	return ERefreshPending
+}
+
+// pendingJob returns the id of the job refreshing the resource, if there is
+// one.
+func (s *Storage) pendingJob(rn pkiadm.ResourceName) string {
+	return s.pending[rn.String()]
+}
+
+// recordRefresh updates the status of the resource after a refresh. Failed
+// refreshes are retried with an exponential backoff.
+func (s *Storage) recordRefresh(rn pkiadm.ResourceName, err error) {
+	st, found := s.Statuses[rn.String()]
+	if !found {
+		st = &RefreshStatus{Resource: rn}
+		s.Statuses[rn.String()] = st
+	}
+	now := s.clock.Now()
+	st.LastAttempt = now
+	if err == nil {
+		st.LastSuccess = now
+		st.Error = ""
+		st.Failures = 0
+		st.RetryAt = time.Time{}
+		return
+	}
+	st.Error = err.Error()
+	st.Failures++
+	st.RetryAt = now.Add(backoff(st.Failures))
+	log.Printf("refresh of '%s' failed %d times, retrying at %s", rn, st.Failures, st.RetryAt.Format(time.RFC3339))
+}
+
+// backoff returns the time to wait after the number of failed refreshes.
+func backoff(failures int) time.Duration {
+	wait := retryMin
+	for i := 1; i < failures && wait < retryMax; i++ {
+		wait *= 2
+	}
+	if wait > retryMax {
+		wait = retryMax
+	}
+	return wait
+}
+
+// nextRefresh returns the time the resource is refreshed next. Failed
+// resources are retried after their backoff. Resources refreshed by a job are
+// planned again, when the job is finished.
+func (s *Storage) nextRefresh(r Resource) time.Time {
+	if _, found := s.pending[r.Name().String()]; found {
+		return time.Time{}
+	}
+	if st, found := s.Statuses[r.Name().String()]; found && st.Failures > 0 {
+		return st.RetryAt
+	}
+	return r.RefreshInterval().NextRefresh()
+}
+
+// statusOf returns the refresh status of the resource in the representation
+// used by the RPC interface.
+func (s *Storage) statusOf(r Resource) pkiadm.RefreshStatus {
+	res := pkiadm.RefreshStatus{
+		Resource:    r.Name(),
+		NextRefresh: s.nextRefresh(r),
+	}
+	if st, found := s.Statuses[r.Name().String()]; found {
+		res.LastAttempt = st.LastAttempt
+		res.LastSuccess = st.LastSuccess
+		res.Error = st.Error
+		res.Failures = st.Failures
+	}
+	return res
+}
+
+// Status returns the refresh status of all resources.
+func (s *Server) Status(filter pkiadm.Filter, res *pkiadm.ResultStatus) error {
+	s.lock()
+	defer s.unlock()
+
+	for _, r := range s.storage.List() {
+		res.Statuses = append(res.Statuses, s.storage.statusOf(r))
+	}
+	return nil
+}
+
+// ShowStatus returns the refresh status of a single resource.
+func (s *Server) ShowStatus(rn pkiadm.ResourceName, res *pkiadm.ResultStatus) error {
+	s.lock()
+	defer s.unlock()
+
+	r, err := s.storage.Get(rn)
+	if err != nil {
+		res.Result.SetError(err, "Could not find resource '%s'", rn)
+		return nil
+	}
+	res.Statuses = []pkiadm.RefreshStatus{s.storage.statusOf(r)}
+	return nil
+}
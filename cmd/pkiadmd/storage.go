@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gibheer/pkiadm"
@@ -15,10 +18,28 @@ import (
 
 type (
 	// Storage is used to add and lookup resources and manages the dependency
-	// chain on an update.
+	// chain on an update. All access has to hold mu, which is shared by the
+	// RPC handlers and the scheduler.
 	Storage struct {
-		// path to the place where the storage should be stored.
-		path         string
+		mu sync.Mutex
+		// clock provides the time for the scheduler.
+		clock Clock
+		// backend persists the resources.
+		backend Backend
+		// backups takes copies of the backend after changes.
+		backups *Backups
+		// audit records the refreshes. It may be nil.
+		audit *AuditLog
+		// jobs runs the slow parts of requests and refreshes in the
+		// background.
+		jobs *Jobs
+		// pending maps the resources, which are refreshed by a job, to the id
+		// of the job.
+		pending map[string]string
+		// written contains the checksums of all records as they were last
+		// written to the backend, so that only changed records are stored.
+		written map[string][]byte
+
 		PrivateKeys  map[string]*PrivateKey
 		PublicKeys   map[string]*PublicKey
 		Locations    map[string]*Location
@@ -27,13 +48,27 @@ type (
 		Serials      map[string]*Serial
 		Subjects     map[string]*Subject
 		CAs          map[string]*CA
+		CRLs         map[string]*CRL
+		OCSPs        map[string]*OCSPResponder
+		Profiles     map[string]*Profile
+		// Issuances contains all certificates issued by the CAs.
+		Issuances map[string]*Issuance
+		// The following maps contain the state of the ACME directories.
+		ACMEAccounts       map[string]*ACMEAccount
+		ACMEOrders         map[string]*ACMEOrder
+		ACMEAuthorizations map[string]*ACMEAuthorization
+		ACMECertificates   map[string]*ACMECertificate
+		// Statuses contains the outcome of the last refresh of the resources.
+		Statuses map[string]*RefreshStatus
+		// MasterKey encrypts the private keys, when set.
+		MasterKey *MasterKey
 		// dependencies maps from a resource name to all resources which depend
 		// on it.
 		dependencies map[string]map[string]Resource
 		// refresh order contains all resources in the order they need to be
 		// refreshed next.
 		refreshOrder RefreshList
-		refreshTimer *time.Timer
+		refreshTimer Timer
 	}
 
 	// RefreshList is a list of resources
@@ -43,14 +78,27 @@ type (
 	RefreshSet struct {
 		Name     pkiadm.ResourceName
 		Interval Interval
+		// Due is the time of the next refresh. It differs from the interval,
+		// when a failed refresh is retried.
+		Due time.Time
 	}
 )
 
 // NewStorage builds a new storage instance and loads available data from the
-// provided file path.
-func NewStorage(path string) (*Storage, error) {
+// provided backend. When backups are given, they are taken after changes.
+func NewStorage(backend Backend, backups *Backups) (*Storage, error) {
+	return newStorage(backend, backups, systemClock{})
+}
+
+// newStorage builds the storage with the clock used by the scheduler.
+func newStorage(backend Backend, backups *Backups, clock Clock) (*Storage, error) {
 	s := &Storage{
-		path:         path,
+		clock:        clock,
+		backend:      backend,
+		backups:      backups,
+		jobs:         NewJobs(clock),
+		pending:      map[string]string{},
+		written:      map[string][]byte{},
 		PrivateKeys:  map[string]*PrivateKey{},
 		PublicKeys:   map[string]*PublicKey{},
 		Locations:    map[string]*Location{},
@@ -59,27 +107,83 @@ func NewStorage(path string) (*Storage, error) {
 		Serials:      map[string]*Serial{},
 		Subjects:     map[string]*Subject{},
 		CAs:          map[string]*CA{},
+		CRLs:         map[string]*CRL{},
+		OCSPs:        map[string]*OCSPResponder{},
+		Profiles:     map[string]*Profile{},
+		Issuances:    map[string]*Issuance{},
+		Statuses:     map[string]*RefreshStatus{},
 		dependencies: map[string]map[string]Resource{},
+
+		ACMEAccounts:       map[string]*ACMEAccount{},
+		ACMEOrders:         map[string]*ACMEOrder{},
+		ACMEAuthorizations: map[string]*ACMEAuthorization{},
+		ACMECertificates:   map[string]*ACMECertificate{},
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if err := s.load(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-// load will restore the state from the file to the storage and overwrite
+// buckets returns the resource maps by the name of the bucket they are
+// persisted in.
+func (s *Storage) buckets() map[string]interface{} {
+	return map[string]interface{}{
+		"PrivateKeys":        &s.PrivateKeys,
+		"PublicKeys":         &s.PublicKeys,
+		"Locations":          &s.Locations,
+		"Certificates":       &s.Certificates,
+		"CSRs":               &s.CSRs,
+		"Serials":            &s.Serials,
+		"Subjects":           &s.Subjects,
+		"CAs":                &s.CAs,
+		"CRLs":               &s.CRLs,
+		"OCSPs":              &s.OCSPs,
+		"Profiles":           &s.Profiles,
+		"Issuances":          &s.Issuances,
+		"ACMEAccounts":       &s.ACMEAccounts,
+		"ACMEOrders":         &s.ACMEOrders,
+		"ACMEAuthorizations": &s.ACMEAuthorizations,
+		"ACMECertificates":   &s.ACMECertificates,
+		"Statuses":           &s.Statuses,
+	}
+}
+
+// load will restore the state from the backend to the storage and overwrite
 // already existing resources.
 func (s *Storage) load() error {
-	raw, err := ioutil.ReadFile(s.path)
-	if os.IsNotExist(err) {
-		return nil
-	}
+	data, err := s.backend.Load()
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(raw, s); err != nil {
+	for bucket, target := range s.buckets() {
+		m := reflect.ValueOf(target).Elem()
+		for id, raw := range data[bucket] {
+			entry := reflect.New(m.Type().Elem().Elem())
+			if err := json.Unmarshal(raw, entry.Interface()); err != nil {
+				return errors.Wrapf(err, "could not load '%s/%s'", bucket, id)
+			}
+			m.SetMapIndex(reflect.ValueOf(id), entry)
+		}
+	}
+	if raw, found := data[bucketSettings][settingMasterKey]; found {
+		s.MasterKey = &MasterKey{}
+		if err := json.Unmarshal(raw, s.MasterKey); err != nil {
+			return errors.Wrap(err, "could not load master key")
+		}
+	}
+	// the checksums are taken from the loaded resources, as the backend may
+	// have stored them in a different format
+	records, err := s.records()
+	if err != nil {
 		return err
 	}
+	for key, rec := range records {
+		s.written[key] = recordSum(rec.Data)
+	}
+	s.completeIssuances()
 	if err := s.refreshDependencies(); err != nil {
 		return err
 	}
@@ -114,6 +218,15 @@ func (s *Storage) refreshDependencies() error {
 	for _, ca := range s.CAs {
 		_ = s.addDependency(ca)
 	}
+	for _, crl := range s.CRLs {
+		_ = s.addDependency(crl)
+	}
+	for _, o := range s.OCSPs {
+		_ = s.addDependency(o)
+	}
+	for _, p := range s.Profiles {
+		_ = s.addDependency(p)
+	}
 	return nil
 }
 
@@ -124,42 +237,58 @@ func (s *Storage) scanForRefresh() {
 	}
 	refList := RefreshList{}
 	for _, res := range s.PrivateKeys {
-		refList.Add(res)
+		refList.Add(res, s.nextRefresh(res))
 	}
 	for _, res := range s.PublicKeys {
-		refList.Add(res)
+		refList.Add(res, s.nextRefresh(res))
 	}
 	for _, res := range s.CSRs {
-		refList.Add(res)
+		refList.Add(res, s.nextRefresh(res))
 	}
 	for _, res := range s.Certificates {
-		refList.Add(res)
+		refList.Add(res, s.nextRefresh(res))
 	}
 	for _, res := range s.Locations {
-		refList.Add(res)
+		refList.Add(res, s.nextRefresh(res))
+	}
+	for _, res := range s.CRLs {
+		refList.Add(res, s.nextRefresh(res))
+	}
+	for _, res := range s.OCSPs {
+		refList.Add(res, s.nextRefresh(res))
 	}
 	sort.Sort(refList)
 	if len(refList) == 0 {
 		log.Println("nothing found to refresh, looking again in 24h")
-		s.refreshTimer = time.AfterFunc(24*time.Hour, s.scanForRefresh)
+		s.refreshTimer = s.clock.AfterFunc(24*time.Hour, s.tick)
 		return
 	}
 	s.refreshOrder = refList
-	duration := refList[0].Interval.LastRefresh.
-		Add(refList[0].Interval.RefreshAfter).
-		Sub(time.Now())
+	duration := refList[0].Due.Sub(s.clock.Now())
 	if duration <= 5*time.Second {
 		duration = 5 * time.Second
 	}
 	log.Printf("next refresh planned for '%s' in %s", refList[0].Name, duration)
-	s.refreshTimer = time.AfterFunc(
+	s.refreshTimer = s.clock.AfterFunc(
 		duration,
-		s.refresh,
+		s.tick,
 	)
 }
 
+// tick is called by the refresh timer. It waits for the running requests to
+// finish before refreshing.
+func (s *Storage) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+}
+
+// refresh refreshes the next resource in the refresh order and plans the next
+// refresh.
 func (s *Storage) refresh() {
-	if len(s.refreshOrder) == 0 {
+	if len(s.refreshOrder) == 0 || s.refreshOrder[0].Due.After(s.clock.Now()) {
+		// the plan changed while waiting for the lock
+		s.scanForRefresh()
 		return
 	}
 	resName := s.refreshOrder[0].Name
@@ -169,7 +298,7 @@ func (s *Storage) refresh() {
 		log.Printf("resource to refresh has gone away: %s", resName)
 		goto rescan
 	}
-	if err := res.Refresh(s); err != nil {
+	if err := s.cascade(res, "scheduled refresh", true); err != nil {
 		log.Printf("error refreshing resource '%s': %s", res.Name(), err)
 	}
 	if err := s.store(); err != nil {
@@ -197,20 +326,84 @@ func (s *Storage) addDependency(r Resource) error {
 	return nil
 }
 
-// store writes the content of the storage to the disk in json format.
+// store writes all resources changed since the last store to the backend.
 func (s *Storage) store() error {
-	raw, err := json.MarshalIndent(s, "", "  ")
+	if err := s.sealKeys(); err != nil {
+		log.Printf("could not encrypt private keys: %s", err)
+		return err
+	}
+	records, err := s.records()
 	if err != nil {
 		log.Printf("could not marshal data: %s", err)
 		return err
 	}
-	if err := ioutil.WriteFile(s.path, raw, 0600); err != nil {
-		log.Printf("could not write to file '%s': %s", s.path, err)
+	changes := []Record{}
+	sums := map[string][]byte{}
+	for key, rec := range records {
+		sums[key] = recordSum(rec.Data)
+		if !bytes.Equal(s.written[key], sums[key]) {
+			changes = append(changes, rec)
+		}
+	}
+	for key := range s.written {
+		if _, found := records[key]; !found {
+			bucket, id := splitRecordKey(key)
+			changes = append(changes, Record{Bucket: bucket, ID: id})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := s.backend.Write(changes); err != nil {
+		log.Printf("could not write %d changed resources: %s", len(changes), err)
 		return err
 	}
+	s.written = sums
+	if err := s.backups.Take(s.backend); err != nil {
+		log.Printf("could not take backup: %s", err)
+	}
 	return nil
 }
 
+// records serializes all resources.
+func (s *Storage) records() (map[string]Record, error) {
+	res := map[string]Record{}
+	for bucket, source := range s.buckets() {
+		iter := reflect.ValueOf(source).Elem().MapRange()
+		for iter.Next() {
+			id := iter.Key().String()
+			raw, err := json.Marshal(iter.Value().Interface())
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not marshal '%s/%s'", bucket, id)
+			}
+			res[recordKey(bucket, id)] = Record{Bucket: bucket, ID: id, Data: raw}
+		}
+	}
+	if s.MasterKey != nil {
+		raw, err := json.Marshal(s.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+		key := recordKey(bucketSettings, settingMasterKey)
+		res[key] = Record{Bucket: bucketSettings, ID: settingMasterKey, Data: raw}
+	}
+	return res, nil
+}
+
+// recordKey returns the key of the record in the list of written records.
+func recordKey(bucket, id string) string { return bucket + "\x00" + id }
+
+// splitRecordKey returns the bucket and id of a record key.
+func splitRecordKey(key string) (string, string) {
+	parts := strings.SplitN(key, "\x00", 2)
+	return parts[0], parts[1]
+}
+
+func recordSum(raw []byte) []byte {
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
+
 // AddSerial adds a serial to the storage and refreshes the dependencies.
 func (s *Storage) AddSerial(se *Serial) error {
 	if err := se.Refresh(s); err != nil {
@@ -239,6 +432,11 @@ func (s *Storage) AddPrivateKey(pk *PrivateKey) error {
 	if err := pk.Refresh(s); err != nil {
 		return err
 	}
+	return s.insertPrivateKey(pk)
+}
+
+// insertPrivateKey adds a private key, which already contains its key.
+func (s *Storage) insertPrivateKey(pk *PrivateKey) error {
 	s.PrivateKeys[pk.Name().ID] = pk
 	s.scanForRefresh()
 	return s.addDependency(pk)
@@ -254,9 +452,14 @@ func (s *Storage) AddPublicKey(pub *PublicKey) error {
 	return s.addDependency(pub)
 }
 
-// AddCertificate adds a certificate to the storage and refreshes the dependencies.
+// AddCertificate adds a certificate to the storage and refreshes the
+// dependencies. Certificates ordered from an ACME directory are added right
+// away and get their data, when the order is finished.
 func (s *Storage) AddCertificate(cert *Certificate) error {
-	if err := cert.Refresh(s); err != nil {
+	if err := s.checkCycle(cert); err != nil {
+		return err
+	}
+	if err := cert.Refresh(s); err != nil && err != ERefreshPending {
 		return err
 	}
 	s.Certificates[cert.Name().ID] = cert
@@ -284,8 +487,13 @@ func (s *Storage) AddLocation(l *Location) error {
 	return s.addDependency(l)
 }
 
+// AddCA adds a CA to the storage and refreshes the dependencies. The ACME
+// account of a CA is registered in a job.
 func (s *Storage) AddCA(ca *CA) error {
-	if err := ca.Refresh(s); err != nil {
+	if err := s.checkCycle(ca); err != nil {
+		return err
+	}
+	if err := ca.Refresh(s); err != nil && err != ERefreshPending {
 		return err
 	}
 	s.CAs[ca.Name().ID] = ca
@@ -293,6 +501,42 @@ func (s *Storage) AddCA(ca *CA) error {
 	return s.addDependency(ca)
 }
 
+// AddCRL adds a CRL to the storage and refreshes the dependencies.
+func (s *Storage) AddCRL(crl *CRL) error {
+	if _, found := s.CRLs[crl.Name().ID]; found {
+		return EAlreadyExist
+	}
+	if err := crl.Refresh(s); err != nil {
+		return err
+	}
+	s.CRLs[crl.Name().ID] = crl
+	s.scanForRefresh()
+	return s.addDependency(crl)
+}
+
+// AddOCSP adds an OCSP responder to the storage and refreshes the
+// dependencies.
+func (s *Storage) AddOCSP(o *OCSPResponder) error {
+	if _, found := s.OCSPs[o.Name().ID]; found {
+		return EAlreadyExist
+	}
+	if err := o.Refresh(s); err != nil {
+		return err
+	}
+	s.OCSPs[o.Name().ID] = o
+	s.scanForRefresh()
+	return s.addDependency(o)
+}
+
+// AddProfile adds a profile to the storage.
+func (s *Storage) AddProfile(p *Profile) error {
+	if _, found := s.Profiles[p.Name().ID]; found {
+		return EAlreadyExist
+	}
+	s.Profiles[p.Name().ID] = p
+	return s.addDependency(p)
+}
+
 // Get figures out the resource to the ResourceName if available.
 func (s *Storage) Get(r pkiadm.ResourceName) (Resource, error) {
 	if r.ID == "" {
@@ -315,6 +559,12 @@ func (s *Storage) Get(r pkiadm.ResourceName) (Resource, error) {
 		return s.GetLocation(r)
 	case pkiadm.RTCA:
 		return s.GetCA(r)
+	case pkiadm.RTCRL:
+		return s.GetCRL(r)
+	case pkiadm.RTOCSP:
+		return s.GetOCSP(r)
+	case pkiadm.RTProfile:
+		return s.GetProfile(r)
 	default:
 		return nil, EUnknownType
 	}
@@ -384,6 +634,30 @@ func (s *Storage) GetCA(r pkiadm.ResourceName) (*CA, error) {
 	return nil, errors.Wrapf(ENotFound, "no CA with id '%s' found", r)
 }
 
+// GetCRL returns the CRL matching the resource name.
+func (s *Storage) GetCRL(r pkiadm.ResourceName) (*CRL, error) {
+	if res, found := s.CRLs[r.ID]; found {
+		return res, nil
+	}
+	return nil, errors.Wrapf(ENotFound, "no CRL with id '%s' found", r)
+}
+
+// GetOCSP returns the OCSP responder matching the resource name.
+func (s *Storage) GetOCSP(r pkiadm.ResourceName) (*OCSPResponder, error) {
+	if res, found := s.OCSPs[r.ID]; found {
+		return res, nil
+	}
+	return nil, errors.Wrapf(ENotFound, "no OCSP responder with id '%s' found", r)
+}
+
+// GetProfile returns the profile matching the resource name.
+func (s *Storage) GetProfile(r pkiadm.ResourceName) (*Profile, error) {
+	if res, found := s.Profiles[r.ID]; found {
+		return res, nil
+	}
+	return nil, errors.Wrapf(ENotFound, "no profile with id '%s' found", r)
+}
+
 // Remove takes a resource and removes it from the system.
 func (s *Storage) Remove(r Resource) error {
 	// TODO implement unable to remove when having dependencies
@@ -404,6 +678,12 @@ func (s *Storage) Remove(r Resource) error {
 		delete(s.Locations, r.Name().ID)
 	case pkiadm.RTCA:
 		delete(s.CAs, r.Name().ID)
+	case pkiadm.RTCRL:
+		delete(s.CRLs, r.Name().ID)
+	case pkiadm.RTOCSP:
+		delete(s.OCSPs, r.Name().ID)
+	case pkiadm.RTProfile:
+		delete(s.Profiles, r.Name().ID)
 	default:
 		return EUnknownType
 	}
@@ -413,6 +693,7 @@ func (s *Storage) Remove(r Resource) error {
 			delete(deps, r.Name().String())
 		}
 	}
+	delete(s.Statuses, r.Name().String())
 	s.scanForRefresh()
 	return nil
 }
@@ -423,37 +704,85 @@ func (s *Storage) Update(rn pkiadm.ResourceName) error {
 	if err != nil {
 		return err
 	}
-	updateOrder := []Resource{r}
-	checkList := map[string]bool{rn.String(): true}
-	depsToCheck := []Resource{}
-	for _, nextDep := range s.dependencies[rn.String()] {
-		depsToCheck = append(depsToCheck, nextDep)
+	// the dependencies might have been changed
+	if err := s.relink(r); err != nil {
+		return err
 	}
+	err = s.cascade(r, "update", true)
+	s.scanForRefresh()
+	return err
+}
 
-	var dep Resource
-	for {
-		if len(depsToCheck) == 0 {
-			break
-		}
-		dep, depsToCheck = depsToCheck[0], depsToCheck[1:]
-		if _, found := checkList[dep.Name().String()]; found {
-			continue
-		}
-		updateOrder = append(updateOrder, dep)
-		checkList[dep.Name().String()] = true
-		for _, nextDep := range s.dependencies[dep.Name().String()] {
-			depsToCheck = append(depsToCheck, nextDep)
-		}
+// Propagate sends a refresh through all resources depending on the one given,
+// after it was changed by the caller.
+func (s *Storage) Propagate(rn pkiadm.ResourceName) error {
+	r, err := s.Get(rn)
+	if err != nil {
+		return err
 	}
+	s.recordRefresh(rn, nil)
+	err = s.cascade(r, "update", false)
+	s.scanForRefresh()
+	return err
+}
 
-	for _, dep := range updateOrder {
-		log.Printf("refreshing resource '%s' because of '%s'", dep.Name(), rn.String())
-		if err := dep.Refresh(s); err != nil {
-			return err
+// cascade refreshes the resource and then all resources depending on it in
+// topological order, so that they pick up the new content. The resource
+// itself is only refreshed, when refreshRoot is set. The reason is logged as
+// the cause of the first refresh. When a refresh fails, the resources
+// depending on the failed one are skipped and the first error is returned.
+// Resources depending on a refresh continued in a job are refreshed by the
+// job.
+func (s *Storage) cascade(r Resource, reason string, refreshRoot bool) error {
+	plan, err := s.refreshPlan(r)
+	if err != nil {
+		return err
+	}
+	rn := r.Name()
+	planned := map[string]bool{}
+	failed := map[string]bool{}
+	var firstErr error
+	for _, dep := range plan {
+		name := dep.Name()
+		deps := causes(dep, planned)
+		planned[name.String()] = true
+		if name == rn {
+			if !refreshRoot {
+				continue
+			}
+			log.Printf("refreshing resource '%s' because of %s", name, reason)
+		} else {
+			skip := false
+			for _, cause := range deps {
+				if failed[cause.String()] {
+					log.Printf("skipping refresh of '%s', because '%s' failed", name, cause)
+					skip = true
+					break
+				}
+			}
+			if skip {
+				failed[name.String()] = true
+				continue
+			}
+			cause := rn
+			if len(deps) > 0 {
+				cause = deps[0]
+			}
+			log.Printf("refreshing resource '%s' because of '%s' (%s of '%s')", name, cause, reason, rn)
+		}
+		if err := s.refreshResource(dep); err == ERefreshPending {
+			// the job refreshes the dependents, when it is finished
+			log.Printf("refresh of '%s' continues in job %s", name, s.pending[name.String()])
+			failed[name.String()] = true
+		} else if err != nil {
+			log.Printf("error refreshing resource '%s': %s", name, err)
+			failed[name.String()] = true
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
-	s.scanForRefresh()
-	return nil
+	return firstErr
 }
 
 // List returns all currently registered resources.
@@ -480,17 +809,47 @@ func (s *Storage) List() []Resource {
 	for _, res := range s.Subjects {
 		resources = append(resources, res)
 	}
+	for _, res := range s.CAs {
+		resources = append(resources, res)
+	}
+	for _, res := range s.CRLs {
+		resources = append(resources, res)
+	}
+	for _, res := range s.OCSPs {
+		resources = append(resources, res)
+	}
+	for _, res := range s.Profiles {
+		resources = append(resources, res)
+	}
+	return resources
+}
+
+// RevocationPublishers returns all resources publishing the revocation status
+// of certificates issued by the CA.
+func (s *Storage) RevocationPublishers(ca pkiadm.ResourceName) []Resource {
+	resources := []Resource{}
+	for _, res := range s.CRLs {
+		if res.CA.ID == ca.ID {
+			resources = append(resources, res)
+		}
+	}
+	for _, res := range s.OCSPs {
+		if res.CA.ID == ca.ID {
+			resources = append(resources, res)
+		}
+	}
 	return resources
 }
 
-// Add adds a resource to the refreshList when it should be refreshed.
-func (refList *RefreshList) Add(res Resource) {
+// Add adds a resource to the refreshList when it should be refreshed at due.
+func (refList *RefreshList) Add(res Resource, due time.Time) {
+	if due.IsZero() {
+		return
+	}
 	refSet := RefreshSet{
 		Name:     res.Name(),
 		Interval: res.RefreshInterval(),
-	}
-	if refSet.Interval.RefreshAfter <= 0 {
-		return
+		Due:      due,
 	}
 	newRefList := append(*refList, refSet)
 	*refList = newRefList
@@ -502,12 +861,7 @@ func (refList RefreshList) Len() int { return len(refList) }
 // Less reports whether the element with
 // index i should sort before the element with index j.
 func (refList RefreshList) Less(i, j int) bool {
-	return 0 > refList[i].Interval.LastRefresh.Add(
-		refList[i].Interval.RefreshAfter,
-	).Sub(
-		refList[j].Interval.LastRefresh.Add(
-			refList[j].Interval.RefreshAfter),
-	)
+	return refList[i].Due.Before(refList[j].Due)
 }
 
 // Swap swaps the elements with indexes i and j.
@@ -17,6 +17,74 @@ type (
 	Config struct {
 		Path    string // path to the unix socket
 		Storage string // path to the storage location
+		// StorageType selects the storage backend. It can be 'json' for a
+		// single JSON file or 'bolt' for a bbolt database. The default is
+		// 'json'.
+		StorageType string
+		// Backups is the number of backups of the storage to keep. When 0, 5
+		// backups are kept. A negative number disables the backups.
+		Backups int
+		// BackupInterval is the minimum time between two backups, e.g. '1h',
+		// which is also the default.
+		BackupInterval string
+
+		// ACMEListen is the address to serve the ACME directories on. When
+		// empty, the ACME server is disabled.
+		ACMEListen string
+		// ACMEURL is the URL under which the ACME listener is reachable by
+		// clients, e.g. https://pki.example.com:8443
+		ACMEURL string
+		// ACMECertificate is the id of the certificate to use for TLS on the
+		// ACME listener. When empty, plain http is used.
+		ACMECertificate string
+
+		// OCSPListen is the address to serve OCSP requests on. When empty, the
+		// OCSP responder is disabled.
+		OCSPListen string
+
+		// AdminListen is the TCP address to serve the RPC interface on for
+		// remote administration. When empty, only the unix socket is used.
+		// Clients must authenticate with a certificate. The private key of
+		// the certificate is encrypted with the master key, so the listener
+		// only accepts connections after the storage was unlocked. A locked
+		// storage must be unlocked through the unix socket.
+		AdminListen string
+		// AdminCertificate is the id of the certificate to use for TLS on the
+		// admin listener.
+		AdminCertificate string
+		// AdminClientCA is the id of the CA, which issues the certificates of
+		// the clients allowed to connect to the admin listener.
+		AdminClientCA string
+		// RESTListen is the TCP address to serve the REST API on. It uses
+		// the certificate and client CA of the admin listener and is only
+		// usable after the storage was unlocked. When empty, the REST API is
+		// disabled.
+		RESTListen string
+		// PolicyFile is the path to the JSON file mapping callers to roles.
+		// Callers on the unix socket are identified by their uid and gids,
+		// callers on the admin listener by the subject of their certificate.
+		// When empty, every caller may call all methods.
+		PolicyFile string
+
+		// Address is the TCP address of a remote daemon. When set, the client
+		// connects to it with TLS instead of using the unix socket.
+		Address string
+		// ClientCertificate and ClientKey are the paths to the certificate
+		// and private key in PEM format, the client authenticates with.
+		ClientCertificate string
+		ClientKey         string
+		// ServerCA is the path to the CA certificates in PEM format to verify
+		// the remote daemon with. When empty, the system roots are used.
+		ServerCA string
+		// ServerName is the name expected in the certificate of the remote
+		// daemon. When empty, the host of Address is used.
+		ServerName string
+
+		// PassphraseFile is the path to a file containing the passphrase to
+		// unlock the encrypted private keys at startup. When empty, the
+		// passphrase is read from the environment variable PKIADM_PASSPHRASE
+		// or must be given with 'pkiadm unlock'.
+		PassphraseFile string
 	}
 )
 
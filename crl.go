@@ -0,0 +1,134 @@
+package pkiadm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The reason codes for revocations as defined in RFC 5280.
+const (
+	RRUnspecified          RevocationReason = 0
+	RRKeyCompromise        RevocationReason = 1
+	RRCACompromise         RevocationReason = 2
+	RRAffiliationChanged   RevocationReason = 3
+	RRSuperseded           RevocationReason = 4
+	RRCessationOfOperation RevocationReason = 5
+	RRCertificateHold      RevocationReason = 6
+	RRRemoveFromCRL        RevocationReason = 8
+	RRPrivilegeWithdrawn   RevocationReason = 9
+	RRAACompromise         RevocationReason = 10
+)
+
+var revocationReasonNames = map[RevocationReason]string{
+	RRUnspecified:          "unspecified",
+	RRKeyCompromise:        "key-compromise",
+	RRCACompromise:         "ca-compromise",
+	RRAffiliationChanged:   "affiliation-changed",
+	RRSuperseded:           "superseded",
+	RRCessationOfOperation: "cessation-of-operation",
+	RRCertificateHold:      "certificate-hold",
+	RRRemoveFromCRL:        "remove-from-crl",
+	RRPrivilegeWithdrawn:   "privilege-withdrawn",
+	RRAACompromise:         "aa-compromise",
+}
+
+type (
+	// RevocationReason is the reason code given when revoking a certificate.
+	RevocationReason int
+
+	CRL struct {
+		ID string
+		// CA is the CA signing the revocation list.
+		CA ResourceName
+		// Duration is the time between this and the next update of the list.
+		Duration time.Duration
+		// Renewal configures when the list is regenerated before the next
+		// update. The lifetime is not used, as it is set by the duration.
+		Renewal Renewal
+
+		// The following fields are filled in by the server.
+		Number     int64
+		NextUpdate time.Time
+		Revoked    int
+		Checksum   []byte
+	}
+
+	CRLChange struct {
+		CRL       CRL
+		FieldList []string
+	}
+
+	ResultCRL struct {
+		Result Result
+		CRLs   []CRL
+	}
+
+	// Revocation identifies a certificate to revoke. Either the ID of the
+	// certificate resource or the CA together with the serial in hex must be
+	// given.
+	Revocation struct {
+		ID     string
+		CA     ResourceName
+		Serial string
+		Reason RevocationReason
+	}
+)
+
+func (c *Client) CreateCRL(crl CRL) error {
+	return c.exec("CreateCRL", crl)
+}
+func (c *Client) SetCRL(crl CRL, fieldList []string) error {
+	changeset := CRLChange{crl, fieldList}
+	return c.exec("SetCRL", changeset)
+}
+func (c *Client) DeleteCRL(id string) error {
+	crl := ResourceName{ID: id, Type: RTCRL}
+	return c.exec("DeleteCRL", crl)
+}
+func (c *Client) ListCRL() ([]CRL, error) {
+	result := &ResultCRL{}
+	if err := c.query("ListCRL", Filter{}, result); err != nil {
+		return []CRL{}, err
+	}
+	if result.Result.HasError {
+		return []CRL{}, result.Result.Error
+	}
+	return result.CRLs, nil
+}
+func (c *Client) ShowCRL(id string) (CRL, error) {
+	crl := ResourceName{ID: id, Type: RTCRL}
+	result := &ResultCRL{}
+	if err := c.query("ShowCRL", crl, result); err != nil {
+		return CRL{}, err
+	}
+	if result.Result.HasError {
+		return CRL{}, result.Result.Error
+	}
+	for _, crl := range result.CRLs {
+		return crl, nil
+	}
+	return CRL{}, nil
+}
+
+// RevokeCertificate revokes a certificate. All CRLs and OCSP responses of the
+// issuing CA are regenerated.
+func (c *Client) RevokeCertificate(rev Revocation) error {
+	return c.exec("RevokeCertificate", rev)
+}
+
+func (r RevocationReason) String() string {
+	if name, found := revocationReasonNames[r]; found {
+		return name
+	}
+	return fmt.Sprintf("RevocationReason(%d)", r)
+}
+
+func StringToRevocationReason(in string) (RevocationReason, error) {
+	for reason, name := range revocationReasonNames {
+		if name == strings.ToLower(in) {
+			return reason, nil
+		}
+	}
+	return RRUnspecified, fmt.Errorf("unknown revocation reason")
+}
@@ -18,10 +18,21 @@ type (
 		PrivateKey ResourceName
 		Subject    ResourceName
 
+		// Imported is set by the server for CSRs, which were generated outside
+		// of pkiadm and imported with ImportCSR.
+		Imported bool
+		// Renewal configures when a new request is generated.
+		Renewal Renewal
 		// Checksum provides the checksum of the CSR on the server.
 		Checksum []byte
 	}
 
+	// CSRImport contains an externally generated CSR in PEM format.
+	CSRImport struct {
+		ID  string
+		Pem []byte
+	}
+
 	CSRChange struct {
 		CSR       CSR
 		FieldList []string
@@ -40,6 +51,13 @@ func (c *Client) SetCSR(pk CSR, fieldList []string) error {
 	changeset := CSRChange{pk, fieldList}
 	return c.exec("SetCSR", changeset)
 }
+
+// ImportCSR stores an externally generated CSR. The signature of the request
+// is checked by the server. Importing a CSR with the id of an already imported
+// one replaces it and reissues all depending certificates.
+func (c *Client) ImportCSR(id string, pem []byte) error {
+	return c.exec("ImportCSR", CSRImport{id, pem})
+}
 func (c *Client) DeleteCSR(id string) error {
 	pk := ResourceName{ID: id, Type: RTCSR}
 	return c.exec("DeleteCSR", pk)
@@ -0,0 +1,175 @@
+package pkiadm
+
+import (
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+const (
+	EKCreated EventKind = iota
+	EKUpdated
+	EKRefreshed
+	EKFailed
+	EKDeleted
+	EKRevoked
+)
+
+const (
+	// watchPoll is the time a single watch request waits for events.
+	watchPoll = time.Minute
+	// watchRetryMin is the time to wait before reconnecting after the
+	// connection was lost. It is doubled for every failed attempt up to
+	// watchRetryMax.
+	watchRetryMin = time.Second
+	watchRetryMax = time.Minute
+)
+
+type (
+	// EventKind is the kind of change of a resource.
+	EventKind uint
+
+	// Event is a change of a resource. The revision increases with every
+	// change of the storage, so that it can be used to continue watching
+	// after the last event seen.
+	Event struct {
+		Revision uint64
+		Time     time.Time
+		Kind     EventKind
+		Resource ResourceName
+		// Checksum is the checksum of the resource after the change.
+		Checksum []byte
+		// Caller is the identity of the client causing the change or
+		// 'pkiadmd' for changes made by the daemon itself.
+		Caller string
+		// Error is the message of the failure for failed events.
+		Error string
+	}
+
+	// WatchRequest selects the events to wait for.
+	WatchRequest struct {
+		// After is the revision of the last event seen.
+		After uint64
+		// Current requests the current revision instead of the events, so
+		// that only later events are watched. It is returned without
+		// waiting.
+		Current bool
+		// Resources selects the events of resources with the names, e.g.
+		// 'cert/www', or all resources of a type, e.g. 'cert/'. When empty,
+		// all events are returned.
+		Resources []string
+		// Timeout is the maximum time to wait for an event. When 0, the
+		// server uses its own limit.
+		Timeout time.Duration
+	}
+
+	ResultEvents struct {
+		Result Result
+		Events []Event
+		// Revision is the revision the request has seen up to. It is used
+		// as After of the next request.
+		Revision uint64
+	}
+)
+
+// Match returns true, when the event is selected by the request.
+func (w WatchRequest) Match(e Event) bool {
+	if len(w.Resources) == 0 {
+		return true
+	}
+	name := e.Resource.String()
+	for _, r := range w.Resources {
+		if r == name || (strings.HasSuffix(r, "/") && strings.HasPrefix(name, r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitEvents waits for the events selected by the request and returns them
+// with the revision to continue with.
+func (c *Client) WaitEvents(req WatchRequest) ([]Event, uint64, error) {
+	result := &ResultEvents{}
+	if err := c.query("Watch", req, result); err != nil {
+		return []Event{}, req.After, err
+	}
+	if result.Result.HasError {
+		return []Event{}, req.After, result.Result.Error
+	}
+	return result.Events, result.Revision, nil
+}
+
+// Watch calls the handler for every event selected by the request until the
+// handler returns an error, which is then returned. Watch uses its own
+// connection to the server. When the connection is lost, it reconnects and
+// continues after the last event seen.
+func (c *Client) Watch(req WatchRequest, handle func(Event) error) error {
+	if req.Timeout == 0 {
+		req.Timeout = watchPoll
+	}
+	var watcher *Client
+	defer func() {
+		if watcher != nil {
+			watcher.Close()
+		}
+	}()
+	retry := watchRetryMin
+	for {
+		if watcher == nil {
+			var err error
+			if watcher, err = NewClient(c.cfg); err != nil {
+				time.Sleep(retry)
+				retry = nextRetry(retry)
+				continue
+			}
+		}
+		events, revision, err := watcher.WaitEvents(req)
+		switch err.(type) {
+		case nil:
+		case Error, rpc.ServerError:
+			// the server rejected the request, so retrying doesn't help
+			return err
+		default:
+			watcher.Close()
+			watcher = nil
+			time.Sleep(retry)
+			retry = nextRetry(retry)
+			continue
+		}
+		retry = watchRetryMin
+		req.Current = false
+		for _, e := range events {
+			if err := handle(e); err != nil {
+				return err
+			}
+		}
+		req.After = revision
+	}
+}
+
+// nextRetry returns the time to wait after another failed attempt.
+func nextRetry(retry time.Duration) time.Duration {
+	if retry*2 > watchRetryMax {
+		return watchRetryMax
+	}
+	return retry * 2
+}
+
+func (k EventKind) String() string {
+	switch k {
+	case EKCreated:
+		return "created"
+	case EKUpdated:
+		return "updated"
+	case EKRefreshed:
+		return "refreshed"
+	case EKFailed:
+		return "failed"
+	case EKDeleted:
+		return "deleted"
+	case EKRevoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,82 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+// The states of an issued certificate.
+const (
+	ISValid IssuanceStatus = iota
+	ISExpired
+	ISRevoked
+)
+
+var issuanceStatusNames = map[IssuanceStatus]string{
+	ISValid:   "valid",
+	ISExpired: "expired",
+	ISRevoked: "revoked",
+}
+
+type (
+	// IssuanceStatus is the state of an issued certificate.
+	IssuanceStatus int
+
+	// Issuance is a certificate issued by one of the CAs.
+	Issuance struct {
+		// CA is the id of the issuing CA.
+		CA string
+		// Serial is the serial number of the certificate in hex.
+		Serial  string
+		Subject string
+		// SANs contains the DNS names, IP addresses, email addresses and URIs
+		// of the certificate.
+		SANs      []string
+		Issuer    string
+		NotBefore time.Time
+		NotAfter  time.Time
+		Issued    time.Time
+		// Requester describes the resource the certificate was issued for, e.g.
+		// cert/www or acme-order/<id>.
+		Requester string
+
+		// The following fields are filled in by the server.
+		Status    IssuanceStatus
+		RevokedAt time.Time
+		Reason    RevocationReason
+	}
+
+	// IssuanceFilter selects the issued certificates to return. Empty fields
+	// match all certificates. The serial is given in hex, the subject matches
+	// any part of the subject.
+	IssuanceFilter struct {
+		CA      string
+		Serial  string
+		SAN     string
+		Subject string
+	}
+
+	ResultIssuance struct {
+		Result    Result
+		Issuances []Issuance
+	}
+)
+
+// FindCertificate returns the issued certificates matching the filter, ordered
+// by the time they were issued.
+func (c *Client) FindCertificate(filter IssuanceFilter) ([]Issuance, error) {
+	result := &ResultIssuance{}
+	if err := c.query("FindCertificate", filter, result); err != nil {
+		return []Issuance{}, err
+	}
+	if result.Result.HasError {
+		return []Issuance{}, result.Result.Error
+	}
+	return result.Issuances, nil
+}
+
+func (s IssuanceStatus) String() string {
+	if name, found := issuanceStatusNames[s]; found {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,88 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+const (
+	JSQueued JobState = iota
+	JSRunning
+	JSDone
+	JSFailed
+)
+
+type (
+	// JobState is the progress of a job.
+	JobState uint
+
+	// Job is an operation, which continues in the background after the
+	// request returned.
+	Job struct {
+		ID          string
+		Description string
+		// Resource is the resource changed by the job.
+		Resource ResourceName
+		State    JobState
+		// Error is the message of the failure, when the job failed.
+		Error    string
+		Created  time.Time
+		Started  time.Time
+		Finished time.Time
+	}
+	// JobWait selects the job to wait for and how long to wait at most.
+	JobWait struct {
+		ID string
+		// Timeout is the maximum time to wait. When 0, the server uses its
+		// own limit.
+		Timeout time.Duration
+	}
+	ResultJob struct {
+		Result Result
+		Jobs   []Job
+	}
+)
+
+// Done returns true, when the job is finished or failed.
+func (j Job) Done() bool { return j.State == JSDone || j.State == JSFailed }
+
+func (c *Client) ListJobs() ([]Job, error) {
+	result := &ResultJob{}
+	if err := c.query("ListJobs", Filter{}, result); err != nil {
+		return []Job{}, err
+	}
+	if result.Result.HasError {
+		return []Job{}, result.Result.Error
+	}
+	return result.Jobs, nil
+}
+
+// WaitJob waits until the job is finished or the timeout is hit and returns
+// its current state.
+func (c *Client) WaitJob(id string, timeout time.Duration) (Job, error) {
+	result := &ResultJob{}
+	if err := c.query("WaitJob", JobWait{ID: id, Timeout: timeout}, result); err != nil {
+		return Job{}, err
+	}
+	if result.Result.HasError {
+		return Job{}, result.Result.Error
+	}
+	for _, job := range result.Jobs {
+		return job, nil
+	}
+	return Job{}, nil
+}
+
+func (s JobState) String() string {
+	switch s {
+	case JSQueued:
+		return "queued"
+	case JSRunning:
+		return "running"
+	case JSDone:
+		return "done"
+	case JSFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
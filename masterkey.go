@@ -0,0 +1,28 @@
+package pkiadm
+
+type (
+	// MasterKeyUnlock contains the passphrase to unlock the encrypted private
+	// keys of the server.
+	MasterKeyUnlock struct {
+		Passphrase []byte
+	}
+	// MasterKeyChange contains the current passphrase and the one to protect
+	// the new master key with. The current passphrase is ignored, when the
+	// private keys are not encrypted yet.
+	MasterKeyChange struct {
+		Passphrase    []byte
+		NewPassphrase []byte
+	}
+)
+
+// Unlock decrypts the private keys on the server. Until the server is
+// unlocked, no certificates can be signed.
+func (c *Client) Unlock(passphrase []byte) error {
+	return c.exec("Unlock", MasterKeyUnlock{passphrase})
+}
+
+// Rekey replaces the master key encrypting the private keys. When the private
+// keys are not encrypted yet, encryption is enabled.
+func (c *Client) Rekey(passphrase, newPassphrase []byte) error {
+	return c.exec("Rekey", MasterKeyChange{passphrase, newPassphrase})
+}
@@ -0,0 +1,69 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+type (
+	// OCSP is a responder answering status requests for the certificates of a
+	// CA. The responses are signed by a delegated certificate, which is
+	// created and renewed by the server.
+	OCSP struct {
+		ID string
+		// CA is the CA to answer status requests for.
+		CA ResourceName
+		// Duration is the time the pre-generated responses are valid.
+		Duration time.Duration
+
+		// The following fields are filled in by the server.
+		CertificateNotAfter time.Time
+		Responses           int
+		Checksum            []byte
+	}
+
+	OCSPChange struct {
+		OCSP      OCSP
+		FieldList []string
+	}
+
+	ResultOCSP struct {
+		Result Result
+		OCSPs  []OCSP
+	}
+)
+
+func (c *Client) CreateOCSP(ocsp OCSP) error {
+	return c.exec("CreateOCSP", ocsp)
+}
+func (c *Client) SetOCSP(ocsp OCSP, fieldList []string) error {
+	changeset := OCSPChange{ocsp, fieldList}
+	return c.exec("SetOCSP", changeset)
+}
+func (c *Client) DeleteOCSP(id string) error {
+	ocsp := ResourceName{ID: id, Type: RTOCSP}
+	return c.exec("DeleteOCSP", ocsp)
+}
+func (c *Client) ListOCSP() ([]OCSP, error) {
+	result := &ResultOCSP{}
+	if err := c.query("ListOCSP", Filter{}, result); err != nil {
+		return []OCSP{}, err
+	}
+	if result.Result.HasError {
+		return []OCSP{}, result.Result.Error
+	}
+	return result.OCSPs, nil
+}
+func (c *Client) ShowOCSP(id string) (OCSP, error) {
+	ocsp := ResourceName{ID: id, Type: RTOCSP}
+	result := &ResultOCSP{}
+	if err := c.query("ShowOCSP", ocsp, result); err != nil {
+		return OCSP{}, err
+	}
+	if result.Result.HasError {
+		return OCSP{}, result.Result.Error
+	}
+	for _, ocsp := range result.OCSPs {
+		return ocsp, nil
+	}
+	return OCSP{}, nil
+}
@@ -13,6 +13,18 @@ type (
 		Type     PrivateKeyType
 		Bits     uint
 		Checksum []byte // This field is only set by the server
+		// Imported is set by the server for keys, which were generated outside
+		// of pkiadm. They are not regenerated until type or bits are changed.
+		Imported bool
+		// Renewal configures when a new key is generated. Without a lifetime,
+		// the key is kept until it is changed.
+		Renewal Renewal
+	}
+	// PrivateKeyImport contains an externally generated private key in PEM
+	// format.
+	PrivateKeyImport struct {
+		ID  string
+		Pem []byte
 	}
 	PrivateKeyChange struct {
 		PrivateKey PrivateKey
@@ -25,13 +37,23 @@ type (
 	PrivateKeyType uint
 )
 
-// CreatePrivateKey sends a RPC request to create a new private key.
-func (c *Client) CreatePrivateKey(pk PrivateKey) error {
-	return c.exec("CreatePrivateKey", pk)
+// CreatePrivateKey sends a RPC request to create a new private key. The key is
+// generated by the returned job.
+func (c *Client) CreatePrivateKey(pk PrivateKey) (string, error) {
+	return c.submit("CreatePrivateKey", pk)
 }
-func (c *Client) SetPrivateKey(pk PrivateKey, fieldList []string) error {
+
+// SetPrivateKey changes the private key. When a new key has to be generated,
+// the id of the job doing so is returned.
+func (c *Client) SetPrivateKey(pk PrivateKey, fieldList []string) (string, error) {
 	changeset := PrivateKeyChange{pk, fieldList}
-	return c.exec("SetPrivateKey", changeset)
+	return c.submit("SetPrivateKey", changeset)
+}
+
+// ImportPrivateKey stores an externally generated private key. The key can be
+// in PKCS#1, PKCS#8 or SEC1 format.
+func (c *Client) ImportPrivateKey(id string, pem []byte) error {
+	return c.exec("ImportPrivateKey", PrivateKeyImport{id, pem})
 }
 func (c *Client) DeletePrivateKey(id string) error {
 	pk := ResourceName{ID: id, Type: RTPrivateKey}
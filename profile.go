@@ -0,0 +1,87 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+type (
+	// Profile contains the settings used to issue certificates. Certificates
+	// referencing a profile use these settings instead of their own.
+	Profile struct {
+		ID string
+
+		// Duration is the validity of the issued certificates.
+		Duration time.Duration
+		// KeyUsage and ExtKeyUsage restrict what the certificates may be used
+		// for. Certificates with cert-sign are issued as CA certificates.
+		KeyUsage    KeyUsage
+		ExtKeyUsage []ExtKeyUsage
+		// MaxPathLen is the maximum number of intermediate CAs allowed below a
+		// CA certificate. A negative value means no limit. Like in crypto/x509,
+		// a value of 0 only forbids intermediate CAs, when MaxPathLenZero is
+		// set.
+		MaxPathLen     int
+		MaxPathLenZero bool
+		// PathLenCritical marks the basic constraints as critical.
+		PathLenCritical bool
+		// Policies contains the certificate policy OIDs, e.g. 2.23.140.1.2.1
+		Policies []string
+		// CRLURLs, OCSPURLs and IssuerURLs are added as CRL distribution points
+		// and authority information access to the certificates.
+		CRLURLs    []string
+		OCSPURLs   []string
+		IssuerURLs []string
+		// AllowedNames restricts the subject alternative names of the
+		// certificates. Entries can be names like 'host.example.com',
+		// '*.example.com' for all names below a domain, networks like
+		// '10.0.0.0/8' or mail domains like '@example.com'. When empty, all
+		// names are allowed.
+		AllowedNames []string
+	}
+
+	ProfileChange struct {
+		Profile   Profile
+		FieldList []string
+	}
+
+	ResultProfile struct {
+		Result   Result
+		Profiles []Profile
+	}
+)
+
+func (c *Client) CreateProfile(profile Profile) error {
+	return c.exec("CreateProfile", profile)
+}
+func (c *Client) SetProfile(profile Profile, fieldList []string) error {
+	changeset := ProfileChange{profile, fieldList}
+	return c.exec("SetProfile", changeset)
+}
+func (c *Client) DeleteProfile(id string) error {
+	profile := ResourceName{ID: id, Type: RTProfile}
+	return c.exec("DeleteProfile", profile)
+}
+func (c *Client) ListProfile() ([]Profile, error) {
+	result := &ResultProfile{}
+	if err := c.query("ListProfile", Filter{}, result); err != nil {
+		return []Profile{}, err
+	}
+	if result.Result.HasError {
+		return []Profile{}, result.Result.Error
+	}
+	return result.Profiles, nil
+}
+func (c *Client) ShowProfile(id string) (Profile, error) {
+	profile := ResourceName{ID: id, Type: RTProfile}
+	result := &ResultProfile{}
+	if err := c.query("ShowProfile", profile, result); err != nil {
+		return Profile{}, err
+	}
+	if result.Result.HasError {
+		return Profile{}, result.Result.Error
+	}
+	for _, profile := range result.Profiles {
+		return profile, nil
+	}
+	return Profile{}, nil
+}
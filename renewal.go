@@ -0,0 +1,29 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+type (
+	// Renewal configures when a resource is renewed. Resources with an end of
+	// validity are renewed relative to it, by default after 2/3 of their
+	// lifetime.
+	Renewal struct {
+		// Lifetime is the validity of private keys and CSRs, which have no
+		// end of validity on their own. When 0, they are not renewed.
+		Lifetime time.Duration
+		// Before renews the resource the given time before the end of its
+		// validity.
+		Before time.Duration
+		// At renews the resource after the share of its lifetime, e.g. 0.5.
+		// It is only used, when Before is not set.
+		At float64
+		// Jitter is the maximum random time the renewal is moved forward, so
+		// that resources created together are not renewed at once.
+		Jitter time.Duration
+
+		// NextRefresh is filled by the server with the time of the next
+		// renewal. It is zero, when the resource is not renewed.
+		NextRefresh time.Time
+	}
+)
@@ -22,6 +22,12 @@ func (i ResourceType) String() string {
 		return "location"
 	case RTCA:
 		return "CA"
+	case RTCRL:
+		return "crl"
+	case RTOCSP:
+		return "ocsp"
+	case RTProfile:
+		return "profile"
 	case RTUnknown:
 		return "unknown"
 	default:
@@ -47,6 +53,12 @@ func StringToResourceType(in string) (ResourceType, error) {
 		return RTSerial, nil
 	case "ca":
 		return RTCA, nil
+	case "crl":
+		return RTCRL, nil
+	case "ocsp":
+		return RTOCSP, nil
+	case "profile":
+		return RTProfile, nil
 	default:
 		return RTUnknown, fmt.Errorf("unknown resource type")
 	}
@@ -1,10 +1,40 @@
 package pkiadm
 
+import (
+	"math/big"
+	"strings"
+)
+
+const (
+	// SMRange picks random serials between Min and Max and remembers them to
+	// not use them twice.
+	SMRange SerialMode = iota
+	// SMRandom generates random serials with the configured number of bytes.
+	SMRandom
+	// SMSequential counts up from Min to Max.
+	SMSequential
+	SMUnknown
+)
+
 type (
+	// SerialMode selects how a serial generates the serial numbers.
+	SerialMode uint
+
 	Serial struct {
-		ID  string
-		Min int64
-		Max int64
+		ID   string
+		Mode SerialMode
+		// Min and Max limit the serials of the range and sequential modes.
+		// Max is not included.
+		Min *big.Int
+		Max *big.Int
+		// Length is the number of bytes of random serials, at most 20.
+		Length int
+
+		// The following fields are filled in by the server.
+		// Used is the number of serials generated.
+		Used *big.Int
+		// Capacity is the number of serials available in total.
+		Capacity *big.Int
 	}
 
 	SerialChange struct {
@@ -54,3 +84,29 @@ func (c *Client) ShowSerial(id string) (Serial, error) {
 	}
 	return Serial{}, nil
 }
+
+func (sm SerialMode) String() string {
+	switch sm {
+	case SMRange:
+		return "range"
+	case SMRandom:
+		return "random"
+	case SMSequential:
+		return "sequential"
+	default:
+		return "unknown"
+	}
+}
+
+func StringToSerialMode(in string) SerialMode {
+	switch strings.ToLower(in) {
+	case "range":
+		return SMRange
+	case "random":
+		return SMRandom
+	case "sequential":
+		return SMSequential
+	default:
+		return SMUnknown
+	}
+}
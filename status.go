@@ -0,0 +1,55 @@
+package pkiadm
+
+import (
+	"time"
+)
+
+type (
+	// RefreshStatus is the outcome of the refreshes of a resource.
+	RefreshStatus struct {
+		Resource    ResourceName
+		LastAttempt time.Time
+		LastSuccess time.Time
+		// Error is the message of the last refresh, when it failed.
+		Error string
+		// Failures is the number of failed refreshes since the last success.
+		Failures int
+		// NextRefresh is the time of the next refresh or, after a failure, of
+		// the next attempt. It is zero, when the resource is not refreshed.
+		NextRefresh time.Time
+	}
+	ResultStatus struct {
+		Result   Result
+		Statuses []RefreshStatus
+	}
+)
+
+// Failed returns true, when the last refresh of the resource failed.
+func (s RefreshStatus) Failed() bool { return s.Failures > 0 }
+
+// Status returns the refresh status of all resources.
+func (c *Client) Status() ([]RefreshStatus, error) {
+	result := &ResultStatus{}
+	if err := c.query("Status", Filter{}, result); err != nil {
+		return []RefreshStatus{}, err
+	}
+	if result.Result.HasError {
+		return []RefreshStatus{}, result.Result.Error
+	}
+	return result.Statuses, nil
+}
+
+// ShowStatus returns the refresh status of the resource.
+func (c *Client) ShowStatus(rn ResourceName) (RefreshStatus, error) {
+	result := &ResultStatus{}
+	if err := c.query("ShowStatus", rn, result); err != nil {
+		return RefreshStatus{}, err
+	}
+	if result.Result.HasError {
+		return RefreshStatus{}, result.Result.Error
+	}
+	if len(result.Statuses) > 0 {
+		return result.Statuses[0], nil
+	}
+	return RefreshStatus{}, nil
+}
@@ -13,10 +13,16 @@ type Result struct {
 	Error Error
 	// A message with more detailed information can be provided.
 	Message string
+	// Job is the id of the job continuing the request in the background.
+	Job string
 }
 
 type Error string
 
+// EPermissionDenied is returned, when the caller is not allowed to call the
+// method.
+const EPermissionDenied = Error("permission denied")
+
 func (e Error) Error() string { return string(e) }
 func (r *Result) SetError(err error, msg string, args ...interface{}) {
 	r.HasError = true
@@ -39,6 +45,9 @@ const (
 	RTSubject
 	RTUnknown
 	RTCA
+	RTCRL
+	RTOCSP
+	RTProfile
 )
 
 type ResourceName struct {
@@ -81,3 +90,30 @@ func (c *Client) List() (ResourceNameList, error) {
 	}
 	return result.Resources, nil
 }
+
+type (
+	// PlanStep is a resource refreshed as part of a change, after all the
+	// resources it depends on.
+	PlanStep struct {
+		Resource ResourceName
+		// Causes are the resources refreshed before, the resource depends on.
+		Causes []ResourceName
+	}
+	ResultPlan struct {
+		Result Result
+		Steps  []PlanStep
+	}
+)
+
+// PlanRefresh returns the order in which the resource and all resources
+// depending on it are refreshed, when it changes.
+func (c *Client) PlanRefresh(rn ResourceName) ([]PlanStep, error) {
+	result := &ResultPlan{}
+	if err := c.query("PlanRefresh", rn, result); err != nil {
+		return []PlanStep{}, err
+	}
+	if result.Result.HasError {
+		return []PlanStep{}, result.Result.Error
+	}
+	return result.Steps, nil
+}
@@ -0,0 +1,106 @@
+package pkiadm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The key usages use the same bits as x509.KeyUsage.
+const (
+	KUDigitalSignature KeyUsage = 1 << iota
+	KUContentCommitment
+	KUKeyEncipherment
+	KUDataEncipherment
+	KUKeyAgreement
+	KUCertSign
+	KUCRLSign
+	KUEncipherOnly
+	KUDecipherOnly
+)
+
+const (
+	EKUServerAuth ExtKeyUsage = iota
+	EKUClientAuth
+	EKUCodeSigning
+	EKUEmailProtection
+	EKUOCSPSigning
+)
+
+var keyUsageNames = []struct {
+	usage KeyUsage
+	name  string
+}{
+	{KUDigitalSignature, "digital-signature"},
+	{KUContentCommitment, "content-commitment"},
+	{KUKeyEncipherment, "key-encipherment"},
+	{KUDataEncipherment, "data-encipherment"},
+	{KUKeyAgreement, "key-agreement"},
+	{KUCertSign, "cert-sign"},
+	{KUCRLSign, "crl-sign"},
+	{KUEncipherOnly, "encipher-only"},
+	{KUDecipherOnly, "decipher-only"},
+}
+
+var extKeyUsageNames = map[ExtKeyUsage]string{
+	EKUServerAuth:      "server-auth",
+	EKUClientAuth:      "client-auth",
+	EKUCodeSigning:     "code-signing",
+	EKUEmailProtection: "email-protection",
+	EKUOCSPSigning:     "ocsp-signing",
+}
+
+type (
+	// KeyUsage is a bit field of the allowed usages of a certificate key.
+	KeyUsage uint
+	// ExtKeyUsage is an extended purpose the certificate may be used for.
+	ExtKeyUsage uint
+)
+
+// Names returns the names of all usages set.
+func (ku KeyUsage) Names() []string {
+	names := []string{}
+	for _, entry := range keyUsageNames {
+		if ku&entry.usage != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+func (ku KeyUsage) String() string {
+	return strings.Join(ku.Names(), ",")
+}
+
+// StringsToKeyUsage combines the named usages into a bit field.
+func StringsToKeyUsage(in []string) (KeyUsage, error) {
+	var ku KeyUsage
+	for _, name := range in {
+		found := false
+		for _, entry := range keyUsageNames {
+			if entry.name == strings.ToLower(name) {
+				ku |= entry.usage
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown key usage '%s'", name)
+		}
+	}
+	return ku, nil
+}
+
+func (eku ExtKeyUsage) String() string {
+	if name, found := extKeyUsageNames[eku]; found {
+		return name
+	}
+	return fmt.Sprintf("ExtKeyUsage(%d)", eku)
+}
+
+func StringToExtKeyUsage(in string) (ExtKeyUsage, error) {
+	for eku, name := range extKeyUsageNames {
+		if name == strings.ToLower(in) {
+			return eku, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown extended key usage '%s'", in)
+}